@@ -1,46 +1,628 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-// ServeFiles starts the HTTP server to serve files from the specified folder
-func ServeFiles(port, folder string) {
+// Config holds the settings for the server. It uses the same schema as the
+// config.json of the Windows variant, but only these few of its settings: a
+// file with any other is refused rather than served without them.
+type Config struct {
+	Port   string `json:"port"`
+	Folder string `json:"folder"`
+	// ShutdownTimeout is how many seconds in-flight requests get to finish on stop
+	ShutdownTimeout int `json:"shutdownTimeout"`
+	// AdminToken enables the admin API for requests sending it as a bearer token
+	AdminToken string `json:"adminToken"`
+	// CaseInsensitive serves files whose names differ from the request only
+	// by case, as they were on Windows
+	CaseInsensitive bool `json:"caseInsensitive"`
+	// RunAs is the uid:gid switched to once the port is bound. It is only
+	// set from RUN_AS, the Windows service has no equivalent.
+	RunAs string `json:"-"`
+}
+
+// defaultConfigFile is read when CONFIG_FILE isn't set, if it exists
+const defaultConfigFile = "/config/config.json"
+
+// LoadConfig reads the config file, if any, and applies the environment
+// variables and defaults on top of it
+func LoadConfig() (*Config, error) {
+	config := &Config{}
+
+	configFile := os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			configFile = defaultConfigFile
+		}
+	}
+	if configFile != "" {
+		// The Windows variant also reads YAML and TOML, with parsers that
+		// aren't in the standard library
+		switch strings.ToLower(filepath.Ext(configFile)) {
+		case ".yaml", ".yml", ".toml":
+			return nil, fmt.Errorf("config file %s: the container only reads JSON config files", configFile)
+		}
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config file %s: %w", configFile, err)
+		}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("failed to decode config file %s: %w", configFile, err)
+		}
+		// Settings such as apiKeys or readOnly restrict access, so silently
+		// dropping them would serve more than the file says
+		if unsupported := unsupportedConfigKeys(data); len(unsupported) > 0 {
+			return nil, fmt.Errorf("config file %s has settings the container doesn't support: %s", configFile, strings.Join(unsupported, ", "))
+		}
+		log.Println("Loaded config file", configFile)
+	}
+
+	// Environment variables take precedence over the config file
+	if port := os.Getenv("PORT"); port != "" {
+		config.Port = port
+	}
+	if folder := os.Getenv("IMAGE_FOLDER"); folder != "" {
+		config.Folder = folder
+	}
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		config.AdminToken = token
+	}
+	if value := os.Getenv("CASE_INSENSITIVE"); value != "" {
+		caseInsensitive, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("CASE_INSENSITIVE must be true or false, got %q", value)
+		}
+		config.CaseInsensitive = caseInsensitive
+	}
+	config.RunAs = os.Getenv("RUN_AS")
+	if config.RunAs != "" {
+		if _, _, err := parseRunAs(config.RunAs); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Port == "" {
+		config.Port = "8089" // Default port
+		log.Println("Port not set in config or PORT environment variable, using default port:", config.Port)
+	}
+	if config.Folder == "" {
+		config.Folder = "/images" // Default folder inside the container
+		log.Println("Folder not set in config or IMAGE_FOLDER environment variable, using default folder:", config.Folder)
+	}
+	if config.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdownTimeout cannot be negative")
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 5
+	}
+
+	return config, nil
+}
+
+// unsupportedConfigKeys returns the top-level keys of the config file data
+// that Config has no field for, sorted. Keys match fields case insensitively,
+// as they do for encoding/json.
+func unsupportedConfigKeys(data []byte) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	// $schema is for editors, pointing them at config.schema.json
+	supported := map[string]bool{"$schema": true}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			supported[strings.ToLower(name)] = true
+		}
+	}
+	var unsupported []string
+	for key := range fields {
+		if !supported[strings.ToLower(key)] {
+			unsupported = append(unsupported, key)
+		}
+	}
+	sort.Strings(unsupported)
+	return unsupported
+}
+
+// parseRunAs parses RUN_AS, a numeric uid with an optional :gid, the gid
+// defaulting to the uid
+func parseRunAs(value string) (int, int, error) {
+	uidText, gidText, hasGID := strings.Cut(value, ":")
+	uid, err := strconv.Atoi(uidText)
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("RUN_AS must be a numeric uid or uid:gid, got %q", value)
+	}
+	gid := uid
+	if hasGID {
+		if gid, err = strconv.Atoi(gidText); err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("RUN_AS must be a numeric uid or uid:gid, got %q", value)
+		}
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switches the process to the RUN_AS user and group, so a
+// container started as root to bind a low port serves files unprivileged.
+// A restarted server already runs as that user and is left alone.
+func dropPrivileges(runAs string) error {
+	uid, gid, err := parseRunAs(runAs)
+	if err != nil {
+		return err
+	}
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("failed to drop supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to switch to group %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to switch to user %d: %w", uid, err)
+	}
+	return nil
+}
+
+// caseIndexRefresh is how old the listing of a directory has to be before a
+// name missing from it is looked up again
+const caseIndexRefresh = 10 * time.Second
+
+// caseIndex maps the lowercase names of each directory below root to the
+// names on disk, so requests for a library copied from Windows keep working
+// whatever case its links use
+type caseIndex struct {
+	root string
+
+	mu sync.Mutex
+	// dirs is keyed by the path of the directory on disk, relative to root
+	dirs map[string]*caseDir
+}
+
+type caseDir struct {
+	names map[string]string
+	read  time.Time
+}
+
+func newCaseIndex(root string) *caseIndex {
+	return &caseIndex{root: root, dirs: map[string]*caseDir{}}
+}
+
+// build indexes every directory below root up front, so the first requests
+// don't have to read them
+func (c *caseIndex) build() {
+	started := time.Now()
+	count := 0
+	filepath.WalkDir(c.root, func(name string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.root, name)
+		if err != nil {
+			return nil
+		}
+		c.read(filepath.ToSlash(rel))
+		count++
+		return nil
+	})
+	log.Printf("Indexed %d directories for case-insensitive lookups in %s", count, time.Since(started).Round(time.Millisecond))
+}
+
+// read lists the directory rel and stores it. Of names differing only by
+// case the first in name order wins.
+func (c *caseIndex) read(rel string) *caseDir {
+	entries, err := os.ReadDir(filepath.Join(c.root, filepath.FromSlash(rel)))
+	dir := &caseDir{names: map[string]string{}, read: time.Now()}
+	if err == nil {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		for _, entry := range entries {
+			folded := strings.ToLower(entry.Name())
+			if _, ok := dir.names[folded]; !ok {
+				dir.names[folded] = entry.Name()
+			}
+		}
+	}
+	c.mu.Lock()
+	c.dirs[rel] = dir
+	c.mu.Unlock()
+	return dir
+}
+
+// lookup returns the name on disk of the entry of the directory rel that
+// matches name but for case
+func (c *caseIndex) lookup(rel, name string) (string, bool) {
+	folded := strings.ToLower(name)
+	c.mu.Lock()
+	dir := c.dirs[rel]
+	c.mu.Unlock()
+	if dir == nil || (dir.names[folded] == "" && time.Since(dir.read) > caseIndexRefresh) {
+		dir = c.read(rel)
+	}
+	actual, ok := dir.names[folded]
+	return actual, ok
+}
+
+// resolve returns the path on disk matching name, a slash-separated path
+// below root, but for case
+func (c *caseIndex) resolve(name string) (string, bool) {
+	rel := "."
+	for _, element := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if element == "" {
+			continue
+		}
+		actual, ok := c.lookup(rel, element)
+		if !ok {
+			return "", false
+		}
+		rel = path.Join(rel, actual)
+	}
+	return "/" + strings.TrimPrefix(rel, "."), true
+}
+
+// caseInsensitiveDir opens the file matching a name but for case when no
+// file has that exact name
+type caseInsensitiveDir struct {
+	http.Dir
+	index *caseIndex
+}
+
+func (d caseInsensitiveDir) Open(name string) (http.File, error) {
+	f, err := d.Dir.Open(name)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	actual, ok := d.index.resolve(name)
+	if !ok {
+		return nil, err
+	}
+	return d.Dir.Open(actual)
+}
+
+// Environment variables a restarted server is started with, naming the file
+// descriptors of the inherited listener and of the pipe it reports readiness on
+const (
+	listenerFDEnv = "IMAGE_SERVER_LISTENER_FD"
+	readyFDEnv    = "IMAGE_SERVER_READY_FD"
+)
+
+// handOverSignal tells a server that the one started after it is serving on
+// the same socket, so it drains without closing the socket, which SIGTERM does
+const handOverSignal = syscall.SIGUSR1
+
+// restartReadyTimeout is how long a restarted server gets to start serving
+// before the restart is abandoned and the current server keeps running
+const restartReadyTimeout = 30 * time.Second
+
+// listen returns the listener inherited from the previous server on a
+// restart, or a new one on port. The inherited listener is only used while
+// the port hasn't changed.
+func listen(port string) (net.Listener, error) {
+	if fd, err := strconv.Atoi(os.Getenv(listenerFDEnv)); err == nil {
+		file := os.NewFile(uintptr(fd), "listener")
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use inherited listener: %w", err)
+		}
+		if _, inheritedPort, _ := net.SplitHostPort(ln.Addr().String()); inheritedPort == port {
+			return ln, nil
+		}
+		log.Printf("Port changed from %s to %s, not using the inherited listener", ln.Addr(), port)
+		ln.Close()
+	}
+	return net.Listen("tcp", ":"+port)
+}
+
+// notifyReady tells the server that started this one that it is serving
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// startServer re-executes the binary, which may have been replaced, handing
+// it the listener. It returns once the new server reports it is serving, so
+// a bad config or binary leaves the current server running.
+func startServer(listener *os.File) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyRead.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles start at fd 3
+	cmd.ExtraFiles = []*os.File{listener, readyWrite}
+	cmd.Env = append(os.Environ(), listenerFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// The read fails with EOF if the new server exits before it is ready
+	readyRead.SetReadDeadline(time.Now().Add(restartReadyTimeout))
+	if _, err := readyRead.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new server didn't start: %w", err)
+	}
+	return cmd, nil
+}
+
+// defaultDrainGrace is how many seconds a drained server keeps serving with
+// /readyz failing, so load balancers take it out of rotation before it stops
+// accepting connections
+const defaultDrainGrace = 5
+
+// drainRequest is how long a drained server keeps serving with /readyz
+// failing, and how long its in-flight downloads then get to finish
+type drainRequest struct {
+	grace, deadline time.Duration
+}
+
+// drainHandler serves POST /api/admin/drain, which takes the server out of
+// rotation for a rolling update: /readyz starts failing, after ?grace=
+// seconds (defaultDrainGrace by default) the listener is closed, in-flight
+// downloads get ?deadline= seconds (shutdownTimeout by default) to finish,
+// and the process exits. The request is sent to drains.
+func drainHandler(token string, defaultDeadline int, drains chan<- drainRequest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) || subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ImageServer"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deadline, grace := defaultDeadline, defaultDrainGrace
+		if value := r.URL.Query().Get("deadline"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "deadline must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+			deadline = n
+		}
+		if value := r.URL.Query().Get("grace"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "grace must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+			grace = n
+		}
+		select {
+		case drains <- drainRequest{time.Duration(grace) * time.Second, time.Duration(deadline) * time.Second}:
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "draining, accepting connections for %ds and exiting within %ds\n", grace, grace+deadline)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "already draining")
+		}
+	})
+}
+
+// ServeFiles starts the HTTP server to serve files from the configured folder
+// and shuts it down gracefully on SIGTERM/SIGINT or a drain request. On SIGHUP it starts a new
+// server with the same listener and hands over to it, draining its own
+// downloads: the first time this process stops serving and stays around to
+// supervise, since it is the container's main process, and on later restarts
+// it replaces the server it started. It returns the process exit code.
+func ServeFiles(config *Config) int {
+	// draining is set once a drain was requested, failing /readyz
+	var draining int32
+	drains := make(chan drainRequest, 1)
+
 	// Custom handler to log every request
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if atomic.LoadInt32(&draining) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "draining")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if config.AdminToken != "" {
+		mux.Handle("/api/admin/drain", drainHandler(config.AdminToken, config.ShutdownTimeout, drains))
+	}
+	var files http.FileSystem = http.Dir(config.Folder)
+	if config.CaseInsensitive {
+		index := newCaseIndex(config.Folder)
+		go index.build()
+		files = caseInsensitiveDir{http.Dir(config.Folder), index}
+	}
+	fileServer := http.FileServer(files)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Received request: %s %s", r.Method, r.URL.Path)
-		http.FileServer(http.Dir(folder)).ServeHTTP(w, r)
+		fileServer.ServeHTTP(w, r)
 	})
+	server := &http.Server{Addr: ":" + config.Port, Handler: mux}
+	shutdownTimeout := time.Duration(config.ShutdownTimeout) * time.Second
 
-	fmt.Println("Serving", folder, "on port", port)
-	err := http.ListenAndServe(":"+port, nil)
+	ln, err := listen(config.Port)
 	if err != nil {
-		log.Fatal("Error starting server:", err)
+		log.Println("Error starting server:", err)
+		return 1
+	}
+	// Keep a duplicate of the listener, Shutdown closes ln but later servers still need it
+	listener, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		log.Println("Error starting server:", err)
+		return 1
+	}
+	defer listener.Close()
+	if config.RunAs != "" {
+		if err := dropPrivileges(config.RunAs); err != nil {
+			log.Println("Error starting server:", err)
+			return 1
+		}
+		log.Println("Running as", config.RunAs)
 	}
-}
 
-func main() {
-	// Read config from environment variables
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8089" // Default port
-		log.Println("PORT environment variable not set, using default port:", port)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP, handOverSignal)
+	defer signal.Stop(signals)
+
+	// Serve returns as soon as Shutdown is called, so wait for the drain to finish
+	serveErr := make(chan error, 1)
+	drained := make(chan struct{})
+	// stopped is set once the listening socket was shut down, failing Accept
+	var stopped int32
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed && atomic.LoadInt32(&stopped) == 0 {
+			serveErr <- err
+		}
+	}()
+	// drain stops serving after grace, then gives in-flight requests timeout
+	// to finish. When the server stops for good rather than handing over to
+	// a new one, the socket stops listening too: Shutdown only closes ln,
+	// and the duplicate in listener, and the one of any server started
+	// since, would keep it listening with nobody accepting.
+	drain := func(grace, timeout time.Duration, stop bool) {
+		defer close(drained)
+		time.Sleep(grace)
+		if stop {
+			atomic.StoreInt32(&stopped, 1)
+			syscall.Shutdown(int(listener.Fd()), syscall.SHUT_RDWR)
+			listener.Close()
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("Error during shutdown:", err)
+		}
 	}
 
-	folder := os.Getenv("IMAGE_FOLDER")
-	if folder == "" {
-		folder = "/images" // Default folder inside the container
-		log.Println("IMAGE_FOLDER environment variable not set, using default folder:", folder)
+	fmt.Println("Serving", config.Folder, "on port", config.Port)
+	notifyReady()
+
+	// current is the server started on the last restart, nil while this process serves
+	var (
+		current  *exec.Cmd
+		children sync.WaitGroup
+		exited   = make(chan *exec.Cmd)
+		done     = make(chan struct{})
+	)
+	defer close(done)
+	for {
+		select {
+		case err := <-serveErr:
+			log.Println("Error starting server:", err)
+			return 1
+		case cmd := <-exited:
+			if cmd == current {
+				log.Println("Server exited:", cmd.ProcessState)
+				children.Wait()
+				<-drained
+				return cmd.ProcessState.ExitCode()
+			}
+		case req := <-drains:
+			log.Println("Draining, exiting within", req.grace+req.deadline)
+			atomic.StoreInt32(&draining, 1)
+			if current == nil {
+				go drain(req.grace, req.deadline, true)
+			} else {
+				current.Process.Signal(syscall.SIGTERM)
+			}
+			children.Wait()
+			<-drained
+			return 0
+		case sig := <-signals:
+			if sig == handOverSignal {
+				log.Println("Handing over to the new server")
+				atomic.StoreInt32(&draining, 1)
+				go drain(0, shutdownTimeout, false)
+				<-drained
+				return 0
+			}
+			if sig != syscall.SIGHUP {
+				log.Println("Shutting down")
+				atomic.StoreInt32(&draining, 1)
+				if current == nil {
+					go drain(0, shutdownTimeout, true)
+				} else {
+					current.Process.Signal(syscall.SIGTERM)
+				}
+				children.Wait()
+				<-drained
+				return 0
+			}
+
+			log.Println("Restarting")
+			next, err := startServer(listener)
+			if err != nil {
+				log.Println("Restart failed, keeping the current server:", err)
+				continue
+			}
+			if current == nil {
+				go drain(0, shutdownTimeout, false)
+			} else {
+				current.Process.Signal(handOverSignal)
+			}
+			current = next
+			children.Add(1)
+			go func() {
+				next.Wait()
+				children.Done()
+				select {
+				case exited <- next:
+				case <-done:
+				}
+			}()
+		}
+	}
+}
+
+func main() {
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Check if the folder exists
-	if _, err := os.Stat(folder); os.IsNotExist(err) {
-		log.Fatalf("The folder %s does not exist", folder)
+	if _, err := os.Stat(config.Folder); os.IsNotExist(err) {
+		log.Fatalf("The folder %s does not exist", config.Folder)
 	}
 
 	// Start HTTP server
-	ServeFiles(port, folder)
+	os.Exit(ServeFiles(config))
 }
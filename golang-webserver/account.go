@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modadvapi32               = windows.NewLazySystemDLL("advapi32.dll")
+	procLsaOpenPolicy         = modadvapi32.NewProc("LsaOpenPolicy")
+	procLsaAddAccountRights   = modadvapi32.NewProc("LsaAddAccountRights")
+	procLsaClose              = modadvapi32.NewProc("LsaClose")
+	procLsaNtStatusToWinError = modadvapi32.NewProc("LsaNtStatusToWinError")
+)
+
+const (
+	policyCreateAccount = 0x00000010
+	policyLookupNames   = 0x00000800
+)
+
+type lsaUnicodeString struct {
+	Length        uint16
+	MaximumLength uint16
+	Buffer        *uint16
+}
+
+type lsaObjectAttributes struct {
+	Length                   uint32
+	RootDirectory            uintptr
+	ObjectName               *lsaUnicodeString
+	Attributes               uint32
+	SecurityDescriptor       uintptr
+	SecurityQualityOfService uintptr
+}
+
+// normalizeAccountName expands the ".\user" shorthand for local accounts,
+// which LookupAccountName doesn't understand
+func normalizeAccountName(account string) string {
+	if strings.HasPrefix(account, `.\`) {
+		if host, err := os.Hostname(); err == nil {
+			return host + account[1:]
+		}
+	}
+	return account
+}
+
+// grantLogonAsService gives account the "Log on as a service" right, which the
+// service manager requires before a non-builtin account can run the service
+func grantLogonAsService(account string) error {
+	sid, _, _, err := windows.LookupSID("", account)
+	if err != nil {
+		return fmt.Errorf("failed to look up account %s: %w", account, err)
+	}
+
+	var attrs lsaObjectAttributes
+	attrs.Length = uint32(unsafe.Sizeof(attrs))
+	var policy uintptr
+	status, _, _ := procLsaOpenPolicy.Call(0, uintptr(unsafe.Pointer(&attrs)), policyCreateAccount|policyLookupNames, uintptr(unsafe.Pointer(&policy)))
+	if status != 0 {
+		return fmt.Errorf("failed to open LSA policy: %w", lsaError(status))
+	}
+	defer procLsaClose.Call(policy)
+
+	right, err := windows.UTF16FromString("SeServiceLogonRight")
+	if err != nil {
+		return err
+	}
+	rights := lsaUnicodeString{
+		Length:        uint16((len(right) - 1) * 2),
+		MaximumLength: uint16(len(right) * 2),
+		Buffer:        &right[0],
+	}
+	status, _, _ = procLsaAddAccountRights.Call(policy, uintptr(unsafe.Pointer(sid)), uintptr(unsafe.Pointer(&rights)), 1)
+	if status != 0 {
+		return fmt.Errorf("failed to grant log on as a service right to %s: %w", account, lsaError(status))
+	}
+	return nil
+}
+
+func lsaError(status uintptr) error {
+	code, _, _ := procLsaNtStatusToWinError.Call(status)
+	return windows.Errno(code)
+}
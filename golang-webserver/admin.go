@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminOnly rejects requests that don't carry token, or the admin listener's
+// own token, as a bearer token
+func adminOnly(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected, ok := adminTokenFor(r, token)
+		if !ok {
+			// Not even hinting at the admin API on public listeners
+			http.NotFound(w, r)
+			return
+		}
+		if !hasBearer(r, expected) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ImageServer"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasBearer reports whether r carries token as a bearer token
+func hasBearer(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	return strings.HasPrefix(auth, prefix) && subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+// configResponse is the body of GET /api/config
+type configResponse struct {
+	Config   *Config           `json:"config"`
+	Sources  map[string]string `json:"sources"`
+	Warnings []string          `json:"warnings"`
+}
+
+// configHandler serves the effective configuration with secrets redacted and
+// where each setting came from
+func configHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		redacted, err := redactedCopy(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		warnings := config.Warnings()
+		if warnings == nil {
+			warnings = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(configResponse{Config: redacted, Sources: config.Sources(), Warnings: warnings})
+	})
+}
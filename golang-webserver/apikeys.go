@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// operationRead is the only API key operation: no route writes to the
+// folder on behalf of a key, so keys scope reads and nothing else
+const operationRead = "read"
+
+// APIKey grants access to the files below its path prefixes. Once any key is
+// configured, file requests without a valid key are rejected.
+type APIKey struct {
+	// Name identifies the key, e.g. the agency it was issued to
+	Name string `json:"name"`
+	Key  string `json:"key" secret:"true"`
+	// Prefixes are the URL paths of the directories the key can access, e.g. /campaigns/agencyX/. Empty allows everything.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Operations can only be read, which is also what empty means
+	Operations []string `json:"operations,omitempty"`
+}
+
+func validateAPIKeys(keys []APIKey) []error {
+	var errs []error
+	names := map[string]bool{}
+	for i, key := range keys {
+		label := fmt.Sprintf("apiKeys[%d]", i)
+		if key.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name cannot be empty", label))
+		} else if names[key.Name] {
+			errs = append(errs, fmt.Errorf("%s.name %q is used by another key", label, key.Name))
+		}
+		names[key.Name] = true
+		if key.Key == "" {
+			errs = append(errs, fmt.Errorf("%s.key cannot be empty", label))
+		}
+		for _, prefix := range key.Prefixes {
+			if !strings.HasPrefix(prefix, "/") {
+				errs = append(errs, fmt.Errorf("%s.prefixes must start with /, got %q", label, prefix))
+			}
+		}
+		for _, op := range key.Operations {
+			if !strings.EqualFold(op, operationRead) {
+				errs = append(errs, fmt.Errorf("%s.operations can only be read, keys don't grant writes, got %q", label, op))
+			}
+		}
+	}
+	return errs
+}
+
+// allows reports whether the key may perform operation on the cleaned URL path
+func (k *APIKey) allows(operation, urlPath string) bool {
+	ops := k.Operations
+	if len(ops) == 0 {
+		ops = []string{operationRead}
+	}
+	if !containsFold(ops, operation) {
+		return false
+	}
+	if len(k.Prefixes) == 0 {
+		return true
+	}
+	// Prefixes are directories, and paths are case insensitive on Windows
+	p := strings.ToLower(urlPath)
+	for _, prefix := range k.Prefixes {
+		dir := strings.TrimSuffix(strings.ToLower(prefix), "/")
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAPIKey returns the key sent in the X-API-Key header or as a bearer token
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	const prefix = "Bearer "
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, prefix) {
+		return auth[len(prefix):]
+	}
+	return ""
+}
+
+// findAPIKey returns the one of keys that r carries, or nil
+func findAPIKey(keys []APIKey, r *http.Request) *APIKey {
+	sent := []byte(requestAPIKey(r))
+	if len(sent) == 0 {
+		return nil
+	}
+	var key *APIKey
+	for i := range keys {
+		// Compare against every key so the timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare(sent, []byte(keys[i].Key)) == 1 {
+			key = &keys[i]
+		}
+	}
+	return key
+}
+
+// apiKeyGuard only lets requests through whose API key covers the path.
+// Keys only grant reads, GET, HEAD and OPTIONS, any other method is refused.
+func apiKeyGuard(keys []APIKey, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWarmup(r) {
+			// Replayed by the service itself, not a client
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := findAPIKey(keys, r)
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ImageServer"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !key.allows(operationRead, path.Clean("/"+r.URL.Path)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyGuard(t *testing.T) {
+	keys := []APIKey{
+		{Name: "everything", Key: "key-everything"},
+		{Name: "agencyX", Key: "key-agency-x", Prefixes: []string{"/campaigns/agencyX/"}, Operations: []string{"read"}},
+	}
+	handler := apiKeyGuard(keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(method, url string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete}
+	reads := map[string]bool{http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true}
+
+	for _, method := range methods {
+		for _, test := range []struct {
+			name   string
+			header []string
+		}{
+			{"missing", nil},
+			{"empty", []string{"X-API-Key", ""}},
+			{"wrong", []string{"X-API-Key", "key-wrong"}},
+			{"prefix of a key", []string{"X-API-Key", "key-every"}},
+			{"wrong case", []string{"X-API-Key", "KEY-EVERYTHING"}},
+			{"wrong bearer", []string{"Authorization", "Bearer key-wrong"}},
+			{"not a bearer", []string{"Authorization", "Basic key-everything"}},
+		} {
+			w := serve(method, "/campaigns/agencyX/a.jpg", test.header...)
+			if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s with a %s key got %d, WWW-Authenticate %q", method, test.name, w.Code, w.Header().Get("WWW-Authenticate"))
+			}
+		}
+
+		for _, test := range []struct {
+			name, url string
+			header    []string
+			allowed   bool
+		}{
+			{"unscoped key", "/other/a.jpg", []string{"X-API-Key", "key-everything"}, true},
+			{"unscoped bearer", "/other/a.jpg", []string{"Authorization", "Bearer key-everything"}, true},
+			{"read-only key", "/campaigns/agencyX/a.jpg", []string{"X-API-Key", "key-agency-x"}, true},
+			{"read-only key, other case", "/CAMPAIGNS/agencyx/a.jpg", []string{"X-API-Key", "key-agency-x"}, true},
+			{"read-only key, its directory", "/campaigns/agencyX", []string{"X-API-Key", "key-agency-x"}, true},
+			{"read-only key, other directory", "/campaigns/agencyY/a.jpg", []string{"X-API-Key", "key-agency-x"}, false},
+			{"read-only key, sibling", "/campaigns/agencyX2/a.jpg", []string{"X-API-Key", "key-agency-x"}, false},
+			{"read-only key, dot segments", "/campaigns/agencyX/../agencyY/a.jpg", []string{"X-API-Key", "key-agency-x"}, false},
+		} {
+			w := serve(method, test.url, test.header...)
+			// Keys only grant reads, writes are refused whatever the key covers
+			want := http.StatusOK
+			if !test.allowed || !reads[method] {
+				want = http.StatusForbidden
+			}
+			if w.Code != want {
+				t.Errorf("%s %s with the %s got %d, want %d", method, test.url, test.name, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestValidateAPIKeys(t *testing.T) {
+	valid := []APIKey{
+		{Name: "a", Key: "key-a"},
+		{Name: "b", Key: "key-b", Prefixes: []string{"/b/"}, Operations: []string{"READ"}},
+	}
+	if errs := validateAPIKeys(valid); len(errs) != 0 {
+		t.Errorf("valid keys got %v", errs)
+	}
+	for _, test := range []struct {
+		name string
+		key  APIKey
+	}{
+		{"no name", APIKey{Key: "key-c"}},
+		{"a name in use", APIKey{Name: "a", Key: "key-c"}},
+		{"no key", APIKey{Name: "c"}},
+		{"a relative prefix", APIKey{Name: "c", Key: "key-c", Prefixes: []string{"c/"}}},
+		{"a write operation", APIKey{Name: "c", Key: "key-c", Operations: []string{"read", "write"}}},
+	} {
+		if errs := validateAPIKeys(append(valid[:len(valid):len(valid)], test.key)); len(errs) != 1 {
+			t.Errorf("a key with %s got %d errors: %v", test.name, len(errs), errs)
+		}
+	}
+}
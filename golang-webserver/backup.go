@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// backupStateFile records what was copied, so later runs only copy new and changed files
+	backupStateFile = ".imageserver-backup.json"
+	// backupManifestFile lists every backed up file in sha256sum format for restores
+	backupManifestFile = "SHA256SUMS"
+)
+
+// BackupConfig copies new and changed originals to a second location
+type BackupConfig struct {
+	// Target is the folder backups are written to, e.g. a share on another NAS
+	Target string `json:"target"`
+	// Interval is how many seconds to wait between backups, 0 only backs up with the backup command
+	Interval int `json:"interval,omitempty"`
+}
+
+func (b *BackupConfig) validate(folder string) []error {
+	var errs []error
+	if b.Target == "" {
+		errs = append(errs, fmt.Errorf("backup.target cannot be empty"))
+	} else if rel, err := filepath.Rel(folder, b.Target); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		errs = append(errs, fmt.Errorf("backup.target %s cannot be inside the folder", b.Target))
+	}
+	if b.Interval < 0 {
+		errs = append(errs, fmt.Errorf("backup.interval cannot be negative"))
+	}
+	return errs
+}
+
+// backupState is what the last backup copied, keyed by slash separated relative path
+type backupState struct {
+	Files map[string]backupEntry `json:"files"`
+}
+
+type backupEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// backupResult summarizes a backup run
+type backupResult struct {
+	Copied    int
+	Unchanged int
+	Bytes     int64
+	Failed    []verifyProblem
+}
+
+func (r backupResult) String() string {
+	return fmt.Sprintf("%d files copied (%d bytes), %d unchanged, %d failed", r.Copied, r.Bytes, r.Unchanged, len(r.Failed))
+}
+
+// runBackup copies the files below folder that are new or changed since the
+// last run to target, keeping the directory layout, then writes the
+// SHA256SUMS manifest. Files deleted from folder are kept in the backup.
+func runBackup(ctx context.Context, folder, target string) (backupResult, error) {
+	var result backupResult
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return result, err
+	}
+	state, err := readBackupState(target)
+	if err != nil {
+		return result, err
+	}
+
+	err = filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, relErr := filepath.Rel(folder, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			result.Failed = append(result.Failed, verifyProblem{Path: rel, Problem: err.Error()})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			result.Failed = append(result.Failed, verifyProblem{Path: rel, Problem: err.Error()})
+			return nil
+		}
+
+		dest := filepath.Join(target, filepath.FromSlash(rel))
+		if prev, ok := state.Files[rel]; ok && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) && fileExists(dest) {
+			result.Unchanged++
+			return nil
+		}
+		sum, err := copyFile(path, dest, info.ModTime())
+		if err != nil {
+			result.Failed = append(result.Failed, verifyProblem{Path: rel, Problem: err.Error()})
+			return nil
+		}
+		state.Files[rel] = backupEntry{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+		result.Copied++
+		result.Bytes += info.Size()
+		return nil
+	})
+
+	// Save what was copied even when the walk was interrupted, so it isn't copied again
+	if saveErr := writeBackupState(target, state); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return result, err
+}
+
+// copyFile copies src to dest through a temporary file, so an interrupted
+// copy never leaves a truncated file in place, and returns its SHA-256
+func copyFile(src, dest string, modTime time.Time) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func readBackupState(target string) (*backupState, error) {
+	state := &backupState{Files: map[string]backupEntry{}}
+	data, err := os.ReadFile(filepath.Join(target, backupStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid backup state %s: %w", backupStateFile, err)
+	}
+	if state.Files == nil {
+		state.Files = map[string]backupEntry{}
+	}
+	return state, nil
+}
+
+// writeBackupState saves the state and regenerates the manifest from it
+func writeBackupState(target string, state *backupState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(target, backupStateFile), data); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(state.Files))
+	for name := range state.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var manifest strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&manifest, "%s  %s\n", state.Files[name].SHA256, name)
+	}
+	return writeFileAtomic(filepath.Join(target, backupManifestFile), []byte(manifest.String()))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// scheduleBackups runs a backup every interval until ctx is done, logging the results
+func scheduleBackups(ctx context.Context, folder string, backup *BackupConfig, elog debug.Log) {
+	ticker := time.NewTicker(time.Duration(backup.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		result, err := runBackup(ctx, folder, backup.Target)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil:
+			elog.Error(eventBackup, fmt.Sprintf("Backup to %s failed after %s: %v", backup.Target, result, err))
+		case len(result.Failed) > 0:
+			elog.Warning(eventBackup, fmt.Sprintf("Backup to %s finished with errors, %s. First failure: %s: %s", backup.Target, result, result.Failed[0].Path, result.Failed[0].Problem))
+		default:
+			elog.Info(eventBackup, fmt.Sprintf("Backup to %s finished, %s", backup.Target, result))
+		}
+	}
+}
+
+// runBackupCommand backs up the configured folder once. It returns the
+// process exit code: 0 on success, 1 when files failed to copy and 2 when
+// the backup couldn't run.
+func runBackupCommand(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	target := fs.String("target", "", "folder to back up to (overrides backup.target)")
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	config, err := flags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *target == "" && config.Backup != nil {
+		*target = config.Backup.Target
+	}
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "No backup target, set backup.target in the config or pass --target")
+		return 2
+	}
+
+	result, err := runBackup(context.Background(), config.Folder, *target)
+	for _, f := range result.Failed {
+		fmt.Printf("%s: %s\n", f.Path, f.Problem)
+	}
+	fmt.Printf("Backup to %s: %s\n", *target, result)
+	switch {
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "Backup failed:", err)
+		return 2
+	case len(result.Failed) > 0:
+		return 1
+	}
+	return 0
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
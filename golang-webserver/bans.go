@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxBan is the longest a client can be banned for, bans are meant to stop a
+// scraper now, blocking a network for good belongs in the firewall
+const maxBan = 7 * 24 * time.Hour
+
+// connContextKey is the request context key of the connection a request came in on
+type connContextKey struct{}
+
+// connContext is the http.Server.ConnContext hook that lets transfers be killed
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// banned reports whether client is banned, dropping the ban once it expired
+func (t *liveTracker) banned(client string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.bans[client]
+	if ok && time.Now().After(until) {
+		delete(t.bans, client)
+		return false
+	}
+	return ok
+}
+
+// kill closes the connection of transfer id, and when ban is set bans its
+// client for that long and kills all its other transfers too. It returns the
+// client, or "" when there is no such transfer.
+func (t *liveTracker) kill(id uint64, ban time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.transfers[id]
+	if !ok {
+		return ""
+	}
+	client := tr.Client
+	if ban > 0 {
+		if t.bans == nil {
+			t.bans = map[string]time.Time{}
+		}
+		t.bans[client] = time.Now().Add(ban)
+	}
+	for _, other := range t.transfers {
+		if other == tr || (ban > 0 && other.Client == client) {
+			// Closing the connection also interrupts a TransmitFile in progress
+			if other.conn != nil {
+				other.conn.Close()
+			}
+		}
+	}
+	return client
+}
+
+// killHandler serves POST /api/transfers/kill?id=<id>[&ban=<duration>]
+func (t *liveTracker) killHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id must be the id of a transfer from /api/stats/live", http.StatusBadRequest)
+			return
+		}
+		var ban time.Duration
+		if v := r.URL.Query().Get("ban"); v != "" {
+			if ban, err = time.ParseDuration(v); err != nil || ban <= 0 || ban > maxBan {
+				http.Error(w, fmt.Sprintf("ban must be a duration such as 30m, up to %v", maxBan), http.StatusBadRequest)
+				return
+			}
+		}
+		client := t.kill(id, ban)
+		if client == "" {
+			http.Error(w, "no such transfer, it may have finished", http.StatusNotFound)
+			return
+		}
+		if t.elog != nil {
+			if ban > 0 {
+				t.elog.Warning(eventHTTP, fmt.Sprintf("Killed the transfers of %s and banned it for %v on admin request", client, ban))
+			} else {
+				t.elog.Info(eventHTTP, fmt.Sprintf("Killed transfer %d of %s on admin request", id, client))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// clientBan is an entry of GET /api/bans
+type clientBan struct {
+	Client string    `json:"client"`
+	Until  time.Time `json:"until"`
+}
+
+// bansHandler lists the bans with GET and lifts one with DELETE ?client=<address>
+func (t *liveTracker) bansHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			now := time.Now()
+			t.mu.Lock()
+			bans := make([]clientBan, 0, len(t.bans))
+			for client, until := range t.bans {
+				if now.Before(until) {
+					bans = append(bans, clientBan{Client: client, Until: until})
+				}
+			}
+			t.mu.Unlock()
+			sort.Slice(bans, func(i, j int) bool { return bans[i].Client < bans[j].Client })
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(bans)
+		case http.MethodDelete:
+			client := r.URL.Query().Get("client")
+			t.mu.Lock()
+			_, ok := t.bans[client]
+			delete(t.bans, client)
+			t.mu.Unlock()
+			if !ok {
+				http.Error(w, "no such ban", http.StatusNotFound)
+				return
+			}
+			if t.elog != nil {
+				t.elog.Info(eventHTTP, fmt.Sprintf("Lifted the ban of %s on admin request", client))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
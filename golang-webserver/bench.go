@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// benchCrawlPages bounds how many directory listings the synthetic traffic is built from
+	benchCrawlPages = 200
+	// benchCrawlImages bounds how many images the synthetic traffic requests
+	benchCrawlImages = 20000
+	// benchPageRatio is how many of the synthetic requests, one in n, are directory listings
+	benchPageRatio = 10
+)
+
+// readBenchLog returns the GET and HEAD paths of an access log: W3C logs
+// as IIS writes them, common or combined log format lines, or one path or
+// URL per line
+func readBenchLog(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	// Field positions from the W3C #Fields: directive, -1 until seen
+	stem, query, method := -1, -1, -1
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, "#Fields:") {
+				stem, query, method = -1, -1, -1
+				for i, field := range strings.Fields(strings.TrimPrefix(line, "#Fields:")) {
+					switch field {
+					case "cs-uri-stem":
+						stem = i
+					case "cs-uri-query":
+						query = i
+					case "cs-method":
+						method = i
+					}
+				}
+			}
+			continue
+		}
+		if p := benchLogPath(line, stem, query, method); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s has no GET or HEAD requests", name)
+	}
+	return paths, nil
+}
+
+// benchLogPath returns the path requested by a log line, or an empty string
+// for other methods and lines it doesn't understand
+func benchLogPath(line string, stem, query, method int) string {
+	readOnly := func(m string) bool { return m == http.MethodGet || m == http.MethodHead }
+	switch {
+	case stem >= 0:
+		fields := strings.Fields(line)
+		if stem >= len(fields) || (method >= 0 && (method >= len(fields) || !readOnly(fields[method]))) {
+			return ""
+		}
+		p := fields[stem]
+		if query >= 0 && query < len(fields) && fields[query] != "-" {
+			p += "?" + fields[query]
+		}
+		return p
+	case strings.Contains(line, `"`):
+		// "GET /path HTTP/1.1" in common and combined log format
+		_, request, _ := strings.Cut(line, `"`)
+		request, _, _ = strings.Cut(request, `"`)
+		fields := strings.Fields(request)
+		if len(fields) < 2 || !readOnly(fields[0]) || !strings.HasPrefix(fields[1], "/") {
+			return ""
+		}
+		return fields[1]
+	case strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://"):
+		u, err := url.Parse(strings.Fields(line)[0])
+		if err != nil {
+			return ""
+		}
+		return u.RequestURI()
+	case strings.HasPrefix(line, "/"):
+		return strings.Fields(line)[0]
+	}
+	return ""
+}
+
+var benchLinkPattern = regexp.MustCompile(`href="([^"]+)"`)
+
+// crawlGallery follows the directory listings below start, returning the
+// listings and the images found in them
+func crawlGallery(ctx context.Context, client *http.Client, target, start, apiKey string) (pages, images []string, err error) {
+	queue := []string{start}
+	seen := map[string]bool{start: true}
+	for len(queue) > 0 && len(pages) < benchCrawlPages && len(images) < benchCrawlImages {
+		page := queue[0]
+		queue = queue[1:]
+		body, err := benchGetPage(ctx, client, target+page, apiKey)
+		if err != nil {
+			if len(pages) == 0 {
+				return nil, nil, err
+			}
+			continue
+		}
+		pages = append(pages, page)
+		for _, m := range benchLinkPattern.FindAllSubmatch(body, -1) {
+			link, err := url.Parse(string(m[1]))
+			if err != nil || link.IsAbs() || link.Host != "" {
+				continue
+			}
+			p := (&url.URL{Path: page}).ResolveReference(link)
+			if p.RawQuery != "" || !strings.HasPrefix(p.Path, start) || seen[p.Path] {
+				continue
+			}
+			seen[p.Path] = true
+			switch {
+			case strings.HasSuffix(p.Path, "/"):
+				queue = append(queue, p.EscapedPath())
+			case strings.HasPrefix(mime.TypeByExtension(path.Ext(p.Path)), "image/"):
+				images = append(images, p.EscapedPath())
+			}
+		}
+	}
+	if len(images) == 0 {
+		return nil, nil, fmt.Errorf("no images found in the listings below %s", start)
+	}
+	return pages, images, nil
+}
+
+func benchGetPage(ctx context.Context, client *http.Client, u, apiKey string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+}
+
+// benchResult is what one worker measured
+type benchResult struct {
+	latencies []time.Duration
+	bytes     int64
+	statuses  map[int]int
+	failures  int
+}
+
+// benchPercentile returns the latency that p (0 to 1) of the sorted requests took at most
+func benchPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// runBench sends requests to --target from --concurrency workers until
+// --duration or --requests is reached, replaying --log or, without one,
+// browsing the gallery found in the directory listings below --path with
+// a few popular images requested most. It returns the process exit code: 0
+// once the report is printed, 2 when the benchmark couldn't run.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("target", "", "server to load, e.g. http://imageserver:8089")
+	concurrency := fs.Int("concurrency", 16, "requests sent at the same time")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send requests for")
+	requests := fs.Int("requests", 0, "stop after this many requests (default: run for --duration)")
+	logFile := fs.String("log", "", "access log or list of paths to replay instead of browsing the gallery")
+	start := fs.String("path", "/", "directory the synthetic gallery traffic browses below")
+	apiKey := fs.String("api-key", "", "API key sent with every request")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	u, err := url.Parse(*target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintln(os.Stderr, "--target must be an http(s) URL, e.g. http://imageserver:8089")
+		return 2
+	}
+	base := strings.TrimSuffix(*target, "/")
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "--concurrency must be at least 1")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, MaxIdleConnsPerHost: *concurrency},
+		// The redirects are part of what is measured
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	// newNext returns the func a worker picks the path of request n with
+	var newNext func(rng *rand.Rand) func(n int) string
+	if *logFile != "" {
+		paths, err := readBenchLog(*logFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read the log:", err)
+			return 2
+		}
+		fmt.Printf("Replaying %d requests from %s\n", len(paths), *logFile)
+		newNext = func(*rand.Rand) func(int) string {
+			return func(n int) string { return paths[n%len(paths)] }
+		}
+	} else {
+		pages, images, err := crawlGallery(ctx, client, base, "/"+strings.TrimPrefix(*start, "/"), *apiKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to browse the gallery:", err)
+			return 2
+		}
+		fmt.Printf("Browsing %d directories with %d images\n", len(pages), len(images))
+		rand.Shuffle(len(images), func(i, j int) { images[i], images[j] = images[j], images[i] })
+		newNext = func(rng *rand.Rand) func(int) string {
+			// Zipf distributed, the first images of the shuffled list are the popular ones
+			popular := rand.NewZipf(rng, 1.1, 1, uint64(len(images)-1))
+			return func(n int) string {
+				if n%benchPageRatio == 0 {
+					return pages[rng.Intn(len(pages))]
+				}
+				return images[popular.Uint64()]
+			}
+		}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+	var mu sync.Mutex
+	sent := 0
+	// claim hands out request numbers until --requests is reached
+	claim := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if *requests > 0 && sent >= *requests {
+			return 0, false
+		}
+		sent++
+		return sent - 1, true
+	}
+
+	started := time.Now()
+	results := make([]benchResult, *concurrency)
+	var wg sync.WaitGroup
+	for w := range results {
+		wg.Add(1)
+		go func(result *benchResult, seed int64) {
+			defer wg.Done()
+			result.statuses = map[int]int{}
+			next := newNext(rand.New(rand.NewSource(seed)))
+			for runCtx.Err() == nil {
+				n, ok := claim()
+				if !ok {
+					return
+				}
+				req, err := http.NewRequestWithContext(runCtx, http.MethodGet, base+next(n), nil)
+				if err != nil {
+					result.failures++
+					continue
+				}
+				if *apiKey != "" {
+					req.Header.Set("X-API-Key", *apiKey)
+				}
+				begin := time.Now()
+				resp, err := client.Do(req)
+				if err == nil {
+					var written int64
+					written, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					result.bytes += written
+				}
+				if runCtx.Err() != nil {
+					// Cut off by the end of the run, not measured
+					return
+				}
+				if err != nil {
+					result.failures++
+					continue
+				}
+				result.latencies = append(result.latencies, time.Since(begin))
+				result.statuses[resp.StatusCode]++
+			}
+		}(&results[w], time.Now().UnixNano()+int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	var latencies []time.Duration
+	var bytes int64
+	statuses := map[int]int{}
+	failures := 0
+	for _, r := range results {
+		latencies = append(latencies, r.latencies...)
+		bytes += r.bytes
+		failures += r.failures
+		for status, n := range r.statuses {
+			statuses[status] += n
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	seconds := elapsed.Seconds()
+	fmt.Printf("%d requests in %s with %d connections: %.1f requests/s, %.1f MB/s\n", len(latencies), elapsed.Round(time.Millisecond), *concurrency, float64(len(latencies))/seconds, float64(bytes)/seconds/(1<<20))
+	codes := make([]int, 0, len(statuses))
+	for status := range statuses {
+		codes = append(codes, status)
+	}
+	sort.Ints(codes)
+	var counts []string
+	for _, status := range codes {
+		counts = append(counts, fmt.Sprintf("%d: %d", status, statuses[status]))
+	}
+	if failures > 0 {
+		counts = append(counts, fmt.Sprintf("failed: %d", failures))
+	}
+	fmt.Printf("Responses: %s\n", strings.Join(counts, ", "))
+	if len(latencies) > 0 {
+		p := func(q float64) time.Duration { return benchPercentile(latencies, q).Round(100 * time.Microsecond) }
+		fmt.Printf("Latency: p50 %s, p90 %s, p99 %s, max %s\n", p(0.5), p(0.9), p(0.99), p(1))
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// CircuitBreakerConfig answers file requests with 503 right away once opening
+// files keeps failing or hanging, e.g. when the NAS died, instead of every
+// request waiting on the SMB timeout until the service runs out of goroutines
+type CircuitBreakerConfig struct {
+	// Failures is how many file opens in a row have to fail or time out to open the breaker, 5 by default
+	Failures int `json:"failures,omitempty"`
+	// TimeoutMS is how many milliseconds opening a file may take before it counts as failed, 5000 by default
+	TimeoutMS int `json:"timeoutMS,omitempty"`
+	// OpenSeconds is how long requests are refused before the folder is probed again, 30 by default
+	OpenSeconds int `json:"openSeconds,omitempty"`
+}
+
+func (c *CircuitBreakerConfig) validate() []error {
+	var errs []error
+	if c.Failures < 0 {
+		errs = append(errs, fmt.Errorf("circuitBreaker.failures cannot be negative"))
+	}
+	if c.TimeoutMS < 0 {
+		errs = append(errs, fmt.Errorf("circuitBreaker.timeoutMS cannot be negative"))
+	}
+	if c.OpenSeconds < 0 {
+		errs = append(errs, fmt.Errorf("circuitBreaker.openSeconds cannot be negative"))
+	}
+	return errs
+}
+
+func (c *CircuitBreakerConfig) failures() int {
+	if c.Failures == 0 {
+		return 5
+	}
+	return c.Failures
+}
+
+func (c *CircuitBreakerConfig) timeout() time.Duration {
+	if c.TimeoutMS == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.TimeoutMS) * time.Millisecond
+}
+
+func (c *CircuitBreakerConfig) openDuration() time.Duration {
+	if c.OpenSeconds == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.OpenSeconds) * time.Second
+}
+
+// circuitBreaker counts failed file opens. Once open, no files are opened
+// until Run has probed the folder successfully (half-open), so requests
+// don't pile up behind a share that doesn't answer.
+type circuitBreaker struct {
+	config *CircuitBreakerConfig
+	folder string
+	elog   debug.Log
+	opened chan struct{}
+
+	mu       sync.Mutex
+	failures int
+	openErr  error
+	trips    uint64
+}
+
+// newCircuitBreaker returns nil when config is nil
+func newCircuitBreaker(config *CircuitBreakerConfig, folder string, elog debug.Log) *circuitBreaker {
+	if config == nil {
+		return nil
+	}
+	return &circuitBreaker{config: config, folder: folder, elog: elog, opened: make(chan struct{}, 1)}
+}
+
+// Err returns nil while the breaker is closed, or why it opened
+func (b *circuitBreaker) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openErr
+}
+
+// Trips returns how many times the breaker opened
+func (b *circuitBreaker) Trips() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trips
+}
+
+// record counts the outcome of opening a file. Missing files and denied
+// access are answers from the storage, so they count as successes.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	if err == nil || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		b.failures = 0
+		b.mu.Unlock()
+		return
+	}
+	b.failures++
+	if b.openErr != nil || b.failures < b.config.failures() {
+		b.mu.Unlock()
+		return
+	}
+	b.openErr = fmt.Errorf("circuit breaker open after %d failed file opens: %w", b.failures, err)
+	b.trips++
+	b.mu.Unlock()
+
+	b.elog.Error(eventStorage, fmt.Sprintf("Opening files on %s keeps failing, refusing requests for %s: %v", b.folder, b.config.openDuration(), err))
+	select {
+	case b.opened <- struct{}{}:
+	default:
+	}
+}
+
+// Run probes the folder every openDuration while the breaker is open and
+// closes it once the folder can be listed again, until ctx is done
+func (b *circuitBreaker) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.opened:
+		}
+		for b.Err() != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(b.config.openDuration()):
+			}
+			if err := b.probe(); err != nil {
+				continue
+			}
+			b.mu.Lock()
+			b.openErr, b.failures = nil, 0
+			b.mu.Unlock()
+			b.elog.Info(eventStorage, fmt.Sprintf("Files on %s can be opened again, serving requests", b.folder))
+		}
+	}
+}
+
+// probe checks the folder, giving up after the open timeout
+func (b *circuitBreaker) probe() error {
+	done := make(chan error, 1)
+	go func() { done <- checkFolder(b.folder) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(b.config.timeout()):
+		return fmt.Errorf("checking %s took longer than %s", b.folder, b.config.timeout())
+	}
+}
+
+// breakerFS opens files through the breaker, giving up on opens that take
+// longer than the timeout. The abandoned open finishes in the background
+// once the share answers or the SMB client gives up.
+type breakerFS struct {
+	http.FileSystem
+	breaker *circuitBreaker
+}
+
+func (f breakerFS) Open(name string) (http.File, error) {
+	if err := f.breaker.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		file http.File
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		file, err := f.FileSystem.Open(name)
+		done <- result{file, err}
+	}()
+	timeout := time.NewTimer(f.breaker.config.timeout())
+	defer timeout.Stop()
+	select {
+	case res := <-done:
+		f.breaker.record(res.err)
+		return res.file, res.err
+	case <-timeout.C:
+		go func() {
+			if res := <-done; res.file != nil {
+				res.file.Close()
+			}
+		}()
+		err := fmt.Errorf("opening %s took longer than %s", name, f.breaker.config.timeout())
+		f.breaker.record(err)
+		return nil, err
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// dosWildcards are the characters FindFirstFile matches other names with:
+// besides * and ?, < > and " are their DOS forms. No file name has them.
+const dosWildcards = `*?<>"`
+
+// canonicalPath returns urlPath with each element in the case it has on disk
+// below folder, or "" when it doesn't exist. Windows matches names case
+// insensitively, so /Photos/IMG_1.JPG and /photos/img_1.jpg are the same file.
+func canonicalPath(folder, urlPath string) string {
+	if strings.ContainsAny(urlPath, dosWildcards) {
+		return ""
+	}
+	elems := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(elems) == 1 && elems[0] == "" {
+		return urlPath
+	}
+	dir := folder
+	for i, elem := range elems {
+		p, err := windows.UTF16PtrFromString(filepath.Join(dir, elem))
+		if err != nil {
+			return ""
+		}
+		var data windows.Win32finddata
+		h, err := windows.FindFirstFile(p, &data)
+		if err != nil {
+			return ""
+		}
+		windows.FindClose(h)
+		elems[i] = windows.UTF16ToString(data.FileName[:])
+		dir = filepath.Join(dir, elems[i])
+	}
+	canonical := "/" + strings.Join(elems, "/")
+	if strings.HasSuffix(urlPath, "/") {
+		canonical += "/"
+	}
+	return canonical
+}
+
+// longPath returns the slash separated urlPath with the 8.3 short names
+// among its elements, such as PRIVAT~1, replaced by the long names of the
+// files below folder. Elements from the first missing file on are kept.
+func longPath(folder, urlPath string) string {
+	if folder == "" || !strings.Contains(urlPath, "~") || strings.ContainsAny(urlPath, dosWildcards) {
+		return urlPath
+	}
+	elems := strings.Split(urlPath, "/")
+	dir := folder
+	for i, elem := range elems {
+		if elem == "" {
+			continue
+		}
+		if strings.Contains(elem, "~") {
+			p, err := windows.UTF16PtrFromString(filepath.Join(dir, elem))
+			if err != nil {
+				break
+			}
+			var data windows.Win32finddata
+			h, err := windows.FindFirstFile(p, &data)
+			if err != nil {
+				break
+			}
+			windows.FindClose(h)
+			elems[i] = windows.UTF16ToString(data.FileName[:])
+		}
+		dir = filepath.Join(dir, elems[i])
+	}
+	return strings.Join(elems, "/")
+}
+
+// canonicalCaseRedirect permanently redirects GET and HEAD requests whose
+// path differs from the on-disk case of the file, so downstream caches only
+// ever see one URL per file
+func canonicalCaseRedirect(folder string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Wildcards would make FindFirstFile match other names, and the
+		// redirect tell them even where listings are off
+		if strings.ContainsAny(r.URL.Path, dosWildcards) {
+			http.NotFound(w, r)
+			return
+		}
+		urlPath := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") && urlPath != "/" {
+			urlPath += "/"
+		}
+		if canonical := canonicalPath(folder, urlPath); canonical != "" && canonical != urlPath {
+			target := *r.URL
+			target.Path = canonical
+			target.RawPath = ""
+			http.Redirect(w, r, target.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestCanonicalCaseRedirect(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("s"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := canonicalCaseRedirect(dir, http.FileServer(http.Dir(dir)))
+	for _, test := range []struct {
+		path     string
+		code     int
+		location string
+	}{
+		{"/SECRET.TXT", http.StatusMovedPermanently, "/secret.txt"},
+		{"/secret.txt", http.StatusOK, ""},
+		// Wildcards don't find names, which would be a listing
+		{"/secre*", http.StatusNotFound, ""},
+		{"/secre?.txt", http.StatusNotFound, ""},
+		{"/secre<", http.StatusNotFound, ""},
+		{"/secret>txt", http.StatusNotFound, ""},
+		{`/secret"txt`, http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com"+(&url.URL{Path: test.path}).EscapedPath(), nil))
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Errorf("%s got %d to %q, want %d to %q", test.path, w.Code, w.Header().Get("Location"), test.code, test.location)
+		}
+	}
+}
+
+func TestPrefixShortNames(t *testing.T) {
+	dir := t.TempDir()
+	long := filepath.Join(dir, "privatefolder")
+	if err := os.Mkdir(long, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p, err := windows.UTF16PtrFromString(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]uint16, windows.MAX_PATH)
+	n, err := windows.GetShortPathName(p, &buf[0], uint32(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := filepath.Base(windows.UTF16ToString(buf[:n]))
+	if short == "privatefolder" {
+		t.Skip("the volume has no 8.3 short names")
+	}
+
+	off := false
+	config := &Config{Folder: dir, Prefixes: []PrefixConfig{{Path: "/privatefolder/", Listings: &off}}}
+	for _, name := range []string{short, short + ".", short + " "} {
+		if featuresFor(config, "/"+name+"/x.jpg").listings {
+			t.Errorf("/%s/x.jpg got the default features", name)
+		}
+	}
+	// Missing files below the short name still match, for uploads
+	if featuresFor(config, "/"+short+"/new/x.jpg").listings {
+		t.Errorf("/%s/new/x.jpg got the default features", short)
+	}
+
+	// Header rules match the same way
+	handler := headerRules(dir, []HeaderRule{{Path: "/privatefolder/**", Set: map[string]string{"Content-Disposition": "attachment"}}}, http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+short+"/x.jpg", nil))
+	if w.Header().Get("Content-Disposition") == "" {
+		t.Errorf("/%s/x.jpg was served without the rule's header", short)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// cdnPurgeDelay batches the changes of a copy or sync into one purge call
+	cdnPurgeDelay = 2 * time.Second
+	// cdnPurgeAttempts is how many times a failing purge is tried before giving up
+	cdnPurgeAttempts = 3
+)
+
+// cdnAPIBase are the purge API endpoints, variables so they can point at a proxy
+var (
+	cloudflareAPIBase = "https://api.cloudflare.com/client/v4"
+	fastlyAPIBase     = "https://api.fastly.com"
+)
+
+// CDNConfig enables surrogate keys on responses and purges them from the CDN
+// in front of the server when files change
+type CDNConfig struct {
+	// Provider is cloudflare or fastly
+	Provider string `json:"provider"`
+	// ZoneID is the Cloudflare zone
+	ZoneID string `json:"zoneID,omitempty"`
+	// ServiceID is the Fastly service
+	ServiceID string `json:"serviceID,omitempty"`
+	// APIToken is a Cloudflare API token with cache purge permission or a Fastly API key
+	APIToken string `json:"apiToken" secret:"true"`
+}
+
+func (c *CDNConfig) validate() []error {
+	var errs []error
+	switch c.Provider {
+	case "cloudflare":
+		if c.ZoneID == "" {
+			errs = append(errs, fmt.Errorf("cdn.zoneID is required for cloudflare"))
+		}
+	case "fastly":
+		if c.ServiceID == "" {
+			errs = append(errs, fmt.Errorf("cdn.serviceID is required for fastly"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cdn.provider must be cloudflare or fastly, got %q", c.Provider))
+	}
+	if c.APIToken == "" {
+		errs = append(errs, fmt.Errorf("cdn.apiToken cannot be empty"))
+	}
+	return errs
+}
+
+// surrogateKeys returns the keys a response for urlPath is tagged with: the
+// path itself and each directory above it, so a directory can be purged at
+// once. Keys are lowercase since Windows paths are case insensitive, and
+// escaped since both CDNs separate keys with spaces or commas.
+func surrogateKeys(urlPath string) []string {
+	p := strings.ToLower(path.Clean("/" + urlPath))
+	keys := []string{surrogateKey(p)}
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		keys = append(keys, surrogateKey(dir+"/"))
+	}
+	return keys
+}
+
+func surrogateKey(p string) string {
+	return strings.ReplaceAll((&url.URL{Path: p}).EscapedPath(), ",", "%2C")
+}
+
+// surrogateKeyHeaders tags responses with their surrogate keys, as
+// Surrogate-Key for Fastly and Cache-Tag for Cloudflare
+func surrogateKeyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := surrogateKeys(r.URL.Path)
+		w.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+		w.Header().Set("Cache-Tag", strings.Join(keys, ","))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cdnPurger purges the surrogate keys of changed files from the CDN
+type cdnPurger struct {
+	config  *CDNConfig
+	elog    debug.Log
+	client  *http.Client
+	changes chan string
+}
+
+// newCDNPurger returns a purger for config, or nil when no CDN is configured
+func newCDNPurger(config *CDNConfig, elog debug.Log) *cdnPurger {
+	if config == nil {
+		return nil
+	}
+	return &cdnPurger{
+		config:  config,
+		elog:    elog,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		changes: make(chan string, 1024),
+	}
+}
+
+// changed queues the purge of a path relative to the folder, "" purges everything
+func (p *cdnPurger) changed(name string) {
+	select {
+	case p.changes <- name:
+	default:
+		// Too many changes to keep up with, purge everything instead
+		select {
+		case p.changes <- "":
+		default:
+		}
+	}
+}
+
+// Run purges the queued changes in batches until ctx is done
+func (p *cdnPurger) Run(ctx context.Context) {
+	for {
+		var name string
+		select {
+		case <-ctx.Done():
+			return
+		case name = <-p.changes:
+		}
+
+		// Collect whatever else changes shortly after
+		keys := map[string]bool{}
+		everything := false
+		timer := time.NewTimer(cdnPurgeDelay)
+		for collecting := true; collecting; {
+			if name == "" {
+				everything = true
+			} else {
+				// The change could be to a file or a directory
+				keys[surrogateKey(strings.ToLower("/"+name))] = true
+				keys[surrogateKey(strings.ToLower("/"+name+"/"))] = true
+			}
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case name = <-p.changes:
+			case <-timer.C:
+				collecting = false
+			}
+		}
+
+		list := make([]string, 0, len(keys))
+		for key := range keys {
+			list = append(list, key)
+		}
+		var err error
+		for attempt := 1; attempt <= cdnPurgeAttempts; attempt++ {
+			if err = p.purge(ctx, list, everything); err == nil || ctx.Err() != nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err != nil {
+			p.elog.Warning(eventStorage, fmt.Sprintf("Failed to purge %d changed paths from %s: %v", len(list), p.config.Provider, err))
+		}
+	}
+}
+
+// purge removes keys, or everything, from the CDN, in as many calls as the API limits require
+func (p *cdnPurger) purge(ctx context.Context, keys []string, everything bool) error {
+	switch p.config.Provider {
+	case "cloudflare":
+		endpoint := cloudflareAPIBase + "/zones/" + url.PathEscape(p.config.ZoneID) + "/purge_cache"
+		header := map[string]string{"Authorization": "Bearer " + p.config.APIToken, "Content-Type": "application/json"}
+		if everything {
+			return p.post(ctx, endpoint, header, map[string]bool{"purge_everything": true})
+		}
+		const maxTags = 30
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > maxTags {
+				n = maxTags
+			}
+			if err := p.post(ctx, endpoint, header, map[string][]string{"tags": keys[:n]}); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+	case "fastly":
+		service := fastlyAPIBase + "/service/" + url.PathEscape(p.config.ServiceID)
+		if everything {
+			return p.post(ctx, service+"/purge_all", map[string]string{"Fastly-Key": p.config.APIToken}, nil)
+		}
+		const maxKeys = 256
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > maxKeys {
+				n = maxKeys
+			}
+			header := map[string]string{"Fastly-Key": p.config.APIToken, "Surrogate-Key": strings.Join(keys[:n], " ")}
+			if err := p.post(ctx, service+"/purge", header, nil); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+	}
+	return nil
+}
+
+func (p *cdnPurger) post(ctx context.Context, endpoint string, header map[string]string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s %s", endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runCheck validates a config file and prints the effective configuration.
+// It returns the process exit code: 0 when valid, 1 on validation errors and
+// 2 when the config can't be read at all.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	configPath, err := resolveConfigPath(flags.file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	config, err := readConfig(configPath, flags.overrides())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for _, warning := range config.Warnings() {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+
+	errs := config.Validate()
+	// Only probe the folder once; a pipeline shouldn't wait for share retries.
+	// A Git folder that doesn't exist yet is cloned when the service starts.
+	if config.Folder != "" && config.Folder != embeddedFolder {
+		if err := checkFolder(config.Folder); err != nil && !(config.Git != nil && os.IsNotExist(err)) {
+			errs = append(errs, fmt.Errorf("folder is not accessible: %w", err))
+		}
+	}
+
+	redacted, err := redactedCopy(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	effective, err := json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("Effective configuration (%s):\n%s\n", configPath, effective)
+
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%s\n", joinErrors(errs))
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings for the server
+type Config struct {
+	Port   string `json:"port"`
+	Folder string `json:"folder"`
+	// ShutdownTimeout is how many seconds in-flight requests get to finish on stop
+	ShutdownTimeout int `json:"shutdownTimeout"`
+	// LogLevel is the minimum level written to the event log: error, warning or info
+	LogLevel string `json:"logLevel"`
+	// UpdateURL is where the update command downloads new releases from
+	UpdateURL string `json:"updateURL"`
+	// UpdatePublicKey is the base64 Ed25519 public key releases are signed with
+	UpdatePublicKey string `json:"updatePublicKey"`
+	// RemoteConfig fetches further settings from a central server
+	RemoteConfig *RemoteConfig `json:"remoteConfig,omitempty"`
+	// SlowRequestMS logs requests taking longer than this many milliseconds, 0 disables the log
+	SlowRequestMS int `json:"slowRequestMS,omitempty"`
+	// FileCacheMB is how many megabytes of file metadata and small files are cached in memory, 0 disables the cache
+	FileCacheMB int `json:"fileCacheMB,omitempty"`
+	// SniffContentType picks the Content-Type from the file's magic bytes instead of its extension
+	SniffContentType bool `json:"sniffContentType,omitempty"`
+	// ContentTypes maps file extensions to the Content-Type they are served with, over sniffing
+	ContentTypes map[string]string `json:"contentTypes,omitempty"`
+	// DefaultCharset is added to text types that don't name a charset, e.g. utf-8
+	DefaultCharset string `json:"defaultCharset,omitempty"`
+	// DimensionHeaders adds X-Image-Width and X-Image-Height headers to images
+	DimensionHeaders bool `json:"dimensionHeaders,omitempty"`
+	// CanonicalCase redirects requests to the case file names have on disk
+	CanonicalCase bool `json:"canonicalCase,omitempty"`
+	// CaseInsensitive is read by the Docker variant, names on Windows are case insensitive already
+	CaseInsensitive bool `json:"caseInsensitive,omitempty"`
+	// ChangeEvents streams the changes to the folder at /api/events, over gRPC
+	// and to the share pages, which update in place
+	ChangeEvents bool `json:"changeEvents,omitempty"`
+	// PreloadImages is how many images of a directory listing are announced with Link preload headers
+	PreloadImages int `json:"preloadImages,omitempty"`
+	// Language is the language of the share pages and error pages, e.g. de, instead of the one the browser prefers
+	Language string `json:"language,omitempty"`
+	// Theme brands the share pages and error pages
+	Theme *ThemeConfig `json:"theme,omitempty"`
+	// ListingPageSize is how many entries a page of a directory listing has, 1000 by default
+	ListingPageSize int `json:"listingPageSize,omitempty"`
+	// ReadOnly rejects every request that could modify the folder, and the sync command
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// APIKeys, when set, are required for file requests and scope them to paths and operations
+	APIKeys []APIKey `json:"apiKeys,omitempty"`
+	// RobotsTxt is served as /robots.txt instead of the folder's
+	RobotsTxt string `json:"robotsTxt,omitempty"`
+	// Fetch enables downloading files from URLs into the folder with the admin API
+	Fetch *FetchConfig `json:"fetch,omitempty"`
+	// Shares enables guest share links created with the admin API
+	Shares *ShareConfig `json:"shares,omitempty"`
+	// Sitemap serves /sitemap.xml listing the images below public prefixes
+	Sitemap *SitemapConfig `json:"sitemap,omitempty"`
+	// BlockUserAgents rejects file requests whose User-Agent contains one of these
+	BlockUserAgents []string `json:"blockUserAgents,omitempty"`
+	// Limits bounds request bodies, URL lengths and query parameters
+	Limits *LimitsConfig `json:"limits,omitempty"`
+	// Conversions tunes the image conversions of ?format= and ?ops=
+	Conversions *ConversionConfig `json:"conversions,omitempty"`
+	// Headers adds response headers to the paths matching globs
+	Headers []HeaderRule `json:"headers,omitempty"`
+	// Prefixes turn features on or off below URL paths
+	Prefixes []PrefixConfig `json:"prefixes,omitempty"`
+	// Backup copies new and changed originals to a second location
+	Backup *BackupConfig `json:"backup,omitempty"`
+	// LogExport ships access logs and events to Loki or Elasticsearch
+	LogExport *LogExportConfig `json:"logExport,omitempty"`
+	// Publish sends file and access events to RabbitMQ or Kafka
+	Publish *PublishConfig `json:"publish,omitempty"`
+	// GeoIP allows or denies clients by country
+	GeoIP *GeoIPConfig `json:"geoIP,omitempty"`
+	// Index keeps the directory listings in memory, built in the background at startup
+	Index *IndexConfig `json:"index,omitempty"`
+	// Warmup replays the most requested URLs of an access log when the service starts
+	Warmup *WarmupConfig `json:"warmup,omitempty"`
+	// CircuitBreaker refuses file requests for a while once opening files keeps failing
+	CircuitBreaker *CircuitBreakerConfig `json:"circuitBreaker,omitempty"`
+	// Git clones the folder from a repository and keeps it pulled
+	Git *GitConfig `json:"git,omitempty"`
+	// CDN tags responses with surrogate keys and purges changed files from the CDN
+	CDN *CDNConfig `json:"cdn,omitempty"`
+	// Consul registers the instance with the Consul agent while it runs
+	Consul *ConsulConfig `json:"consul,omitempty"`
+	// Report emails a weekly summary of the requests and the folder
+	Report *ReportConfig `json:"report,omitempty"`
+	// Notifications email the watchers of folders when files land in them
+	Notifications *NotificationConfig `json:"notifications,omitempty"`
+	// Listeners are further addresses served besides port, e.g. HTTPS or a private admin port
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+	// AdminToken enables the admin API for requests sending it as a bearer token
+	AdminToken string `json:"adminToken,omitempty" secret:"true"`
+
+	// warnings are non-fatal problems found while reading the file, e.g. unknown keys
+	warnings []string
+	// sources records where each key's value came from: file, remote, env, flag or default
+	sources map[string]string
+}
+
+// Warnings returns the non-fatal problems found while reading the config file
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// Sources returns where each setting's value came from, keyed by config key
+func (c *Config) Sources() map[string]string {
+	return c.sources
+}
+
+// defaultShutdownTimeout is used when the config doesn't set shutdownTimeout
+const defaultShutdownTimeout = 5
+
+// ShutdownDuration returns the configured shutdown drain timeout
+func (c *Config) ShutdownDuration() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+// applyDefaults fills in optional settings that were left out
+func (c *Config) applyDefaults() {
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+}
+
+// Validate checks the settings without touching the folder, returning every
+// problem found rather than stopping at the first one
+func (c *Config) Validate() []error {
+	var errs []error
+
+	if c.Port == "" {
+		errs = append(errs, fmt.Errorf("port cannot be empty"))
+	} else if n, err := strconv.Atoi(c.Port); err != nil || n < 1 || n > 65535 {
+		errs = append(errs, fmt.Errorf("port must be a number between 1 and 65535, got %q", c.Port))
+	}
+	if c.Folder == "" {
+		errs = append(errs, fmt.Errorf("folder cannot be empty"))
+	} else if c.Folder == embeddedFolder {
+		errs = append(errs, c.validateEmbedded()...)
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("shutdownTimeout cannot be negative"))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if c.UpdateURL != "" {
+		if u, err := url.Parse(c.UpdateURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("updateURL must be an http(s) URL, got %q", c.UpdateURL))
+		}
+	}
+	if c.UpdatePublicKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.UpdatePublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			errs = append(errs, fmt.Errorf("updatePublicKey is not a base64 encoded Ed25519 public key"))
+		}
+	}
+	if c.SlowRequestMS < 0 {
+		errs = append(errs, fmt.Errorf("slowRequestMS cannot be negative"))
+	}
+	if c.FileCacheMB < 0 {
+		errs = append(errs, fmt.Errorf("fileCacheMB cannot be negative"))
+	}
+	if c.PreloadImages < 0 {
+		errs = append(errs, fmt.Errorf("preloadImages cannot be negative"))
+	}
+	if err := validateLanguage(c.Language); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ListingPageSize < 0 || c.ListingPageSize > maxListingLimit {
+		errs = append(errs, fmt.Errorf("listingPageSize must be between 1 and %d", maxListingLimit))
+	}
+	errs = append(errs, validateContentTypes(c.ContentTypes)...)
+	if err := validateCharset(c.DefaultCharset); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, validateAPIKeys(c.APIKeys)...)
+	errs = append(errs, validatePrefixes(c.Prefixes)...)
+	errs = append(errs, validateHeaderRules(c.Headers)...)
+	for i, agent := range c.BlockUserAgents {
+		if agent == "" {
+			errs = append(errs, fmt.Errorf("blockUserAgents[%d] cannot be empty, it would block every client", i))
+		}
+	}
+	if c.Backup != nil {
+		errs = append(errs, c.Backup.validate(c.Folder)...)
+	}
+	if c.LogExport != nil {
+		errs = append(errs, c.LogExport.validate()...)
+	}
+	if c.Publish != nil {
+		errs = append(errs, c.Publish.validate()...)
+	}
+	if c.Fetch != nil {
+		errs = append(errs, c.Fetch.validate(c.adminAPI(), c.ReadOnly)...)
+	}
+	if c.Shares != nil {
+		errs = append(errs, c.Shares.validate(c.adminAPI())...)
+	}
+	if c.Sitemap != nil {
+		errs = append(errs, c.Sitemap.validate()...)
+	}
+	if c.Theme != nil {
+		errs = append(errs, c.Theme.validate()...)
+	}
+	if c.Index != nil {
+		errs = append(errs, c.Index.validate()...)
+	}
+	if c.Warmup != nil {
+		errs = append(errs, c.Warmup.validate()...)
+	}
+	if c.Limits != nil {
+		errs = append(errs, c.Limits.validate()...)
+	}
+	if c.Conversions != nil {
+		errs = append(errs, c.Conversions.validate()...)
+	}
+	if c.CircuitBreaker != nil {
+		errs = append(errs, c.CircuitBreaker.validate()...)
+	}
+	if c.Git != nil {
+		errs = append(errs, c.Git.validate(c.ReadOnly)...)
+	}
+	if c.GeoIP != nil {
+		errs = append(errs, c.GeoIP.validate()...)
+	}
+	if c.CDN != nil {
+		errs = append(errs, c.CDN.validate()...)
+	}
+	for i := range c.Listeners {
+		errs = append(errs, c.Listeners[i].validate(i)...)
+	}
+	if c.Consul != nil {
+		errs = append(errs, c.Consul.validate()...)
+	}
+	if c.Report != nil {
+		errs = append(errs, c.Report.validate()...)
+	}
+	if c.Notifications != nil {
+		errs = append(errs, c.Notifications.validate(c.Shares)...)
+	}
+	if c.RemoteConfig != nil {
+		errs = append(errs, c.RemoteConfig.validate()...)
+	}
+
+	return errs
+}
+
+// resolveConfigPath returns filename as is when absolute, otherwise relative
+// to the executable's directory. For the default config.json, a config.yaml,
+// config.yml or config.toml is used instead when only one of those exists.
+func resolveConfigPath(filename string) (string, error) {
+	if filepath.IsAbs(filename) {
+		return filename, nil
+	}
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable path: %w", err)
+	}
+	dir := filepath.Dir(exePath)
+
+	if filename == configFileNames[0] {
+		for _, name := range configFileNames {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return filepath.Join(dir, name), nil
+			}
+		}
+	}
+	return filepath.Join(dir, filename), nil
+}
+
+// configSetting describes a setting that can be overridden from the
+// environment or the command line
+type configSetting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+// configSettings lists the overridable settings. Environment variables are
+// applied over the config file and command line flags over both.
+var configSettings = []configSetting{
+	{key: "port", env: "IMAGESERVER_PORT", flag: "port", usage: "port to listen on", set: func(c *Config, v string) error {
+		c.Port = v
+		return nil
+	}},
+	{key: "folder", env: "IMAGESERVER_FOLDER", flag: "folder", usage: "folder to serve", set: func(c *Config, v string) error {
+		c.Folder = v
+		return nil
+	}},
+	{key: "logLevel", env: "IMAGESERVER_LOG_LEVEL", flag: "log-level", usage: "minimum event log level: error, warning or info", set: func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{key: "shutdownTimeout", env: "IMAGESERVER_SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "seconds to drain requests on stop", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("shutdownTimeout must be a number of seconds, got %q", v)
+		}
+		c.ShutdownTimeout = n
+		return nil
+	}},
+	{key: "updateURL", env: "IMAGESERVER_UPDATE_URL", flag: "update-url", usage: "URL new releases are downloaded from", set: func(c *Config, v string) error {
+		c.UpdateURL = v
+		return nil
+	}},
+	{key: "updatePublicKey", env: "IMAGESERVER_UPDATE_PUBLIC_KEY", flag: "update-public-key", usage: "base64 Ed25519 key releases are signed with", set: func(c *Config, v string) error {
+		c.UpdatePublicKey = v
+		return nil
+	}},
+	{key: "slowRequestMS", env: "IMAGESERVER_SLOW_REQUEST_MS", flag: "slow-request-ms", usage: "log requests taking longer than this many milliseconds, 0 disables the log", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("slowRequestMS must be a number of milliseconds, got %q", v)
+		}
+		c.SlowRequestMS = n
+		return nil
+	}},
+	{key: "fileCacheMB", env: "IMAGESERVER_FILE_CACHE_MB", flag: "file-cache-mb", usage: "megabytes of files cached in memory, 0 disables the cache", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("fileCacheMB must be a number of megabytes, got %q", v)
+		}
+		c.FileCacheMB = n
+		return nil
+	}},
+	{key: "sniffContentType", env: "IMAGESERVER_SNIFF_CONTENT_TYPE", flag: "sniff-content-type", usage: "detect the Content-Type from the file content: true or false", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("sniffContentType must be true or false, got %q", v)
+		}
+		c.SniffContentType = b
+		return nil
+	}},
+	{key: "defaultCharset", env: "IMAGESERVER_DEFAULT_CHARSET", flag: "default-charset", usage: "charset added to text types that don't name one, e.g. utf-8", set: func(c *Config, v string) error {
+		c.DefaultCharset = v
+		return nil
+	}},
+	{key: "dimensionHeaders", env: "IMAGESERVER_DIMENSION_HEADERS", flag: "dimension-headers", usage: "add image width and height headers: true or false", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("dimensionHeaders must be true or false, got %q", v)
+		}
+		c.DimensionHeaders = b
+		return nil
+	}},
+	{key: "canonicalCase", env: "IMAGESERVER_CANONICAL_CASE", flag: "canonical-case", usage: "redirect to the on-disk case of file names: true or false", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("canonicalCase must be true or false, got %q", v)
+		}
+		c.CanonicalCase = b
+		return nil
+	}},
+	{key: "preloadImages", env: "IMAGESERVER_PRELOAD_IMAGES", flag: "preload-images", usage: "images of directory listings announced with Link preload headers", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("preloadImages must be a number, got %q", v)
+		}
+		c.PreloadImages = n
+		return nil
+	}},
+	{key: "readOnly", env: "IMAGESERVER_READ_ONLY", flag: "read-only", usage: "reject everything that could modify the folder: true or false", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("readOnly must be true or false, got %q", v)
+		}
+		c.ReadOnly = b
+		return nil
+	}},
+	{key: "adminToken", env: "IMAGESERVER_ADMIN_TOKEN", flag: "admin-token", usage: "bearer token for the admin API", set: func(c *Config, v string) error {
+		c.AdminToken = v
+		return nil
+	}},
+}
+
+// configFlags holds the --config flag and the per-setting override flags
+type configFlags struct {
+	file   string
+	values map[string]*string
+}
+
+// registerConfigFlags adds --config and the override flags to fs
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{values: map[string]*string{}}
+	fs.StringVar(&f.file, "config", "config.json", "config file, relative paths are resolved next to the executable")
+	for _, setting := range configSettings {
+		f.values[setting.flag] = fs.String(setting.flag, "", setting.usage+" (overrides the config file and "+setting.env+")")
+	}
+	return f
+}
+
+// overrides returns the override flags that were given
+func (f *configFlags) overrides() map[string]string {
+	set := map[string]string{}
+	if f == nil {
+		return set
+	}
+	for name, value := range f.values {
+		if *value != "" {
+			set[name] = *value
+		}
+	}
+	return set
+}
+
+// args returns the flags that were given, to pass them on to the service command line
+func (f *configFlags) args() ([]string, error) {
+	var args []string
+	if f.file != "config.json" {
+		configPath, err := resolveConfigPath(f.file)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--config", configPath)
+	}
+	for _, setting := range configSettings {
+		if value := *f.values[setting.flag]; value != "" {
+			args = append(args, "--"+setting.flag, value)
+		}
+	}
+	return args, nil
+}
+
+// Load reads the config file given with --config and applies all overrides
+func (f *configFlags) Load() (*Config, error) {
+	return loadConfig(f.file, f.overrides())
+}
+
+// readConfig decodes the config file at path, applies the environment and
+// flag overrides and fills in defaults
+func readConfig(configPath string, flagValues map[string]string) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file %s: %w", configPath, err)
+	}
+
+	var config Config
+	config.sources = map[string]string{}
+	warnings, err := decodeConfigFile(configPath, data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config %s: %w", configPath, err)
+	}
+	config.warnings = warnings
+	values := config.markSources(nil, "file")
+
+	if config.RemoteConfig != nil {
+		if err := applyRemoteConfig(configPath, &config); err != nil {
+			return nil, err
+		}
+		values = config.markSources(values, "remote")
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(setting.env); ok && value != "" {
+			if err := setting.set(&config, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", setting.env, err)
+			}
+			config.sources[setting.key] = "env"
+		}
+	}
+	for _, setting := range configSettings {
+		if value, ok := flagValues[setting.flag]; ok {
+			if err := setting.set(&config, value); err != nil {
+				return nil, fmt.Errorf("--%s: %w", setting.flag, err)
+			}
+			config.sources[setting.key] = "flag"
+		}
+	}
+
+	values = config.markSources(nil, "")
+	config.applyDefaults()
+	config.markSources(values, "default")
+
+	if err := resolveSecrets(&config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// markSources records source for every top-level key whose value differs
+// from before, and returns the current values for the next step to compare
+// against. An empty source only takes the snapshot.
+func (c *Config) markSources(before map[string]json.RawMessage, source string) map[string]json.RawMessage {
+	var after map[string]json.RawMessage
+	data, err := json.Marshal(c)
+	if err != nil || json.Unmarshal(data, &after) != nil {
+		return before
+	}
+	if source == "" {
+		return after
+	}
+	for key, value := range after {
+		if old, ok := before[key]; ok && bytes.Equal(old, value) {
+			continue
+		}
+		if !isZeroJSON(value) {
+			c.sources[key] = source
+		}
+	}
+	return after
+}
+
+// isZeroJSON reports whether value is the JSON encoding of an unset setting
+func isZeroJSON(value json.RawMessage) bool {
+	switch string(value) {
+	case `""`, "0", "null", "false":
+		return true
+	}
+	return false
+}
+
+// LoadConfig reads the configuration file from the executable's directory
+func LoadConfig(filename string) (*Config, error) {
+	return loadConfig(filename, nil)
+}
+
+func loadConfig(filename string, flagValues map[string]string) (*Config, error) {
+	configPath, err := resolveConfigPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, err := readConfig(configPath, flagValues)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate config
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	return config, nil
+}
+
+// prepareFolder clones the Git folder if it isn't yet and verifies the folder
+// is reachable, giving network shares some time to come up. Loading the config
+// doesn't do it: commands and the service manager expect that to be quick.
+func prepareFolder(config *Config) error {
+	if config.Folder == embeddedFolder {
+		return nil
+	}
+	if config.Git != nil {
+		if err := cloneGitFolder(config.Git, config.Folder); err != nil {
+			return fmt.Errorf("failed to clone git.url into %s: %w", config.Folder, err)
+		}
+	}
+	return waitForFolder(config.Folder)
+}
+
+// redactedCopy returns a deep copy of config with secrets blanked, for display
+func redactedCopy(config *Config) (*Config, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var redacted Config
+	if err := json.Unmarshal(data, &redacted); err != nil {
+		return nil, err
+	}
+	redactSecrets(&redacted)
+	return &redacted, nil
+}
+
+// joinErrors formats a list of validation errors, one per line
+func joinErrors(errs []error) string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = "  - " + err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are tried in order next to the executable when no --config is given
+var configFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// position is a 1-based line and column in a config file
+type position struct {
+	line, col int
+}
+
+func (p position) String() string {
+	if p.line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("line %d, column %d", p.line, p.col)
+}
+
+// decodeConfigFile decodes data into config based on the file extension.
+// YAML and TOML are converted to the JSON form first so the json struct tags
+// are the single source of truth for key names. It returns a warning for each
+// key that isn't part of the schema.
+func decodeConfigFile(path string, data []byte, config *Config) ([]string, error) {
+	var (
+		tree      interface{}
+		positions map[string]position
+	)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			// yaml errors already carry "line N:"
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		if err := doc.Decode(&tree); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		positions = map[string]position{}
+		yamlKeyPositions(&doc, "", positions)
+		if err := decodeTree(tree, config); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if _, err := toml.Decode(string(data), &tree); err != nil {
+			var perr toml.ParseError
+			if errors.As(err, &perr) {
+				pos := offsetPosition(data, int64(perr.Position.Start))
+				return nil, fmt.Errorf("invalid TOML at %s: %s", pos, strings.TrimPrefix(perr.Error(), "toml: "))
+			}
+			return nil, fmt.Errorf("invalid TOML: %w", err)
+		}
+		if err := decodeTree(tree, config); err != nil {
+			return nil, err
+		}
+	default:
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, jsonError(data, err)
+		}
+		if err := json.Unmarshal(data, &tree); err != nil {
+			return nil, jsonError(data, err)
+		}
+		positions = jsonKeyPositions(data)
+	}
+
+	var warnings []string
+	unknownKeys(tree, reflect.TypeOf(config).Elem(), "", func(key string) {
+		if pos, ok := positions[key]; ok {
+			warnings = append(warnings, fmt.Sprintf("unknown key %q at %s", key, pos))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("unknown key %q", key))
+		}
+	})
+	return warnings, nil
+}
+
+// decodeTree converts a generic YAML/TOML tree into config through JSON
+func decodeTree(tree interface{}, config *Config) error {
+	data, err := json.Marshal(normalizeTree(tree))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		var terr *json.UnmarshalTypeError
+		if errors.As(err, &terr) {
+			return fmt.Errorf("invalid value for %q: expected %s", terr.Field, terr.Type)
+		}
+		return err
+	}
+	return nil
+}
+
+// normalizeTree turns the map[interface{}]interface{} values some decoders
+// produce into map[string]interface{} so they can be marshalled to JSON
+func normalizeTree(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalizeTree(val)
+		}
+		return m
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = normalizeTree(val)
+		}
+		return v
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalizeTree(val)
+		}
+		return v
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, val := range v {
+			list[i] = normalizeTree(val)
+		}
+		return list
+	}
+	return v
+}
+
+// jsonError adds the line and column to JSON syntax and type errors
+func jsonError(data []byte, err error) error {
+	var serr *json.SyntaxError
+	if errors.As(err, &serr) {
+		// The offset is just past the offending character
+		return fmt.Errorf("invalid JSON at %s: %v", offsetPosition(data, serr.Offset-1), serr)
+	}
+	var terr *json.UnmarshalTypeError
+	if errors.As(err, &terr) {
+		return fmt.Errorf("invalid value for %q at %s: expected %s, got %s", terr.Field, offsetPosition(data, terr.Offset), terr.Type, terr.Value)
+	}
+	return fmt.Errorf("invalid JSON: %w", err)
+}
+
+// offsetPosition converts a byte offset into a line and column
+func offsetPosition(data []byte, offset int64) position {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return position{line: line, col: col}
+}
+
+// jsonKeyPositions records where each object key starts, by dotted key path
+func jsonKeyPositions(data []byte) map[string]position {
+	positions := map[string]position{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				start := dec.InputOffset()
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				// InputOffset is before any whitespace and the separator, so skip to the quote
+				for start < int64(len(data)) && data[start] != '"' {
+					start++
+				}
+				keyPath := joinKey(path, fmt.Sprint(key))
+				positions[keyPath] = offsetPosition(data, start)
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+	walk("")
+	return positions
+}
+
+// yamlKeyPositions records where each mapping key is, by dotted key path
+func yamlKeyPositions(node *yaml.Node, path string, positions map[string]position) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			yamlKeyPositions(child, path, positions)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			keyPath := joinKey(path, key.Value)
+			positions[keyPath] = position{line: key.Line, col: key.Column}
+			yamlKeyPositions(node.Content[i+1], keyPath, positions)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			yamlKeyPositions(child, fmt.Sprintf("%s[%d]", path, i), positions)
+		}
+	}
+}
+
+// unknownKeys walks a decoded tree alongside the config type and reports
+// every object key that doesn't map to a field
+func unknownKeys(tree interface{}, t reflect.Type, path string, report func(key string)) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := tree.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			// Editors use $schema to pick up config.schema.json
+			if path == "" && k == "$schema" {
+				continue
+			}
+			keyPath := joinKey(path, k)
+			switch t.Kind() {
+			case reflect.Struct:
+				field, ok := jsonField(t, k)
+				if !ok {
+					report(keyPath)
+					continue
+				}
+				unknownKeys(v[k], field.Type, keyPath, report)
+			case reflect.Map:
+				unknownKeys(v[k], t.Elem(), keyPath, report)
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, item := range v {
+				unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), report)
+			}
+		}
+	}
+}
+
+// jsonField finds the struct field decoded from key, matching case-insensitively like encoding/json
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		// The fields of embedded structs are decoded as if they were the outer struct's
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			if inner, ok := jsonField(field.Type, key); ok {
+				return inner, true
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// consulTimeout bounds a single call to the Consul agent
+	consulTimeout = 10 * time.Second
+	// consulRetryInterval is how long to wait before registering again when the agent can't be reached
+	consulRetryInterval = 30 * time.Second
+)
+
+// ConsulConfig registers the instance with the local Consul agent at startup
+// and deregisters it on shutdown, so the front door and monitoring find it
+type ConsulConfig struct {
+	// URL is the Consul agent's HTTP API, e.g. http://127.0.0.1:8500
+	URL string `json:"url"`
+	// Token is the ACL token the registration is made with
+	Token string `json:"token,omitempty" secret:"true"`
+	// Service is the name registered, imageserver by default
+	Service string `json:"service,omitempty"`
+	// Address is advertised to clients, the agent's address when empty
+	Address string `json:"address,omitempty"`
+	// Tags are added to the registration
+	Tags []string `json:"tags,omitempty"`
+}
+
+func (c *ConsulConfig) validate() []error {
+	var errs []error
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("consul.url must be an http(s) URL, got %q", c.URL))
+	}
+	if strings.ContainsAny(c.Service, "/ ") {
+		errs = append(errs, fmt.Errorf("consul.service %q cannot contain slashes or spaces", c.Service))
+	}
+	for i, tag := range c.Tags {
+		if tag == "" {
+			errs = append(errs, fmt.Errorf("consul.tags[%d] cannot be empty", i))
+		}
+	}
+	return errs
+}
+
+func (c *ConsulConfig) service() string {
+	if c.Service == "" {
+		return "imageserver"
+	}
+	return c.Service
+}
+
+// serviceID identifies this instance, unique per machine and port
+func (c *ConsulConfig) serviceID(port string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return c.service() + "-" + strings.ToLower(host) + "-" + port
+}
+
+// consulRegistration is the body of PUT /v1/agent/service/register
+type consulRegistration struct {
+	ID      string      `json:"ID"`
+	Name    string      `json:"Name"`
+	Tags    []string    `json:"Tags,omitempty"`
+	Address string      `json:"Address,omitempty"`
+	Port    int         `json:"Port"`
+	Check   consulCheck `json:"Check"`
+}
+
+type consulCheck struct {
+	HTTP     string `json:"HTTP"`
+	Interval string `json:"Interval"`
+	Timeout  string `json:"Timeout"`
+	// DeregisterCriticalServiceAfter removes instances that crashed without deregistering
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// consulPut calls the agent API
+func consulPut(ctx context.Context, config *ConsulConfig, endpoint string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, consulTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(config.URL, "/")+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Token != "" {
+		req.Header.Set("X-Consul-Token", config.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// registerConsul registers the service with a check on /readyz, retrying
+// until it succeeds or ctx is done
+func registerConsul(ctx context.Context, config *ConsulConfig, port string, elog debug.Log) {
+	n, _ := strconv.Atoi(port)
+	checkHost := config.Address
+	if checkHost == "" {
+		// The agent runs on the same machine
+		checkHost = "127.0.0.1"
+	}
+	registration := consulRegistration{
+		ID:      config.serviceID(port),
+		Name:    config.service(),
+		Tags:    config.Tags,
+		Address: config.Address,
+		Port:    n,
+		Check: consulCheck{
+			HTTP:                           "http://" + checkHost + ":" + port + "/readyz",
+			Interval:                       "10s",
+			Timeout:                        "5s",
+			DeregisterCriticalServiceAfter: "10m",
+		},
+	}
+	for failed := false; ; failed = true {
+		err := consulPut(ctx, config, "/v1/agent/service/register", registration)
+		if err == nil {
+			elog.Info(eventStartup, fmt.Sprintf("Registered as %s with Consul at %s", registration.ID, config.URL))
+			return
+		}
+		if !failed {
+			elog.Warning(eventStartup, fmt.Sprintf("Failed to register with Consul at %s, retrying every %s: %v", config.URL, consulRetryInterval, err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(consulRetryInterval):
+		}
+	}
+}
+
+// deregisterConsul removes the registration, so clients stop being sent
+// here before the in-flight requests are drained
+func deregisterConsul(config *ConsulConfig, port string, elog debug.Log) {
+	id := config.serviceID(port)
+	if err := consulPut(context.Background(), config, "/v1/agent/service/deregister/"+url.PathEscape(id), nil); err != nil {
+		elog.Warning(eventStartup, fmt.Sprintf("Failed to deregister %s from Consul, its check will fail until it is removed: %v", id, err))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// contactSheetPrefix is the URL path GET /api/contactsheet/<folder> is served below
+	contactSheetPrefix = "/api/contactsheet/"
+	// contactSheetPageSize is how many images one sheet holds, more are split into ?page=
+	contactSheetPageSize = 200
+	contactSheetGap      = 8
+)
+
+// fitSize returns w x h scaled down to fit in a box of size, keeping the aspect ratio
+func fitSize(w, h, size int) (int, int) {
+	if w <= size && h <= size {
+		return w, h
+	}
+	if w >= h {
+		return size, max1(h * size / w)
+	}
+	return max1(w * size / h), size
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// thumbnail scales img down to w x h, averaging up to 4x4 samples of the
+// source pixels behind each thumbnail pixel
+func thumbnail(img image.Image, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max1((y+1)*sh/h)
+		stepY := max1((y1 - y0) / 4)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max1((x+1)*sw/w)
+			stepX := max1((x1 - x0) / 4)
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					pr, pg, pb, pa := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			if n > 0 {
+				dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+			}
+		}
+	}
+	return dst
+}
+
+// contactSheet draws the images at names in a grid of cols columns, each
+// fitted in a square cell of size pixels. Files that don't decode get a gray cell.
+func contactSheet(names []string, cols, size int) *image.RGBA {
+	rows := (len(names) + cols - 1) / cols
+	if rows == 0 {
+		rows = 1
+	}
+	if cols > len(names) && len(names) > 0 {
+		cols = len(names)
+	}
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*(size+contactSheetGap)+contactSheetGap, rows*(size+contactSheetGap)+contactSheetGap))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	placeholder := image.NewUniform(color.Gray{Y: 0xcc})
+	for i, name := range names {
+		cell := image.Rect(0, 0, size, size).Add(image.Pt(
+			contactSheetGap+(i%cols)*(size+contactSheetGap),
+			contactSheetGap+(i/cols)*(size+contactSheetGap),
+		))
+		img, err := decodeImageFile(name)
+		if err != nil {
+			draw.Draw(sheet, cell, placeholder, image.Point{}, draw.Src)
+			continue
+		}
+		w, h := fitSize(img.Bounds().Dx(), img.Bounds().Dy(), size)
+		thumb := thumbnail(img, w, h)
+		at := cell.Min.Add(image.Pt((size-w)/2, (size-h)/2))
+		draw.Draw(sheet, thumb.Bounds().Add(at), thumb, image.Point{}, draw.Over)
+	}
+	return sheet
+}
+
+func decodeImageFile(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// contactSheetParam reads an integer query parameter from lo to hi
+func contactSheetParam(r *http.Request, name string, def, lo, hi int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s must be a number from %d to %d", name, lo, hi)
+	}
+	return n, nil
+}
+
+// contactSheetHandler serves GET /api/contactsheet/<folder>, a JPEG grid of
+// the images directly in the folder, in name order, for proof sheets
+func contactSheetHandler(folder string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cols, err := contactSheetParam(r, "cols", 6, 1, 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		size, err := contactSheetParam(r, "size", 240, 32, 800)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err := contactSheetParam(r, "page", 1, 1, 1<<20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveContactSheet(w, r, folder, cols, size, page)
+	})
+}
+
+func serveContactSheet(w http.ResponseWriter, r *http.Request, folder string, cols, size, page int) {
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, contactSheetPrefix))
+	dir := filepath.Join(folder, filepath.FromSlash(name))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var images []string
+	for _, entry := range entries {
+		if !entry.IsDir() && decodableExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			images = append(images, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(images)
+	pages := (len(images) + contactSheetPageSize - 1) / contactSheetPageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		http.Error(w, fmt.Sprintf("the folder only has %d pages", pages), http.StatusNotFound)
+		return
+	}
+	images = images[(page-1)*contactSheetPageSize:]
+	if len(images) > contactSheetPageSize {
+		images = images[:contactSheetPageSize]
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, contactSheet(images, cols, size), &jpeg.Options{Quality: 90}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := path.Base(name)
+	if filename == "/" {
+		filename = "contactsheet"
+	}
+	if pages > 1 {
+		filename += fmt.Sprintf("-%d", page)
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename + ".jpg"}))
+	w.Header().Set("X-Contact-Sheet-Pages", strconv.Itoa(pages))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// builtinContentTypes are types for extensions that Go doesn't know, or that
+// Windows often maps wrongly in the registry, which mime.TypeByExtension
+// consults. contentTypes in the config overrides them.
+var builtinContentTypes = map[string]string{
+	".avif": "image/avif",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".jxl":  "image/jxl",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+	".dng":  "image/x-adobe-dng",
+	".cr2":  "image/x-canon-cr2",
+	".nef":  "image/x-nikon-nef",
+	".arw":  "image/x-sony-arw",
+	".js":   "text/javascript",
+	".css":  "text/css",
+	".json": "application/json",
+}
+
+// contentTypeOverrides returns the built-in types overlaid with types, keyed by lowercase extension
+func contentTypeOverrides(types map[string]string) map[string]string {
+	overrides := make(map[string]string, len(builtinContentTypes)+len(types))
+	for ext, contentType := range builtinContentTypes {
+		overrides[ext] = contentType
+	}
+	for ext, contentType := range types {
+		overrides[strings.ToLower(ext)] = contentType
+	}
+	return overrides
+}
+
+// validateCharset checks the defaultCharset setting
+func validateCharset(charset string) error {
+	if charset != "" && mime.FormatMediaType("text/plain", map[string]string{"charset": charset}) == "" {
+		return fmt.Errorf("defaultCharset %q is not a valid charset name", charset)
+	}
+	return nil
+}
+
+// withCharset adds charset to text types that don't name one
+func withCharset(contentType, charset string) string {
+	if charset == "" || !strings.HasPrefix(contentType, "text/") {
+		return contentType
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] != "" {
+		return contentType
+	}
+	params["charset"] = charset
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// validateContentTypes checks the contentTypes map of extensions to MIME types
+func validateContentTypes(types map[string]string) []error {
+	var errs []error
+	for ext, contentType := range types {
+		if !strings.HasPrefix(ext, ".") {
+			errs = append(errs, fmt.Errorf("contentTypes keys must be extensions starting with a dot, got %q", ext))
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			errs = append(errs, fmt.Errorf("contentTypes[%q] is not a valid MIME type: %v", ext, err))
+		}
+	}
+	return errs
+}
+
+// sniffedType returns the type of a file from its first bytes, or "" when
+// they don't identify it. Text formats such as CSS, JSON and SVG have no
+// magic bytes and would only be recognized as plain text or XML, so only
+// binary types are trusted over the extension.
+func sniffedType(head []byte) string {
+	detected := http.DetectContentType(head)
+	if strings.HasPrefix(detected, "text/") || detected == "application/octet-stream" {
+		return ""
+	}
+	return detected
+}
+
+// contentTypeHandler sets Content-Type before next, an http.FileServer,
+// falls back on the extension. Types in overrides, keyed by lowercase
+// extension, always win; otherwise when sniff is set the file's magic bytes
+// decide, since files copied from scanners and cameras often have a wrong or
+// missing extension. Text types without a charset get charset, if set.
+func contentTypeHandler(files http.FileSystem, overrides map[string]string, sniff bool, charset string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		ext := strings.ToLower(path.Ext(name))
+		contentType, ok := overrides[ext]
+		if !ok && sniff && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			contentType = sniffFile(files, name)
+		}
+		if contentType == "" && charset != "" && ext != "" {
+			contentType = mime.TypeByExtension(ext)
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", withCharset(contentType, charset))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sniffFile returns the sniffed type of the file at name, or "" for
+// directories and files that can't be read or identified
+func sniffFile(files http.FileSystem, name string) string {
+	f, err := files.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		return ""
+	}
+	// DetectContentType looks at the first 512 bytes at most
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	return sniffedType(head[:n])
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// trafficMinutes is how far back the traffic history goes
+	trafficMinutes = 24 * 60
+	// trafficBucketMinutes is the width of a bar of the traffic chart
+	trafficBucketMinutes = 15
+	// maxTopFiles bounds the paths counted for the most requested files
+	maxTopFiles = 1000
+	// dashboardTopFiles is how many of them the dashboard lists
+	dashboardTopFiles = 20
+)
+
+// trafficHistory counts the requests of each minute of the last day, in a ring
+type trafficHistory struct {
+	mu      sync.Mutex
+	minutes [trafficMinutes]trafficMinute
+}
+
+type trafficMinute struct {
+	// minute is the Unix minute the slot counts, older slots are stale
+	minute   int64
+	requests uint64
+	errors   uint64
+	bytes    uint64
+}
+
+func (h *trafficHistory) add(now time.Time, status int, bytes int64) {
+	minute := now.Unix() / 60
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slot := &h.minutes[minute%trafficMinutes]
+	if slot.minute != minute {
+		*slot = trafficMinute{minute: minute}
+	}
+	slot.requests++
+	slot.bytes += uint64(bytes)
+	if status >= 400 {
+		slot.errors++
+	}
+}
+
+// buckets returns the day up to now in buckets of width minutes, oldest
+// first, each with the first minute it counts
+func (h *trafficHistory) buckets(now time.Time, width int) []trafficMinute {
+	last := now.Unix() / 60
+	first := last - trafficMinutes + 1
+	// Aligned, so a bar keeps its minutes from one refresh to the next
+	first -= first % int64(width)
+	buckets := make([]trafficMinute, 0, trafficMinutes/width+1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for start := first; start <= last; start += int64(width) {
+		bucket := trafficMinute{minute: start}
+		for m := start; m < start+int64(width) && m <= last; m++ {
+			if slot := h.minutes[m%trafficMinutes]; slot.minute == m {
+				bucket.requests += slot.requests
+				bucket.errors += slot.errors
+				bucket.bytes += slot.bytes
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// topFiles counts the requests of the most requested files. Once it tracks
+// maxTopFiles paths, a new one replaces the least requested and starts from
+// its count, so popular files still rise to the top while the counts of the
+// rarely requested ones become estimates.
+type topFiles struct {
+	mu     sync.Mutex
+	counts map[string]*fileCount
+}
+
+type fileCount struct {
+	path     string
+	requests uint64
+	bytes    uint64
+}
+
+func (t *topFiles) observe(urlPath string, bytes int64) {
+	// Lowercase since paths are case insensitive on Windows
+	key := strings.ToLower(path.Clean("/" + urlPath))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts == nil {
+		t.counts = map[string]*fileCount{}
+	}
+	count, ok := t.counts[key]
+	if !ok {
+		count = &fileCount{path: key}
+		if len(t.counts) >= maxTopFiles {
+			var least *fileCount
+			for _, c := range t.counts {
+				if least == nil || c.requests < least.requests {
+					least = c
+				}
+			}
+			delete(t.counts, least.path)
+			count.requests = least.requests
+		}
+		t.counts[key] = count
+	}
+	count.requests++
+	count.bytes += uint64(bytes)
+}
+
+// top returns the n most requested files, most requested first
+func (t *topFiles) top(n int) []fileCount {
+	t.mu.Lock()
+	counts := make([]fileCount, 0, len(t.counts))
+	for _, c := range t.counts {
+		counts = append(counts, *c)
+	}
+	t.mu.Unlock()
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].requests != counts[j].requests {
+			return counts[i].requests > counts[j].requests
+		}
+		return counts[i].path < counts[j].path
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// isFileRequest reports whether a response is a file served from the
+// folder, what the most requested files are counted from
+func isFileRequest(urlPath string, status int) bool {
+	if status != http.StatusOK && status != http.StatusPartialContent {
+		return false
+	}
+	for _, prefix := range []string{"/api/", "/admin/", "/debug/"} {
+		if strings.HasPrefix(urlPath, prefix) {
+			return false
+		}
+	}
+	return urlPath != "/readyz" && !strings.HasSuffix(urlPath, "/")
+}
+
+// formatBytes returns n in B, KB, MB, GB or TB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n)/unit, "KB"
+	for _, next := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+// adminPage lets browsers in with the admin token as the password of the
+// login prompt, since they can't send it as a bearer token
+func adminPage(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected, ok := adminTokenFor(r, token)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, password, _ := r.BasicAuth()
+		if !hasBearer(r, expected) && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ImageServer admin", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The size of the traffic chart, in SVG units
+const (
+	trafficChartWidth  = 960
+	trafficChartHeight = 200
+)
+
+type trafficBar struct {
+	X, Width            float64
+	Y, Height           float64
+	ErrorY, ErrorHeight float64
+	Title               string
+}
+
+type trafficLabel struct {
+	X    float64
+	Text string
+}
+
+type statusShare struct {
+	Code     int
+	Class    string
+	Requests uint64
+	Percent  float64
+}
+
+type topFileRow struct {
+	Path     string
+	Requests uint64
+	Served   string
+}
+
+type dashboardData struct {
+	Text         messages
+	Theme        pageTheme
+	Since        string
+	Requests     uint64
+	ClientErrors uint64
+	ServerErrors uint64
+	Served       string
+	Latency      string
+	Bars         []trafficBar
+	Labels       []trafficLabel
+	PeakRequests uint64
+	Statuses     []statusShare
+	CacheEnabled bool
+	CacheHitRate float64
+	CacheHits    uint64
+	CacheMisses  uint64
+	TopFiles     []topFileRow
+	ChartWidth   int
+	ChartHeight  int
+}
+
+var dashboardTemplate = template.Must(template.New("stats").Parse(`<!doctype html>
+<html lang="{{.Text.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<meta name="robots" content="noindex, nofollow">
+<meta http-equiv="refresh" content="60">
+<title>{{.Text.T "stats.title"}}</title>
+<style>
+{{.Theme.Colors}}
+body{font-family:system-ui,sans-serif;margin:0;background:var(--bg);color:var(--fg)}
+header{display:flex;align-items:center;gap:1em;padding:1em 2em;background:var(--surface);border-bottom:1px solid var(--border)}
+header img{max-height:48px}
+h1{font-size:1.4em;margin:0}
+h2{font-size:1.1em;margin:0 0 .8em}
+main{padding:1em 2em;display:grid;gap:1em;grid-template-columns:repeat(auto-fit,minmax(280px,1fr))}
+section{background:var(--surface);border-radius:4px;padding:1em 1.5em}
+.wide{grid-column:1/-1}
+.figures{display:flex;flex-wrap:wrap;gap:2em}
+.figures strong{display:block;font-size:1.6em}
+.muted,footer{color:var(--muted);font-size:.85em}
+svg{width:100%;height:auto;display:block}
+.bar{fill:var(--accent)}
+.error{fill:#dc2626}
+.axis{fill:var(--muted);font-size:12px}
+.mix{display:flex;height:1.5em;border-radius:4px;overflow:hidden;margin-bottom:.8em}
+.s2{background:#16a34a}.s3{background:#2563eb}.s4{background:#f59e0b}.s5{background:#dc2626}
+.dot{display:inline-block;width:.8em;height:.8em;border-radius:50%;margin-right:.4em}
+.meter{height:1.5em;background:var(--placeholder);border-radius:4px;overflow:hidden}
+.meter div{height:100%;background:var(--accent)}
+table{width:100%;border-collapse:collapse;font-size:.9em}
+td,th{text-align:left;padding:.3em .5em;border-bottom:1px solid var(--border)}
+td.n,th.n{text-align:right;white-space:nowrap}
+td.path{word-break:break-all}
+footer{padding:0 2em 1em}
+{{.Theme.CSS}}
+</style>
+</head>
+<body>
+<header>{{if .Theme.Logo}}<img src="{{.Theme.Logo}}" alt="">{{end}}<h1>{{if .Theme.Title}}{{.Theme.Title}} &ndash; {{end}}{{.Text.T "stats.title"}}</h1></header>
+<main>
+<section class="wide">
+<div class="figures">
+<div><strong>{{.Requests}}</strong>{{.Text.T "stats.requests"}}</div>
+<div><strong>{{.Served}}</strong>{{.Text.T "stats.served"}}</div>
+<div><strong>{{.ClientErrors}}</strong>{{.Text.T "stats.clientErrors"}}</div>
+<div><strong>{{.ServerErrors}}</strong>{{.Text.T "stats.serverErrors"}}</div>
+<div><strong>{{.Latency}}</strong>{{.Text.T "stats.latency"}}</div>
+</div>
+</section>
+<section class="wide">
+<h2>{{.Text.T "stats.traffic"}}</h2>
+<svg viewBox="0 0 {{.ChartWidth}} {{.ChartHeight}}" role="img" aria-label="{{.Text.T "stats.traffic"}}">
+{{range .Bars}}<g><title>{{.Title}}</title><rect class="bar" x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}"/>{{if .ErrorHeight}}<rect class="error" x="{{.X}}" y="{{.ErrorY}}" width="{{.Width}}" height="{{.ErrorHeight}}"/>{{end}}</g>
+{{end}}{{range .Labels}}<text class="axis" x="{{.X}}" y="{{$.ChartHeight}}" text-anchor="middle">{{.Text}}</text>
+{{end}}</svg>
+<p class="muted">{{.Text.T "stats.peak" .PeakRequests}}</p>
+</section>
+<section>
+<h2>{{.Text.T "stats.statuses"}}</h2>
+{{if .Statuses}}<div class="mix">{{range .Statuses}}<div class="{{.Class}}" style="width:{{printf "%.2f" .Percent}}%" title="{{.Code}}"></div>{{end}}</div>
+<table>{{range .Statuses}}<tr><td><span class="dot {{.Class}}"></span>{{.Code}}</td><td class="n">{{.Requests}}</td><td class="n">{{printf "%.1f" .Percent}}%</td></tr>{{end}}</table>
+{{else}}<p class="muted">{{.Text.T "stats.none"}}</p>{{end}}
+</section>
+<section>
+<h2>{{.Text.T "stats.cache"}}</h2>
+{{if .CacheEnabled}}<p><strong>{{printf "%.1f" .CacheHitRate}}%</strong></p>
+<div class="meter"><div style="width:{{printf "%.2f" .CacheHitRate}}%"></div></div>
+<p class="muted">{{.Text.T "stats.cacheDetail" .CacheHits .CacheMisses}}</p>
+{{else}}<p class="muted">{{.Text.T "stats.cacheOff"}}</p>{{end}}
+</section>
+<section class="wide">
+<h2>{{.Text.T "stats.top"}}</h2>
+{{if .TopFiles}}<table><tr><th>{{.Text.T "stats.file"}}</th><th class="n">{{.Text.T "stats.requests"}}</th><th class="n">{{.Text.T "stats.served"}}</th></tr>
+{{range .TopFiles}}<tr><td class="path">{{.Path}}</td><td class="n">{{.Requests}}</td><td class="n">{{.Served}}</td></tr>
+{{end}}</table>{{else}}<p class="muted">{{.Text.T "stats.none"}}</p>{{end}}
+</section>
+</main>
+<footer>{{.Text.T "stats.since" .Since}}</footer>
+</body>
+</html>
+`))
+
+// dashboardHandler serves GET /admin/stats, the request statistics as a
+// page with charts. cache may be nil when the file cache is disabled.
+func dashboardHandler(stats *requestStats, cache *fileCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		text := pageText(r)
+		now := time.Now()
+		snapshot := stats.Snapshot()
+		data := dashboardData{
+			Text:         text,
+			Theme:        requestTheme(r),
+			Since:        stats.started.Format(text.T("share.dateLayout")),
+			Requests:     snapshot.Requests,
+			ClientErrors: snapshot.ClientErrors,
+			ServerErrors: snapshot.ServerErrors,
+			Served:       formatBytes(snapshot.BytesServed),
+			Latency:      fmt.Sprintf("%s / %s / %s", stats.latency.percentile(0.5).Round(time.Millisecond), stats.latency.percentile(0.9).Round(time.Millisecond), stats.latency.percentile(0.99).Round(time.Millisecond)),
+			ChartWidth:   trafficChartWidth,
+			ChartHeight:  trafficChartHeight,
+		}
+
+		buckets := stats.history.buckets(now, trafficBucketMinutes)
+		for _, b := range buckets {
+			if b.requests > data.PeakRequests {
+				data.PeakRequests = b.requests
+			}
+		}
+		// The bottom 20 units are left to the hour labels
+		plot := float64(trafficChartHeight - 20)
+		width := float64(trafficChartWidth) / float64(len(buckets))
+		for i, b := range buckets {
+			bar := trafficBar{X: float64(i) * width, Width: width * 0.8, Y: plot}
+			if data.PeakRequests > 0 {
+				bar.Height = plot * float64(b.requests) / float64(data.PeakRequests)
+				bar.ErrorHeight = plot * float64(b.errors) / float64(data.PeakRequests)
+			}
+			bar.Y = plot - bar.Height
+			bar.ErrorY = plot - bar.ErrorHeight
+			start := time.Unix(b.minute*60, 0)
+			bar.Title = text.T("stats.bar", start.Format("15:04"), b.requests, b.errors, formatBytes(b.bytes))
+			data.Bars = append(data.Bars, bar)
+			if start.Minute() == 0 && start.Hour()%3 == 0 {
+				data.Labels = append(data.Labels, trafficLabel{X: bar.X, Text: start.Format("15:04")})
+			}
+		}
+
+		statuses := stats.breakdown.statuses()
+		var total uint64
+		for _, requests := range statuses {
+			total += requests
+		}
+		for code, requests := range statuses {
+			data.Statuses = append(data.Statuses, statusShare{Code: code, Class: fmt.Sprintf("s%d", code/100), Requests: requests, Percent: 100 * float64(requests) / float64(total)})
+		}
+		sort.Slice(data.Statuses, func(i, j int) bool { return data.Statuses[i].Code < data.Statuses[j].Code })
+
+		if cache != nil {
+			data.CacheEnabled = true
+			data.CacheHits, data.CacheMisses = atomic.LoadUint64(&cache.hits), atomic.LoadUint64(&cache.misses)
+			if lookups := data.CacheHits + data.CacheMisses; lookups > 0 {
+				data.CacheHitRate = 100 * float64(data.CacheHits) / float64(lookups)
+			}
+		}
+
+		for _, f := range stats.top.top(dashboardTopFiles) {
+			data.TopFiles = append(data.TopFiles, topFileRow{Path: f.path, Requests: f.requests, Served: formatBytes(f.bytes)})
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead {
+			return
+		}
+		dashboardTemplate.Execute(w, data)
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// embeddedFolder is the folder setting that serves the files built into the
+// executable instead of a folder on disk, for kiosks shipping a single exe.
+// Build with -tags embedassets after copying the files into assets.
+const embeddedFolder = "embedded"
+
+// validateEmbedded rejects the settings that need the folder on disk
+func (c *Config) validateEmbedded() []error {
+	if embeddedFiles() == nil {
+		return []error{fmt.Errorf("folder %q needs an executable built with -tags embedassets", embeddedFolder)}
+	}
+	var errs []error
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{
+		{"backup", c.Backup != nil},
+		{"canonicalCase", c.CanonicalCase},
+		{"circuitBreaker", c.CircuitBreaker != nil},
+		{"fetch", c.Fetch != nil},
+		{"fileCacheMB", c.FileCacheMB > 0},
+		{"git", c.Git != nil},
+		{"index", c.Index != nil},
+		{"shares", c.Shares != nil},
+		{"sitemap", c.Sitemap != nil},
+	} {
+		if setting.set {
+			errs = append(errs, fmt.Errorf("%s cannot be used with the embedded folder", setting.name))
+		}
+	}
+	return errs
+}
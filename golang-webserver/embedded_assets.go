@@ -0,0 +1,64 @@
+//go:build embedassets
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+)
+
+//go:embed all:assets
+var embeddedAssets embed.FS
+
+// embeddedFiles returns the files built into the executable
+func embeddedFiles() http.FileSystem {
+	assets, err := fs.Sub(embeddedAssets, "assets")
+	if err != nil {
+		panic(err)
+	}
+	// Embedded files have no modification time, the executable's stands in
+	// for it so ETags and Last-Modified change when a new build is deployed
+	var built time.Time
+	if exe, err := os.Executable(); err == nil {
+		if info, err := os.Stat(exe); err == nil {
+			built = info.ModTime()
+		}
+	}
+	return embeddedFS{http.FS(assets), built}
+}
+
+type embeddedFS struct {
+	http.FileSystem
+	built time.Time
+}
+
+func (f embeddedFS) Open(name string) (http.File, error) {
+	file, err := f.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return embeddedFile{file, f.built}, nil
+}
+
+type embeddedFile struct {
+	http.File
+	built time.Time
+}
+
+func (f embeddedFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return embeddedInfo{info, f.built}, nil
+}
+
+type embeddedInfo struct {
+	fs.FileInfo
+	built time.Time
+}
+
+func (i embeddedInfo) ModTime() time.Time { return i.built }
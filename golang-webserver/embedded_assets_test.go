@@ -0,0 +1,20 @@
+//go:build embedassets
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEmbeddedFS checks that the files built into the executable carry its
+// modification time and otherwise behave like the folder
+func TestEmbeddedFS(t *testing.T) {
+	built := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := embeddedFS{newMemFixture(t, "/"), built}
+	testFileSystem(t, fsys, built)
+
+	if _, err := embeddedFiles().Open("/"); err != nil {
+		t.Errorf("opening the embedded assets: %v", err)
+	}
+}
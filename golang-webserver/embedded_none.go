@@ -0,0 +1,10 @@
+//go:build !embedassets
+
+package main
+
+import "net/http"
+
+// embeddedFiles returns nil, the executable wasn't built with -tags embedassets
+func embeddedFiles() http.FileSystem {
+	return nil
+}
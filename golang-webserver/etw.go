@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Microsoft/go-winio/pkg/etw"
+)
+
+// etwProviderName is the ETW provider the service publishes statistics on.
+// The provider GUID is derived from the name, so tools can enable it by name
+// (e.g. "logman start imageserver -p ImageServer -ets" or PerfView "*ImageServer").
+const etwProviderName = "ImageServer"
+
+// etwStatsInterval is how often a statistics event is written
+const etwStatsInterval = 10 * time.Second
+
+// publishETWStats writes a "RequestStats" event every interval with the
+// request rate, error rate and bytes served since the previous event
+func publishETWStats(ctx context.Context, stats *requestStats) error {
+	provider, err := etw.NewProvider(etwProviderName, nil)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer provider.Close()
+
+		ticker := time.NewTicker(etwStatsInterval)
+		defer ticker.Stop()
+
+		prev := stats.Snapshot()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cur := stats.Snapshot()
+				if !provider.IsEnabled() {
+					prev = cur
+					continue
+				}
+
+				seconds := etwStatsInterval.Seconds()
+				requests := cur.Requests - prev.Requests
+				errors := (cur.ClientErrors - prev.ClientErrors) + (cur.ServerErrors - prev.ServerErrors)
+				provider.WriteEvent(
+					"RequestStats",
+					etw.WithEventOpts(etw.WithLevel(etw.LevelInfo)),
+					etw.WithFields(
+						etw.Float64Field("RequestsPerSec", float64(requests)/seconds),
+						etw.Float64Field("ErrorsPerSec", float64(errors)/seconds),
+						etw.Float64Field("BytesPerSec", float64(cur.BytesServed-prev.BytesServed)/seconds),
+						etw.Uint64Field("TotalRequests", cur.Requests),
+						etw.Uint64Field("TotalClientErrors", cur.ClientErrors),
+						etw.Uint64Field("TotalServerErrors", cur.ServerErrors),
+						etw.Uint64Field("TotalBytesServed", cur.BytesServed),
+					),
+				)
+				prev = cur
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// Event IDs by category. The source is registered with EventCreate.exe as its
+// message file, which only has messages for IDs 1 to 1000, so keep them in range.
+const (
+	eventStartup uint32 = 100 // service lifecycle: start, stop, control requests
+	eventConfig  uint32 = 200 // loading and validating the configuration
+	eventHTTP    uint32 = 300 // HTTP server and request errors
+	eventStorage uint32 = 400 // image folder availability
+	eventBackup  uint32 = 500 // scheduled backups
+	eventExport  uint32 = 600 // shipping logs and events to Loki, Elasticsearch, RabbitMQ or Kafka
+	eventGit     uint32 = 700 // pulling the folder from a Git repository
+	eventMail    uint32 = 800 // report and notification emails
+)
+
+// logLevel controls which events are written to the event log
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarning
+	levelInfo
+)
+
+// parseLogLevel converts the logLevel config value, defaulting to info
+func parseLogLevel(value string) (logLevel, error) {
+	switch strings.ToLower(value) {
+	case "error":
+		return levelError, nil
+	case "warning", "warn":
+		return levelWarning, nil
+	case "info", "":
+		return levelInfo, nil
+	}
+	return levelInfo, fmt.Errorf("invalid logLevel %q, expected error, warning or info", value)
+}
+
+// leveledLog drops events below the configured level. Errors are always written.
+type leveledLog struct {
+	debug.Log
+	level int32
+}
+
+func newLeveledLog(elog debug.Log, level string) *leveledLog {
+	l := &leveledLog{Log: elog}
+	l.SetLevel(level)
+	return l
+}
+
+// SetLevel changes the minimum level, it is safe to call while logging
+func (l *leveledLog) SetLevel(level string) {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		// LoadConfig already validated the level, fall back to logging everything
+		parsed = levelInfo
+	}
+	atomic.StoreInt32(&l.level, int32(parsed))
+}
+
+func (l *leveledLog) enabled(level logLevel) bool {
+	return logLevel(atomic.LoadInt32(&l.level)) >= level
+}
+
+func (l *leveledLog) Info(eid uint32, msg string) error {
+	if !l.enabled(levelInfo) {
+		return nil
+	}
+	return l.Log.Info(eid, msg)
+}
+
+func (l *leveledLog) Warning(eid uint32, msg string) error {
+	if !l.enabled(levelWarning) {
+		return nil
+	}
+	return l.Log.Warning(eid, msg)
+}
+
+// eventLogWriter adapts the event log for http.Server.ErrorLog
+type eventLogWriter struct {
+	elog debug.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	w.elog.Warning(eventHTTP, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// httpErrorLog returns a logger that writes HTTP server errors to elog
+func httpErrorLog(elog debug.Log) *log.Logger {
+	return log.New(eventLogWriter{elog: elog}, "", 0)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventsPrefix is the URL path GET /api/events/<folder> is served at
+	eventsPrefix = "/api/events"
+	// maxFeedEvents is how many of the latest events clients can resume after
+	maxFeedEvents = 1024
+	// eventsHeartbeat is how often an idle stream is written to, so proxies
+	// don't close it
+	eventsHeartbeat = 30 * time.Second
+)
+
+// changeEvent is a change to the folder sent to the clients of the streams.
+// Action resync, with path /, tells them that changes were missed and that
+// they should reload what they show.
+type changeEvent struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	fileEvent
+}
+
+// changeFeed keeps the latest changes to the folder for the clients
+// streaming them, which each follow it at their own pace
+type changeFeed struct {
+	mu sync.Mutex
+	// events are the latest events, oldest first, last is the ID of the
+	// latest one
+	events []changeEvent
+	last   uint64
+	// wake is closed and replaced when an event is added
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	watched   bool
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{wake: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// watch returns the change listener of folder. Watching another folder
+// after a config change tells the clients to resync.
+func (f *changeFeed) watch(folder string) func(name string) {
+	f.mu.Lock()
+	resync := f.watched
+	f.watched = true
+	f.mu.Unlock()
+	if resync {
+		f.add(fileEvent{Action: "resync", Path: "/"})
+	}
+	return func(name string) {
+		if name == "" {
+			// Changes were missed, there is no telling which
+			f.add(fileEvent{Action: "resync", Path: "/"})
+		} else if event := statFileEvent(folder, name); event != nil {
+			f.add(*event)
+		}
+	}
+}
+
+func (f *changeFeed) add(event fileEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last++
+	f.events = append(f.events, changeEvent{ID: f.last, Time: time.Now().UTC(), fileEvent: event})
+	if len(f.events) > 2*maxFeedEvents {
+		f.events = append(f.events[:0], f.events[len(f.events)-maxFeedEvents:]...)
+	}
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// close ends the streams, when the server shuts down
+func (f *changeFeed) close() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
+
+// resumeID returns the ID a stream starts after: lastID as sent by a
+// reconnecting client, or the latest event for new ones
+func (f *changeFeed) resumeID(lastID string) uint64 {
+	if id, err := strconv.ParseUint(lastID, 10, 64); err == nil && lastID != "" {
+		return id
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last
+}
+
+// since returns the events after id and the channel closed when there are
+// more. When events after id were dropped, or id is from before a restart,
+// it returns a resync event instead.
+func (f *changeFeed) since(id uint64) ([]changeEvent, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first := f.last + 1
+	if len(f.events) > 0 {
+		first = f.events[0].ID
+	}
+	if id > f.last || id+1 < first {
+		return []changeEvent{{ID: f.last, Time: time.Now().UTC(), fileEvent: fileEvent{Action: "resync", Path: "/"}}}, f.wake
+	}
+	events := f.events[len(f.events)-int(f.last-id):]
+	return append([]changeEvent(nil), events...), f.wake
+}
+
+// stream sends the events after id that visible lets through until ctx is
+// done, the feed closes, until passes (unless it is zero) or send fails.
+// heartbeat is called when nothing was sent for a while.
+func (f *changeFeed) stream(ctx context.Context, id uint64, until time.Time, visible func(*changeEvent) bool, send func(*changeEvent) error, heartbeat func() error) error {
+	var end <-chan time.Time
+	if !until.IsZero() {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		end = timer.C
+	}
+	idle := time.NewTicker(eventsHeartbeat)
+	defer idle.Stop()
+	for {
+		events, wake := f.since(id)
+		for i := range events {
+			id = events[i].ID
+			if visible(&events[i]) {
+				if err := send(&events[i]); err != nil {
+					return err
+				}
+				idle.Reset(eventsHeartbeat)
+			}
+		}
+		select {
+		case <-wake:
+		case <-idle.C:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		case <-end:
+			return nil
+		case <-f.closed:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// liftReadDeadline takes the read timeout off the HTTP/1 connection of r,
+// for a stream: it would cancel the request context. Writes only time out
+// when the client stops reading, see listenerConn.Write.
+func liftReadDeadline(r *http.Request) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok && r.ProtoMajor == 1 {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// eventAccess decides which events a client may see: those of the files
+// whose folder it may list
+type eventAccess struct {
+	config *Config
+	key    *APIKey
+}
+
+func newEventAccess(config *Config, r *http.Request) eventAccess {
+	return eventAccess{config: config, key: findAPIKey(config.APIKeys, r)}
+}
+
+// check returns the HTTP status refusing a stream of the events below
+// folder, or 0 when the client may follow it
+func (a eventAccess) check(folder string) int {
+	features := featuresFor(a.config, folder)
+	switch {
+	case !features.listings:
+		return http.StatusNotFound
+	case !features.requireAPIKey || len(a.config.APIKeys) == 0:
+		return 0
+	case a.key == nil:
+		return http.StatusUnauthorized
+	case !a.key.allows(operationRead, folder):
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+// visible returns the filter of the events below folder the client may see
+func (a eventAccess) visible(folder string) func(*changeEvent) bool {
+	folder = strings.ToLower(folder)
+	return func(e *changeEvent) bool {
+		if e.Action == "resync" {
+			return true
+		}
+		p := strings.ToLower(e.Path)
+		if folder != "/" && p != folder && !strings.HasPrefix(p, folder+"/") {
+			return false
+		}
+		return a.check(path.Dir(e.Path)) == 0
+	}
+}
+
+// eventsHandler serves GET /api/events/<folder> as server-sent events, for
+// browsers. Reconnecting EventSources send the Last-Event-ID header, so no
+// change is missed while they are away.
+func (f *changeFeed) eventsHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		folder := path.Clean("/" + strings.TrimPrefix(r.URL.Path, eventsPrefix))
+		access := newEventAccess(config, r)
+		if status := access.check(folder); status != 0 {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ImageServer"`)
+			}
+			http.Error(w, strings.ToLower(http.StatusText(status)), status)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+		id := f.resumeID(lastID)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		// Stop nginx from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		liftReadDeadline(r)
+		fmt.Fprint(w, "retry: 1000\n\n")
+		flusher.Flush()
+		f.stream(r.Context(), id, time.Time{}, access.visible(folder), func(e *changeEvent) error {
+			data, _ := json.Marshal(e)
+			event := "change"
+			if e.Action == "resync" {
+				event = "resync"
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, event, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}, func() error {
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+			return err
+		})
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// fetchTimeout bounds a whole download, a stalled supplier shouldn't hold the request forever
+	fetchTimeout = 2 * time.Minute
+	// fetchMaxRedirects is how many redirects a download follows
+	fetchMaxRedirects = 5
+)
+
+// FetchConfig enables POST /api/fetch, which downloads a file from a URL into the folder
+type FetchConfig struct {
+	// MaxMB is the largest download in megabytes, 50 by default
+	MaxMB int `json:"maxMB,omitempty"`
+	// AllowHosts, when set, are the only hosts downloaded from, a leading dot allows subdomains
+	AllowHosts []string `json:"allowHosts,omitempty"`
+	// ContentTypes are the media types accepted, image/* by default
+	ContentTypes []string `json:"contentTypes,omitempty"`
+}
+
+func (c *FetchConfig) validate(adminAPI bool, readOnly bool) []error {
+	var errs []error
+	if !adminAPI {
+		errs = append(errs, fmt.Errorf("fetch needs an adminToken to call it with"))
+	}
+	if readOnly {
+		errs = append(errs, fmt.Errorf("fetch cannot be enabled on a readOnly folder"))
+	}
+	if c.MaxMB < 0 {
+		errs = append(errs, fmt.Errorf("fetch.maxMB cannot be negative, got %d", c.MaxMB))
+	}
+	for _, host := range c.AllowHosts {
+		if host == "" || strings.Contains(host, "/") {
+			errs = append(errs, fmt.Errorf("fetch.allowHosts must be host names, got %q", host))
+		}
+	}
+	return errs
+}
+
+func (c *FetchConfig) maxBytes() int64 {
+	if c.MaxMB == 0 {
+		return 50 << 20
+	}
+	return int64(c.MaxMB) << 20
+}
+
+// hostAllowed reports whether host may be downloaded from
+func (c *FetchConfig) hostAllowed(host string) bool {
+	if len(c.AllowHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range c.AllowHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeAllowed reports whether the Content-Type, or sniffed type, of a download is accepted
+func (c *FetchConfig) typeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	patterns := c.ContentTypes
+	if len(patterns) == 0 {
+		patterns = []string{"image/*"}
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// nonPublicNets are the ranges that aren't on the internet besides those
+// the net.IP methods know
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // this network, 0.x.x.x reaches the machine itself on some systems
+		"100.64.0.0/10", // carrier-grade NAT
+		"198.18.0.0/15", // benchmarking, used for internal networks too
+		"240.0.0.0/4",   // reserved, and the broadcast address
+		"64:ff9b::/96",  // NAT64, reaches any IPv4 address through the translator
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicIP reports whether ip is on the internet, downloads must not reach
+// the machine itself or the LAN it sits on
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// errFetchBlocked is returned when a download would connect to a non public address
+var errFetchBlocked = errors.New("the URL resolves to a private address")
+
+// newFetchClient returns the client downloads are made with. The address is
+// checked when connecting, after DNS resolution, so a host name resolving to
+// a private address or a redirect to one is refused too.
+func newFetchClient(config *FetchConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return errFetchBlocked
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			// A proxy would connect on our behalf and bypass the address check
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", fetchMaxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirected to an unsupported URL %s", req.URL.Redacted())
+			}
+			if !config.hostAllowed(req.URL.Hostname()) {
+				return fmt.Errorf("redirected to %s, which isn't in fetch.allowHosts", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+}
+
+// fetchRequest is the body of POST /api/fetch
+type fetchRequest struct {
+	// URL is the http or https URL to download
+	URL string `json:"url"`
+	// Path is the URL path the file is saved as, ending in / to keep the name from the URL
+	Path string `json:"path"`
+	// Overwrite replaces an existing file instead of failing
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// fetchResult is the answer of POST /api/fetch
+type fetchResult struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+// fetchError is a failed download with the status to answer
+type fetchError struct {
+	status int
+	err    error
+}
+
+func (e *fetchError) Error() string { return e.err.Error() }
+
+// fetchHandler serves POST /api/fetch, downloading a URL into the folder.
+// overrides are the content types by extension the folder is served with.
+func fetchHandler(config *FetchConfig, folder string, overrides map[string]string) http.Handler {
+	client := newFetchClient(config)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req fetchRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		source, err := url.Parse(req.URL)
+		if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+			http.Error(w, "url must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+		if !config.hostAllowed(source.Hostname()) {
+			http.Error(w, fmt.Sprintf("%s isn't in fetch.allowHosts", source.Hostname()), http.StatusForbidden)
+			return
+		}
+		target := req.Path
+		if target == "" || strings.HasSuffix(target, "/") {
+			name := path.Base(source.Path)
+			if name == "." || name == "/" {
+				http.Error(w, "path must name a file, the URL has no file name", http.StatusBadRequest)
+				return
+			}
+			target += name
+		}
+		target = path.Clean("/" + target)
+		dest := filepath.Join(folder, filepath.FromSlash(target))
+		if info, err := os.Stat(dest); err == nil && (info.IsDir() || !req.Overwrite) {
+			http.Error(w, target+" already exists, set overwrite to replace it", http.StatusConflict)
+			return
+		}
+
+		result, err := fetchFile(r.Context(), client, config, source, dest, servedType(overrides, target))
+		if err != nil {
+			status := http.StatusBadGateway
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				status = fe.status
+			}
+			http.Error(w, "fetching "+source.Redacted()+" failed: "+err.Error(), status)
+			return
+		}
+		result.Path = target
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// servedType returns the media type the file at urlPath will be served
+// with, from its extension, or "" when the extension has none
+func servedType(overrides map[string]string, urlPath string) string {
+	ext := strings.ToLower(path.Ext(urlPath))
+	contentType, ok := overrides[ext]
+	if !ok {
+		contentType = mime.TypeByExtension(ext)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType
+}
+
+// fetchFile downloads source into dest through a temporary file, so a failed
+// or refused download never leaves a partial image behind. The Content-Type
+// the server claims isn't trusted: the file's first bytes must be of an
+// accepted type too, and of served, the type dest is served with, so an
+// HTML page sent as image/png can't end up in the folder and be served as
+// a page of the server's origin.
+func fetchFile(ctx context.Context, client *http.Client, config *FetchConfig, source *url.URL, dest, served string) (fetchResult, error) {
+	var result fetchResult
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return result, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, errFetchBlocked) {
+			return result, &fetchError{http.StatusForbidden, err}
+		}
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("the server answered %s", resp.Status)
+	}
+	result.ContentType = resp.Header.Get("Content-Type")
+	if !config.typeAllowed(result.ContentType) {
+		return result, &fetchError{http.StatusUnsupportedMediaType, fmt.Errorf("content type %q isn't accepted", result.ContentType)}
+	}
+	limit := config.maxBytes()
+	if resp.ContentLength > limit {
+		return result, &fetchError{http.StatusRequestEntityTooLarge, fmt.Errorf("the file is larger than %d MB", limit>>20)}
+	}
+
+	// DetectContentType looks at the first 512 bytes at most
+	head := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return result, err
+	}
+	head = head[:n]
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !config.typeAllowed(sniffed) {
+		return result, &fetchError{http.StatusUnsupportedMediaType, fmt.Errorf("the file is %s, which isn't accepted", sniffed)}
+	}
+	if sniffed != served {
+		as := "without a type"
+		if served != "" {
+			as = "as " + served
+		}
+		return result, &fetchError{http.StatusUnsupportedMediaType, fmt.Errorf("the file is %s but %s would be served %s, use a matching extension", sniffed, filepath.Base(dest), as)}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return result, &fetchError{http.StatusInternalServerError, err}
+	}
+	// A name of its own, so concurrent downloads to the same path don't
+	// write into each other's file
+	out, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return result, &fetchError{http.StatusInternalServerError, err}
+	}
+	tmp := out.Name()
+	result.Size, err = io.Copy(out, io.LimitReader(io.MultiReader(bytes.NewReader(head), resp.Body), limit+1))
+	if closeErr := out.Close(); err == nil && closeErr != nil {
+		err = &fetchError{http.StatusInternalServerError, closeErr}
+	}
+	if err == nil && result.Size > limit {
+		err = &fetchError{http.StatusRequestEntityTooLarge, fmt.Errorf("the file is larger than %d MB", limit>>20)}
+	}
+	if err == nil {
+		if renameErr := os.Rename(tmp, dest); renameErr != nil {
+			err = &fetchError{http.StatusInternalServerError, renameErr}
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return result, err
+	}
+	return result, nil
+}
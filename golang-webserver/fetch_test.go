@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	for _, test := range []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"198.17.255.255", true},
+		{"198.20.0.0", true},
+		{"223.255.255.255", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"64:ff9b:1::1", true},
+		{"127.0.0.1", false},
+		{"127.8.9.10", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:198.18.0.1", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::808:808", false},
+	} {
+		if got := publicIP(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("publicIP(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestFetchClientBlocksPrivateAddresses(t *testing.T) {
+	client := newFetchClient(&FetchConfig{})
+	// The dialer refuses these before connecting, nothing has to listen there
+	for _, u := range []string{
+		"http://127.0.0.1:1/a.jpg",
+		"http://localhost:1/a.jpg",
+		"http://10.0.0.1/a.jpg",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://0.0.0.0:1/a.jpg",
+		"http://198.18.0.1/a.jpg",
+		"http://240.0.0.1/a.jpg",
+		"http://[::1]:1/a.jpg",
+		"http://[::ffff:127.0.0.1]:1/a.jpg",
+		"http://[64:ff9b::a00:1]/a.jpg",
+	} {
+		resp, err := client.Get(u)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, errFetchBlocked) {
+			t.Errorf("fetching %s got %v, want it blocked", u, err)
+		}
+	}
+}
+
+func TestFetchClientBlocksRedirects(t *testing.T) {
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the private server was reached for %s", r.URL)
+	}))
+	defer private.Close()
+	privateURL, _ := url.Parse(private.URL)
+	_, port, _ := net.SplitHostPort(privateURL.Host)
+	supplier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	}))
+	defer supplier.Close()
+
+	client := newFetchClient(&FetchConfig{})
+	// supplier.test stands for a public host, every other address goes
+	// through the fetch dialer and its check
+	transport := client.Transport.(*http.Transport)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "supplier.test:80" {
+			return (&net.Dialer{}).DialContext(ctx, network, strings.TrimPrefix(supplier.URL, "http://"))
+		}
+		return dial(ctx, network, address)
+	}
+	for _, to := range []string{
+		private.URL + "/secret",
+		"http://localhost:" + port + "/secret",
+		"http://[::ffff:127.0.0.1]:" + port + "/secret",
+		"http://169.254.169.254/latest/meta-data/",
+	} {
+		resp, err := client.Get("http://supplier.test/a.jpg?to=" + url.QueryEscape(to))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, errFetchBlocked) {
+			t.Errorf("a redirect to %s got %v, want it blocked", to, err)
+		}
+	}
+}
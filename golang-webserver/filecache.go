@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// fileCacheMaxFile is the largest file whose content is kept in memory,
+	// larger files only have their metadata cached
+	fileCacheMaxFile = 1 << 20
+
+	// fileCacheTTL bounds how stale an entry gets when a change notification
+	// is missed, or when the folder doesn't support them
+	fileCacheTTL = time.Minute
+
+	// fileCacheEntryOverhead approximates the memory used by an entry besides its content
+	fileCacheEntryOverhead = 256
+)
+
+// fileCache is an http.FileSystem that caches file metadata, missing files
+// and the content of small files in memory, so frequently requested
+// thumbnails are served without touching the disk or share. Entries are
+// invalidated by change notifications on the folder and evicted least
+// recently used first once the cache reaches its size limit.
+type fileCache struct {
+	fs       http.FileSystem
+	maxBytes int64
+	// hits and misses count lookups for the metrics
+	hits   uint64
+	misses uint64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+// fileCacheEntry is the cached result of opening a file: its FileInfo, with
+// its content when small enough, or the not-exist error
+type fileCacheEntry struct {
+	key     string
+	info    os.FileInfo
+	data    []byte
+	err     error
+	expires time.Time
+}
+
+func (e *fileCacheEntry) size() int64 {
+	return int64(len(e.data)+len(e.key)) + fileCacheEntryOverhead
+}
+
+// newFileCache returns a cache of up to maxMB megabytes for files, or nil when maxMB is 0
+func newFileCache(files http.FileSystem, maxMB int) *fileCache {
+	if maxMB <= 0 {
+		return nil
+	}
+	return &fileCache{
+		fs:       files,
+		maxBytes: int64(maxMB) << 20,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// cacheKey normalizes name, the folder is on Windows so names are case insensitive
+func cacheKey(name string) string {
+	return strings.ToLower(name)
+}
+
+func (c *fileCache) Open(name string) (http.File, error) {
+	key := cacheKey(name)
+	if e := c.get(key); e != nil {
+		atomic.AddUint64(&c.hits, 1)
+		if e.err != nil {
+			return nil, e.err
+		}
+		if e.data != nil {
+			return &memFile{Reader: bytes.NewReader(e.data), info: e.info}, nil
+		}
+		f, err := c.fs.Open(name)
+		if err != nil {
+			c.remove(key)
+			return nil, err
+		}
+		return &statFile{File: f, info: e.info}, nil
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	f, err := c.fs.Open(name)
+	if err != nil {
+		// Remember missing files too, clients keep asking for the same missing thumbnails
+		if errors.Is(err, os.ErrNotExist) {
+			c.put(&fileCacheEntry{key: key, err: err})
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		// Directory listings aren't cached
+		return f, nil
+	}
+
+	entry := &fileCacheEntry{key: key, info: info}
+	if info.Size() <= fileCacheMaxFile && info.Size() <= c.maxBytes/16 {
+		data, err := io.ReadAll(f)
+		if err == nil && int64(len(data)) == info.Size() {
+			f.Close()
+			entry.data = data
+			c.put(entry)
+			return &memFile{Reader: bytes.NewReader(data), info: info}, nil
+		}
+		// The file changed while reading it, serve it from disk without caching
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	c.put(entry)
+	return &statFile{File: f, info: info}, nil
+}
+
+func (c *fileCache) get(key string) *fileCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*fileCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeElement(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *fileCache) put(entry *fileCacheEntry) {
+	entry.expires = time.Now().Add(fileCacheTTL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *fileCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *fileCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*fileCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// invalidate drops the entries for the changed path, relative to the folder,
+// and for everything below it in case it is a directory. An empty path drops
+// everything.
+func (c *fileCache) invalidate(changed string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if changed == "" {
+		c.entries = map[string]*list.Element{}
+		c.lru.Init()
+		c.size = 0
+		return
+	}
+	key := cacheKey("/" + changed)
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	for k, elem := range c.entries {
+		if strings.HasPrefix(k, key+"/") {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// memFile serves a cached file's content
+type memFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("%s is not a directory", f.info.Name())
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// statFile is an open file whose FileInfo comes from the cache
+type statFile struct {
+	http.File
+	info os.FileInfo
+}
+
+func (f *statFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *statFile) unwrap() http.File {
+	return f.File
+}
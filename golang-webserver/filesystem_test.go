@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileSystemFixture is the tree testFileSystem expects, by slash separated name
+var fileSystemFixture = map[string]string{
+	"/a.txt":         "hello, world",
+	"/empty.txt":     "",
+	"/dir/b.jpg":     "\xff\xd8\xff\xe0 not much of a JPEG",
+	"/dir/c.txt":     "c",
+	"/dir/sub/d.txt": "a longer file in a nested directory",
+}
+
+var fixtureTime = time.Date(2024, 5, 17, 8, 30, 0, 0, time.UTC)
+
+// newMemFixture returns a memFS with fileSystemFixture below root
+func newMemFixture(t *testing.T, root string) *memFS {
+	t.Helper()
+	m := newMemFS()
+	for name, content := range fileSystemFixture {
+		if err := m.WriteFile(path.Join(root, name), []byte(content), fixtureTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// fixtureDirs returns the sorted entry names of every directory in fileSystemFixture
+func fixtureDirs() map[string][]string {
+	dirs := map[string][]string{"/": nil}
+	seen := map[string]bool{}
+	for name := range fileSystemFixture {
+		for name != "/" {
+			dir := path.Dir(name)
+			if !seen[name] {
+				seen[name] = true
+				dirs[dir] = append(dirs[dir], path.Base(name))
+			}
+			name = dir
+		}
+	}
+	for _, names := range dirs {
+		sort.Strings(names)
+	}
+	return dirs
+}
+
+// testFileSystem checks that fsys holds fileSystemFixture, with modTime on
+// its files, and behaves like http.Dir on it: names are cleaned, missing
+// files are fs.ErrNotExist, reads and seeks follow io.ReadSeeker and
+// directories list in batches until io.EOF. Storage for the folder and the
+// wrappers around it all have to pass it, http.FileServer relies on each.
+func testFileSystem(t *testing.T, fsys http.FileSystem, modTime time.Time) {
+	t.Helper()
+	for name, content := range fileSystemFixture {
+		for _, open := range []string{name, name[1:], "/x/.." + name, "/" + name} {
+			checkFixtureFile(t, fsys, open, content, modTime)
+		}
+	}
+
+	for dir, names := range fixtureDirs() {
+		for _, open := range []string{dir, dir + "/", dir + "/."} {
+			checkFixtureDir(t, fsys, open, names)
+		}
+	}
+
+	for _, name := range []string{"/missing.txt", "/dir/missing", "/nodir/d.txt", "/a.txt/x"} {
+		f, err := fsys.Open(name)
+		if err == nil {
+			f.Close()
+			t.Errorf("opening %s: no error for a missing file", name)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("opening %s: %v, want fs.ErrNotExist", name, err)
+		}
+	}
+}
+
+func checkFixtureFile(t *testing.T, fsys http.FileSystem, name, content string, modTime time.Time) {
+	t.Helper()
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Errorf("opening %s: %v", name, err)
+		return
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Errorf("closing %s: %v", name, err)
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Errorf("stat %s: %v", name, err)
+		return
+	}
+	if got, want := info.Name(), path.Base(path.Clean("/"+name)); got != want {
+		t.Errorf("%s is named %q, want %q", name, got, want)
+	}
+	if info.IsDir() || !info.Mode().IsRegular() {
+		t.Errorf("%s has mode %v, want a regular file", name, info.Mode())
+	}
+	if info.Size() != int64(len(content)) {
+		t.Errorf("%s has size %d, want %d", name, info.Size(), len(content))
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("%s was modified %v, want %v", name, info.ModTime(), modTime)
+	}
+	if _, err := f.Readdir(-1); err == nil {
+		t.Errorf("listing the file %s succeeded", name)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != content {
+		t.Errorf("reading %s: %q, %v, want %q", name, data, err, content)
+		return
+	}
+	if n, err := f.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Errorf("reading %s at its end: %d, %v, want io.EOF", name, n, err)
+	}
+
+	seeks := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{0, io.SeekStart, 0},
+		{int64(len(content)) / 2, io.SeekStart, int64(len(content)) / 2},
+		{-1, io.SeekEnd, int64(len(content)) - 1},
+		{0, io.SeekEnd, int64(len(content))},
+	}
+	for _, s := range seeks {
+		if s.want < 0 {
+			continue
+		}
+		pos, err := f.Seek(s.offset, s.whence)
+		if err != nil || pos != s.want {
+			t.Errorf("seeking %s to %d from %d: %d, %v, want %d", name, s.offset, s.whence, pos, err, s.want)
+			continue
+		}
+		rest, err := io.ReadAll(f)
+		if err != nil || string(rest) != content[s.want:] {
+			t.Errorf("reading %s from %d: %q, %v, want %q", name, s.want, rest, err, content[s.want:])
+		}
+	}
+	if len(content) >= 2 {
+		f.Seek(1, io.SeekStart)
+		if pos, err := f.Seek(1, io.SeekCurrent); err != nil || pos != 2 {
+			t.Errorf("seeking %s 1 past 1: %d, %v, want 2", name, pos, err)
+		}
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("seeking %s before its start succeeded", name)
+	}
+}
+
+func checkFixtureDir(t *testing.T, fsys http.FileSystem, name string, names []string) {
+	t.Helper()
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Errorf("opening %s: %v", name, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Errorf("stat %s: %v", name, err)
+		return
+	}
+	if !info.IsDir() || !info.Mode().IsDir() {
+		t.Errorf("%s has mode %v, want a directory", name, info.Mode())
+	}
+	if clean := path.Clean("/" + name); clean != "/" && info.Name() != path.Base(clean) {
+		t.Errorf("%s is named %q, want %q", name, info.Name(), path.Base(clean))
+	}
+
+	all, err := f.Readdir(-1)
+	if err != nil {
+		t.Errorf("listing %s: %v", name, err)
+		return
+	}
+	checkFixtureEntries(t, name, all, path.Clean("/"+name), names)
+	if rest, err := f.Readdir(-1); len(rest) != 0 || err != nil {
+		t.Errorf("listing %s again: %d entries, %v, want none", name, len(rest), err)
+	}
+
+	// In batches, the end shows as io.EOF with no entries
+	g, err := fsys.Open(name)
+	if err != nil {
+		t.Errorf("opening %s: %v", name, err)
+		return
+	}
+	defer g.Close()
+	var batched []fs.FileInfo
+	for {
+		batch, err := g.Readdir(2)
+		if err == io.EOF {
+			if len(batch) != 0 {
+				t.Errorf("listing %s: %d entries with io.EOF", name, len(batch))
+			}
+			break
+		}
+		if err != nil {
+			t.Errorf("listing %s in batches: %v", name, err)
+			return
+		}
+		if len(batch) == 0 || len(batch) > 2 {
+			t.Errorf("listing %s in batches of 2: got %d entries", name, len(batch))
+			return
+		}
+		batched = append(batched, batch...)
+	}
+	checkFixtureEntries(t, name, batched, path.Clean("/"+name), names)
+}
+
+// checkFixtureEntries compares the listing of dir to the fixture's names
+func checkFixtureEntries(t *testing.T, name string, entries []fs.FileInfo, dir string, names []string) {
+	t.Helper()
+	got := make([]string, len(entries))
+	for i, entry := range entries {
+		got[i] = entry.Name()
+		content, isFile := fileSystemFixture[path.Join(dir, entry.Name())]
+		if entry.IsDir() == isFile {
+			t.Errorf("listing %s: %s is a directory: %v, want %v", name, entry.Name(), entry.IsDir(), !isFile)
+		} else if isFile && entry.Size() != int64(len(content)) {
+			t.Errorf("listing %s: %s has size %d, want %d", name, entry.Name(), entry.Size(), len(content))
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(names, ",") {
+		t.Errorf("listing %s: %v, want %v", name, got, names)
+	}
+}
+
+// TestFileSystems runs testFileSystem on the folder on disk, on memFS and on
+// the wrappers the service puts around the folder. Each runs twice, the
+// second time on what the first left cached.
+func TestFileSystems(t *testing.T) {
+	tests := []struct {
+		name string
+		fs   func(t *testing.T) http.FileSystem
+	}{
+		{"Dir", func(t *testing.T) http.FileSystem {
+			return http.Dir(writeZipFolder(t, fileSystemFixture, fixtureTime))
+		}},
+		{"memFS", func(t *testing.T) http.FileSystem {
+			return newMemFixture(t, "/")
+		}},
+		{"fileCache", func(t *testing.T) http.FileSystem {
+			return newFileCache(newMemFixture(t, "/"), 1)
+		}},
+		{"fileCacheDir", func(t *testing.T) http.FileSystem {
+			return newFileCache(http.Dir(writeZipFolder(t, fileSystemFixture, fixtureTime)), 1)
+		}},
+		{"indexFS", func(t *testing.T) http.FileSystem {
+			folder := writeZipFolder(t, fileSystemFixture, fixtureTime)
+			index := newFolderIndex(&IndexConfig{}, folder, false, discardLog{})
+			index.build(context.Background())
+			if _, ok := index.entries("/dir/sub"); !ok {
+				t.Fatal("the index has no /dir/sub")
+			}
+			return indexFS{http.Dir(folder), index}
+		}},
+		{"gitTreeFS", func(t *testing.T) http.FileSystem {
+			m := newMemFixture(t, "/")
+			if err := m.WriteFile("/.git/HEAD", []byte("ref: refs/heads/main\n"), fixtureTime); err != nil {
+				t.Fatal(err)
+			}
+			return gitTreeFS{m, ""}
+		}},
+		{"normalizedFS", func(t *testing.T) http.FileSystem {
+			return normalizedFS{newMemFixture(t, "/")}
+		}},
+		{"breakerFS", func(t *testing.T) http.FileSystem {
+			return breakerFS{newMemFixture(t, "/"), newCircuitBreaker(&CircuitBreakerConfig{}, "", discardLog{})}
+		}},
+		{"subFS", func(t *testing.T) http.FileSystem {
+			return subFS{newMemFixture(t, "/shared"), "/shared"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := tt.fs(t)
+			testFileSystem(t, fsys, fixtureTime)
+			testFileSystem(t, fsys, fixtureTime)
+		})
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	m := newMemFixture(t, "/")
+	later := fixtureTime.Add(time.Hour)
+
+	// Writing replaces the content, files opened before keep theirs
+	before, err := m.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	if err := m.WriteFile("/a.txt", []byte("changed"), later); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(before); string(data) != fileSystemFixture["/a.txt"] {
+		t.Errorf("file opened before the write reads %q", data)
+	}
+	after, err := m.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if data, _ := io.ReadAll(after); string(data) != "changed" {
+		t.Errorf("file opened after the write reads %q, want %q", data, "changed")
+	}
+	if info, _ := after.Stat(); !info.ModTime().Equal(later) {
+		t.Errorf("rewritten file was modified %v, want %v", info.ModTime(), later)
+	}
+
+	// The caller's slice isn't kept
+	data := []byte("mine")
+	if err := m.WriteFile("/new/e.txt", data, later); err != nil {
+		t.Fatal(err)
+	}
+	copy(data, "xxxx")
+	f, err := m.Open("/new/e.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(f); !bytes.Equal(got, []byte("mine")) {
+		t.Errorf("written file reads %q, want %q", got, "mine")
+	}
+	f.Close()
+
+	for _, tt := range []struct {
+		name    string
+		wantErr string
+	}{
+		{"/", "invalid argument"},
+		{"/a.txt/f.txt", "not a directory"},
+		{"/dir", "is a directory"},
+	} {
+		if err := m.WriteFile(tt.name, nil, later); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("writing %s: %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if err := m.Remove("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/dir", "/dir/sub/d.txt"} {
+		if _, err := m.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("opening %s after removing /dir: %v, want fs.ErrNotExist", name, err)
+		}
+	}
+	for _, name := range []string{"/dir", "/", "/missing"} {
+		if err := m.Remove(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("removing %s: %v, want fs.ErrNotExist", name, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// firewallRuleName is the name of the inbound rule created by "install --firewall"
+const firewallRuleName = "ImageServer"
+
+// firewallPorts lists port and the ports of the listeners other than the
+// admin ones, which are meant to stay private, for netsh's localport
+func firewallPorts(config *Config) string {
+	ports := []string{config.Port}
+	for _, l := range config.Listeners {
+		if _, port, err := net.SplitHostPort(l.Address); err == nil && !l.Admin && !containsFold(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return strings.Join(ports, ",")
+}
+
+// addFirewallRule creates an inbound Windows Firewall rule allowing TCP traffic
+// to the given ports, comma separated, for this executable
+func addFirewallRule(exePath, port string) error {
+	// Drop any stale rule first so reinstalling with a new port doesn't leave the old one open
+	if err := removeFirewallRule(); err != nil {
+		return err
+	}
+
+	out, err := exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
+		"name="+firewallRuleName,
+		"dir=in",
+		"action=allow",
+		"protocol=TCP",
+		"localport="+port,
+		"program="+exePath,
+		"enable=yes",
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to add firewall rule: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// firewallRuleExists reports whether the rule created by addFirewallRule
+// exists. netsh exits with 1 when no rule has the name, its message for
+// that is translated, so only the exit code tells.
+func firewallRuleExists() (bool, error) {
+	out, err := exec.Command("netsh", "advfirewall", "firewall", "show", "rule",
+		"name="+firewallRuleName,
+	).CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to look up the firewall rule: %w: %s", err, strings.TrimSpace(string(out)))
+}
+
+// removeFirewallRule deletes the inbound rule created by addFirewallRule, if any
+func removeFirewallRule() error {
+	exists, err := firewallRuleExists()
+	if err != nil || !exists {
+		return err
+	}
+	out, err := exec.Command("netsh", "advfirewall", "firewall", "delete", "rule",
+		"name="+firewallRuleName,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove firewall rule: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
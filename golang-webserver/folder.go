@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// folderStartupAttempts is how many times a UNC folder is checked at startup
+	// before giving up, since shares are often not mounted yet right after boot
+	folderStartupAttempts = 10
+	folderStartupDelay    = 3 * time.Second
+
+	// folderCheckInterval is how often the folder is probed while serving
+	folderCheckInterval = 30 * time.Second
+)
+
+// checkFolder verifies that folder exists, is a directory and can be listed.
+// Listing catches stale network sessions where Stat still succeeds from cache.
+func checkFolder(folder string) error {
+	info, err := os.Stat(folder)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", folder)
+	}
+
+	dir, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// waitForFolder checks folder, retrying for UNC paths which may not be reachable yet
+func waitForFolder(folder string) error {
+	attempts := 1
+	if isUNCPath(folder) {
+		attempts = folderStartupAttempts
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = checkFolder(folder); err == nil {
+			return nil
+		}
+		if i < attempts-1 {
+			time.Sleep(folderStartupDelay)
+		}
+	}
+	return fmt.Errorf("folder is not accessible: %s: %w", folder, err)
+}
+
+// shareRoot returns the \\server\share part of a UNC path
+func shareRoot(path string) string {
+	parts := strings.FieldsFunc(path, func(r rune) bool { return r == '\\' || r == '/' })
+	if len(parts) < 2 {
+		return ""
+	}
+	return `\\` + parts[0] + `\` + parts[1]
+}
+
+// folderMonitor periodically checks that the served folder is reachable and
+// tries to reconnect network shares that dropped
+type folderMonitor struct {
+	folder  string
+	elog    debug.Log
+	breaker *circuitBreaker
+
+	mu      sync.RWMutex
+	lastErr error
+}
+
+func newFolderMonitor(folder string, breaker *CircuitBreakerConfig, elog debug.Log) *folderMonitor {
+	return &folderMonitor{folder: folder, elog: elog, breaker: newCircuitBreaker(breaker, folder, elog)}
+}
+
+// files returns the folder's files, opened through the circuit breaker when there is one
+func (m *folderMonitor) files() http.FileSystem {
+	var files http.FileSystem = http.Dir(m.folder)
+	if m.breaker != nil {
+		files = breakerFS{files, m.breaker}
+	}
+	return files
+}
+
+// Healthy returns nil while the folder is reachable, or the last check error.
+// An open circuit breaker makes the folder unhealthy too.
+func (m *folderMonitor) Healthy() error {
+	if m.breaker != nil {
+		if err := m.breaker.Err(); err != nil {
+			return err
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastErr
+}
+
+// Run checks the folder until ctx is cancelled
+func (m *folderMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(folderCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+func (m *folderMonitor) check() {
+	err := checkFolder(m.folder)
+	if err != nil && isUNCPath(m.folder) {
+		if rerr := m.reconnect(); rerr != nil {
+			m.elog.Warning(eventStorage, fmt.Sprintf("Failed to reconnect %s: %v", shareRoot(m.folder), rerr))
+		} else {
+			err = checkFolder(m.folder)
+		}
+	}
+
+	m.mu.Lock()
+	wasHealthy := m.lastErr == nil
+	m.lastErr = err
+	m.mu.Unlock()
+
+	// Only log state transitions so an outage doesn't flood the event log
+	switch {
+	case err != nil && wasHealthy:
+		m.elog.Error(eventStorage, fmt.Sprintf("Image folder became unavailable, serving degraded: %v", err))
+	case err == nil && !wasHealthy:
+		m.elog.Info(eventStorage, fmt.Sprintf("Image folder %s is available again", m.folder))
+	}
+}
+
+// reconnect re-establishes the SMB session for the share using the service account
+func (m *folderMonitor) reconnect() error {
+	root := shareRoot(m.folder)
+	if root == "" {
+		return fmt.Errorf("invalid UNC path %s", m.folder)
+	}
+	out, err := exec.Command("net", "use", root).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// readyHandler reports whether the server can currently serve files
+func (m *folderMonitor) readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := m.Healthy(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "degraded: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// middleware answers 503 instead of 404 while the folder is unreachable
+func (m *folderMonitor) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Healthy(); err != nil {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Image folder is temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxConvertPixels bounds the images ?format= decodes: a small file can
+	// declare dimensions that take gigabytes once decoded
+	maxConvertPixels = 50_000_000
+	// defaultConversionCacheMB bounds the converted images kept in memory
+	// when conversions.cacheMB isn't set
+	defaultConversionCacheMB = 64
+)
+
+// outputFormats are the formats ?format= converts images to. The standard
+// library has no WebP or AVIF encoder, so those are refused.
+var outputFormats = map[string]struct {
+	ext         string
+	contentType string
+	encode      func(*bytes.Buffer, image.Image) error
+}{
+	"png": {".png", "image/png", func(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) }},
+	"jpg": {".jpg", "image/jpeg", func(b *bytes.Buffer, img image.Image) error {
+		return jpeg.Encode(b, img, &jpeg.Options{Quality: 90})
+	}},
+}
+
+// conversions runs the ?format= conversions of every prefix, one per CPU at
+// a time, and keeps the latest results
+var conversions = &imageConverter{slots: make(chan struct{}, runtime.NumCPU()), entries: map[string]*list.Element{}, lru: list.New(), backlog: defaultConversionBacklog(), limit: defaultConversionCacheMB << 20}
+
+// ConversionConfig tunes the image conversions of ?format=, ?ops= and the
+// share pages' thumbnails
+type ConversionConfig struct {
+	// Backlog is how many conversions may wait for a free CPU, requests
+	// beyond it get 503. 4 per CPU by default.
+	Backlog int `json:"backlog,omitempty"`
+	// CacheMB is how many megabytes of converted images are kept in memory, 64 by default
+	CacheMB int `json:"cacheMB,omitempty"`
+}
+
+func (c *ConversionConfig) validate() []error {
+	var errs []error
+	if c.Backlog < 0 {
+		errs = append(errs, fmt.Errorf("conversions.backlog cannot be negative"))
+	}
+	if c.CacheMB < 0 {
+		errs = append(errs, fmt.Errorf("conversions.cacheMB cannot be negative"))
+	}
+	return errs
+}
+
+func defaultConversionBacklog() int {
+	return 4 * runtime.NumCPU()
+}
+
+// configure applies config, which may be nil, to the conversions to come
+func (c *imageConverter) configure(config *ConversionConfig) {
+	backlog, limit := defaultConversionBacklog(), int64(defaultConversionCacheMB<<20)
+	if config != nil && config.Backlog > 0 {
+		backlog = config.Backlog
+	}
+	if config != nil && config.CacheMB > 0 {
+		limit = int64(config.CacheMB) << 20
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backlog, c.limit = backlog, limit
+	c.evict()
+}
+
+// imageConverter bounds the CPU and memory spent on conversions, and caches
+// converted images by file and ETag, least recently used evicted first
+type imageConverter struct {
+	slots chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	// limit bounds size, entries above an eighth of it aren't cached
+	limit int64
+	// hits and misses count the lookups of do, read atomically
+	hits, misses uint64
+	// calls are the conversions running by cache key, which the requests
+	// for the same key wait for instead of converting the image again
+	calls map[string]*conversionCall
+	// waiting is how many conversions wait for a slot, up to backlog if set
+	waiting int
+	backlog int
+}
+
+type conversionCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+type convertedImage struct {
+	key  string
+	data []byte
+}
+
+var (
+	errImageTooLarge = errors.New("the image is too large to convert")
+	errConverterBusy = errors.New("too many images are being converted, try again shortly")
+)
+
+// conversionRetryAfter is the Retry-After sent with errConverterBusy, in seconds
+const conversionRetryAfter = "5"
+
+func (c *imageConverter) get(key string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*convertedImage).data
+	}
+	return nil
+}
+
+func (c *imageConverter) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok || int64(len(data)) > c.limit/8 {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&convertedImage{key, data})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// evict drops the least recently used entries until the cache fits its
+// limit, with c.mu held
+func (c *imageConverter) evict() {
+	for c.size > c.limit {
+		oldest := c.lru.Remove(c.lru.Back()).(*convertedImage)
+		delete(c.entries, oldest.key)
+		c.size -= int64(len(oldest.data))
+	}
+}
+
+// do returns the conversion of src with encode cached under key. Requests
+// for a key that is being converted wait for that conversion and share it.
+func (c *imageConverter) do(ctx context.Context, key string, src io.ReadSeeker, encode func(*bytes.Buffer, image.Image) error) ([]byte, error) {
+	for first := true; ; first = false {
+		if data := c.get(key); data != nil {
+			if first {
+				atomic.AddUint64(&c.hits, 1)
+			}
+			return data, nil
+		}
+		if first {
+			atomic.AddUint64(&c.misses, 1)
+		}
+		c.mu.Lock()
+		call, running := c.calls[key]
+		if !running {
+			call = &conversionCall{done: make(chan struct{})}
+			if c.calls == nil {
+				c.calls = map[string]*conversionCall{}
+			}
+			c.calls[key] = call
+		}
+		c.mu.Unlock()
+
+		if !running {
+			call.data, call.err = c.convert(ctx, src, encode)
+			if call.err == nil {
+				c.put(key, call.data)
+			}
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			close(call.done)
+			return call.data, call.err
+		}
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The request converting it went away, this one takes over
+		if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+			continue
+		}
+		return call.data, call.err
+	}
+}
+
+// convert decodes src and encodes it with encode, after checking its
+// dimensions and waiting for a free slot
+func (c *imageConverter) convert(ctx context.Context, src io.ReadSeeker, encode func(*bytes.Buffer, image.Image) error) ([]byte, error) {
+	config, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxConvertPixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-c.slots }()
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// acquire takes a slot, waiting for one when there is room in the backlog
+func (c *imageConverter) acquire(ctx context.Context) error {
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	c.mu.Lock()
+	if c.backlog > 0 && c.waiting >= c.backlog {
+		c.mu.Unlock()
+		return errConverterBusy
+	}
+	c.waiting++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.waiting--
+		c.mu.Unlock()
+	}()
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sourceFormat returns the ?format= name of a file's own format, so asking
+// for it serves the file unchanged
+func sourceFormat(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png":
+		return "png"
+	case ".jpg", ".jpeg":
+		return "jpg"
+	}
+	return ""
+}
+
+// attachmentName makes name safe for Content-Disposition: no path, control
+// characters or quotes, which some clients mishandle even when escaped
+func attachmentName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`"\/:*?<>|`, r) {
+			return '_'
+		}
+		return r
+	}, path.Base(name))
+	if name == "" || name == "." || name == "_" {
+		return "download"
+	}
+	return name
+}
+
+// outputOptions handles ?format=png|jpg, converting decodable images,
+// ?ops=, transforming them, and ?download=1, which sends the file as an
+// attachment instead of inline. Without transforms ?format= and ?ops= are
+// ignored and files are served as they are.
+func outputOptions(files http.FileSystem, transforms bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !transforms {
+			query.Del("format")
+			query.Del("ops")
+		}
+		format := strings.ToLower(query.Get("format"))
+		if format == "jpeg" {
+			format = "jpg"
+		}
+		out, ok := outputFormats[format]
+		if format == "webp" || format == "avif" {
+			http.Error(w, fmt.Sprintf("format %q isn't supported, the server has no %s encoder; use png or jpg", format, strings.ToUpper(format)), http.StatusBadRequest)
+			return
+		}
+		if format != "" && !ok {
+			http.Error(w, fmt.Sprintf("format %q isn't supported, use png or jpg", format), http.StatusBadRequest)
+			return
+		}
+		ops, err := parseOps(query.Get("ops"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		// Transformed images keep their format, GIFs become PNGs
+		if format == "" && len(ops) > 0 {
+			if format = sourceFormat(name); format == "" {
+				format = "png"
+			}
+			out, ok = outputFormats[format]
+		}
+		download := query.Get("download") == "1" || query.Get("download") == "true"
+		if download && !strings.HasSuffix(r.URL.Path, "/") {
+			filename := attachmentName(name)
+			if ok && format != sourceFormat(name) {
+				filename = strings.TrimSuffix(filename, path.Ext(filename)) + out.ext
+			}
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		}
+		if (format == "" || format == sourceFormat(name)) && len(ops) == 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := files.Open(name)
+		if err != nil {
+			// Missing files get the usual 404 from the file server
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The converted bytes differ from the file's, so they get their own
+		// validator, known before converting so revalidations skip the work.
+		// It holds the normalized chain, so equivalent ones share the result.
+		etag := strings.TrimSuffix(fileETag(info.Size(), info.ModTime()), `"`) + "-" + format
+		if len(ops) > 0 {
+			etag += "-" + formatOps(ops)
+		}
+		etag += `"`
+		serveConversion(w, r, f, info.ModTime(), cacheKey(name)+"\x00"+etag, etag, out.contentType, ops, out.encode)
+	})
+}
+
+// serveConversion serves src run through ops and encoded with encode, from
+// the cache under key when it's there, with etag for validator. HEAD
+// requests are answered from the image's header, without converting it:
+// they only get a Content-Length when the conversion is cached.
+func serveConversion(w http.ResponseWriter, r *http.Request, src io.ReadSeeker, modTime time.Time, key, etag, contentType string, ops []imageOp, encode func(*bytes.Buffer, image.Image) error) {
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if r.Method == http.MethodHead {
+		if data = conversions.get(key); data == nil {
+			err = probeConversion(src, ops)
+		}
+	} else {
+		data, err = conversions.do(r.Context(), key, src, func(b *bytes.Buffer, img image.Image) error {
+			img, err := applyOps(img, ops)
+			if err != nil {
+				return err
+			}
+			return encode(b, img)
+		})
+	}
+	switch {
+	case errors.Is(err, errConverterBusy):
+		w.Header().Set("Retry-After", conversionRetryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, errCropOutside):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, errImageTooLarge):
+		http.Error(w, fmt.Sprintf("%v, the limit is %d megapixels", err, maxConvertPixels/1_000_000), http.StatusUnprocessableEntity)
+		return
+	case r.Context().Err() != nil:
+		return
+	case err != nil:
+		http.Error(w, "the file isn't an image that can be converted", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if data == nil {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+}
+
+// probeConversion reports the error converting src with ops would fail
+// with, as far as the image's header tells
+func probeConversion(src io.Reader, ops []imageOp) error {
+	config, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > maxConvertPixels {
+		return errImageTooLarge
+	}
+	_, _, err = opsSize(config.Width, config.Height, ops)
+	return err
+}
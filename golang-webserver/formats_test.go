@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestConverter returns an empty converter running conversions one at a time
+func newTestConverter() *imageConverter {
+	return &imageConverter{slots: make(chan struct{}, 1), entries: map[string]*list.Element{}, lru: list.New(), limit: defaultConversionCacheMB << 20}
+}
+
+// testPNGBytes returns a PNG of an empty image of w x h
+func testPNGBytes(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConversionsCoalesce(t *testing.T) {
+	c := newTestConverter()
+	src := testPNGBytes(t, 10, 10)
+	var encodes int32
+	release := make(chan struct{})
+	encode := func(b *bytes.Buffer, img image.Image) error {
+		atomic.AddInt32(&encodes, 1)
+		<-release
+		b.WriteString("converted")
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := c.do(context.Background(), "key", bytes.NewReader(src), encode)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = data
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+	if encodes != 1 {
+		t.Errorf("20 requests for one image encoded it %d times", encodes)
+	}
+	for i, data := range results {
+		if string(data) != "converted" {
+			t.Errorf("request %d got %q", i, data)
+		}
+	}
+}
+
+func TestConversionsCache(t *testing.T) {
+	c := newTestConverter()
+	c.configure(&ConversionConfig{CacheMB: 1})
+	src := testPNGBytes(t, 10, 10)
+	convert := func(key string, size int) {
+		t.Helper()
+		if _, err := c.do(context.Background(), key, bytes.NewReader(src), func(b *bytes.Buffer, img image.Image) error {
+			b.Write(make([]byte, size))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		convert(fmt.Sprint(i), 100<<10)
+	}
+	convert("19", 100<<10)
+	if c.size > 1<<20 || c.get("19") == nil || c.get("0") != nil {
+		t.Errorf("the cache holds %d bytes, the latest: %v, the first: %v", c.size, c.get("19") != nil, c.get("0") != nil)
+	}
+	if c.hits != 1 || c.misses != 20 {
+		t.Errorf("counted %d hits and %d misses, want 1 and 20", c.hits, c.misses)
+	}
+	// Conversions above an eighth of the cache aren't kept
+	convert("big", 200<<10)
+	if c.get("big") != nil {
+		t.Error("a conversion above an eighth of the cache was cached")
+	}
+	// Leaving cacheMB out restores the default
+	c.configure(&ConversionConfig{})
+	if c.limit != defaultConversionCacheMB<<20 {
+		t.Errorf("cacheMB 0 set the limit to %d", c.limit)
+	}
+}
+
+func TestConversionsBacklog(t *testing.T) {
+	c := newTestConverter()
+	c.backlog = 1
+	src := testPNGBytes(t, 10, 10)
+	c.slots <- struct{}{}
+	waiting := make(chan error)
+	go func() {
+		_, err := c.do(context.Background(), "a", bytes.NewReader(src), func(b *bytes.Buffer, img image.Image) error { return nil })
+		waiting <- err
+	}()
+	for n := 0; n == 0; {
+		c.mu.Lock()
+		n = c.waiting
+		c.mu.Unlock()
+	}
+
+	// The backlog is full, other images are refused rather than queued
+	defer func(old *imageConverter) { conversions = old }(conversions)
+	conversions = c
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "b.png"), src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	outputOptions(http.Dir(dir), true, http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/b.png?format=jpg", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("a conversion past the backlog got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	<-c.slots
+	if err := <-waiting; err != nil {
+		t.Errorf("the conversion in the backlog failed: %v", err)
+	}
+}
+
+func TestConversionsTakeOver(t *testing.T) {
+	c := newTestConverter()
+	src := testPNGBytes(t, 10, 10)
+	// The slot is taken, so the first request waits for it until it goes away
+	c.slots <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := c.do(ctx, "key", bytes.NewReader(src), func(b *bytes.Buffer, img image.Image) error { return nil })
+		first <- err
+	}()
+	for running := false; !running; {
+		c.mu.Lock()
+		running = c.calls["key"] != nil
+		c.mu.Unlock()
+	}
+	second := make(chan []byte)
+	go func() {
+		data, _ := c.do(context.Background(), "key", bytes.NewReader(src), func(b *bytes.Buffer, img image.Image) error {
+			b.WriteString("second")
+			return nil
+		})
+		second <- data
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-first; err == nil {
+		t.Error("the request that went away got no error")
+	}
+	<-c.slots
+	if data := <-second; string(data) != "second" {
+		t.Errorf("the waiting request got %q", data)
+	}
+}
+
+func TestConversionsHead(t *testing.T) {
+	defer func(old *imageConverter) { conversions = old }(conversions)
+	conversions = newTestConverter()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.png"), testPNGBytes(t, 400, 200), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := outputOptions(http.Dir(dir), true, http.NotFoundHandler())
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	// HEAD on a cache miss reports the headers without converting
+	w := serve(http.MethodHead, "/a.png?format=jpg&ops=rotate:90")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == "" || w.Header().Get("Content-Type") != "image/jpeg" || w.Header().Get("Content-Length") != "" {
+		t.Errorf("HEAD got %d, ETag %q, Content-Type %q, Content-Length %q", w.Code, w.Header().Get("ETag"), w.Header().Get("Content-Type"), w.Header().Get("Content-Length"))
+	}
+	if conversions.misses != 0 || len(conversions.entries) != 0 {
+		t.Errorf("HEAD converted the image: %d misses, %d cached", conversions.misses, len(conversions.entries))
+	}
+	if w := serve(http.MethodHead, "/a.png?ops=crop:500x0x10x10"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("HEAD with a crop outside the image got %d", w.Code)
+	}
+
+	// Once converted, HEAD answers from the cache with the length
+	get := serve(http.MethodGet, "/a.png?format=jpg&ops=rotate:90")
+	w = serve(http.MethodHead, "/a.png?format=jpg&ops=rotate:90")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != get.Header().Get("ETag") || w.Header().Get("Content-Length") != fmt.Sprint(get.Body.Len()) {
+		t.Errorf("HEAD after GET got %d, ETag %q, Content-Length %q, want %q and %d", w.Code, w.Header().Get("ETag"), w.Header().Get("Content-Length"), get.Header().Get("ETag"), get.Body.Len())
+	}
+	if conversions.misses != 1 {
+		t.Errorf("GET and two HEADs converted the image %d times", conversions.misses)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// GeoIPConfig restricts access by country using a MaxMind format database,
+// e.g. GeoLite2-Country.mmdb, and adds the country to exported logs
+type GeoIPConfig struct {
+	// Database is the path of the .mmdb file
+	Database string `json:"database"`
+	// AllowCountries, when set, are the only ISO country codes allowed
+	AllowCountries []string `json:"allowCountries,omitempty"`
+	// DenyCountries are ISO country codes that are rejected
+	DenyCountries []string `json:"denyCountries,omitempty"`
+}
+
+func (c *GeoIPConfig) validate() []error {
+	var errs []error
+	if c.Database == "" {
+		errs = append(errs, fmt.Errorf("geoIP.database cannot be empty"))
+	} else if _, err := os.Stat(c.Database); err != nil {
+		errs = append(errs, fmt.Errorf("geoIP.database: %v", err))
+	}
+	for _, code := range append(append([]string{}, c.AllowCountries...), c.DenyCountries...) {
+		if len(code) != 2 {
+			errs = append(errs, fmt.Errorf("geoIP countries must be two letter ISO codes, got %q", code))
+		}
+	}
+	return errs
+}
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind database
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const (
+	// maxMMDBDepth bounds the nesting of maps, arrays and pointers, as
+	// libmaxminddb does, so pointers looping back can't recurse forever
+	maxMMDBDepth = 512
+	// maxMMDBValues bounds the values a record expands to, as pointers
+	// shared between the entries of a map can double it at every level
+	maxMMDBValues = 1 << 16
+)
+
+// mmdb is a MaxMind DB file read into memory, see
+// https://maxmind.github.io/MaxMind-DB/ for the format
+type mmdb struct {
+	tree       []byte
+	section    []byte // the data section
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint
+}
+
+func openMMDB(name string) (*mmdb, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseMMDB(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return db, nil
+}
+
+// parseMMDB reads the metadata of a database and finds its sections
+func parseMMDB(data []byte) (*mmdb, error) {
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind database")
+	}
+	meta := data[i+len(mmdbMetadataMarker):]
+	value, _, err := decodeMMDB(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+	// Checked before multiplying, which could overflow
+	if nodeCount > uint64(i) || nodeCount*recordSize/4+16 > uint64(i) {
+		return nil, errors.New("search tree larger than the file")
+	}
+	treeSize := nodeCount * recordSize / 4
+
+	db := &mmdb{
+		tree:       data[:treeSize],
+		section:    data[treeSize+16 : i],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+	}
+	// IPv4 addresses live below 96 zero bits in IPv6 databases
+	if ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (0) or right (1) record of node
+func (db *mmdb) record(node, right uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+right*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if right == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+right*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil when the database has none
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := ip.To16()
+	if v4 := ip.To4(); v4 != nil {
+		node, bits = db.ipv4Start, v4
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-uint(i%8)))&1)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("search tree ended without a record")
+	}
+	if node < db.nodeCount+16 {
+		return nil, errors.New("search tree points into the separator")
+	}
+	value, _, err := decodeMMDB(db.section, node-db.nodeCount-16)
+	return value, err
+}
+
+// country returns the ISO code of the country ip is in, or "" when unknown
+func (db *mmdb) country(ip net.IP) string {
+	record, err := db.lookup(ip)
+	if err != nil {
+		return ""
+	}
+	fields, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := fields[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// decodeMMDB decodes the value at offset of a data section, returning it and
+// the offset after it
+func decodeMMDB(section []byte, offset uint) (interface{}, uint, error) {
+	budget := maxMMDBValues
+	return decodeMMDBValue(section, offset, 0, &budget)
+}
+
+func decodeMMDBValue(section []byte, offset uint, depth int, budget *int) (interface{}, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, fmt.Errorf("data nested more than %d levels deep", maxMMDBDepth)
+	}
+	if *budget--; *budget < 0 {
+		return nil, 0, fmt.Errorf("record of more than %d values", maxMMDBValues)
+	}
+	next := func(n uint) ([]byte, error) {
+		if offset > uint(len(section)) || n > uint(len(section))-offset {
+			return nil, errors.New("unexpected end of data")
+		}
+		b := section[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	kind := uint(ctrl >> 5)
+
+	if kind == 1 {
+		// Pointers have their own size encoding
+		ss, v := uint(ctrl>>3)&3, uint(ctrl&7)
+		b, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var target uint
+		switch ss {
+		case 0:
+			target = v<<8 | uint(b[0])
+		case 1:
+			target = (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			target = (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		// A pointer to a pointer is invalid
+		if target < uint(len(section)) && section[target]>>5 == 1 {
+			return nil, 0, errors.New("pointer to a pointer")
+		}
+		value, _, err := decodeMMDBValue(section, target, depth+1, budget)
+		return value, offset, err
+	}
+	if kind == 0 {
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(b[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := next(n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var extra uint
+		for _, c := range b {
+			extra = extra<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch kind {
+	case 2, 4: // string, bytes
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == 2 {
+			return string(b), offset, nil
+		}
+		return append([]byte{}, b...), offset, nil
+	case 3: // double
+		b, err := next(8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		b, err := next(4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	case 7: // map
+		// The size comes from the data, every entry takes 2 bytes at least
+		m := make(map[string]interface{}, mmdbCapacity(size, section, offset, 2))
+		for i := uint(0); i < size; i++ {
+			key, end, err := decodeMMDBValue(section, offset, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, end, err := decodeMMDBValue(section, end, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset = end
+			if k, ok := key.(string); ok {
+				m[k] = value
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, mmdbCapacity(size, section, offset, 1))
+		for i := uint(0); i < size; i++ {
+			value, end, err := decodeMMDBValue(section, offset, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset = end
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case 14: // boolean, the value is the size
+		return size != 0, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// mmdbCapacity bounds the size of a map or array, with entries of at least
+// min bytes, by what is left of the section after offset
+func mmdbCapacity(size uint, section []byte, offset, min uint) uint {
+	if left := (uint(len(section)) - offset) / min; size > left {
+		return left
+	}
+	return size
+}
+
+// clientIP returns the address of the client of r
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// countryAllowed applies the allow and deny lists of config to country
+func countryAllowed(config *GeoIPConfig, country string) bool {
+	for _, code := range config.DenyCountries {
+		if strings.EqualFold(code, country) {
+			return false
+		}
+	}
+	if len(config.AllowCountries) == 0 {
+		return true
+	}
+	for _, code := range config.AllowCountries {
+		if strings.EqualFold(code, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoIPGuard rejects clients from countries config doesn't allow. Loopback
+// and private addresses, such as kiosks on the LAN, are always let through.
+func geoIPGuard(config *GeoIPConfig, db *mmdb, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !countryAllowed(config, db.country(ip)) {
+			http.Error(w, "not available in your region", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
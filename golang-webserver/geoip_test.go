@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDecodeMMDB(t *testing.T) {
+	long := func(n int) string { return strings.Repeat("x", n) }
+	// Pointers with larger size classes need a section that far long
+	farPointer := func(ctrl string, target int) string {
+		section := make([]byte, target)
+		copy(section, ctrl)
+		return string(section) + "\x43far"
+	}
+	// Each map has both its values point to the next one, which 40 of
+	// expand into 2^40 values
+	sharedMaps := func(n int) string {
+		var b []byte
+		for i := 1; i < n; i++ {
+			hi, lo := byte(0x20|9*i>>8), byte(9*i)
+			b = append(b, 0xE2, 0x41, 'a', hi, lo, 0x41, 'b', hi, lo)
+		}
+		return string(append(b, 0x40))
+	}
+	tests := []struct {
+		name    string
+		section string
+		offset  uint
+		want    interface{}
+		end     uint
+		wantErr string
+	}{
+		{name: "string", section: "\x43foo", want: "foo", end: 4},
+		{name: "empty string", section: "\x40", want: "", end: 1},
+		{name: "string of 29 bytes", section: "\x5D\x00" + long(29), want: long(29), end: 31},
+		{name: "string of 285 bytes", section: "\x5E\x00\x00" + long(285), want: long(285), end: 288},
+		{name: "string of 65821 bytes", section: "\x5F\x00\x00\x00" + long(65821), want: long(65821), end: 65825},
+		{name: "bytes", section: "\x83abc", want: []byte("abc"), end: 4},
+		{name: "uint16", section: "\xA2\x01\x2C", want: uint64(300), end: 3},
+		{name: "uint32 zero", section: "\xC0", want: uint64(0), end: 1},
+		{name: "uint64", section: "\x08\x02\x01\x02\x03\x04\x05\x06\x07\x08", want: uint64(0x0102030405060708), end: 10},
+		{name: "uint128", section: "\x02\x03\x01\x00", want: uint64(256), end: 4},
+		{name: "int32", section: "\x01\x01\x05", want: int64(5), end: 3},
+		{name: "negative int32", section: "\x04\x01\xFF\xFF\xFF\xFE", want: int64(-2), end: 6},
+		{name: "double", section: "\x68\x3F\xF8\x00\x00\x00\x00\x00\x00", want: 1.5, end: 9},
+		{name: "float", section: "\x04\x08\x3F\xC0\x00\x00", want: 1.5, end: 6},
+		{name: "true", section: "\x01\x07", want: true, end: 2},
+		{name: "false", section: "\x00\x07", want: false, end: 2},
+		{name: "map", section: "\xE2\x42en\x43foo\x42de\x43bar", want: map[string]interface{}{"en": "foo", "de": "bar"}, end: 15},
+		{name: "array", section: "\x02\x04\x43foo\xA1\x05", want: []interface{}{"foo", uint64(5)}, end: 8},
+		{name: "value at an offset", section: "\x43foo\x43bar", offset: 4, want: "bar", end: 8},
+
+		{name: "pointer", section: "\x43foo\x20\x00", offset: 4, want: "foo", end: 6},
+		{name: "pointer of 2 bytes", section: farPointer("\x28\x00\x02", 2048+2), want: "far", end: 3},
+		{name: "pointer of 3 bytes", section: farPointer("\x30\x00\x00\x04", 526336+4), want: "far", end: 4},
+		{name: "pointer of 4 bytes", section: "\x38\x00\x00\x00\x05\x43baz", want: "baz", end: 5},
+		{name: "pointer in a map", section: "\x43foo\xE1\x41a\x20\x00", offset: 4, want: map[string]interface{}{"a": "foo"}, end: 9},
+
+		{name: "offset past the end", section: "\x43foo", offset: 10, wantErr: "unexpected end"},
+		{name: "truncated string", section: "\x43fo", wantErr: "unexpected end"},
+		{name: "truncated size", section: "\x5E\x00", wantErr: "unexpected end"},
+		{name: "truncated extended type", section: "\x04", wantErr: "unexpected end"},
+		{name: "truncated double", section: "\x68\x00", wantErr: "unexpected end"},
+		{name: "truncated pointer", section: "\x28\x00", wantErr: "unexpected end"},
+		{name: "pointer past the end", section: "\x20\x10", wantErr: "unexpected end"},
+		{name: "truncated map", section: "\xE2\x41a\x41b", wantErr: "unexpected end"},
+		{name: "huge map", section: "\xFF\xFF\xFF\xFF\x41a", wantErr: "unexpected end"},
+		{name: "huge array", section: "\x1F\x04\xFF\xFF\xFF\xA0", wantErr: "unexpected end"},
+		{name: "unknown type", section: "\x00\x09", wantErr: "unsupported data type 16"},
+		{name: "end marker", section: "\x00\x06", wantErr: "unsupported data type 13"},
+		{name: "pointer to a pointer", section: "\x20\x02\x20\x00", wantErr: "pointer to a pointer"},
+		{name: "map pointing to itself", section: "\xE1\x41a\x20\x00", wantErr: "nested more than"},
+		{name: "maps sharing pointers", section: sharedMaps(40), wantErr: "more than 65536 values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, end, err := decodeMMDB([]byte(tt.section), tt.offset)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeMMDB() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeMMDB() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || end != tt.end {
+				t.Errorf("decodeMMDB() = %#v ending at %d, want %#v ending at %d", got, end, tt.want, tt.end)
+			}
+		})
+	}
+}
+
+// mmdbControl encodes the control byte of a value of kind and size, with
+// the extended type and size bytes that follow it
+func mmdbControl(kind, size int) []byte {
+	var ctrl byte
+	var ext []byte
+	if kind > 7 {
+		ext = append(ext, byte(kind-7))
+	} else {
+		ctrl = byte(kind) << 5
+	}
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		ext = append(ext, byte(size-29))
+	case size < 65821:
+		ctrl |= 30
+		ext = append(ext, byte((size-285)>>8), byte(size-285))
+	default:
+		ctrl |= 31
+		ext = append(ext, byte((size-65821)>>16), byte((size-65821)>>8), byte(size-65821))
+	}
+	return append([]byte{ctrl}, ext...)
+}
+
+// encodeMMDB encodes the strings, unsigned integers, booleans, maps and
+// arrays a database's records and metadata are made of
+func encodeMMDB(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdbControl(2, len(v)), v...)
+	case uint64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		kind := 6
+		if len(b) > 4 {
+			kind = 9
+		}
+		return append(mmdbControl(kind, len(b)), b...)
+	case bool:
+		if v {
+			return mmdbControl(14, 1)
+		}
+		return mmdbControl(14, 0)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := mmdbControl(7, len(v))
+		for _, key := range keys {
+			b = append(b, encodeMMDB(key)...)
+			b = append(b, encodeMMDB(v[key])...)
+		}
+		return b
+	case []interface{}:
+		b := mmdbControl(11, len(v))
+		for _, item := range v {
+			b = append(b, encodeMMDB(item)...)
+		}
+		return b
+	}
+	panic("encodeMMDB: unsupported value")
+}
+
+// buildMMDB writes a database mapping each network of records to its
+// record, with the search tree laid out as MaxMind's writer does
+func buildMMDB(t testing.TB, ipVersion, recordSize int, records map[string]interface{}) []byte {
+	t.Helper()
+	const (
+		empty = -1
+		data  = -2
+	)
+	// Each node has two records, the index of a node, empty, or data-n for
+	// the nth entry of the data section
+	nodes := [][2]int{{empty, empty}}
+	var section []byte
+	var offsets []int
+
+	networks := make([]string, 0, len(records))
+	for network := range records {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		ip := ipnet.IP
+		if ipVersion == 6 {
+			// IPv4 networks go below 96 zero bits
+			if bits == 32 {
+				ones, ip = ones+96, append(make(net.IP, 12), ip...)
+			}
+		} else if bits != 32 {
+			t.Fatalf("%s in an IPv4 database", network)
+		}
+		offsets = append(offsets, len(section))
+		section = append(section, encodeMMDB(records[network])...)
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = data - (len(offsets) - 1)
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	value := func(record int) uint32 {
+		switch {
+		case record == empty:
+			return uint32(nodeCount)
+		case record <= data:
+			return uint32(nodeCount + 16 + offsets[data-record])
+		}
+		return uint32(record)
+	}
+	var file []byte
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			file = append(file, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			file = append(file, byte(left>>16), byte(left>>8), byte(left), byte(left>>24<<4)|byte(right>>24), byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			file = append(file, make([]byte, 8)...)
+			binary.BigEndian.PutUint32(file[len(file)-8:], left)
+			binary.BigEndian.PutUint32(file[len(file)-4:], right)
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, section...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, encodeMMDB(map[string]interface{}{
+		"node_count":  uint64(nodeCount),
+		"record_size": uint64(recordSize),
+		"ip_version":  uint64(ipVersion),
+	})...)
+}
+
+func countryRecord(code string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": code, "geoname_id": uint64(2921044)}}
+}
+
+func TestMMDBCountry(t *testing.T) {
+	records := map[string]interface{}{
+		"1.2.3.0/24":  countryRecord("DE"),
+		"1.2.4.0/23":  countryRecord("FR"),
+		"128.0.0.0/1": map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "US"}},
+		"9.9.9.9/32":  map[string]interface{}{"continent": map[string]interface{}{"code": "EU"}},
+	}
+	v6records := map[string]interface{}{
+		"2001:db8::/32": countryRecord("NL"),
+		"::ffff:0:0/96": countryRecord("XX"),
+	}
+	for network, record := range records {
+		v6records[network] = record
+	}
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.2.3.4", "DE"},
+		{"1.2.3.255", "DE"},
+		{"1.2.2.255", ""},
+		{"1.2.5.1", "FR"},
+		{"1.2.6.1", ""},
+		{"200.1.1.1", "US"},
+		{"9.9.9.9", ""},
+		{"9.9.9.8", ""},
+		{"0.0.0.0", ""},
+	}
+	v6tests := []struct {
+		ip   string
+		want string
+	}{
+		{"2001:db8::1", "NL"},
+		{"2001:db9::1", ""},
+		// Mapped addresses are looked up as IPv4 ones, below 96 zero bits
+		{"::ffff:1.2.3.4", "DE"},
+		{"::1", ""},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			r := records
+			if ipVersion == 6 {
+				r = v6records
+			}
+			db, err := parseMMDB(buildMMDB(t, ipVersion, recordSize, r))
+			if err != nil {
+				t.Fatalf("IPv%d database with %d bit records: %v", ipVersion, recordSize, err)
+			}
+			check := func(ip, want string) {
+				if got := db.country(net.ParseIP(ip)); got != want {
+					t.Errorf("IPv%d database with %d bit records: country(%s) = %q, want %q", ipVersion, recordSize, ip, got, want)
+				}
+			}
+			for _, tt := range tests {
+				check(tt.ip, tt.want)
+			}
+			if ipVersion == 6 {
+				for _, tt := range v6tests {
+					check(tt.ip, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestParseMMDB(t *testing.T) {
+	metadata := func(m map[string]interface{}) []byte {
+		return append(append(make([]byte, 64), mmdbMetadataMarker...), encodeMMDB(m)...)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "no metadata", data: make([]byte, 64), wantErr: "not a MaxMind database"},
+		{name: "truncated metadata", data: append(append([]byte{}, mmdbMetadataMarker...), 0xE3), wantErr: "invalid metadata"},
+		{name: "metadata not a map", data: metadata(map[string]interface{}{"a": "b"})[:64+len(mmdbMetadataMarker)+1], wantErr: "invalid metadata"},
+		{name: "record size", data: metadata(map[string]interface{}{"node_count": uint64(1), "record_size": uint64(20)}), wantErr: "unsupported record size 20"},
+		{name: "too many nodes", data: metadata(map[string]interface{}{"node_count": uint64(100), "record_size": uint64(24)}), wantErr: "larger than the file"},
+		{name: "node count overflowing", data: metadata(map[string]interface{}{"node_count": uint64(1) << 62, "record_size": uint64(32)}), wantErr: "larger than the file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseMMDB(tt.data); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseMMDB() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Broken trees fail lookups, not the whole database
+	tree := func(left, right uint32) []byte {
+		data := make([]byte, 8+16)
+		binary.BigEndian.PutUint32(data, left)
+		binary.BigEndian.PutUint32(data[4:], right)
+		return append(append(data, mmdbMetadataMarker...), encodeMMDB(map[string]interface{}{
+			"node_count": uint64(1), "record_size": uint64(32), "ip_version": uint64(4),
+		})...)
+	}
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "loop", data: tree(0, 0), wantErr: "without a record"},
+		{name: "separator", data: tree(5, 5), wantErr: "separator"},
+		{name: "past the data section", data: tree(1000, 1000), wantErr: "unexpected end"},
+	} {
+		db, err := parseMMDB(tt.data)
+		if err != nil {
+			t.Fatalf("%s: parseMMDB() error = %v", tt.name, err)
+		}
+		if _, err := db.lookup(net.ParseIP("1.2.3.4")); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: lookup() error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func FuzzDecodeMMDB(f *testing.F) {
+	f.Add([]byte("\xE2\x42en\x43foo\x42de\x43bar"), uint(0))
+	f.Add([]byte("\x43foo\xE1\x41a\x20\x00"), uint(4))
+	f.Add([]byte("\x02\x04\x43foo\x04\x01\xFF\xFF\xFF\xFE\x68\x3F\xF8\x00\x00\x00\x00\x00\x00"), uint(0))
+	f.Add([]byte("\xE1\x41a\x20\x00"), uint(0))
+	f.Fuzz(func(t *testing.T, section []byte, offset uint) {
+		_, end, err := decodeMMDB(section, offset)
+		if err == nil && (end <= offset || end > uint(len(section))) {
+			t.Fatalf("decodeMMDB(%x, %d) ended at %d", section, offset, end)
+		}
+	})
+}
+
+func FuzzParseMMDB(f *testing.F) {
+	f.Add(buildMMDB(f, 4, 24, map[string]interface{}{"1.2.3.0/24": countryRecord("DE")}))
+	f.Add(buildMMDB(f, 6, 28, map[string]interface{}{"1.2.3.0/24": countryRecord("DE"), "2001:db8::/32": countryRecord("NL")}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := parseMMDB(data)
+		if err != nil {
+			return
+		}
+		for _, ip := range []string{"1.2.3.4", "0.0.0.0", "255.255.255.255", "2001:db8::1", "::"} {
+			db.country(net.ParseIP(ip))
+		}
+	})
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// GitConfig serves the folder as the working tree of a Git repository, cloned
+// at startup and pulled on a schedule or when the webhook is called, so
+// assets are deployed by merging to the branch
+type GitConfig struct {
+	// URL is the repository cloned into the folder, credentials can be part
+	// of it; they are handed to git when it asks, never written to .git/config
+	URL string `json:"url" secret:"true"`
+	// Branch is checked out, the remote's default branch when empty
+	Branch string `json:"branch,omitempty"`
+	// LFS fetches Git LFS files, which needs git-lfs installed
+	LFS bool `json:"lfs,omitempty"`
+	// Interval is how many seconds to wait between pulls, 0 only pulls at startup and from the webhook
+	Interval int `json:"interval,omitempty"`
+	// WebhookSecret verifies push webhooks to /api/git/pull from GitHub or GitLab
+	WebhookSecret string `json:"webhookSecret,omitempty" secret:"true"`
+}
+
+const (
+	// gitCommandTimeout bounds a single git command, a clone of a large LFS repository included
+	gitCommandTimeout = 30 * time.Minute
+	// gitWebhookMaxBytes is the largest webhook payload read
+	gitWebhookMaxBytes = 10 << 20
+)
+
+func (g *GitConfig) validate(readOnly bool) []error {
+	var errs []error
+	// Pulls rewrite the folder
+	if readOnly {
+		errs = append(errs, fmt.Errorf("git cannot be enabled on a readOnly folder"))
+	}
+	// Neither may be taken for an option by git
+	if g.URL == "" || strings.HasPrefix(g.URL, "-") {
+		errs = append(errs, fmt.Errorf("git.url must be a repository URL, got %q", g.URL))
+	}
+	if strings.HasPrefix(g.Branch, "-") || strings.ContainsAny(g.Branch, " ~^:?*[\\") {
+		errs = append(errs, fmt.Errorf("git.branch %q is not a valid branch name", g.Branch))
+	}
+	if g.Interval < 0 {
+		errs = append(errs, fmt.Errorf("git.interval cannot be negative"))
+	}
+	return errs
+}
+
+// gitAskPassEnv marks the executable started by git as GIT_ASKPASS, which
+// answers with the credentials of git.url from the environment
+const (
+	gitAskPassEnv     = "IMAGESERVER_GIT_ASKPASS"
+	gitAskPassUser    = "IMAGESERVER_GIT_USERNAME"
+	gitAskPassSecret  = "IMAGESERVER_GIT_PASSWORD"
+	gitCredentialsEnv = "GIT_ASKPASS"
+)
+
+// gitRemote splits the credentials off a repository URL: the remote is
+// stored without them, and git gets them from GIT_ASKPASS, so they don't end
+// up in .git/config
+func gitRemote(repo string) (remote string, user *url.Userinfo) {
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil || u.Host == "" {
+		return repo, nil
+	}
+	user, u.User = u.User, nil
+	return u.String(), user
+}
+
+// runGitAskPass is main when git runs the executable for a credential of
+// git.url, with the prompt as argument: "Username for ..." or "Password for ..."
+func runGitAskPass(args []string) int {
+	prompt := ""
+	if len(args) > 0 {
+		prompt = strings.ToLower(args[0])
+	}
+	if strings.HasPrefix(prompt, "username") {
+		fmt.Println(os.Getenv(gitAskPassUser))
+	} else {
+		fmt.Println(os.Getenv(gitAskPassSecret))
+	}
+	return 0
+}
+
+// runGit runs git with args in dir, returning its trimmed output. Prompts
+// are disabled, a missing credential fails instead of hanging the service.
+// The credentials of config.URL are answered by the executable itself as
+// GIT_ASKPASS, other credential helpers are skipped so they aren't stored.
+func runGit(ctx context.Context, config *GitConfig, dir string, lfs bool, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitCommandTimeout)
+	defer cancel()
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	gitArgs := args
+	if _, user := gitRemote(config.URL); user != nil {
+		exe, err := os.Executable()
+		if err != nil {
+			return "", err
+		}
+		password, _ := user.Password()
+		env = append(env, gitCredentialsEnv+"="+exe, gitAskPassEnv+"=1", gitAskPassUser+"="+user.Username(), gitAskPassSecret+"="+password)
+		gitArgs = append([]string{"-c", "credential.helper="}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", gitArgs...)
+	cmd.Dir = dir
+	cmd.Env = env
+	if lfs {
+		// LFS files are fetched in one batch by git lfs pull rather than one by one on checkout
+		cmd.Env = append(cmd.Env, "GIT_LFS_SKIP_SMUDGE=1")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %v: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// cloneGitFolder clones the repository into folder unless it already is a
+// working tree. An empty or missing folder is cloned into, one holding other
+// files is refused rather than mixed with the repository.
+func cloneGitFolder(config *GitConfig, folder string) error {
+	if _, err := os.Stat(filepath.Join(folder, ".git")); err == nil {
+		return nil
+	}
+	if entries, err := os.ReadDir(folder); err == nil && len(entries) > 0 {
+		return fmt.Errorf("folder %s already has files and isn't a clone of git.url", folder)
+	}
+	args := []string{"clone", "--depth", "1"}
+	if config.Branch != "" {
+		args = append(args, "--branch", config.Branch)
+	}
+	remote, _ := gitRemote(config.URL)
+	args = append(args, "--", remote, folder)
+	if _, err := runGit(context.Background(), config, "", config.LFS, args...); err != nil {
+		return err
+	}
+	if config.LFS {
+		if _, err := runGit(context.Background(), config, folder, false, "lfs", "pull"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitRepo pulls the folder's repository. Pulls run one at a time from Run,
+// webhook calls while one is running queue a single further pull.
+type gitRepo struct {
+	config *GitConfig
+	folder string
+	elog   debug.Log
+	pulls  chan struct{}
+
+	mu      sync.Mutex
+	commit  string
+	pulled  time.Time
+	lastErr error
+}
+
+// newGitRepo returns nil when config is nil, so the pull endpoint isn't served
+func newGitRepo(config *GitConfig, folder string, elog debug.Log) *gitRepo {
+	if config == nil {
+		return nil
+	}
+	return &gitRepo{config: config, folder: folder, elog: elog, pulls: make(chan struct{}, 1)}
+}
+
+// Run pulls at startup, every interval and when requested, until ctx is done
+func (g *gitRepo) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if g.config.Interval > 0 {
+		ticker := time.NewTicker(time.Duration(g.config.Interval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		g.pullLogged(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-g.pulls:
+		}
+	}
+}
+
+// Pull queues a pull, it returns false when one is already queued
+func (g *gitRepo) Pull() bool {
+	select {
+	case g.pulls <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *gitRepo) pullLogged(ctx context.Context) {
+	g.mu.Lock()
+	before := g.commit
+	g.mu.Unlock()
+	commit, err := g.pull(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	g.mu.Lock()
+	g.lastErr = err
+	if err == nil {
+		g.commit, g.pulled = commit, time.Now()
+	}
+	g.mu.Unlock()
+	switch {
+	case err != nil:
+		g.elog.Error(eventGit, fmt.Sprintf("Failed to pull %s into %s, serving the files checked out before: %v", redactURL(g.config.URL), g.folder, err))
+	case commit != before:
+		g.elog.Info(eventGit, fmt.Sprintf("Updated %s to commit %s", g.folder, commit))
+	}
+}
+
+// pull fetches the branch and resets the working tree to it. Files changed
+// in the folder are overwritten, the repository is what's served.
+func (g *gitRepo) pull(ctx context.Context) (string, error) {
+	ref := g.config.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	// The URL may have changed with a config reload. Setting it also drops
+	// the credentials clones made before kept in .git/config.
+	remote, _ := gitRemote(g.config.URL)
+	if _, err := runGit(ctx, g.config, g.folder, false, "remote", "set-url", "origin", remote); err != nil {
+		return "", err
+	}
+	if _, err := runGit(ctx, g.config, g.folder, g.config.LFS, "fetch", "--depth", "1", "origin", ref); err != nil {
+		return "", err
+	}
+	if _, err := runGit(ctx, g.config, g.folder, g.config.LFS, "reset", "--hard", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	if g.config.LFS {
+		if _, err := runGit(ctx, g.config, g.folder, false, "lfs", "pull"); err != nil {
+			return "", err
+		}
+	}
+	return runGit(ctx, g.config, g.folder, false, "rev-parse", "HEAD")
+}
+
+// redactURL drops the credentials from a repository URL for logging, a
+// token is often passed as the user name
+func redactURL(repo string) string {
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil {
+		return repo
+	}
+	u.User = nil
+	return u.String()
+}
+
+// gitStatus is the body of GET /api/git/pull
+type gitStatus struct {
+	Commit   string    `json:"commit,omitempty"`
+	PulledAt time.Time `json:"pulledAt,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// handler serves /api/git/pull. POST queues a pull and is accepted with the
+// admin token, a GitHub X-Hub-Signature-256 or a GitLab X-Gitlab-Token;
+// pushes to other branches are ignored. GET reports the last pull to admins.
+func (g *gitRepo) handler(adminToken string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected, ok := adminTokenFor(r, adminToken)
+		admin := ok && hasBearer(r, expected)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if !admin {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ImageServer"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			g.mu.Lock()
+			status := gitStatus{Commit: g.commit, PulledAt: g.pulled}
+			if g.lastErr != nil {
+				status.Error = g.lastErr.Error()
+			}
+			g.mu.Unlock()
+			writeGitJSON(w, http.StatusOK, status)
+		case http.MethodPost:
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, gitWebhookMaxBytes))
+			if err != nil {
+				http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if !admin && !g.validWebhook(r, body) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			var push struct {
+				Ref string `json:"ref"`
+			}
+			if json.Unmarshal(body, &push) == nil && push.Ref != "" && g.config.Branch != "" && push.Ref != "refs/heads/"+g.config.Branch {
+				writeGitJSON(w, http.StatusOK, map[string]bool{"queued": false})
+				return
+			}
+			g.Pull()
+			writeGitJSON(w, http.StatusAccepted, map[string]bool{"queued": true})
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// validWebhook checks the webhook secret as GitHub (an HMAC of the body) or GitLab (the secret itself) sends it
+func (g *gitRepo) validWebhook(r *http.Request, body []byte) bool {
+	secret := g.config.WebhookSecret
+	if secret == "" {
+		return false
+	}
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+func writeGitJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// isGitPath reports whether the slash separated name is inside the .git
+// directory of folder. Windows drops trailing dots and spaces from names, so
+// ".git." and ".git " open .git too, and so does its 8.3 short name (GIT~1),
+// which is compared with the directory itself unless folder is empty.
+func isGitPath(folder, name string) bool {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if strings.EqualFold(strings.TrimRight(segment, ". "), ".git") {
+			return true
+		}
+		if strings.Contains(segment, "~") && folder != "" {
+			gitDir, err := os.Stat(filepath.Join(folder, ".git"))
+			if err != nil {
+				continue
+			}
+			if info, err := os.Stat(filepath.Join(folder, filepath.FromSlash(path.Join(segments[:i+1]...)))); err == nil && os.SameFile(info, gitDir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gitTreeFS hides the .git directory of folder, which holds the
+// repository's history, from the files served
+type gitTreeFS struct {
+	http.FileSystem
+	folder string
+}
+
+func (f gitTreeFS) Open(name string) (http.File, error) {
+	if isGitPath(f.folder, path.Clean("/"+name)) {
+		return nil, os.ErrNotExist
+	}
+	file, err := f.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return gitTreeDir{file}, nil
+}
+
+// gitTreeDir leaves .git out of directory listings
+type gitTreeDir struct {
+	http.File
+}
+
+func (d gitTreeDir) Readdir(count int) ([]fs.FileInfo, error) {
+	for {
+		entries, err := d.File.Readdir(count)
+		kept := entries[:0]
+		for _, entry := range entries {
+			if !strings.EqualFold(entry.Name(), ".git") {
+				kept = append(kept, entry)
+			}
+		}
+		// A batch that only held .git would look like the end of the directory
+		if len(kept) == 0 && len(entries) > 0 && count > 0 && err == nil {
+			continue
+		}
+		return kept, err
+	}
+}
+
+func (d gitTreeDir) unwrap() http.File {
+	return d.File
+}
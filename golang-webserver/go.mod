@@ -2,6 +2,9 @@ module your-module-name
 
 go 1.18
 
-require github.com/kardianos/service v1.2.2
-
-require golang.org/x/sys v0.30.0 // indirect
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/Microsoft/go-winio v0.6.1
+	golang.org/x/sys v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
+)
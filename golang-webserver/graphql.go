@@ -0,0 +1,884 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The GraphQL query language, enough of it for the library API: queries
+// with variables, aliases, arguments, fragments, inline fragments and the
+// @include and @skip directives. There are no mutations, subscriptions or
+// introspection; the schema is documented as SDL instead.
+
+const (
+	// maxGraphQLDepth bounds how deeply selections nest
+	maxGraphQLDepth = 12
+	// maxGraphQLFields bounds the fields a query resolves, so that nested
+	// lists can't make it walk the whole library
+	maxGraphQLFields = 50000
+)
+
+// graphObject is a value of a GraphQL object type
+type graphObject interface {
+	typeName() string
+	// field resolves the field name with its arguments. It returns nil,
+	// another graphObject, []graphObject, or a scalar: string, bool, int,
+	// int64, uint64, float64 or time.Time.
+	field(name string, args map[string]interface{}) (interface{}, error)
+}
+
+// graphError is an entry of the errors of a response
+type graphError struct {
+	Message   string          `json:"message"`
+	Locations []graphLocation `json:"locations,omitempty"`
+	Path      []interface{}   `json:"path,omitempty"`
+}
+
+type graphLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// graphRequest is the body of a POST, or the parameters of a GET
+type graphRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// graphResponse is the result of a query. Data is absent when the query
+// couldn't be run at all.
+type graphResponse struct {
+	Data   *graphResult `json:"data,omitempty"`
+	Errors []graphError `json:"errors,omitempty"`
+}
+
+// graphResult is an object of the response, whose keys keep the order of
+// the query, as the spec requires
+type graphResult struct {
+	keys   []string
+	values []interface{}
+}
+
+func (r *graphResult) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// The syntax tree of a query document
+
+type graphDocument struct {
+	operations []*graphOperation
+	fragments  map[string]*graphFragment
+}
+
+type graphOperation struct {
+	kind       string
+	name       string
+	variables  []graphVariableDef
+	selections []*graphSelection
+	loc        graphLocation
+}
+
+type graphVariableDef struct {
+	name    string
+	typ     string
+	nonNull bool
+	def     interface{}
+	hasDef  bool
+}
+
+type graphFragment struct {
+	on         string
+	selections []*graphSelection
+}
+
+// graphSelection is a field, a fragment spread (spread is set) or an inline
+// fragment (inline is set, with an optional type condition in on)
+type graphSelection struct {
+	alias, name string
+	args        map[string]interface{}
+	directives  []graphDirective
+	selections  []*graphSelection
+	spread      string
+	inline      bool
+	on          string
+	loc         graphLocation
+}
+
+type graphDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// Values that the variables of the request are substituted into
+type (
+	graphVariable string
+	graphEnum     string
+)
+
+// responseKey is the name of the field in the response
+func (s *graphSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type graphToken struct {
+	kind  byte // 'p'unctuator, 'n'ame, 'i'nt, 'f'loat, 's'tring, 0 at the end
+	value string
+	loc   graphLocation
+}
+
+type graphSyntaxError struct {
+	message string
+	loc     graphLocation
+}
+
+func (e *graphSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.loc.Line, e.loc.Column, e.message)
+}
+
+// lexGraphQL splits src into tokens, ending with one of kind 0
+func lexGraphQL(src string) ([]graphToken, error) {
+	var tokens []graphToken
+	line, lineStart := 1, 0
+	i := 0
+	for {
+		// Whitespace, commas and comments are ignored
+		for i < len(src) {
+			c := src[i]
+			if c == '\n' {
+				i++
+				line, lineStart = line+1, i
+			} else if c == ' ' || c == '\t' || c == '\r' || c == ',' {
+				i++
+			} else if strings.HasPrefix(src[i:], "\ufeff") {
+				i += 3
+			} else if c == '#' {
+				for i < len(src) && src[i] != '\n' {
+					i++
+				}
+			} else {
+				break
+			}
+		}
+		loc := graphLocation{line, i - lineStart + 1}
+		if i == len(src) {
+			return append(tokens, graphToken{loc: loc}), nil
+		}
+		c := src[i]
+		start := i
+		switch {
+		case strings.HasPrefix(src[i:], "..."):
+			i += 3
+			tokens = append(tokens, graphToken{'p', "...", loc})
+		case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+			i++
+			tokens = append(tokens, graphToken{'p', src[start:i], loc})
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			for i < len(src) && (src[i] == '_' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, graphToken{'n', src[start:i], loc})
+		case c == '-' || c >= '0' && c <= '9':
+			kind := byte('i')
+			if c == '-' {
+				i++
+			}
+			digits := func() bool {
+				from := i
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+				return i > from
+			}
+			if !digits() {
+				return nil, &graphSyntaxError{"expected a digit", loc}
+			}
+			if i < len(src) && src[i] == '.' {
+				i++
+				kind = 'f'
+				if !digits() {
+					return nil, &graphSyntaxError{"expected a digit after the decimal point", loc}
+				}
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				kind = 'f'
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				if !digits() {
+					return nil, &graphSyntaxError{"expected a digit in the exponent", loc}
+				}
+			}
+			tokens = append(tokens, graphToken{kind, src[start:i], loc})
+		case strings.HasPrefix(src[i:], `"""`):
+			// \""" doesn't end the string
+			end := 0
+			for {
+				n := strings.Index(src[i+3+end:], `"""`)
+				if n < 0 {
+					return nil, &graphSyntaxError{"unterminated block string", loc}
+				}
+				if end += n; src[i+2+end] != '\\' {
+					break
+				}
+				end += 3
+			}
+			block := src[i+3 : i+3+end]
+			for _, r := range block {
+				if r == '\n' {
+					line++
+				}
+			}
+			i += end + 6
+			if nl := strings.LastIndexByte(src[:i], '\n'); nl >= start {
+				lineStart = nl + 1
+			}
+			tokens = append(tokens, graphToken{'s', strings.TrimSpace(strings.ReplaceAll(block, `\"""`, `"""`)), loc})
+		case c == '"':
+			value, n, err := unquoteGraphString(src[i:])
+			if err != nil {
+				return nil, &graphSyntaxError{err.Error(), loc}
+			}
+			i += n
+			tokens = append(tokens, graphToken{'s', value, loc})
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, &graphSyntaxError{fmt.Sprintf("unexpected character %q", r), loc}
+		}
+	}
+}
+
+// unquoteGraphString reads the string literal at the start of s, returning
+// its value and length
+func unquoteGraphString(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\n' || c == '\r':
+			return "", 0, fmt.Errorf("unterminated string")
+		case c != '\\':
+			b.WriteByte(c)
+			i++
+		case i+1 >= len(s):
+			return "", 0, fmt.Errorf("unterminated string")
+		default:
+			escapes := map[byte]string{'"': `"`, '\\': `\`, '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}
+			if e, ok := escapes[s[i+1]]; ok {
+				b.WriteString(e)
+				i += 2
+				continue
+			}
+			if s[i+1] != 'u' || i+6 > len(s) {
+				return "", 0, fmt.Errorf("invalid escape in string")
+			}
+			r, err := strconv.ParseUint(s[i+2:i+6], 16, 16)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid unicode escape in string")
+			}
+			b.WriteRune(rune(r))
+			i += 6
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+type graphParser struct {
+	tokens []graphToken
+	pos    int
+}
+
+func (p *graphParser) peek() graphToken {
+	return p.tokens[p.pos]
+}
+
+func (p *graphParser) next() graphToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the punctuator or keyword value
+func (p *graphParser) is(value string) bool {
+	t := p.peek()
+	return (t.kind == 'p' || t.kind == 'n') && t.value == value
+}
+
+// skip consumes the next token when it is value
+func (p *graphParser) skip(value string) bool {
+	if p.is(value) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *graphParser) expect(value string) error {
+	if !p.skip(value) {
+		return p.unexpected("expected " + value)
+	}
+	return nil
+}
+
+func (p *graphParser) name() (string, error) {
+	t := p.peek()
+	if t.kind != 'n' {
+		return "", p.unexpected("expected a name")
+	}
+	p.pos++
+	return t.value, nil
+}
+
+func (p *graphParser) unexpected(message string) error {
+	t := p.peek()
+	if t.kind == 0 {
+		return &graphSyntaxError{message + ", found the end of the query", t.loc}
+	}
+	return &graphSyntaxError{fmt.Sprintf("%s, found %q", message, t.value), t.loc}
+}
+
+// parseGraphQL parses a query document
+func parseGraphQL(src string) (*graphDocument, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &graphParser{tokens: tokens}
+	doc := &graphDocument{fragments: map[string]*graphFragment{}}
+	for p.peek().kind != 0 {
+		loc := p.peek().loc
+		switch {
+		case p.is("{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &graphOperation{kind: "query", selections: selections, loc: loc})
+		case p.is("query") || p.is("mutation") || p.is("subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.skip("fragment"):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, &graphSyntaxError{fmt.Sprintf("there can be only one fragment named %q", name), loc}
+			}
+			if err := p.expect("on"); err != nil {
+				return nil, err
+			}
+			on, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = &graphFragment{on: on, selections: selections}
+		default:
+			return nil, p.unexpected("expected an operation or a fragment")
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &graphSyntaxError{"the document has no operation", p.peek().loc}
+	}
+	return doc, nil
+}
+
+func (p *graphParser) operation() (*graphOperation, error) {
+	t := p.next()
+	op := &graphOperation{kind: t.value, loc: t.loc}
+	if p.peek().kind == 'n' {
+		op.name, _ = p.name()
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			var def graphVariableDef
+			var err error
+			if def.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if def.typ, def.nonNull, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			if p.skip("=") {
+				if def.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+				def.hasDef = true
+			}
+			op.variables = append(op.variables, def)
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+// typeRef reads a type such as [String!]!, returning it as written and
+// whether it is non-null
+func (p *graphParser) typeRef() (string, bool, error) {
+	var typ string
+	if p.skip("[") {
+		inner, _, err := p.typeRef()
+		if err != nil {
+			return "", false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", false, err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", false, err
+		}
+		typ = name
+	}
+	if p.skip("!") {
+		return typ + "!", true, nil
+	}
+	return typ, false, nil
+}
+
+func (p *graphParser) selectionSet() ([]*graphSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []*graphSelection
+	for !p.skip("}") {
+		s := &graphSelection{loc: p.peek().loc}
+		var err error
+		if p.skip("...") {
+			if p.peek().kind == 'n' && !p.is("on") {
+				s.spread, _ = p.name()
+			} else {
+				s.inline = true
+				if p.skip("on") {
+					if s.on, err = p.name(); err != nil {
+						return nil, err
+					}
+				}
+			}
+		} else {
+			if s.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if p.skip(":") {
+				s.alias = s.name
+				if s.name, err = p.name(); err != nil {
+					return nil, err
+				}
+			}
+			if s.args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		if s.inline || s.spread == "" && p.is("{") {
+			if s.selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, p.unexpected("expected a selection")
+	}
+	return selections, nil
+}
+
+func (p *graphParser) arguments() (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	if !p.skip("(") {
+		return args, nil
+	}
+	for !p.skip(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (p *graphParser) directives() ([]graphDirective, error) {
+	var directives []graphDirective
+	for p.skip("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, graphDirective{name, args})
+	}
+	return directives, nil
+}
+
+// value reads a value literal; constant ones, the defaults of variables,
+// can't refer to variables
+func (p *graphParser) value(constant bool) (interface{}, error) {
+	t := p.peek()
+	switch {
+	case t.kind == 'p' && t.value == "$" && !constant:
+		p.pos++
+		name, err := p.name()
+		return graphVariable(name), err
+	case t.kind == 'i':
+		p.pos++
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, &graphSyntaxError{"integer out of range", t.loc}
+		}
+		return n, nil
+	case t.kind == 'f':
+		p.pos++
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, &graphSyntaxError{"invalid number", t.loc}
+		}
+		return f, nil
+	case t.kind == 's':
+		p.pos++
+		return t.value, nil
+	case t.kind == 'n':
+		p.pos++
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return graphEnum(t.value), nil
+	case p.skip("["):
+		list := []interface{}{}
+		for !p.skip("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case p.skip("{"):
+		object := map[string]interface{}{}
+		for !p.skip("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+// graphExecutor runs an operation of a document
+type graphExecutor struct {
+	doc    *graphDocument
+	vars   map[string]interface{}
+	errors []graphError
+	fields int
+}
+
+// executeGraphQL runs the operation named operation of the query against root
+func executeGraphQL(root graphObject, req graphRequest) graphResponse {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		e := graphError{Message: err.Error()}
+		if syntax, ok := err.(*graphSyntaxError); ok {
+			e.Locations = []graphLocation{syntax.loc}
+		}
+		return graphResponse{Errors: []graphError{e}}
+	}
+	var op *graphOperation
+	for _, o := range doc.operations {
+		if o.name == req.OperationName || req.OperationName == "" && len(doc.operations) == 1 {
+			op = o
+		}
+	}
+	if op == nil {
+		message := fmt.Sprintf("unknown operation %q", req.OperationName)
+		if req.OperationName == "" {
+			message = "operationName is required when the document has several operations"
+		}
+		return graphResponse{Errors: []graphError{{Message: message}}}
+	}
+	if op.kind != "query" {
+		return graphResponse{Errors: []graphError{{Message: fmt.Sprintf("only queries are supported, not %ss", op.kind), Locations: []graphLocation{op.loc}}}}
+	}
+
+	e := &graphExecutor{doc: doc, vars: map[string]interface{}{}}
+	for _, def := range op.variables {
+		v, ok := req.Variables[def.name]
+		if !ok && def.hasDef {
+			v, ok = def.def, true
+		}
+		if def.nonNull && v == nil {
+			return graphResponse{Errors: []graphError{{Message: fmt.Sprintf("variable $%s of type %s is required", def.name, def.typ), Locations: []graphLocation{op.loc}}}}
+		}
+		if ok {
+			e.vars[def.name] = v
+		}
+	}
+	data := e.selectObject(root, op.selections, nil, 1)
+	return graphResponse{Data: data, Errors: e.errors}
+}
+
+func (e *graphExecutor) fail(s *graphSelection, path []interface{}, message string) {
+	e.errors = append(e.errors, graphError{Message: message, Locations: []graphLocation{s.loc}, Path: append([]interface{}{}, path...)})
+}
+
+// resolve substitutes the variables into the value v of the query
+func (e *graphExecutor) resolve(v interface{}) interface{} {
+	switch v := v.(type) {
+	case graphVariable:
+		return e.vars[string(v)]
+	case graphEnum:
+		return string(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = e.resolve(v[i])
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for k := range v {
+			object[k] = e.resolve(v[k])
+		}
+		return object
+	}
+	return v
+}
+
+// included applies the @include and @skip directives of s
+func (e *graphExecutor) included(s *graphSelection) bool {
+	for _, d := range s.directives {
+		condition, _ := e.resolve(d.args["if"]).(bool)
+		if d.name == "include" && !condition || d.name == "skip" && condition {
+			return false
+		}
+	}
+	return true
+}
+
+// collectFields groups the fields selected on obj by key, in order,
+// expanding the fragments that apply to its type. It returns false when a
+// fragment is unknown.
+func (e *graphExecutor) collectFields(obj graphObject, selections []*graphSelection, keys *[]string, fields map[string][]*graphSelection, visited map[string]bool, path []interface{}) bool {
+	for _, s := range selections {
+		if !e.included(s) {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			fragment, ok := e.doc.fragments[s.spread]
+			if !ok {
+				e.fail(s, path, fmt.Sprintf("unknown fragment %q", s.spread))
+				return false
+			}
+			if visited[s.spread] || fragment.on != obj.typeName() {
+				continue
+			}
+			visited[s.spread] = true
+			if !e.collectFields(obj, fragment.selections, keys, fields, visited, path) {
+				return false
+			}
+		case s.inline:
+			if s.on == "" || s.on == obj.typeName() {
+				if !e.collectFields(obj, s.selections, keys, fields, visited, path) {
+					return false
+				}
+			}
+		default:
+			key := s.responseKey()
+			if _, seen := fields[key]; !seen {
+				*keys = append(*keys, key)
+			}
+			fields[key] = append(fields[key], s)
+		}
+	}
+	return true
+}
+
+// selectObject resolves the selections on obj, returning nil when a field
+// of the selections is unknown
+func (e *graphExecutor) selectObject(obj graphObject, selections []*graphSelection, path []interface{}, depth int) *graphResult {
+	var keys []string
+	fields := map[string][]*graphSelection{}
+	if !e.collectFields(obj, selections, &keys, fields, map[string]bool{}, path) {
+		return nil
+	}
+
+	result := &graphResult{}
+	for _, key := range keys {
+		group := fields[key]
+		s := group[0]
+		fieldPath := append(path[:len(path):len(path)], key)
+		if depth > maxGraphQLDepth {
+			e.fail(s, fieldPath, fmt.Sprintf("the query is nested more than %d levels deep", maxGraphQLDepth))
+			return nil
+		}
+		if e.fields++; e.fields > maxGraphQLFields {
+			if e.fields == maxGraphQLFields+1 {
+				e.fail(s, fieldPath, fmt.Sprintf("the query resolves more than %d fields, ask for fewer at a time", maxGraphQLFields))
+			}
+			return nil
+		}
+
+		var value interface{}
+		if s.name == "__typename" {
+			value = obj.typeName()
+		} else {
+			args := make(map[string]interface{}, len(s.args))
+			for name, v := range s.args {
+				args[name] = e.resolve(v)
+			}
+			var err error
+			value, err = obj.field(s.name, args)
+			if err != nil {
+				e.fail(s, fieldPath, err.Error())
+				value = nil
+			}
+		}
+		var sub []*graphSelection
+		for _, f := range group {
+			sub = append(sub, f.selections...)
+		}
+		result.keys = append(result.keys, key)
+		result.values = append(result.values, e.complete(obj, s, value, sub, fieldPath, depth))
+	}
+	return result
+}
+
+// complete turns the value of field s of obj into its response, selecting
+// sub on objects
+func (e *graphExecutor) complete(obj graphObject, s *graphSelection, value interface{}, sub []*graphSelection, path []interface{}, depth int) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case graphObject:
+		if len(sub) == 0 {
+			e.fail(s, path, fmt.Sprintf("field %q of type %s must have a selection of subfields", s.name, v.typeName()))
+			return nil
+		}
+		if r := e.selectObject(v, sub, path, depth+1); r != nil {
+			return r
+		}
+		return nil
+	case []graphObject:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.complete(obj, s, item, sub, append(path[:len(path):len(path)], i), depth)
+		}
+		return list
+	}
+	if len(sub) > 0 {
+		e.fail(s, path, fmt.Sprintf("field %q of %s is a scalar and has no subfields", s.name, obj.typeName()))
+		return nil
+	}
+	if t, ok := value.(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return value
+}
+
+// errUnknownField is the error of a field a type doesn't have
+func errUnknownField(obj graphObject, name string) error {
+	return fmt.Errorf("cannot query field %q on type %s", name, obj.typeName())
+}
+
+// stringArg returns the string argument name, or def when it is absent
+func stringArg(args map[string]interface{}, name, def string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %q must be a string", name)
+}
+
+// intArg returns the integer argument name, or def when it is absent.
+// Variables come from JSON, where numbers are floats.
+func intArg(args map[string]interface{}, name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		if v == int64(int32(v)) {
+			return int(v), nil
+		}
+	case float64:
+		if v == float64(int32(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be a 32-bit integer", name)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNode is a graphObject of type Node with a name, a size and children,
+// the shape of the library's folders
+type testNode struct {
+	name     string
+	size     int64
+	children []*testNode
+}
+
+func (n *testNode) typeName() string { return "Node" }
+
+func (n *testNode) field(name string, args map[string]interface{}) (interface{}, error) {
+	switch name {
+	case "name":
+		return n.name, nil
+	case "size":
+		return n.size, nil
+	case "modified":
+		return time.Date(2026, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600)), nil
+	case "child":
+		want, err := stringArg(args, "name", "")
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range n.children {
+			if c.name == want {
+				return c, nil
+			}
+		}
+		return nil, nil
+	case "children":
+		first, err := intArg(args, "first", len(n.children))
+		if err != nil {
+			return nil, err
+		}
+		var list []graphObject
+		for i, c := range n.children {
+			if i == first {
+				break
+			}
+			list = append(list, c)
+		}
+		return list, nil
+	}
+	return nil, errUnknownField(n, name)
+}
+
+func testTree() *testNode {
+	return &testNode{name: "root", children: []*testNode{
+		{name: "a", size: 1, children: []*testNode{{name: "a1", size: 11}}},
+		{name: "b", size: 2},
+	}}
+}
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		query   string
+		ops     int
+		frags   int
+		wantErr string
+	}{
+		{query: `{ name }`, ops: 1},
+		{query: `query Q($p: String = "x", $n: [Int!]!) { child(name: $p) { name } }`, ops: 1},
+		{query: `query A { name } query B { size }`, ops: 2},
+		{query: `{ ...F } fragment F on Node { name }`, ops: 1, frags: 1},
+		{query: `{ ... on Node @include(if: true) { name } }`, ops: 1},
+		{query: "# comment\n{ a: name, b: size }", ops: 1},
+		{query: `{ child(name: """block "quoted" \""" string""") { name } }`, ops: 1},
+		{query: `{ child(name: "\u00e9\n") { name } }`, ops: 1},
+		{query: `{ children(first: -3, list: [1, 2.5e3, true, null, ENUM, {k: "v"}]) { name } }`, ops: 1},
+
+		{query: ``, wantErr: "syntax error at 1:1"},
+		{query: `{ name `, wantErr: "syntax error"},
+		{query: `{ child(name: "open) { name } }`, wantErr: "syntax error"},
+		{query: `{ child(name: "\x") { name } }`, wantErr: "syntax error"},
+		{query: `{ name } fragment F on Node { name } fragment F on Node { size }`, wantErr: "F"},
+		{query: `{ child(name: $) { name } }`, wantErr: "syntax error"},
+		{query: "{\n  name &\n}", wantErr: "syntax error at 2:8"},
+		{query: `query Q($p: String = $q) { name }`, wantErr: "syntax error"},
+		{query: `{ name } garbage`, wantErr: "syntax error"},
+	}
+	for _, tt := range tests {
+		doc, err := parseGraphQL(tt.query)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseGraphQL(%q) error = %v, want one containing %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGraphQL(%q) error = %v", tt.query, err)
+			continue
+		}
+		if len(doc.operations) != tt.ops || len(doc.fragments) != tt.frags {
+			t.Errorf("parseGraphQL(%q) = %d operations and %d fragments, want %d and %d", tt.query, len(doc.operations), len(doc.fragments), tt.ops, tt.frags)
+		}
+	}
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	tests := []struct {
+		name string
+		req  graphRequest
+		want string
+	}{
+		{
+			name: "fields keep the order of the query",
+			req:  graphRequest{Query: `{ size name __typename }`},
+			want: `{"data":{"size":0,"name":"root","__typename":"Node"}}`,
+		},
+		{
+			name: "aliases and arguments",
+			req:  graphRequest{Query: `{ first: child(name: "a") { name } second: child(name: "b") { size } none: child(name: "z") { name } }`},
+			want: `{"data":{"first":{"name":"a"},"second":{"size":2},"none":null}}`,
+		},
+		{
+			name: "lists and nesting",
+			req:  graphRequest{Query: `{ children { name children(first: 1) { name } } }`},
+			want: `{"data":{"children":[{"name":"a","children":[{"name":"a1"}]},{"name":"b","children":[]}]}}`,
+		},
+		{
+			name: "times are RFC 3339 in UTC",
+			req:  graphRequest{Query: `{ modified }`},
+			want: `{"data":{"modified":"2026-01-02T02:04:05Z"}}`,
+		},
+		{
+			name: "fragments and inline fragments merge",
+			req:  graphRequest{Query: `{ ...F ... on Node { size } ... on Other { name } } fragment F on Node { name size }`},
+			want: `{"data":{"name":"root","size":0}}`,
+		},
+		{
+			name: "variables, defaults and directives",
+			req:  graphRequest{Query: `query($n: String = "b", $skip: Boolean!) { child(name: $n) { name size @skip(if: $skip) } name @include(if: false) }`, Variables: map[string]interface{}{"skip": true}},
+			want: `{"data":{"child":{"name":"b"}}}`,
+		},
+		{
+			name: "JSON numbers are accepted as integers",
+			req:  graphRequest{Query: `query($f: Int) { children(first: $f) { name } }`, Variables: map[string]interface{}{"f": float64(1)}},
+			want: `{"data":{"children":[{"name":"a"}]}}`,
+		},
+		{
+			name: "an operation is picked by name",
+			req:  graphRequest{Query: `query A { name } query B { size }`, OperationName: "B"},
+			want: `{"data":{"size":0}}`,
+		},
+		{
+			name: "unknown fields are errors with a path",
+			req:  graphRequest{Query: `{ child(name: "a") { bogus } name }`},
+			want: `{"data":{"child":{"bogus":null},"name":"root"},"errors":[{"message":"cannot query field \"bogus\" on type Node","locations":[{"line":1,"column":22}],"path":["child","bogus"]}]}`,
+		},
+		{
+			name: "bad arguments are errors",
+			req:  graphRequest{Query: `{ children(first: "x") { name } }`},
+			want: `{"data":{"children":null},"errors":[{"message":"argument \"first\" must be a 32-bit integer","locations":[{"line":1,"column":3}],"path":["children"]}]}`,
+		},
+		{
+			name: "objects need subfields",
+			req:  graphRequest{Query: `{ child(name: "a") }`},
+			want: `{"data":{"child":null},"errors":[{"message":"field \"child\" of type Node must have a selection of subfields","locations":[{"line":1,"column":3}],"path":["child"]}]}`,
+		},
+		{
+			name: "scalars have no subfields",
+			req:  graphRequest{Query: `{ name { x } }`},
+			want: `{"data":{"name":null},"errors":[{"message":"field \"name\" of Node is a scalar and has no subfields","locations":[{"line":1,"column":3}],"path":["name"]}]}`,
+		},
+		{
+			name: "unknown fragments fail the query",
+			req:  graphRequest{Query: `{ ...Missing }`},
+			want: `{"errors":[{"message":"unknown fragment \"Missing\"","locations":[{"line":1,"column":3}]}]}`,
+		},
+		{
+			name: "required variables",
+			req:  graphRequest{Query: `query($x: Int!) { name }`},
+			want: `{"errors":[{"message":"variable $x of type Int! is required","locations":[{"line":1,"column":1}]}]}`,
+		},
+		{
+			name: "mutations are refused",
+			req:  graphRequest{Query: `mutation { name }`},
+			want: `{"errors":[{"message":"only queries are supported, not mutations","locations":[{"line":1,"column":1}]}]}`,
+		},
+		{
+			name: "several operations need a name",
+			req:  graphRequest{Query: `query A { name } query B { size }`},
+			want: `{"errors":[{"message":"operationName is required when the document has several operations"}]}`,
+		},
+		{
+			name: "syntax errors have a location",
+			req:  graphRequest{Query: `{ name`},
+			want: `{"errors":[{"message":"syntax error at 1:7: expected a name, found the end of the query","locations":[{"line":1,"column":7}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(executeGraphQL(testTree(), tt.req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("executeGraphQL(%q)\n got %s\nwant %s", tt.req.Query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteGraphQLLimits(t *testing.T) {
+	deep := &testNode{name: "leaf"}
+	for i := 0; i < maxGraphQLDepth+2; i++ {
+		deep = &testNode{name: fmt.Sprint(i), children: []*testNode{deep}}
+	}
+	query := "{ " + strings.Repeat("children { ", maxGraphQLDepth+1) + "name" + strings.Repeat(" }", maxGraphQLDepth+1) + " }"
+	resp := executeGraphQL(deep, graphRequest{Query: query})
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "nested more than") {
+		t.Errorf("a query %d levels deep got errors %+v", maxGraphQLDepth+1, resp.Errors)
+	}
+
+	wide := &testNode{name: "wide"}
+	for i := 0; i < 300; i++ {
+		wide.children = append(wide.children, &testNode{name: fmt.Sprint(i)})
+	}
+	for _, c := range wide.children {
+		c.children = wide.children
+	}
+	resp = executeGraphQL(wide, graphRequest{Query: `{ children { children { name size } } }`})
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "more than") {
+		t.Errorf("a query resolving %d fields got errors %+v", 300*300*2, resp.Errors)
+	}
+}
+
+func FuzzParseGraphQL(f *testing.F) {
+	for _, seed := range []string{
+		`{ name }`,
+		`query Q($p: String = "x", $n: [Int!]!) { child(name: $p) { name } }`,
+		`{ ...F ... on Node @skip(if: $s) { size } } fragment F on Node { a: name }`,
+		`{ child(name: """block \""" x""") { children(first: 1, l: [1, 2.5, {k: v}]) { name } } }`,
+		"{ child(name: \"\\u00e9\") }",
+		`mutation { name }`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, query string) {
+		doc, err := parseGraphQL(query)
+		if err != nil {
+			return
+		}
+		if len(doc.operations) == 0 {
+			t.Fatalf("parseGraphQL(%q) has no operations and no error", query)
+		}
+		// Whatever parses has to execute without panicking
+		resp := executeGraphQL(testTree(), graphRequest{Query: query, OperationName: doc.operations[0].name})
+		if _, err := json.Marshal(resp); err != nil {
+			t.Fatalf("executeGraphQL(%q) doesn't marshal: %v", query, err)
+		}
+	})
+}
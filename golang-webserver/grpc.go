@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Watch method of events.proto, served with the gRPC wire format by
+// hand since there is no gRPC library among the dependencies. gRPC runs over
+// HTTP/2, which the server only speaks on HTTPS listeners.
+
+// grpcWatchPath is the HTTP path of the Watch method
+const grpcWatchPath = "/imageserver.v1.Changes/Watch"
+
+// gRPC status codes
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnauthenticated  = 16
+)
+
+// maxGRPCRequest bounds the WatchRequest message
+const maxGRPCRequest = 4096
+
+// watchRequest is the WatchRequest message
+type watchRequest struct {
+	path    string
+	afterID uint64
+}
+
+// grpcHandler serves the Watch method, streaming ChangeEvent messages. Like
+// GET /api/events it only sends the changes the client may list.
+func (f *changeFeed) grpcHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC clients only", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		req, err := readWatchRequest(r.Body)
+		if err != nil {
+			code := grpcInvalidArgument
+			if errors.Is(err, errGRPCCompressed) {
+				code = grpcUnimplemented
+			}
+			grpcStatus(w, code, err.Error())
+			return
+		}
+		folder := path.Clean("/" + req.path)
+		access := newEventAccess(config, r)
+		switch access.check(folder) {
+		case http.StatusNotFound:
+			grpcStatus(w, grpcNotFound, "no such folder")
+			return
+		case http.StatusUnauthorized:
+			grpcStatus(w, grpcUnauthenticated, "an API key is required")
+			return
+		case http.StatusForbidden:
+			grpcStatus(w, grpcPermissionDenied, "the API key doesn't cover the folder")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			grpcStatus(w, grpcInternal, "streaming not supported")
+			return
+		}
+		id := req.afterID
+		if id == 0 {
+			id = f.resumeID("")
+		}
+
+		liftReadDeadline(r)
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		err = f.stream(r.Context(), id, time.Time{}, access.visible(folder), func(e *changeEvent) error {
+			if _, err := w.Write(grpcMessage(e.protobuf())); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}, func() error { return nil })
+		if err != nil {
+			grpcStatus(w, grpcInternal, err.Error())
+			return
+		}
+		grpcStatus(w, grpcOK, "")
+	})
+}
+
+// grpcStatus sets the status trailers of the response
+func grpcStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		// The message is percent encoded
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+	}
+}
+
+var errGRPCCompressed = errors.New("compressed requests aren't supported")
+
+// readWatchRequest reads the length-prefixed WatchRequest of a call
+func readWatchRequest(body io.Reader) (watchRequest, error) {
+	var req watchRequest
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return req, fmt.Errorf("reading the request: %v", err)
+	}
+	if prefix[0] != 0 {
+		return req, errGRPCCompressed
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCRequest {
+		return req, fmt.Errorf("the request is larger than %d bytes", maxGRPCRequest)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return req, fmt.Errorf("reading the request: %v", err)
+	}
+
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return req, errors.New("malformed request")
+		}
+		msg = msg[n:]
+		field, wire := key>>3, key&7
+		var value uint64
+		var bytes []byte
+		switch wire {
+		case 0:
+			if value, n = binary.Uvarint(msg); n <= 0 {
+				return req, errors.New("malformed request")
+			}
+			msg = msg[n:]
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return req, errors.New("malformed request")
+			}
+			msg = msg[size:]
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return req, errors.New("malformed request")
+			}
+			bytes, msg = msg[n:n+int(length)], msg[n+int(length):]
+		default:
+			return req, errors.New("malformed request")
+		}
+		// Unknown fields are skipped, as protobuf requires
+		switch {
+		case field == 1 && wire == 2:
+			req.path = string(bytes)
+		case field == 2 && wire == 0:
+			req.afterID = value
+		}
+	}
+	return req, nil
+}
+
+// protobuf encodes e as a ChangeEvent message
+func (e *changeEvent) protobuf() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, e.ID)
+	b = appendProtoString(b, 2, e.Action)
+	b = appendProtoString(b, 3, e.Path)
+	b = appendProtoVarint(b, 4, uint64(e.Size))
+	if e.Modified != nil {
+		b = appendProtoVarint(b, 5, uint64(e.Modified.UnixMilli()))
+	}
+	b = appendProtoVarint(b, 6, uint64(e.Time.UnixMilli()))
+	return b
+}
+
+// appendProtoVarint appends a varint field, leaving out zero as proto3 does
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(field)<<3)]...)
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(field)<<3|2)]...)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(s)))]...)
+	return append(b, s...)
+}
+
+// grpcMessage frames msg as an uncompressed gRPC message
+func grpcMessage(msg []byte) []byte {
+	framed := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(msg)))
+	return append(framed, msg...)
+}
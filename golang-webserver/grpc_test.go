@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeWatchRequest frames req the way a gRPC client sends it
+func encodeWatchRequest(req watchRequest) []byte {
+	return grpcMessage(appendProtoVarint(appendProtoString(nil, 1, req.path), 2, req.afterID))
+}
+
+func TestReadWatchRequest(t *testing.T) {
+	frame := func(flag byte, msg []byte) []byte {
+		b := []byte{flag, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+		return append(b, msg...)
+	}
+	tests := []struct {
+		name    string
+		body    []byte
+		want    watchRequest
+		wantErr string
+	}{
+		{name: "empty message", body: frame(0, nil)},
+		{name: "path", body: frame(0, []byte("\x0a\x04/a/b")), want: watchRequest{path: "/a/b"}},
+		{name: "path and after_id", body: frame(0, []byte("\x0a\x01/\x10\xac\x02")), want: watchRequest{path: "/", afterID: 300}},
+		{name: "fields in any order", body: frame(0, []byte("\x10\x07\x0a\x02/x")), want: watchRequest{path: "/x", afterID: 7}},
+		{name: "last value wins", body: frame(0, []byte("\x10\x01\x10\x02")), want: watchRequest{afterID: 2}},
+		{
+			name: "unknown fields of every wire type are skipped",
+			body: frame(0, []byte("\x18\x05\x21\x01\x02\x03\x04\x05\x06\x07\x08\x2a\x03abc\x35\x01\x02\x03\x04\x0a\x02/y")),
+			want: watchRequest{path: "/y"},
+		},
+		{name: "known field with the wrong wire type", body: frame(0, []byte("\x08\x01\x12\x01x")), want: watchRequest{}},
+		{name: "the stream only has to hold one message", body: append(frame(0, []byte("\x10\x01")), 0xFF, 0xFF), want: watchRequest{afterID: 1}},
+
+		{name: "no prefix", body: nil, wantErr: "reading the request"},
+		{name: "short prefix", body: []byte{0, 0, 0}, wantErr: "reading the request"},
+		{name: "too large", body: frame(0, make([]byte, maxGRPCRequest+1)), wantErr: "larger than"},
+		{name: "truncated message", body: frame(0, []byte("\x0a\x04/a/b"))[:8], wantErr: "reading the request"},
+		{name: "truncated varint", body: frame(0, []byte("\x10\xac")), wantErr: "malformed"},
+		{name: "truncated key", body: frame(0, []byte("\x80")), wantErr: "malformed"},
+		{name: "length past the end", body: frame(0, []byte("\x0a\x05/a")), wantErr: "malformed"},
+		{name: "huge length", body: frame(0, []byte("\x0a\xff\xff\xff\xff\xff\xff\xff\xff\x7f")), wantErr: "malformed"},
+		{name: "truncated fixed64", body: frame(0, []byte("\x19\x01\x02")), wantErr: "malformed"},
+		{name: "groups", body: frame(0, []byte("\x1b\x1c")), wantErr: "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readWatchRequest(bytes.NewReader(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readWatchRequest() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readWatchRequest() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readWatchRequest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	compressed := frame(1, nil)
+	if _, err := readWatchRequest(bytes.NewReader(compressed)); !errors.Is(err, errGRPCCompressed) {
+		t.Errorf("a compressed request got %v, want errGRPCCompressed", err)
+	}
+}
+
+// decodeProto splits a message into its fields, as varints or bytes
+func decodeProto(t *testing.T, msg []byte) map[uint64]interface{} {
+	t.Helper()
+	fields := map[uint64]interface{}{}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			t.Fatalf("malformed key in %x", msg)
+		}
+		msg = msg[n:]
+		value, n := binary.Uvarint(msg)
+		if n <= 0 {
+			t.Fatalf("malformed value in %x", msg)
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0:
+			fields[key>>3] = value
+		case 2:
+			fields[key>>3] = string(msg[:value])
+			msg = msg[value:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestChangeEventProtobuf(t *testing.T) {
+	modified := time.UnixMilli(1767225600123)
+	seen := time.UnixMilli(1767225601456)
+	tests := []struct {
+		name  string
+		event changeEvent
+		want  map[uint64]interface{}
+	}{
+		{
+			name:  "changed file",
+			event: changeEvent{ID: 300, Time: seen, fileEvent: fileEvent{Action: "changed", Path: "/a/é.png", Size: 1 << 40, Modified: &modified}},
+			want:  map[uint64]interface{}{1: uint64(300), 2: "changed", 3: "/a/é.png", 4: uint64(1 << 40), 5: uint64(1767225600123), 6: uint64(1767225601456)},
+		},
+		{
+			name:  "zero values are left out",
+			event: changeEvent{ID: 1, Time: seen, fileEvent: fileEvent{Action: "deleted", Path: "/a"}},
+			want:  map[uint64]interface{}{1: uint64(1), 2: "deleted", 3: "/a", 6: uint64(1767225601456)},
+		},
+		{
+			name:  "resync",
+			event: changeEvent{ID: 9, Time: seen, fileEvent: fileEvent{Action: "resync"}},
+			want:  map[uint64]interface{}{1: uint64(9), 2: "resync", 6: uint64(1767225601456)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeProto(t, tt.event.protobuf())
+			if len(got) != len(tt.want) {
+				t.Fatalf("protobuf() has fields %v, want %v", got, tt.want)
+			}
+			for field, want := range tt.want {
+				if got[field] != want {
+					t.Errorf("field %d = %v, want %v", field, got[field], want)
+				}
+			}
+		})
+	}
+
+	msg := grpcMessage([]byte("abc"))
+	if !bytes.Equal(msg, []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}) {
+		t.Errorf("grpcMessage() = %x", msg)
+	}
+}
+
+func FuzzReadWatchRequest(f *testing.F) {
+	f.Add(encodeWatchRequest(watchRequest{}))
+	f.Add(encodeWatchRequest(watchRequest{path: "/a/b", afterID: 1 << 60}))
+	f.Add([]byte("\x00\x00\x00\x00\x0b\x18\x05\x2a\x03abc\x0a\x02/y"))
+	f.Add([]byte("\x01\x00\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, err := readWatchRequest(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		// What was read encodes back to the same request
+		again, err := readWatchRequest(bytes.NewReader(encodeWatchRequest(req)))
+		if err != nil || again != req {
+			t.Fatalf("%+v encoded and read back as %+v, %v", req, again, err)
+		}
+	})
+}
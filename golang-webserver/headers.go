@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+// HeaderRule adds response headers to the paths matching a glob
+type HeaderRule struct {
+	// Path is a glob over the URL path, e.g. /downloads/** or /embed/*.jpg.
+	// * and ? match within a path element, ** any number of elements.
+	Path string `json:"path"`
+	// Set are the headers to set, replacing any the server would send
+	Set map[string]string `json:"set"`
+}
+
+func validateHeaderRules(rules []HeaderRule) []error {
+	var errs []error
+	for i, rule := range rules {
+		label := fmt.Sprintf("headers[%d]", i)
+		if !strings.HasPrefix(rule.Path, "/") {
+			errs = append(errs, fmt.Errorf("%s.path must start with /, got %q", label, rule.Path))
+		} else if _, err := path.Match(rule.Path, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s.path %q is not a valid glob: %v", label, rule.Path, err))
+		}
+		if len(rule.Set) == 0 {
+			errs = append(errs, fmt.Errorf("%s.set cannot be empty", label))
+		}
+		for name, value := range rule.Set {
+			if name == "" || strings.ContainsAny(name, " :\r\n") {
+				errs = append(errs, fmt.Errorf("%s.set has an invalid header name %q", label, name))
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				errs = append(errs, fmt.Errorf("%s.set[%q] cannot contain line breaks", label, name))
+			}
+		}
+	}
+	return errs
+}
+
+// globMatch reports whether the slash separated urlPath matches pattern, case
+// insensitively since the paths are Windows file names
+func globMatch(pattern, urlPath string) bool {
+	return matchElems(strings.Split(strings.ToLower(pattern), "/"), strings.Split(strings.ToLower(urlPath), "/"))
+}
+
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(elems); i >= 0; i-- {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// headerRules sets the headers of every rule matching the request path, later
+// rules overriding earlier ones. The path is matched as prefixes match it,
+// so other spellings of the same file below folder get the same headers.
+func headerRules(folder string, rules []HeaderRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := matchPath(folder, r.URL.Path)
+		for _, rule := range rules {
+			if globMatch(nfc(rule.Path), p) {
+				for name, value := range rule.Set {
+					w.Header().Set(textproto.CanonicalMIMEHeaderKey(name), value)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
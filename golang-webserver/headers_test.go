@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderRuleAliases(t *testing.T) {
+	handler := headerRules("", []HeaderRule{
+		{Path: "/downloads/**", Set: map[string]string{"Content-Disposition": "attachment"}},
+		{Path: "/embed/*.jpg", Set: map[string]string{"Content-Security-Policy": "default-src 'none'"}},
+	}, http.NotFoundHandler())
+	for _, test := range []struct {
+		url, header string
+	}{
+		{"/downloads/a.jpg", "Content-Disposition"},
+		{"/DOWNLOADS/a.jpg", "Content-Disposition"},
+		{"/downloads./a.jpg", "Content-Disposition"},
+		{"/downloads%20/a.jpg", "Content-Disposition"},
+		{"/downloads/sub/a.jpg", "Content-Disposition"},
+		{"/embed/a.jpg", "Content-Security-Policy"},
+		{"/embed/a.JPG.", "Content-Security-Policy"},
+		{"/embed./a.jpg%20", "Content-Security-Policy"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if w.Header().Get(test.header) == "" {
+			t.Errorf("%s was served without %s", test.url, test.header)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/embed/a.png", nil))
+	if w.Header().Get("Content-Security-Policy") != "" {
+		t.Error("/embed/a.png got the header of *.jpg")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localeFiles are the message catalogs of the pages, one JSON object of
+// message keys to texts per language
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLanguage is used when neither the config nor the browser names a
+// language there is a catalog for, and for the messages a catalog lacks
+const defaultLanguage = "en"
+
+// catalogs maps the languages to their messages
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	names, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := map[string]map[string]string{}
+	for _, entry := range names {
+		data, err := localeFiles.ReadFile("locales/" + entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", entry.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))] = messages
+	}
+	return catalogs
+}
+
+// languages returns the languages there are catalogs for, sorted
+func languages() []string {
+	var langs []string
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func validateLanguage(lang string) error {
+	if lang == "" {
+		return nil
+	}
+	if _, ok := catalogs[lang]; !ok {
+		return fmt.Errorf("language must be one of %s, got %q", strings.Join(languages(), ", "), lang)
+	}
+	return nil
+}
+
+// matchLanguage returns the language of the Accept-Language header that
+// there is a catalog for, by preference. de-CH matches de.
+func matchLanguage(acceptLanguage string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag != "" && tag != "*" && q > 0 {
+			choices = append(choices, choice{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if _, ok := catalogs[c.lang]; ok {
+			return c.lang
+		}
+		primary, _, _ := strings.Cut(c.lang, "-")
+		if _, ok := catalogs[primary]; ok {
+			return primary
+		}
+	}
+	return defaultLanguage
+}
+
+// messages are the texts of the pages in one language
+type messages struct {
+	Lang string
+}
+
+// T returns the text for key, formatted with args, falling back to English
+func (m messages) T(key string, args ...interface{}) string {
+	text, ok := catalogs[m.Lang][key]
+	if !ok {
+		text = catalogs[defaultLanguage][key]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// Has reports whether there is a text for key
+func (m messages) Has(key string) bool {
+	_, ok := catalogs[defaultLanguage][key]
+	return ok
+}
+
+// pageContextKey carries the language and the theme of the pages answering a request
+type pageContextKey struct{}
+
+type pageContext struct {
+	text  messages
+	theme pageTheme
+}
+
+// pageText returns the messages for the pages answering r, in the language
+// pageSettings picked
+func pageText(r *http.Request) messages {
+	if c, ok := r.Context().Value(pageContextKey{}).(pageContext); ok {
+		return c.text
+	}
+	return messages{Lang: defaultLanguage}
+}
+
+// requestTheme returns the theme of the pages answering r
+func requestTheme(r *http.Request) pageTheme {
+	if c, ok := r.Context().Value(pageContextKey{}).(pageContext); ok {
+		return c.theme
+	}
+	return newPageTheme(nil)
+}
+
+// errorPageTemplate is shown to browsers instead of the plain text errors
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!doctype html>
+<html lang="{{.Text.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>{{.Title}}</title>
+<style>
+{{.Theme.Colors}}
+body{font-family:system-ui,sans-serif;margin:0;background:var(--bg);color:var(--fg)}
+header{display:flex;align-items:center;gap:1em;padding:1em 2em;background:var(--surface);border-bottom:1px solid var(--border)}
+header img{max-height:48px}
+header strong{font-size:1.2em}
+main{max-width:40em;margin:4em auto;padding:0 2em}
+h1{font-size:1.4em}
+p{color:var(--muted)}
+a{color:var(--accent)}
+{{.Theme.CSS}}
+</style>
+</head>
+<body>
+{{if or .Theme.Logo .Theme.Title}}<header>{{if .Theme.Logo}}<img src="{{.Theme.Logo}}" alt="">{{end}}{{if .Theme.Title}}<strong>{{.Theme.Title}}</strong>{{end}}</header>{{end}}
+<main>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</main>
+</body>
+</html>
+`))
+
+type errorPageData struct {
+	Text    messages
+	Theme   pageTheme
+	Title   string
+	Message string
+}
+
+// pageSettings picks the language of the pages, language or else the one
+// the browser prefers, passes it on with the theme, and replaces the plain
+// text errors browsers get with a page in them. The API keeps its plain text
+// errors.
+func pageSettings(language string, theme *ThemeConfig, next http.Handler) http.Handler {
+	style := newPageTheme(theme)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := language
+		if lang == "" {
+			lang = matchLanguage(r.Header.Get("Accept-Language"))
+		}
+		page := pageContext{text: messages{Lang: lang}, theme: style}
+		r = r.WithContext(context.WithValue(r.Context(), pageContextKey{}, page))
+		if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/debug/") || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&errorPageWriter{ResponseWriter: w, r: r, page: page}, r)
+	})
+}
+
+// errorPageWriter swaps the body of an http.Error response for the error page
+type errorPageWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	page        pageContext
+	wroteHeader bool
+	// replaced is set once the error page is written, the handler's body is dropped
+	replaced bool
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status < http.StatusBadRequest || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.replaced = true
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+	if w.r.Method == http.MethodHead {
+		return
+	}
+	text := w.page.text
+	data := errorPageData{Text: text, Theme: w.page.theme, Title: text.T("error.title"), Message: text.T("error.text", status)}
+	if key := fmt.Sprintf("error.%d", status); text.Has(key + ".title") {
+		data.Title, data.Message = text.T(key+".title"), text.T(key+".text")
+	}
+	errorPageTemplate.Execute(w.ResponseWriter, data)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps io.Copy going to the underlying writer and its sendfile
+func (w *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return io.Copy(io.Discard, src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Hijack passes WebSocket upgrades through
+func (w *errorPageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// Flush passes flushes through, for responses streamed to the browser
+func (w *errorPageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
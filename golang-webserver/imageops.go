@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxImageOps bounds the operations one ?ops= chain runs
+	maxImageOps = 10
+	// maxResizeSize is the largest box resize: fits images in
+	maxResizeSize = 10000
+)
+
+// imageOp is one operation of an ?ops= chain: rotate:<degrees> clockwise by
+// a multiple of 90, crop:<x>x<y>x<width>x<height>, resize:<pixels> fitting
+// the image in a box without enlarging it, or grayscale
+type imageOp struct {
+	name string
+	args []int
+}
+
+var errCropOutside = errors.New("the crop is outside the image")
+
+// String returns the normalized form of op, which the cache keys use
+func (op imageOp) String() string {
+	if len(op.args) == 0 {
+		return op.name
+	}
+	args := make([]string, len(op.args))
+	for i, n := range op.args {
+		args[i] = strconv.Itoa(n)
+	}
+	return op.name + ":" + strings.Join(args, "x")
+}
+
+// parseOps parses an ?ops= chain such as rotate:90,crop:0x0x400x400,grayscale.
+// Rotations are normalized to 90, 180 or 270, full turns are dropped.
+func parseOps(s string) ([]imageOp, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(strings.ToLower(s), ",")
+	if len(parts) > maxImageOps {
+		return nil, fmt.Errorf("ops has %d operations, the limit is %d", len(parts), maxImageOps)
+	}
+	var ops []imageOp
+	for _, part := range parts {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), ":")
+		var args []int
+		if arg != "" {
+			for _, a := range strings.Split(arg, "x") {
+				n, err := strconv.Atoi(a)
+				if err != nil {
+					return nil, fmt.Errorf("operation %q has a malformed argument", part)
+				}
+				args = append(args, n)
+			}
+		}
+		switch {
+		case name == "rotate" && len(args) == 1 && args[0]%90 == 0:
+			if args[0] = (args[0]%360 + 360) % 360; args[0] == 0 {
+				continue
+			}
+		case name == "crop" && len(args) == 4 && args[0] >= 0 && args[1] >= 0 && args[2] > 0 && args[3] > 0:
+		case name == "resize" && len(args) == 1 && args[0] > 0 && args[0] <= maxResizeSize:
+		case name == "grayscale" && len(args) == 0:
+		default:
+			return nil, fmt.Errorf("operation %q isn't supported, use rotate:90|180|270, crop:XxYxWxH, resize:1-%d or grayscale", part, maxResizeSize)
+		}
+		ops = append(ops, imageOp{name, args})
+	}
+	return ops, nil
+}
+
+// formatOps returns the normalized form of ops
+func formatOps(ops []imageOp) string {
+	s := make([]string, len(ops))
+	for i, op := range ops {
+		s[i] = op.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// applyOps runs ops on img in order. None of them makes the image larger.
+func applyOps(img image.Image, ops []imageOp) (image.Image, error) {
+	for _, op := range ops {
+		b := img.Bounds()
+		switch op.name {
+		case "rotate":
+			img = rotate(img, op.args[0])
+		case "crop":
+			r := image.Rect(op.args[0], op.args[1], op.args[0]+op.args[2], op.args[1]+op.args[3]).Add(b.Min).Intersect(b)
+			if r.Empty() {
+				return nil, errCropOutside
+			}
+			dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+			draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+			img = dst
+		case "resize":
+			if w, h := fitSize(b.Dx(), b.Dy(), op.args[0]); w != b.Dx() || h != b.Dy() {
+				img = thumbnail(img, w, h)
+			}
+		case "grayscale":
+			dst := image.NewGray(b)
+			draw.Draw(dst, b, img, b.Min, draw.Src)
+			img = dst
+		}
+	}
+	return img, nil
+}
+
+// opsSize returns the size an image of w x h has after ops, or the error
+// applyOps would fail with, without decoding it
+func opsSize(w, h int, ops []imageOp) (int, int, error) {
+	for _, op := range ops {
+		switch op.name {
+		case "rotate":
+			if op.args[0] != 180 {
+				w, h = h, w
+			}
+		case "crop":
+			r := image.Rect(op.args[0], op.args[1], op.args[0]+op.args[2], op.args[1]+op.args[3]).Intersect(image.Rect(0, 0, w, h))
+			if r.Empty() {
+				return 0, 0, errCropOutside
+			}
+			w, h = r.Dx(), r.Dy()
+		case "resize":
+			w, h = fitSize(w, h, op.args[0])
+		}
+	}
+	return w, h, nil
+}
+
+// rotate turns img clockwise by degrees, 90, 180 or 270
+func rotate(img image.Image, degrees int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if degrees != 180 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.At(b.Min.X+x, b.Min.Y+y)
+			switch degrees {
+			case 90:
+				dst.Set(h-1-y, x, c)
+			case 180:
+				dst.Set(w-1-x, h-1-y, c)
+			case 270:
+				dst.Set(y, w-1-x, c)
+			}
+		}
+	}
+	return dst
+}
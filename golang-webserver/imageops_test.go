@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseOps(t *testing.T) {
+	for _, test := range []struct {
+		ops, want string
+	}{
+		{"rotate:90,crop:100x100x400x400,resize:800,grayscale", "rotate:90,crop:100x100x400x400,resize:800,grayscale"},
+		{"Rotate:-90, GRAYSCALE", "rotate:270,grayscale"},
+		{"rotate:360,resize:10", "resize:10"},
+		{"rotate:45", ""},
+		{"crop:1x2x3", ""},
+		{"crop:0x0x0x10", ""},
+		{"resize:0", ""},
+		{"resize:big", ""},
+		{"grayscale:1", ""},
+		{"sharpen", ""},
+		{"grayscale,grayscale,grayscale,grayscale,grayscale,grayscale,grayscale,grayscale,grayscale,grayscale,grayscale", ""},
+	} {
+		ops, err := parseOps(test.ops)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q parsed as %q", test.ops, formatOps(ops))
+			}
+			continue
+		}
+		if err != nil || formatOps(ops) != test.want {
+			t.Errorf("%q parsed as %q, %v, want %q", test.ops, formatOps(ops), err, test.want)
+		}
+	}
+}
+
+func TestOutputOps(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	handler := outputOptions(http.Dir(dir), true, http.FileServer(http.Dir(dir)))
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	// The operations run in order: 200x400, then 100x150, then fitted in 50
+	w := get("/a.png?ops=rotate:90,crop:0x0x100x150,resize:50,grayscale")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("got %d, %s", w.Code, w.Body)
+	}
+	config, err := png.DecodeConfig(w.Body)
+	if err != nil || config.Width != 33 || config.Height != 50 {
+		t.Errorf("the result is %dx%d, %v", config.Width, config.Height, err)
+	}
+	// Equivalent chains share the ETag and cached result
+	etag := w.Header().Get("ETag")
+	if other := get("/a.png?ops=ROTATE:450,crop:0x0x100x150,resize:50,grayscale").Header().Get("ETag"); other != etag {
+		t.Errorf("equivalent chains got ETags %s and %s", etag, other)
+	}
+
+	if w := get("/a.png?ops=crop:500x0x10x10"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("a crop outside the image got %d", w.Code)
+	}
+	if w := get("/a.png?ops=sharpen"); w.Code != http.StatusBadRequest {
+		t.Errorf("an unknown operation got %d", w.Code)
+	}
+}
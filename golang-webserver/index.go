@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// indexProgressInterval is how often the event log hears about a build in progress
+	indexProgressInterval = time.Minute
+	// indexRefreshDelay collects the changes of a copy before directories are read again
+	indexRefreshDelay = time.Second
+	// indexMaxPending is how many changed directories are refreshed one by one,
+	// beyond that the index is rebuilt
+	indexMaxPending = 10000
+)
+
+// IndexConfig keeps the folder's directory listings in memory, so listings
+// of large folders don't read the directory from the disk or share
+type IndexConfig struct {
+	// Concurrency is how many directories are read at the same time while building, 8 by default
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+func (c *IndexConfig) validate() []error {
+	var errs []error
+	if c.Concurrency < 0 {
+		errs = append(errs, fmt.Errorf("index.concurrency cannot be negative"))
+	}
+	return errs
+}
+
+func (c *IndexConfig) concurrency() int {
+	if c.Concurrency == 0 {
+		return 8
+	}
+	return c.Concurrency
+}
+
+// indexEntry is the os.FileInfo of a file or directory in the index
+type indexEntry struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (e *indexEntry) Name() string       { return e.name }
+func (e *indexEntry) Size() int64        { return e.size }
+func (e *indexEntry) Mode() fs.FileMode  { return e.mode }
+func (e *indexEntry) ModTime() time.Time { return e.modTime }
+func (e *indexEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e *indexEntry) Sys() interface{}   { return nil }
+
+// folderIndex holds the entries of every directory below the folder, keyed
+// by cacheKey of their URL path. It is built in the background when the
+// service starts and kept up to date from the folder's change notifications;
+// until the first build is done, listings are read from the folder.
+type folderIndex struct {
+	config  *IndexConfig
+	folder  string
+	skipGit bool
+	elog    debug.Log
+	signal  chan struct{}
+
+	// scannedDirs and scannedFiles count the progress of the build running
+	scannedDirs  int64
+	scannedFiles int64
+
+	mu    sync.RWMutex
+	dirs  map[string][]indexEntry
+	files int
+	// built is when the last build finished, zero while the first one runs
+	built     time.Time
+	buildTime time.Duration
+	building  bool
+	// pending are the directories to read again, rebuild replaces them all
+	pending map[string]bool
+	rebuild bool
+}
+
+// newFolderIndex returns nil when config is nil. skipGit leaves .git out, the
+// folder is a Git working tree then.
+func newFolderIndex(config *IndexConfig, folder string, skipGit bool, elog debug.Log) *folderIndex {
+	if config == nil {
+		return nil
+	}
+	return &folderIndex{config: config, folder: folder, skipGit: skipGit, elog: elog, signal: make(chan struct{}, 1), pending: map[string]bool{}}
+}
+
+// readDir returns the entries of the directory at the URL path rel
+func (x *folderIndex) readDir(rel string) ([]indexEntry, error) {
+	dirEntries, err := os.ReadDir(filepath.Join(x.folder, filepath.FromSlash(rel)))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]indexEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		if x.skipGit && rel == "/" && strings.EqualFold(d.Name(), ".git") {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		entries = append(entries, indexEntry{name: info.Name(), size: info.Size(), mode: info.Mode(), modTime: info.ModTime()})
+	}
+	return entries, nil
+}
+
+// indexTree is a part of the index read from the folder
+type indexTree struct {
+	dirs   map[string][]indexEntry
+	files  int
+	failed []string
+}
+
+// scan reads the directory at the URL path root and everything below it
+// from workers goroutines, counting its progress in scannedDirs and
+// scannedFiles
+func (x *folderIndex) scan(ctx context.Context, root string, workers int) indexTree {
+	tree := indexTree{dirs: map[string][]indexEntry{}}
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	queue := []string{root}
+	active := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			for {
+				for len(queue) == 0 && active > 0 && ctx.Err() == nil {
+					cond.Wait()
+				}
+				if len(queue) == 0 || ctx.Err() != nil {
+					// Done, wake up the others so they see it too
+					cond.Broadcast()
+					return
+				}
+				// Depth first keeps the queue short in wide trees
+				rel := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+				active++
+				mu.Unlock()
+				entries, err := x.readDir(rel)
+				mu.Lock()
+				active--
+				if err != nil {
+					tree.failed = append(tree.failed, fmt.Sprintf("%s: %v", rel, err))
+				} else {
+					files := 0
+					for _, e := range entries {
+						if e.IsDir() {
+							queue = append(queue, path.Join(rel, e.name))
+						} else {
+							files++
+						}
+					}
+					tree.dirs[cacheKey(rel)] = entries
+					tree.files += files
+					atomic.AddInt64(&x.scannedDirs, 1)
+					atomic.AddInt64(&x.scannedFiles, int64(files))
+				}
+				cond.Broadcast()
+			}
+		}()
+	}
+	wg.Wait()
+	return tree
+}
+
+// build reads the whole folder and replaces the index with it
+func (x *folderIndex) build(ctx context.Context) {
+	atomic.StoreInt64(&x.scannedDirs, 0)
+	atomic.StoreInt64(&x.scannedFiles, 0)
+	x.mu.Lock()
+	x.building = true
+	first := x.built.IsZero()
+	x.mu.Unlock()
+	if first {
+		x.elog.Info(eventStorage, fmt.Sprintf("Indexing %s, listings are read from the folder until it is done", x.folder))
+	}
+
+	started := time.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(indexProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				x.elog.Info(eventStorage, fmt.Sprintf("Indexing %s: %d directories and %d files so far", x.folder, atomic.LoadInt64(&x.scannedDirs), atomic.LoadInt64(&x.scannedFiles)))
+			}
+		}
+	}()
+	tree := x.scan(ctx, "/", x.config.concurrency())
+	close(done)
+	if ctx.Err() != nil {
+		return
+	}
+
+	x.mu.Lock()
+	x.dirs, x.files = tree.dirs, tree.files
+	x.built, x.buildTime, x.building = time.Now(), time.Since(started), false
+	x.mu.Unlock()
+	msg := fmt.Sprintf("Indexed %s in %s: %d directories and %d files", x.folder, time.Since(started).Round(time.Second), len(tree.dirs), tree.files)
+	if len(tree.failed) > 0 {
+		x.elog.Warning(eventStorage, msg+fmt.Sprintf(", %d directories couldn't be read and are listed from the folder, e.g. %s", len(tree.failed), tree.failed[0]))
+		return
+	}
+	x.elog.Info(eventStorage, msg)
+}
+
+// refresh reads the directory at the URL path rel again, indexing the
+// directories that appeared in it and dropping those that went away
+func (x *folderIndex) refresh(ctx context.Context, rel string) {
+	entries, err := x.readDir(rel)
+	key := cacheKey(rel)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && rel != "/" {
+			x.mu.Lock()
+			x.removeTree(key)
+			x.mu.Unlock()
+		}
+		return
+	}
+
+	x.mu.Lock()
+	var added []string
+	present := map[string]bool{}
+	files := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			files++
+			continue
+		}
+		sub := path.Join(rel, e.name)
+		present[cacheKey(sub)] = true
+		if _, ok := x.dirs[cacheKey(sub)]; !ok {
+			added = append(added, sub)
+		}
+	}
+	for _, e := range x.dirs[key] {
+		if sub := cacheKey(path.Join(rel, e.name)); e.IsDir() && !present[sub] {
+			x.removeTree(sub)
+		}
+	}
+	x.files += files - countFiles(x.dirs[key])
+	x.dirs[key] = entries
+	x.mu.Unlock()
+
+	// New directories, e.g. a copied folder, are read without holding the lock
+	for _, sub := range added {
+		tree := x.scan(ctx, sub, 1)
+		x.mu.Lock()
+		for k, v := range tree.dirs {
+			x.files += countFiles(v) - countFiles(x.dirs[k])
+			x.dirs[k] = v
+		}
+		x.mu.Unlock()
+	}
+}
+
+func countFiles(entries []indexEntry) int {
+	n := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+// removeTree drops key and the directories below it, with x.mu held
+func (x *folderIndex) removeTree(key string) {
+	for k, entries := range x.dirs {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			x.files -= countFiles(entries)
+			delete(x.dirs, k)
+		}
+	}
+}
+
+// changed is the folder watcher's callback: name is the slash separated
+// path that changed, or "" when anything may have changed
+func (x *folderIndex) changed(name string) {
+	x.mu.Lock()
+	if name == "" || len(x.pending) >= indexMaxPending {
+		x.rebuild = true
+	} else {
+		x.pending[path.Dir("/"+name)] = true
+	}
+	x.mu.Unlock()
+	select {
+	case x.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Run builds the index and then applies the changes until ctx is done
+func (x *folderIndex) Run(ctx context.Context) {
+	for {
+		x.build(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-x.signal:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(indexRefreshDelay):
+			}
+			x.mu.Lock()
+			pending, rebuild := x.pending, x.rebuild
+			x.pending, x.rebuild = map[string]bool{}, false
+			x.mu.Unlock()
+			if rebuild {
+				break
+			}
+			for rel := range pending {
+				x.refresh(ctx, rel)
+			}
+		}
+	}
+}
+
+// entries returns the indexed entries of the directory at the URL path name,
+// false when the index isn't built yet or doesn't have it
+func (x *folderIndex) entries(name string) ([]indexEntry, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.built.IsZero() {
+		return nil, false
+	}
+	entries, ok := x.dirs[cacheKey(name)]
+	return entries, ok
+}
+
+// Status describes the index for /readyz
+func (x *folderIndex) Status() string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.built.IsZero() {
+		return fmt.Sprintf("building, %d directories and %d files so far", atomic.LoadInt64(&x.scannedDirs), atomic.LoadInt64(&x.scannedFiles))
+	}
+	status := fmt.Sprintf("ready, %d directories and %d files, built in %s", len(x.dirs), x.files, x.buildTime.Round(time.Second))
+	if x.building {
+		status += ", rebuilding"
+	}
+	return status
+}
+
+// readyHandler adds the index status to the folder's readiness. The service
+// is ready while the index builds, files are served meanwhile.
+func (x *folderIndex) readyHandler(monitor *folderMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		monitor.readyHandler(w, r)
+		fmt.Fprintf(w, "index: %s\n", x.Status())
+	}
+}
+
+// indexFS lists directories from the index once it is built
+type indexFS struct {
+	http.FileSystem
+	index *folderIndex
+}
+
+func (f indexFS) Open(name string) (http.File, error) {
+	file, err := f.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, ok := f.index.entries(path.Clean("/" + name))
+	if !ok {
+		return file, nil
+	}
+	if info, err := file.Stat(); err != nil || !info.IsDir() {
+		return file, nil
+	}
+	return &indexedDir{File: file, entries: entries}, nil
+}
+
+// indexedDir is a directory whose Readdir serves the indexed entries
+type indexedDir struct {
+	http.File
+	entries []indexEntry
+	offset  int
+}
+
+func (d *indexedDir) Readdir(count int) ([]fs.FileInfo, error) {
+	rest := d.entries[d.offset:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if len(rest) > count {
+			rest = rest[:count]
+		}
+	}
+	infos := make([]fs.FileInfo, len(rest))
+	for i := range rest {
+		infos[i] = &rest[i]
+	}
+	d.offset += len(rest)
+	return infos, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// latencySamples is how many of the most recent request durations the
+// percentiles are computed over
+const latencySamples = 2048
+
+// latencyWindow keeps the durations of the most recent requests
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	next    int
+	full    bool
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencySamples
+	if w.next == 0 {
+		w.full = true
+	}
+	w.mu.Unlock()
+}
+
+// percentile returns the duration that p (0 to 1) of the recent requests took at most
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = latencySamples
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.mu.Unlock()
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p*float64(n)+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// slowRequestLog logs requests taking longer than the threshold, which can
+// change while the server runs
+type slowRequestLog struct {
+	threshold int64 // time.Duration, 0 disables the log
+	elog      debug.Log
+}
+
+func newSlowRequestLog(elog debug.Log, thresholdMS int) *slowRequestLog {
+	l := &slowRequestLog{elog: elog}
+	l.SetThreshold(thresholdMS)
+	return l
+}
+
+// SetThreshold changes the threshold, it is safe to call while requests are served
+func (l *slowRequestLog) SetThreshold(ms int) {
+	atomic.StoreInt64(&l.threshold, int64(time.Duration(ms)*time.Millisecond))
+}
+
+// middleware logs slow requests with the time until the first byte, mostly
+// opening and reading the file from the disk or share, and the time spent
+// sending the response, mostly the client's bandwidth
+func (l *slowRequestLog) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		threshold := time.Duration(atomic.LoadInt64(&l.threshold))
+		if threshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		end := time.Now()
+		if end.Sub(start) < threshold || rec.isStream() {
+			return
+		}
+
+		firstByte := rec.firstByte
+		if firstByte.IsZero() {
+			firstByte = end
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		l.elog.Warning(eventHTTP, fmt.Sprintf("Slow request: %s %s from %s took %v (%v until the first byte, %v sending %d bytes), status %d",
+			r.Method, r.URL.Path, client, end.Sub(start).Round(time.Millisecond),
+			firstByte.Sub(start).Round(time.Millisecond), end.Sub(firstByte).Round(time.Millisecond), rec.bytes, rec.status))
+	})
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// graphqlPath is where the library API is served
+	graphqlPath = "/api/graphql"
+	// maxGraphQLBody bounds the body of a query
+	maxGraphQLBody = 1 << 20
+	// maxLibraryPage is the most entries files and folders return at a time
+	maxLibraryPage = 1000
+)
+
+// librarySchema is the schema of the library API, served by GET /api/graphql.
+// Sizes and counters are Float because GraphQL's Int is 32 bits.
+const librarySchema = `type Query {
+  "The folder at path, null when there is none"
+  folder(path: String = "/"): Folder
+  "The file at path, null when there is none"
+  file(path: String!): File
+  stats: Stats!
+}
+
+type Folder {
+  "The name, empty for the root"
+  name: String!
+  path: String!
+  url: String!
+  modified: String!
+  "The README.md, as written"
+  readme: String
+  "Up to first files, by name, after the one named after"
+  files(first: Int = 100, after: String = ""): [File!]!
+  "Up to first subfolders, by name, after the one named after"
+  folders(first: Int = 100, after: String = ""): [Folder!]!
+  fileCount: Int!
+  "null for the root"
+  parent: Folder
+}
+
+type File {
+  name: String!
+  path: String!
+  url: String!
+  size: Float!
+  modified: String!
+  etag: String!
+  contentType: String
+  "null when the file isn't an image the server can decode"
+  width: Int
+  height: Int
+  "From the captions.json of the folder"
+  caption: String
+  folder: Folder!
+}
+
+type Stats {
+  "When the service started, the counters cover the time since"
+  since: String!
+  requests: Float!
+  bytesServed: Float!
+  clientErrors: Float!
+  serverErrors: Float!
+  "null when the file cache is off"
+  cacheHits: Float
+  cacheMisses: Float
+  "The most requested files"
+  topFiles(first: Int = 10): [TopFile!]!
+}
+
+type TopFile {
+  path: String!
+  requests: Float!
+  bytes: Float!
+  "null when the file is gone"
+  file: File
+}
+`
+
+// library answers GraphQL queries about the folder, reading it through
+// files like the file server does
+type library struct {
+	files      http.FileSystem
+	dimensions *imageDimensions
+	stats      *requestStats
+	cache      *fileCache
+	types      map[string]string
+}
+
+func newLibrary(files http.FileSystem, dimensions *imageDimensions, stats *requestStats, cache *fileCache, contentTypes map[string]string) *library {
+	return &library{files: files, dimensions: dimensions, stats: stats, cache: cache, types: contentTypeOverrides(contentTypes)}
+}
+
+// handler serves queries as POST with a JSON or application/graphql body,
+// or as GET with query, operationName and variables parameters. GET without
+// a query returns the schema.
+func (l *library) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphRequest
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			params := r.URL.Query()
+			if params.Get("query") == "" {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				io.WriteString(w, librarySchema)
+				return
+			}
+			req.Query, req.OperationName = params.Get("query"), params.Get("operationName")
+			if variables := params.Get("variables"); variables != "" {
+				if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+					http.Error(w, "variables must be a JSON object", http.StatusBadRequest)
+					return
+				}
+			}
+		case http.MethodPost:
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGraphQLBody))
+			if err != nil {
+				http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/graphql" {
+				req.Query = string(body)
+			} else if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp := executeGraphQL(&libraryQuery{library: l, notes: map[string]folderNotes{}}, req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if resp.Data == nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// libraryQuery is the Query type, for one request
+type libraryQuery struct {
+	*library
+	// notes caches the README and captions of the folders the query reads
+	notes map[string]folderNotes
+}
+
+func (q *libraryQuery) typeName() string { return "Query" }
+
+func (q *libraryQuery) field(name string, args map[string]interface{}) (interface{}, error) {
+	switch name {
+	case "folder":
+		p, err := stringArg(args, "path", "/")
+		if err != nil {
+			return nil, err
+		}
+		return q.folder(p)
+	case "file":
+		p, err := stringArg(args, "path", "")
+		if err != nil || p == "" {
+			return nil, errors.New(`argument "path" is required`)
+		}
+		return q.file(p)
+	case "stats":
+		return &libraryStats{q}, nil
+	}
+	return nil, errUnknownField(q, name)
+}
+
+// stat returns the info of the entry at name, nil when there is none
+func (q *libraryQuery) stat(name string) (fs.FileInfo, error) {
+	f, err := q.files.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// folder returns the folder at name, or nil when it isn't one. The nil is
+// untyped, as the executor expects.
+func (q *libraryQuery) folder(name string) (interface{}, error) {
+	name = path.Clean("/" + name)
+	info, err := q.stat(name)
+	if err != nil || info == nil || !info.IsDir() {
+		return nil, err
+	}
+	return &libraryFolder{q: q, path: name, info: info}, nil
+}
+
+// file returns the file at name, or nil when it isn't one
+func (q *libraryQuery) file(name string) (interface{}, error) {
+	name = path.Clean("/" + name)
+	info, err := q.stat(name)
+	if err != nil || info == nil || info.IsDir() || isNotesFile(path.Base(name)) {
+		return nil, err
+	}
+	return &libraryFile{q: q, path: name, info: info}, nil
+}
+
+// folderNotes returns the README and captions of dir
+func (q *libraryQuery) folderNotes(dir string) folderNotes {
+	notes, ok := q.notes[dir]
+	if !ok {
+		notes = readFolderNotes(q.files, dir)
+		q.notes[dir] = notes
+	}
+	return notes
+}
+
+// pageArgs returns the first and after arguments of files and folders
+func pageArgs(args map[string]interface{}) (int, string, error) {
+	first, err := intArg(args, "first", 100)
+	if err != nil {
+		return 0, "", err
+	}
+	if first < 0 || first > maxLibraryPage {
+		return 0, "", fmt.Errorf("argument \"first\" must be between 0 and %d", maxLibraryPage)
+	}
+	after, err := stringArg(args, "after", "")
+	return first, after, err
+}
+
+// list returns up to first of the subfolders (dirs) or files of dir whose
+// names sort after after
+func (q *libraryQuery) list(dir string, dirs bool, first int, after string) ([]fs.FileInfo, error) {
+	f, err := q.files.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// One read: plain directories can't be read again after Readdir(-1)
+	entries, _, err := readdirAfter(f, after, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	var kept []fs.FileInfo
+	for _, entry := range entries {
+		if len(kept) == first {
+			break
+		}
+		if entry.IsDir() == dirs && (dirs || !isNotesFile(entry.Name())) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, nil
+}
+
+// libraryFolder is the Folder type
+type libraryFolder struct {
+	q    *libraryQuery
+	path string
+	info fs.FileInfo
+}
+
+func (f *libraryFolder) typeName() string { return "Folder" }
+
+func (f *libraryFolder) field(name string, args map[string]interface{}) (interface{}, error) {
+	switch name {
+	case "name":
+		if f.path == "/" {
+			return "", nil
+		}
+		return path.Base(f.path), nil
+	case "path":
+		return f.path, nil
+	case "url":
+		return (&url.URL{Path: strings.TrimSuffix(f.path, "/") + "/"}).EscapedPath(), nil
+	case "modified":
+		return f.info.ModTime(), nil
+	case "readme":
+		if readme := f.q.folderNotes(f.path).readme; readme != "" {
+			return readme, nil
+		}
+		return nil, nil
+	case "files", "folders":
+		first, after, err := pageArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := f.q.list(f.path, name == "folders", first, after)
+		if err != nil {
+			return nil, err
+		}
+		objects := make([]graphObject, len(entries))
+		for i, entry := range entries {
+			if entry.IsDir() {
+				objects[i] = &libraryFolder{q: f.q, path: path.Join(f.path, entry.Name()), info: entry}
+			} else {
+				objects[i] = &libraryFile{q: f.q, path: path.Join(f.path, entry.Name()), info: entry}
+			}
+		}
+		return objects, nil
+	case "fileCount":
+		entries, err := f.q.list(f.path, false, math.MaxInt32, "")
+		return len(entries), err
+	case "parent":
+		if f.path == "/" {
+			return nil, nil
+		}
+		return f.q.folder(path.Dir(f.path))
+	}
+	return nil, errUnknownField(f, name)
+}
+
+// libraryFile is the File type
+type libraryFile struct {
+	q    *libraryQuery
+	path string
+	info fs.FileInfo
+}
+
+func (f *libraryFile) typeName() string { return "File" }
+
+func (f *libraryFile) field(name string, args map[string]interface{}) (interface{}, error) {
+	switch name {
+	case "name":
+		return path.Base(f.path), nil
+	case "path":
+		return f.path, nil
+	case "url":
+		return (&url.URL{Path: f.path}).EscapedPath(), nil
+	case "size":
+		return float64(f.info.Size()), nil
+	case "modified":
+		return f.info.ModTime(), nil
+	case "etag":
+		return fileETag(f.info.Size(), f.info.ModTime()), nil
+	case "contentType":
+		ext := strings.ToLower(path.Ext(f.path))
+		contentType, ok := f.q.types[ext]
+		if !ok {
+			contentType = mime.TypeByExtension(ext)
+		}
+		if contentType == "" {
+			return nil, nil
+		}
+		return contentType, nil
+	case "width", "height":
+		width, height, ok := f.q.dimensions.get(f.q.files, f.path, f.info.Size(), f.info.ModTime())
+		if !ok {
+			return nil, nil
+		}
+		if name == "width" {
+			return width, nil
+		}
+		return height, nil
+	case "caption":
+		if caption := f.q.folderNotes(path.Dir(f.path)).caption(path.Base(f.path)); caption != "" {
+			return caption, nil
+		}
+		return nil, nil
+	case "folder":
+		return f.q.folder(path.Dir(f.path))
+	}
+	return nil, errUnknownField(f, name)
+}
+
+// libraryStats is the Stats type
+type libraryStats struct {
+	q *libraryQuery
+}
+
+func (s *libraryStats) typeName() string { return "Stats" }
+
+func (s *libraryStats) field(name string, args map[string]interface{}) (interface{}, error) {
+	stats := s.q.stats
+	snapshot := stats.Snapshot()
+	switch name {
+	case "since":
+		return stats.started, nil
+	case "requests":
+		return float64(snapshot.Requests), nil
+	case "bytesServed":
+		return float64(snapshot.BytesServed), nil
+	case "clientErrors":
+		return float64(snapshot.ClientErrors), nil
+	case "serverErrors":
+		return float64(snapshot.ServerErrors), nil
+	case "cacheHits", "cacheMisses":
+		if s.q.cache == nil {
+			return nil, nil
+		}
+		if name == "cacheHits" {
+			return float64(atomic.LoadUint64(&s.q.cache.hits)), nil
+		}
+		return float64(atomic.LoadUint64(&s.q.cache.misses)), nil
+	case "topFiles":
+		first, err := intArg(args, "first", 10)
+		if err != nil {
+			return nil, err
+		}
+		if first < 0 || first > maxTopFiles {
+			return nil, fmt.Errorf("argument \"first\" must be between 0 and %d", maxTopFiles)
+		}
+		top := stats.top.top(first)
+		objects := make([]graphObject, len(top))
+		for i := range top {
+			objects[i] = &libraryTopFile{s.q, top[i]}
+		}
+		return objects, nil
+	}
+	return nil, errUnknownField(s, name)
+}
+
+// libraryTopFile is the TopFile type
+type libraryTopFile struct {
+	q *libraryQuery
+	fileCount
+}
+
+func (t *libraryTopFile) typeName() string { return "TopFile" }
+
+func (t *libraryTopFile) field(name string, args map[string]interface{}) (interface{}, error) {
+	switch name {
+	case "path":
+		return t.path, nil
+	case "requests":
+		return float64(t.requests), nil
+	case "bytes":
+		return float64(t.bytes), nil
+	case "file":
+		return t.q.file(t.path)
+	}
+	return nil, errUnknownField(t, name)
+}
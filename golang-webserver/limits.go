@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// LimitsConfig bounds the size of requests before any route sees them, so
+// oversized uploads and URLs are refused the same way everywhere. The
+// defaults apply when the section is left out.
+type LimitsConfig struct {
+	// MaxBodyKB is the largest request body accepted in kilobytes, 10240 by default
+	MaxBodyKB int `json:"maxBodyKB,omitempty"`
+	// MaxURLLength is the longest path and query accepted in bytes, 8192 by default
+	MaxURLLength int `json:"maxURLLength,omitempty"`
+	// MaxQueryParams is how many query parameters a request may have, 100 by default
+	MaxQueryParams int `json:"maxQueryParams,omitempty"`
+}
+
+func (c *LimitsConfig) validate() []error {
+	var errs []error
+	if c.MaxBodyKB < 0 {
+		errs = append(errs, fmt.Errorf("limits.maxBodyKB cannot be negative"))
+	}
+	if c.MaxURLLength < 0 {
+		errs = append(errs, fmt.Errorf("limits.maxURLLength cannot be negative"))
+	}
+	if c.MaxQueryParams < 0 {
+		errs = append(errs, fmt.Errorf("limits.maxQueryParams cannot be negative"))
+	}
+	return errs
+}
+
+// maxBody returns the body limit in bytes, c may be nil
+func (c *LimitsConfig) maxBody() int64 {
+	if c == nil || c.MaxBodyKB == 0 {
+		return 10240 << 10
+	}
+	return int64(c.MaxBodyKB) << 10
+}
+
+func (c *LimitsConfig) maxURLLength() int {
+	if c == nil || c.MaxURLLength == 0 {
+		return 8192
+	}
+	return c.MaxURLLength
+}
+
+func (c *LimitsConfig) maxQueryParams() int {
+	if c == nil || c.MaxQueryParams == 0 {
+		return 100
+	}
+	return c.MaxQueryParams
+}
+
+// queryParams counts the parameters of a raw query the way url.ParseQuery
+// splits them, without decoding them
+func queryParams(raw string) int {
+	n := 0
+	for raw != "" {
+		var param string
+		param, raw, _ = strings.Cut(raw, "&")
+		if param != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// requestLimits answers 414 for long URLs or too many query parameters and
+// 413 for large bodies. Bodies without a Content-Length are cut off at the
+// limit instead, the handler reading them gets an error.
+func requestLimits(config *LimitsConfig, next http.Handler) http.Handler {
+	maxBody := config.maxBody()
+	maxURL := config.maxURLLength()
+	maxParams := config.maxQueryParams()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > maxURL {
+			http.Error(w, fmt.Sprintf("the URL is longer than %d bytes", maxURL), http.StatusRequestURITooLong)
+			return
+		}
+		if n := queryParams(r.URL.RawQuery); n > maxParams {
+			http.Error(w, fmt.Sprintf("the URL has %d query parameters, at most %d are accepted", n, maxParams), http.StatusRequestURITooLong)
+			return
+		}
+		if r.ContentLength > maxBody {
+			// Not reading the body, the connection is closed afterwards
+			w.Header().Set("Connection", "close")
+			http.Error(w, fmt.Sprintf("the request body is larger than %d KB", maxBody>>10), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sendFileChunk is how much of a file is handed to sendfile at once. A
+// client has writeTimeout to take each chunk, so it is small enough for
+// slow connections, and large enough to keep the system calls few.
+const sendFileChunk = 256 << 10
+
+// ListenerConfig is an address the server listens on besides port, sharing
+// its routes, e.g. :8443 for HTTPS or 127.0.0.1:8090 for the admin API
+type ListenerConfig struct {
+	// Address is host:port, an empty host listens on every interface
+	Address string `json:"address"`
+	// CertFile and KeyFile are the PEM certificate and key to serve HTTPS with
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ClientCAFile requires clients to present a certificate issued by one of these PEM CAs
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	// Admin serves the admin API here. Once a listener sets it, the admin
+	// API is only served on the listeners that do.
+	Admin bool `json:"admin,omitempty"`
+	// AdminToken is the bearer token the admin API expects here instead of adminToken
+	AdminToken string `json:"adminToken,omitempty" secret:"true"`
+}
+
+func (l *ListenerConfig) validate(i int) []error {
+	var errs []error
+	if _, port, err := net.SplitHostPort(l.Address); err != nil {
+		errs = append(errs, fmt.Errorf("listeners[%d].address must be host:port, got %q", i, l.Address))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		errs = append(errs, fmt.Errorf("listeners[%d].address must have a port between 1 and 65535, got %q", i, l.Address))
+	}
+	if (l.CertFile == "") != (l.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("listeners[%d].certFile and listeners[%d].keyFile must be set together", i, i))
+	}
+	if l.ClientCAFile != "" && l.CertFile == "" {
+		errs = append(errs, fmt.Errorf("listeners[%d].clientCAFile needs certFile, client certificates only work over HTTPS", i))
+	}
+	if l.AdminToken != "" && !l.Admin {
+		errs = append(errs, fmt.Errorf("listeners[%d].adminToken is only used on admin listeners", i))
+	}
+	return errs
+}
+
+// tlsConfig loads the certificate and client CAs of an HTTPS listener
+func (l *ListenerConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate for %s: %w", l.Address, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// http.Server.Serve handles h2 connections, ServeTLS would only add this
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if l.ClientCAFile != "" {
+		pem, err := os.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CAs for %s: %w", l.Address, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s has no certificates", l.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// adminListener reports whether a listener is set aside for the admin API
+func (c *Config) adminListener() bool {
+	for _, l := range c.Listeners {
+		if l.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAPI reports whether the admin API is served at all, with adminToken
+// or an admin listener's own token
+func (c *Config) adminAPI() bool {
+	if c.AdminToken != "" {
+		return true
+	}
+	for _, l := range c.Listeners {
+		if l.Admin && l.AdminToken != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// serverListener is a bound address. Its connections record how the admin
+// API may be used on them, see adminTokenFor. The settings can change while
+// it is served, by a config reload: connections accepted afterwards get the
+// new certificate and admin API, the open ones keep theirs.
+type serverListener struct {
+	net.Listener
+
+	mu         sync.Mutex
+	config     ListenerConfig
+	adminAPI   bool
+	adminToken string
+	tls        *tls.Config
+	// closed is set when the address was removed from the config, so the
+	// error Serve returns for it isn't taken for a failure
+	closed bool
+}
+
+func (l *serverListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lc := &listenerConn{Conn: conn, adminAPI: l.adminAPI, adminToken: l.adminToken}
+	if l.tls != nil {
+		// What tls.NewListener does, with the current certificate
+		return tls.Server(lc, l.tls), nil
+	}
+	return lc, nil
+}
+
+// set replaces the settings of the listener with those of setting
+func (l *serverListener) set(setting listenerSetting) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config, l.adminAPI, l.adminToken, l.tls = setting.config, setting.adminAPI, setting.config.AdminToken, setting.tls
+}
+
+// remove stops listening. Connections accepted already aren't affected.
+func (l *serverListener) remove() {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	l.Close()
+}
+
+// removed reports whether remove was called
+func (l *serverListener) removed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// listenerConn is a connection accepted on a serverListener
+type listenerConn struct {
+	net.Conn
+	adminAPI   bool
+	adminToken string
+}
+
+// Write gives each write writeTimeout to complete, instead of the whole
+// response: a download lasts as long as the client keeps reading, a client
+// that stops is cut off.
+func (c *listenerConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.Conn.Write(p)
+}
+
+// ReadFrom hands files to the connection's own ReadFrom, which sends them
+// with sendfile or TransmitFile. net/http only uses it when the connection
+// it serves has one, the embedded interface would hide it. A file is sent
+// sendFileChunk at a time, each with writeTimeout to go out like a Write.
+func (c *listenerConn) ReadFrom(r io.Reader) (n int64, err error) {
+	// http.ServeContent sends files as an *io.LimitedReader, and sendfile
+	// only looks for an *os.File inside it
+	limit := int64(-1)
+	lr, limited := r.(*io.LimitedReader)
+	src := r
+	if limited {
+		src, limit = lr.R, lr.N
+	}
+	src = unwrapFile(src)
+	rf, ok := c.Conn.(io.ReaderFrom)
+	if _, file := src.(*os.File); !ok || !file {
+		// Hides ReadFrom, for Write to set the deadlines
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+	for limit < 0 || n < limit {
+		chunk := int64(sendFileChunk)
+		if limit >= 0 && limit-n < chunk {
+			chunk = limit - n
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		sent, err := rf.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		n += sent
+		if limited {
+			lr.N -= sent
+		}
+		if err != nil || sent < chunk {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// wrappedFile is an http.File that wraps another and reads the same bytes
+type wrappedFile interface {
+	unwrap() http.File
+}
+
+// unwrapFile returns the file underneath the wrappers of r, the *os.File of
+// http.Dir once the cache and the .git filter are taken off
+func unwrapFile(r io.Reader) io.Reader {
+	for {
+		w, ok := r.(wrappedFile)
+		if !ok {
+			return r
+		}
+		r = w.unwrap()
+	}
+}
+
+// listenerSetting is what a config asks of one address
+type listenerSetting struct {
+	config   ListenerConfig
+	adminAPI bool
+	tls      *tls.Config
+}
+
+// listenerSettings returns the settings of port and the configured
+// listeners, in that order. Certificates are loaded here, so a missing one
+// fails like a taken port does.
+func listenerSettings(config *Config) ([]listenerSetting, error) {
+	all := append([]ListenerConfig{{Address: ":" + config.Port}}, config.Listeners...)
+	adminListener := config.adminListener()
+	settings := make([]listenerSetting, 0, len(all))
+	for i, l := range all {
+		// port serves the admin API unless a listener is set aside for it
+		setting := listenerSetting{config: l, adminAPI: l.Admin || (i == 0 && !adminListener)}
+		if l.CertFile != "" {
+			var err error
+			if setting.tls, err = l.tlsConfig(); err != nil {
+				return nil, err
+			}
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+// listenerSet is the addresses the service listens on, port first
+type listenerSet struct {
+	listeners []*serverListener
+}
+
+// update binds the addresses of config that aren't bound yet, applies the
+// settings of config to those that are and stops listening on the others.
+// The new listeners are returned for the caller to serve, the removed ones
+// have their open connections finish. When an address can't be bound
+// nothing changes. Addresses are compared as written, so a change from
+// :8089 to 0.0.0.0:8089 fails the way a taken port does.
+func (s *listenerSet) update(config *Config) (added, removed []*serverListener, err error) {
+	settings, err := listenerSettings(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	current := map[string]*serverListener{}
+	for _, l := range s.listeners {
+		current[l.config.Address] = l
+	}
+	listeners := make([]*serverListener, 0, len(settings))
+	for _, setting := range settings {
+		if l := current[setting.config.Address]; l != nil {
+			listeners = append(listeners, l)
+			continue
+		}
+		ln, err := net.Listen("tcp", setting.config.Address)
+		if err != nil {
+			for _, l := range added {
+				l.Close()
+			}
+			return nil, nil, err
+		}
+		l := &serverListener{Listener: ln}
+		added = append(added, l)
+		listeners = append(listeners, l)
+	}
+
+	// Every address is bound, nothing can fail from here
+	kept := map[*serverListener]bool{}
+	for i, l := range listeners {
+		l.set(settings[i])
+		kept[l] = true
+	}
+	for _, l := range s.listeners {
+		if !kept[l] {
+			l.remove()
+			removed = append(removed, l)
+		}
+	}
+	s.listeners = listeners
+	return added, removed, nil
+}
+
+// close stops listening on every address
+func (s *listenerSet) close() {
+	for _, l := range s.listeners {
+		l.remove()
+	}
+}
+
+// String describes the listener for the event log
+func (l *serverListener) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	description := l.config.Address
+	if l.config.ClientCAFile != "" {
+		description += " (HTTPS with client certificates)"
+	} else if l.config.CertFile != "" {
+		description += " (HTTPS)"
+	}
+	if l.config.Admin {
+		description += " for the admin API"
+	}
+	return description
+}
+
+// adminTokenFor returns the bearer token the admin API expects on the
+// connection r came in on: the listener's own, or token. It returns false
+// when the admin API isn't served there, on the public listeners once one
+// is marked admin or when there is no token to check.
+func adminTokenFor(r *http.Request, token string) (string, bool) {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if lc, ok := conn.(*listenerConn); ok {
+		if !lc.adminAPI {
+			return "", false
+		}
+		if lc.adminToken != "" {
+			return lc.adminToken, true
+		}
+	}
+	return token, token != ""
+}
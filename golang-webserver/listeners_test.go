@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a port nothing listens on
+func freePort(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestListenerSetUpdate(t *testing.T) {
+	release := make(chan struct{})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, admin := adminTokenFor(r, "token")
+			if r.URL.Path == "/slow" {
+				fmt.Fprintln(w, "first half")
+				w.(http.Flusher).Flush()
+				<-release
+			}
+			fmt.Fprintf(w, "admin %v\n", admin)
+		}),
+		ConnContext: connContext,
+	}
+	defer server.Close()
+	set := &listenerSet{}
+	serve := func(config *Config) (added, removed []*serverListener) {
+		t.Helper()
+		added, removed, err := set.update(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ln := range added {
+			go server.Serve(ln)
+		}
+		return added, removed
+	}
+	get := func(port, path string) string {
+		t.Helper()
+		resp, err := http.Get("http://127.0.0.1:" + port + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	first := freePort(t)
+	if added, _ := serve(&Config{Port: first}); len(added) != 1 {
+		t.Fatalf("update bound %d addresses, want 1", len(added))
+	}
+	// A download is in progress when the port changes
+	conn, err := net.Dial("tcp", "127.0.0.1:"+first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bufio.NewReader(resp.Body)
+	if line, err := body.ReadString('\n'); err != nil || !strings.Contains(line, "first half") {
+		t.Fatalf("the download started with %q, %v", line, err)
+	}
+
+	second, admin := freePort(t), freePort(t)
+	config := &Config{Port: second, Listeners: []ListenerConfig{{Address: "127.0.0.1:" + admin, Admin: true}}}
+	added, removed := serve(config)
+	if len(added) != 2 || len(removed) != 1 || set.listeners[0].config.Address != ":"+second {
+		t.Fatalf("update added %v and removed %v", added, removed)
+	}
+	if _, err := net.DialTimeout("tcp", "127.0.0.1:"+first, time.Second); err == nil {
+		t.Error("the old port still accepts connections")
+	}
+	// The admin API moved to its listener, port doesn't serve it anymore
+	if got := get(second, "/"); got != "admin false\n" {
+		t.Errorf("the new port answered %q", got)
+	}
+	if got := get(admin, "/"); got != "admin true\n" {
+		t.Errorf("the admin listener answered %q", got)
+	}
+
+	// The download on the old port finishes, with the settings it started with
+	close(release)
+	rest, err := io.ReadAll(body)
+	if err != nil || string(rest) != "admin true\n" {
+		t.Errorf("the download ended with %q, %v", rest, err)
+	}
+
+	// An address that can't be bound leaves everything as it was
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	broken := &Config{Port: second, Listeners: []ListenerConfig{{Address: "127.0.0.1:" + admin, Admin: true}, {Address: taken.Addr().String()}}}
+	if _, _, err := set.update(broken); err == nil {
+		t.Fatal("update bound a taken address")
+	}
+	if len(set.listeners) != 2 {
+		t.Errorf("a failed update left %d listeners, want 2", len(set.listeners))
+	}
+	if got := get(admin, "/"); got != "admin true\n" {
+		t.Errorf("after a failed update the admin listener answered %q", got)
+	}
+
+	set.close()
+	for _, ln := range set.listeners {
+		if !ln.removed() {
+			t.Errorf("%s wasn't closed", ln)
+		}
+	}
+}
+
+// sendfileConn records what ReadFrom is given
+type sendfileConn struct {
+	net.Conn
+	src io.Reader
+}
+
+func (c *sendfileConn) ReadFrom(r io.Reader) (int64, error) {
+	c.src = r
+	return io.Copy(io.Discard, r)
+}
+
+func (c *sendfileConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestListenerConnSendsFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), make([]byte, 100<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The file as the git filter serves it from the cache, too large for
+	// its content to be kept in memory
+	cache := newFileCache(http.Dir(dir), 1)
+	f, err := gitTreeFS{cache, dir}.Open("/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	conn := &sendfileConn{}
+	lr := &io.LimitedReader{R: f, N: 60 << 10}
+	n, err := (&listenerConn{Conn: conn}).ReadFrom(lr)
+	if err != nil || n != 60<<10 || lr.N != 0 {
+		t.Fatalf("ReadFrom sent %d bytes and left %d: %v", n, lr.N, err)
+	}
+	if sent, ok := conn.src.(*io.LimitedReader); !ok {
+		t.Errorf("the connection got a %T", conn.src)
+	} else if _, ok := sent.R.(*os.File); !ok {
+		t.Errorf("the connection got a %T to send, sendfile needs an *os.File", sent.R)
+	}
+}
+
+func TestSlowDownload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("downloads for 20 seconds")
+	}
+	// Far more than the socket buffers hold, so the server is still
+	// writing after writeTimeout
+	const size = 40 << 20
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "large.bin"), make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	config := &Config{Port: port}
+	set := &listenerSet{}
+	added, _, err := set.update(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.close()
+	server := createServer(config, http.FileServer(http.Dir(dir)), discardLog{})
+	go server.Serve(added[0])
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(64 << 10)
+	fmt.Fprint(conn, "GET /large.bin HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 MB a second, the download takes 20 seconds
+	start := time.Now()
+	buf := make([]byte, 256<<10)
+	var n int
+	for {
+		read, err := io.ReadFull(resp.Body, buf)
+		n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("the download failed after %d bytes and %v: %v", n, time.Since(start), err)
+		}
+		time.Sleep(125 * time.Millisecond)
+	}
+	if n != size {
+		t.Fatalf("the download was cut off after %d bytes and %v", n, time.Since(start))
+	}
+	if took := time.Since(start); took < writeTimeout {
+		t.Errorf("the download took %v, less than the write timeout it should outlast", took)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultListingPageSize is how many entries a listing page has unless listingPageSize says otherwise
+	defaultListingPageSize = 1000
+	// maxListingLimit bounds ?limit=
+	maxListingLimit = 10000
+)
+
+// listingPageSize returns how many entries a listing page has
+func (c *Config) listingPageSize() int {
+	if c.ListingPageSize == 0 {
+		return defaultListingPageSize
+	}
+	return c.ListingPageSize
+}
+
+// pagedDir is a directory that returns a page of its entries, sorted by
+// name, without reading all of them, like the indexed ones
+type pagedDir interface {
+	readdirAfter(after string, n int) ([]fs.FileInfo, bool, error)
+}
+
+// readdirAfter returns up to n entries of dir whose names sort after after,
+// and whether more follow
+func readdirAfter(dir http.File, after string, n int) ([]fs.FileInfo, bool, error) {
+	if d, ok := dir.(pagedDir); ok {
+		return d.readdirAfter(after, n)
+	}
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Name() > after })
+	entries = entries[i:]
+	if len(entries) > n {
+		return entries[:n], true, nil
+	}
+	return entries, false, nil
+}
+
+func (d *indexedDir) readdirAfter(after string, n int) ([]fs.FileInfo, bool, error) {
+	i := sort.Search(len(d.entries), func(i int) bool { return d.entries[i].name > after })
+	rest := d.entries[i:]
+	more := len(rest) > n
+	if more {
+		rest = rest[:n]
+	}
+	infos := make([]fs.FileInfo, len(rest))
+	for i := range rest {
+		infos[i] = &rest[i]
+	}
+	return infos, more, nil
+}
+
+func (d gitTreeDir) readdirAfter(after string, n int) ([]fs.FileInfo, bool, error) {
+	// One more in case .git is on the page
+	entries, more, err := readdirAfter(d.File, after, n+1)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !strings.EqualFold(entry.Name(), ".git") {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) > n {
+		kept, more = kept[:n], true
+	}
+	return kept, more, err
+}
+
+// listingEntry is an entry of a JSON listing
+type listingEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Caption  string    `json:"caption,omitempty"`
+}
+
+// listingServer serves directory listings a page at a time, as HTML like
+// http.FileServer's or as JSON for clients accepting application/json.
+// ?limit= sets the page size and ?cursor= continues after the previous page,
+// whose next link carries it. Files, directories with an index.html and the
+// redirects are left to next.
+func listingServer(files http.FileSystem, pageSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		dir, err := files.Open(name)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer dir.Close()
+		if info, err := dir.Stat(); err != nil || !info.IsDir() || fileExistsIn(files, path.Join(name, "index.html")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		limit := pageSize
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxListingLimit {
+				http.Error(w, fmt.Sprintf("limit must be a number between 1 and %d", maxListingLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		var after string
+		if v := query.Get("cursor"); v != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(v)
+			if err != nil {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+			after = string(decoded)
+		}
+		entries, more, err := readdirAfter(dir, after, limit)
+		if err != nil {
+			http.Error(w, "Error reading directory", http.StatusInternalServerError)
+			return
+		}
+
+		var nextPage string
+		if more {
+			params := url.Values{"cursor": {base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].Name()))}}
+			if query.Get("limit") != "" {
+				params.Set("limit", strconv.Itoa(limit))
+			}
+			nextPage = "?" + params.Encode()
+			w.Header().Add("Link", "<"+nextPage+`>; rel="next"`)
+		}
+		asJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+		w.Header().Add("Vary", "Accept")
+		if asJSON {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		notes := readFolderNotes(files, name)
+		// The README heads the first page only
+		if after != "" {
+			notes.readme, notes.readmeHTML = "", ""
+		}
+		// Written as it is produced, large pages stream out in chunks
+		out := bufio.NewWriterSize(w, 32<<10)
+		defer out.Flush()
+		if asJSON {
+			writeJSONListing(out, name, entries, notes, nextPage)
+			return
+		}
+		fmt.Fprint(out, "<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n")
+		if notes.readmeHTML != "" {
+			fmt.Fprintf(out, "<article>\n%s</article>\n", notes.readmeHTML)
+		}
+		fmt.Fprint(out, "<pre>\n")
+		for _, entry := range entries {
+			entryName := entry.Name()
+			if entry.IsDir() {
+				entryName += "/"
+			}
+			href := url.URL{Path: entryName}
+			fmt.Fprintf(out, "<a href=\"%s\">%s</a>", href.String(), html.EscapeString(entryName))
+			if caption := notes.caption(entry.Name()); caption != "" {
+				fmt.Fprintf(out, "  %s", html.EscapeString(caption))
+			}
+			out.WriteByte('\n')
+		}
+		fmt.Fprint(out, "</pre>\n")
+		if nextPage != "" {
+			fmt.Fprintf(out, "<p><a rel=\"next\" href=\"%s\">%s</a></p>\n", html.EscapeString(nextPage), html.EscapeString(pageText(r).T("listing.next")))
+		}
+	})
+}
+
+// writeJSONListing writes {"path", "readme", "entries", "next"} an entry at a time
+func writeJSONListing(out *bufio.Writer, name string, entries []fs.FileInfo, notes folderNotes, nextPage string) {
+	dirPath, _ := json.Marshal(strings.TrimSuffix(name, "/") + "/")
+	fmt.Fprintf(out, "{\"path\":%s,", dirPath)
+	if notes.readme != "" {
+		readme, _ := json.Marshal(notes.readme)
+		fmt.Fprintf(out, "\"readme\":%s,", readme)
+	}
+	out.WriteString("\"entries\":[")
+	for i, entry := range entries {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		data, _ := json.Marshal(listingEntry{Name: entry.Name(), Dir: entry.IsDir(), Size: entry.Size(), Modified: entry.ModTime().UTC(), Caption: notes.caption(entry.Name())})
+		out.Write(data)
+	}
+	out.WriteString("]")
+	if nextPage != "" {
+		next, _ := json.Marshal(nextPage)
+		fmt.Fprintf(out, ",\"next\":%s", next)
+	}
+	out.WriteString("}\n")
+}
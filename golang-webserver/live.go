@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// transferChunk is how much of a file is sent between progress updates
+const transferChunk = 1 << 20
+
+// throughputWindow is how many seconds of throughput are kept
+const throughputWindow = 60
+
+// liveTracker follows the connections and transfers in progress, for
+// answering who is using the server right now
+type liveTracker struct {
+	// elog logs kills and bans, it can be nil
+	elog debug.Log
+
+	mu        sync.Mutex
+	conns     map[net.Conn]http.ConnState
+	nextID    uint64
+	transfers map[uint64]*transfer
+	// seconds holds the bytes sent per second, indexed by Unix time modulo the window
+	seconds   [throughputWindow]int64
+	secondsAt [throughputWindow]int64
+	// bans are the banned client addresses and until when
+	bans map[string]time.Time
+}
+
+// transfer is a request being answered
+type transfer struct {
+	ID      uint64    `json:"id"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Client  string    `json:"client"`
+	Started time.Time `json:"started"`
+	// Size is the Content-Length of the response, -1 until known or when not set
+	Size int64 `json:"size"`
+	Sent int64 `json:"bytesSent"`
+
+	// conn is closed to kill the transfer
+	conn net.Conn
+}
+
+// connState is the http.Server.ConnState hook following the open connections
+func (t *liveTracker) connState(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, conn)
+	default:
+		if t.conns == nil {
+			t.conns = map[net.Conn]http.ConnState{}
+		}
+		t.conns[conn] = state
+	}
+}
+
+func (t *liveTracker) start(r *http.Request) *transfer {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	tr := &transfer{Method: r.Method, Path: r.URL.Path, Client: client, Started: time.Now(), Size: -1}
+	tr.conn, _ = r.Context().Value(connContextKey{}).(net.Conn)
+	t.mu.Lock()
+	if t.transfers == nil {
+		t.transfers = map[uint64]*transfer{}
+	}
+	t.nextID++
+	tr.ID = t.nextID
+	t.transfers[tr.ID] = tr
+	t.mu.Unlock()
+	return tr
+}
+
+func (t *liveTracker) finish(tr *transfer) {
+	t.mu.Lock()
+	delete(t.transfers, tr.ID)
+	t.mu.Unlock()
+}
+
+// sent adds n bytes to the transfer and to the current second's throughput
+func (t *liveTracker) sent(tr *transfer, n int64) {
+	atomic.AddInt64(&tr.Sent, n)
+	now := time.Now().Unix()
+	i := now % throughputWindow
+	t.mu.Lock()
+	if t.secondsAt[i] != now {
+		t.secondsAt[i] = now
+		t.seconds[i] = 0
+	}
+	t.seconds[i] += n
+	t.mu.Unlock()
+}
+
+// throughput returns the bytes per second sent over the last seconds, not
+// counting the current one which isn't over yet
+func (t *liveTracker) throughput(seconds int) float64 {
+	now := time.Now().Unix()
+	var total int64
+	t.mu.Lock()
+	for s := now - int64(seconds); s < now; s++ {
+		if i := s % throughputWindow; t.secondsAt[i] == s {
+			total += t.seconds[i]
+		}
+	}
+	t.mu.Unlock()
+	return float64(total) / float64(seconds)
+}
+
+// middleware tracks the request as a transfer until its response is sent,
+// and rejects banned clients
+func (t *liveTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := t.start(r)
+		if t.banned(tr.Client) {
+			t.finish(tr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		defer t.finish(tr)
+		next.ServeHTTP(&trackedWriter{ResponseWriter: w, tracker: t, transfer: tr}, r)
+	})
+}
+
+// trackedWriter updates the progress of a transfer as the response is written
+type trackedWriter struct {
+	http.ResponseWriter
+	tracker     *liveTracker
+	transfer    *transfer
+	wroteHeader bool
+}
+
+func (w *trackedWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if size := w.Header().Get("Content-Length"); size != "" {
+			if n, err := strconv.ParseInt(size, 10, 64); err == nil {
+				atomic.StoreInt64(&w.transfer.Size, n)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackedWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.tracker.sent(w.transfer, int64(n))
+	return n, err
+}
+
+// Flush passes flushes through, for streamed responses
+func (w *trackedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Hijack passes WebSocket upgrades through, the tracker sees the connection
+// hijacked
+func (w *trackedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// ReadFrom sends src in chunks to report progress on large files. A chunk of
+// an *os.File, the file http.FileServer passes in an io.LimitedReader, is
+// still sent with TransmitFile, so it only unwraps that one level.
+func (w *trackedWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	var total int64
+	for {
+		chunk := &io.LimitedReader{R: src, N: transferChunk}
+		lr, limited := src.(*io.LimitedReader)
+		if limited {
+			if lr.N <= 0 {
+				return total, nil
+			}
+			chunk.R = lr.R
+			if lr.N < chunk.N {
+				chunk.N = lr.N
+			}
+		}
+		want := chunk.N
+		n, err := io.Copy(w.ResponseWriter, chunk)
+		if limited {
+			lr.N -= n
+		}
+		total += n
+		w.tracker.sent(w.transfer, n)
+		if err != nil || n < want {
+			return total, err
+		}
+	}
+}
+
+// liveStats is the body of GET /api/stats/live
+type liveStats struct {
+	Connections struct {
+		Active int64 `json:"active"`
+		Idle   int64 `json:"idle"`
+	} `json:"connections"`
+	Transfers  []transfer `json:"transfers"`
+	Throughput struct {
+		Last10s float64 `json:"last10s"`
+		Last60s float64 `json:"last60s"`
+	} `json:"throughput"`
+}
+
+// handler serves the current connections, transfers and recent throughput in bytes per second
+func (t *liveTracker) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var stats liveStats
+		stats.Throughput.Last10s = t.throughput(10)
+		stats.Throughput.Last60s = t.throughput(throughputWindow)
+
+		t.mu.Lock()
+		for _, state := range t.conns {
+			if state == http.StateIdle {
+				stats.Connections.Idle++
+			} else {
+				stats.Connections.Active++
+			}
+		}
+		stats.Transfers = make([]transfer, 0, len(t.transfers))
+		for _, tr := range t.transfers {
+			stats.Transfers = append(stats.Transfers, transfer{
+				ID:      tr.ID,
+				Method:  tr.Method,
+				Path:    tr.Path,
+				Client:  tr.Client,
+				Started: tr.Started,
+				Size:    atomic.LoadInt64(&tr.Size),
+				Sent:    atomic.LoadInt64(&tr.Sent),
+			})
+		}
+		t.mu.Unlock()
+		// Biggest first, that's who is saturating the link
+		sort.Slice(stats.Transfers, func(i, j int) bool { return stats.Transfers[i].Sent > stats.Transfers[j].Sent })
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// logExportQueue is how many entries wait for export before new ones are dropped
+	logExportQueue = 10000
+	// logExportAttempts is how many times a batch is sent before it is dropped
+	logExportAttempts = 3
+	// logExportFinalFlush bounds sending the last batch when the service stops
+	logExportFinalFlush = 5 * time.Second
+)
+
+// LogExportConfig ships access logs and events to Grafana Loki or
+// Elasticsearch, for servers without a log agent
+type LogExportConfig struct {
+	// Type is loki or elasticsearch
+	Type string `json:"type"`
+	// URL is the base URL of the Loki or Elasticsearch server
+	URL string `json:"url"`
+	// Index is the Elasticsearch index or data stream, imageserver by default
+	Index string `json:"index,omitempty"`
+	// Labels are added to the Loki streams, e.g. {"branch": "hamburg"}
+	Labels map[string]string `json:"labels,omitempty"`
+	// Username and Password authenticate with basic auth
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty" secret:"true"`
+	// BatchSize is how many entries are sent at once, 500 by default
+	BatchSize int `json:"batchSize,omitempty"`
+	// FlushInterval is the most seconds an entry waits to be sent, 5 by default
+	FlushInterval int `json:"flushInterval,omitempty"`
+}
+
+func (c *LogExportConfig) validate() []error {
+	var errs []error
+	if c.Type != "loki" && c.Type != "elasticsearch" {
+		errs = append(errs, fmt.Errorf("logExport.type must be loki or elasticsearch, got %q", c.Type))
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		errs = append(errs, fmt.Errorf("logExport.url must be an http or https URL, got %q", c.URL))
+	}
+	if c.BatchSize < 0 {
+		errs = append(errs, fmt.Errorf("logExport.batchSize cannot be negative"))
+	}
+	if c.FlushInterval < 0 {
+		errs = append(errs, fmt.Errorf("logExport.flushInterval cannot be negative"))
+	}
+	return errs
+}
+
+// logEntry is one exported line, either a request or an event log entry
+type logEntry struct {
+	Time       time.Time `json:"@timestamp"`
+	Kind       string    `json:"kind"`
+	Level      string    `json:"level"`
+	EventID    uint32    `json:"eventID,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	DurationMS float64   `json:"durationMs,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Country    string    `json:"country,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+}
+
+// logExporter queues entries and sends them in batches. When the server
+// can't keep up the queue fills and entries are dropped rather than slowing
+// down requests.
+type logExporter struct {
+	config  *LogExportConfig
+	elog    debug.Log
+	client  *http.Client
+	entries chan logEntry
+	dropped uint64
+	// geo adds the client's country to access entries when set
+	geo *mmdb
+}
+
+// newLogExporter returns an exporter for config, or nil when export isn't configured.
+// Its own failures are logged to elog.
+func newLogExporter(config *LogExportConfig, elog debug.Log) *logExporter {
+	if config == nil {
+		return nil
+	}
+	return &logExporter{
+		config:  config,
+		elog:    elog,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		entries: make(chan logEntry, logExportQueue),
+	}
+}
+
+func (e *logExporter) add(entry logEntry) {
+	select {
+	case e.entries <- entry:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// middleware queues an access log entry for every request
+func (e *logExporter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := "info"
+		switch {
+		case rec.status >= 500:
+			level = "error"
+		case rec.status >= 400:
+			level = "warning"
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		var country string
+		if ip := net.ParseIP(client); ip != nil && e.geo != nil {
+			country = e.geo.country(ip)
+		}
+		e.add(logEntry{
+			Time:       start,
+			Kind:       "access",
+			Level:      level,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Client:     client,
+			Country:    country,
+			UserAgent:  r.UserAgent(),
+		})
+	})
+}
+
+// Run sends the queued entries until ctx is done, then sends what is left
+func (e *logExporter) Run(ctx context.Context) {
+	batchSize := e.config.BatchSize
+	if batchSize == 0 {
+		batchSize = 500
+	}
+	interval := time.Duration(e.config.FlushInterval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []logEntry
+	failing := false
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		var err error
+		for attempt := 1; attempt <= logExportAttempts; attempt++ {
+			if err = e.send(ctx, batch); err == nil || ctx.Err() != nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+		// Only log changes, a down log server would otherwise flood the event log
+		if err != nil && !failing {
+			e.elog.Warning(eventExport, fmt.Sprintf("Failed to export %d log entries to %s, dropping them until it recovers: %v", len(batch), e.config.URL, err))
+		} else if err == nil && failing {
+			e.elog.Info(eventExport, fmt.Sprintf("Exporting logs to %s again", e.config.URL))
+		}
+		failing = err != nil
+		batch = batch[:0]
+		if dropped := atomic.SwapUint64(&e.dropped, 0); dropped > 0 {
+			e.elog.Warning(eventExport, fmt.Sprintf("Dropped %d log entries because the export queue was full", dropped))
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Drain what was queued before the stop
+			for len(e.entries) > 0 && len(batch) < logExportQueue {
+				batch = append(batch, <-e.entries)
+			}
+			final, cancel := context.WithTimeout(context.Background(), logExportFinalFlush)
+			flush(final)
+			cancel()
+			return
+		case entry := <-e.entries:
+			batch = append(batch, entry)
+			if len(batch) >= batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+// send posts batch to the log server
+func (e *logExporter) send(ctx context.Context, batch []logEntry) error {
+	var body bytes.Buffer
+	var endpoint, contentType string
+	switch e.config.Type {
+	case "loki":
+		endpoint = strings.TrimSuffix(e.config.URL, "/") + "/loki/api/v1/push"
+		contentType = "application/json"
+		if err := json.NewEncoder(&body).Encode(e.lokiPush(batch)); err != nil {
+			return err
+		}
+	case "elasticsearch":
+		endpoint = strings.TrimSuffix(e.config.URL, "/") + "/_bulk"
+		contentType = "application/x-ndjson"
+		index := e.config.Index
+		if index == "" {
+			index = "imageserver"
+		}
+		enc := json.NewEncoder(&body)
+		for _, entry := range batch {
+			// create works for both indices and data streams
+			enc.Encode(map[string]map[string]string{"create": {"_index": index}})
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.config.Username != "" {
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s %s", endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if e.config.Type == "elasticsearch" {
+		// The bulk API answers 200 even when documents are rejected
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.Errors {
+			return fmt.Errorf("%s rejected some of the documents", endpoint)
+		}
+	}
+	return nil
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// lokiPush groups batch into one stream per kind and level, Loki wants few
+// label combinations and everything else in the line
+func (e *logExporter) lokiPush(batch []logEntry) map[string][]*lokiStream {
+	streams := map[string]*lokiStream{}
+	var order []*lokiStream
+	for _, entry := range batch {
+		key := entry.Kind + "/" + entry.Level
+		stream, ok := streams[key]
+		if !ok {
+			labels := map[string]string{"job": "imageserver", "kind": entry.Kind, "level": entry.Level}
+			for k, v := range e.config.Labels {
+				labels[k] = v
+			}
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			order = append(order, stream)
+		}
+		line, _ := json.Marshal(entry)
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.Time.UnixNano(), 10), string(line)})
+	}
+	return map[string][]*lokiStream{"streams": order}
+}
+
+// exportedLog also queues the events logged through it for export
+type exportedLog struct {
+	debug.Log
+	exporter *logExporter
+}
+
+func (l exportedLog) event(level string, eid uint32, msg string) {
+	l.exporter.add(logEntry{Time: time.Now(), Kind: "event", Level: level, EventID: eid, Message: msg})
+}
+
+func (l exportedLog) Info(eid uint32, msg string) error {
+	l.event("info", eid, msg)
+	return l.Log.Info(eid, msg)
+}
+
+func (l exportedLog) Warning(eid uint32, msg string) error {
+	l.event("warning", eid, msg)
+	return l.Log.Warning(eid, msg)
+}
+
+func (l exportedLog) Error(eid uint32, msg string) error {
+	l.event("error", eid, msg)
+	return l.Log.Error(eid, msg)
+}
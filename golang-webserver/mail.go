@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// mailTimeout bounds sending a mail to the SMTP server
+const mailTimeout = time.Minute
+
+// MailConfig is the mail server the reports and notifications are sent through
+type MailConfig struct {
+	// SMTP is the host:port of the mail server, e.g. smtp.example.com:587.
+	// Port 465 is implicit TLS, other ports use STARTTLS when the server offers it.
+	SMTP string `json:"smtp"`
+	// Username and Password log on to the mail server when set
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty" secret:"true"`
+	// From is the sender address
+	From string `json:"from"`
+}
+
+// validate checks the settings of the section named key
+func (c *MailConfig) validate(key string) []error {
+	var errs []error
+	if host, port, err := net.SplitHostPort(c.SMTP); err != nil || host == "" || port == "" {
+		errs = append(errs, fmt.Errorf("%s.smtp must be host:port, got %q", key, c.SMTP))
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		errs = append(errs, fmt.Errorf("%s.from must be an email address, got %q", key, c.From))
+	}
+	return errs
+}
+
+// validateRecipients checks the addresses of the setting named key
+func validateRecipients(key string, to []string) []error {
+	var errs []error
+	if len(to) == 0 {
+		errs = append(errs, fmt.Errorf("%s needs at least one recipient", key))
+	}
+	for i, address := range to {
+		if _, err := mail.ParseAddress(address); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d] must be an email address, got %q", key, i, address))
+		}
+	}
+	return errs
+}
+
+// writeMailHeader writes the header of a mail from c to the recipients,
+// up to the MIME-Version. The caller adds the Content-Type and the body.
+func (c *MailConfig) writeMailHeader(msg *bytes.Buffer, to []string, subject string) {
+	fmt.Fprintf(msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+}
+
+// send mails msg, a complete message with its header, to the recipients
+func (c *MailConfig) send(to []string, msg []byte) error {
+	host, port, _ := net.SplitHostPort(c.SMTP)
+	dialer := &net.Dialer{Timeout: mailTimeout}
+	var conn net.Conn
+	var err error
+	if port == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.SMTP, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.SMTP)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && port != "465" {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		// PlainAuth refuses to send the password unencrypted, except to localhost
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(mailAddress(c.From)); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := client.Rcpt(mailAddress(address)); err != nil {
+			return fmt.Errorf("%s: %w", address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// mailAddress returns the bare address of "Name <address>"
+func mailAddress(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+	return address
+}
+
+// base64Lines encodes data in base64 broken into the 76 character lines mail allows
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b bytes.Buffer
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	return b.Bytes()
+}
@@ -2,157 +2,498 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/pprof"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unsafe"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.org/x/sys/windows/svc/mgr"
 )
 
-// Config holds the settings for the server
-type Config struct {
-	Port   string `json:"port"`
-	Folder string `json:"folder"`
-}
-
 // Service structure with embedded dependencies
 type Service struct {
 	server     *http.Server
-	elog       *eventlog.Log
+	handler    *swapHandler
+	elog       *leveledLog
 	config     *Config
-	isRunning  bool
-	runningMux sync.Mutex
+	loadConfig func() (*Config, error)
+	monitor    *folderMonitor
+	cache      *fileCache
+	sitemap    *sitemap
+	shares     *shareStore
+	verifier   *folderVerifier
+	hashes     *imageHashIndex
+	git        *gitRepo
+	index      *folderIndex
+	stats      *requestStats
+	exporter   *logExporter
+	publisher  *eventPublisher
+	slowLog    *slowRequestLog
+	notifier   *notifier
+	feed       *changeFeed
+	// listeners are the bound addresses, serveErrors gets the errors that
+	// stop serving one of them
+	listeners   *listenerSet
+	serveErrors chan error
+	isRunning   bool
+	runningMux  sync.Mutex
 }
 
-// LoadConfig reads the configuration file from the executable's directory
-func LoadConfig(filename string) (*Config, error) {
-	exePath, err := os.Executable()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get executable path: %w", err)
-	}
-
-	configPath := filepath.Join(filepath.Dir(exePath), filename)
-	file, err := os.Open(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open config file %s: %w", configPath, err)
-	}
-	defer file.Close()
-
-	var config Config
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to decode config: %w", err)
-	}
-
-	// Validate config
-	if config.Port == "" {
-		return nil, fmt.Errorf("port cannot be empty")
-	}
-	if config.Folder == "" {
-		return nil, fmt.Errorf("folder cannot be empty")
-	}
+// swapHandler lets the handler be replaced while the server is running,
+// e.g. when a config reload changes the folder
+type swapHandler struct {
+	mu sync.RWMutex
+	h  http.Handler
+}
 
-	// Verify folder exists
-	if _, err := os.Stat(config.Folder); os.IsNotExist(err) {
-		return nil, fmt.Errorf("folder does not exist: %s", config.Folder)
-	}
+func (h *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	next := h.h
+	h.mu.RUnlock()
+	next.ServeHTTP(w, r)
+}
 
-	return &config, nil
+// Set replaces the handler used for new requests
+func (h *swapHandler) Set(next http.Handler) {
+	h.mu.Lock()
+	h.h = next
+	h.mu.Unlock()
 }
 
 func (s *Service) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPreShutdown
 	changes <- svc.Status{State: svc.StartPending, Accepts: cmdsAccepted, WaitHint: 10000}
 
-	s.elog.Info(1, "Service Execute started")
+	s.elog.Info(eventStartup, "Service Execute started")
 
 	// Initialize context for shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start server in goroutine
-	errChan := make(chan error, 1)
-	go func() {
-		s.elog.Info(1, fmt.Sprintf("Starting HTTP server on port %s serving folder %s", s.config.Port, s.config.Folder))
+	if s.exporter != nil {
+		// Wait for the last batch, cancel runs first since defers run in reverse
+		exported := make(chan struct{})
+		go func() {
+			s.exporter.Run(ctx)
+			close(exported)
+		}()
+		defer func() {
+			cancel()
+			<-exported
+		}()
+	}
+	if s.publisher != nil {
+		published := make(chan struct{})
+		go func() {
+			s.publisher.Run(ctx)
+			close(published)
+		}()
+		defer func() {
+			cancel()
+			<-published
+		}()
+	}
 
-		s.runningMux.Lock()
-		s.isRunning = true
-		s.runningMux.Unlock()
+	// Cloning the folder or waiting for a network share can take a while,
+	// the service manager is kept informed so it doesn't give up on the start
+	if err := s.startPending(changes, cmdsAccepted, func() error { return prepareFolder(s.config) }); err != nil {
+		s.elog.Error(eventStorage, err.Error())
+		return true, 1
+	}
 
-		if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
-			s.elog.Error(1, fmt.Sprintf("HTTP server error: %v", err))
-			errChan <- err
+	folderCtx, cancelFolder := context.WithCancel(ctx)
+	s.startFolder(folderCtx)
+	defer func() { cancelFolder() }()
+	defer s.verifier.Stop()
+	defer s.hashes.Stop()
+
+	reloads := make(chan *Config)
+	if remote := s.config.RemoteConfig; remote != nil && remote.Interval > 0 {
+		go s.watchRemoteConfig(ctx, time.Duration(remote.Interval)*time.Second, reloads)
+	}
+
+	if err := publishETWStats(ctx, s.stats); err != nil {
+		s.elog.Warning(eventStartup, fmt.Sprintf("Failed to register ETW provider, statistics won't be published: %v", err))
+	}
+
+	// Bind the port before reporting Running so a port conflict fails the start
+	// instead of leaving a service that looks healthy but serves nothing
+	s.elog.Info(eventStartup, fmt.Sprintf("Starting HTTP server on port %s serving folder %s", s.config.Port, s.config.Folder))
+	s.listeners = &listenerSet{}
+	listeners, _, err := s.listeners.update(s.config)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to listen: %v", err)
+		if conflict := portConflict(err); conflict != "" {
+			msg += ", " + conflict
 		}
-	}()
+		s.elog.Error(eventHTTP, msg)
+		return listenExitCode(err)
+	}
+	for _, ln := range listeners[1:] {
+		s.elog.Info(eventStartup, fmt.Sprintf("Also listening on %s", ln))
+	}
 
-	// Wait a moment to ensure server starts
-	time.Sleep(1 * time.Second)
+	// Start server in goroutines, one per listener
+	s.runningMux.Lock()
+	s.isRunning = true
+	s.runningMux.Unlock()
+	s.serveErrors = make(chan error, 1)
+	for _, ln := range listeners {
+		s.serve(ln)
+	}
 
 	// Update status to running
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
-	s.elog.Info(1, "Service status set to running")
+	s.elog.Info(eventStartup, "Service status set to running")
+	if consul := s.config.Consul; consul != nil {
+		go registerConsul(ctx, consul, s.config.Port, s.elog)
+	}
+	if warmup := s.config.Warmup; warmup != nil {
+		go s.warmup(ctx, warmup)
+	}
+	if report := s.config.Report; report != nil {
+		go newReporter(report, s.config.Folder, s.config.Git != nil, s.stats, s.elog).Run(ctx)
+	}
 
 	// Service loop
 	for {
 		select {
-		case err := <-errChan:
-			s.elog.Error(1, fmt.Sprintf("Server error: %v", err))
+		case err := <-s.serveErrors:
+			s.elog.Error(eventHTTP, fmt.Sprintf("Server error: %v", err))
 			return false, 1
+		case config := <-reloads:
+			// Applied from the service loop so s.config is only touched by this goroutine
+			if cancel := s.applyConfig(ctx, config); cancel != nil {
+				cancelFolder()
+				cancelFolder = cancel
+			}
 		case c := <-r:
 			switch c.Cmd {
 			case svc.Interrogate:
-				s.elog.Info(1, "Service interrogate received")
+				s.elog.Info(eventStartup, "Service interrogate received")
 				changes <- c.CurrentStatus
-			case svc.Stop, svc.Shutdown:
-				s.elog.Info(1, "Service stop/shutdown received")
-				changes <- svc.Status{State: svc.StopPending, Accepts: cmdsAccepted, WaitHint: 10000}
+			case svc.Stop, svc.Shutdown, svc.PreShutdown:
+				s.elog.Info(eventStartup, "Service stop/shutdown received")
+				s.shutdown(ctx, changes)
+				s.elog.Info(eventStartup, "Service stopped successfully")
+				return false, 0
+			default:
+				s.elog.Error(eventStartup, fmt.Sprintf("Unexpected control request: %d", c))
+			}
+		}
+	}
+}
+
+// serve serves ln until the server shuts down or ln is removed by a config
+// reload. Any other error stops the service.
+func (s *Service) serve(ln *serverListener) {
+	go func() {
+		if err := s.server.Serve(ln); err != http.ErrServerClosed && !ln.removed() {
+			s.elog.Error(eventHTTP, fmt.Sprintf("HTTP server error on %s: %v", ln, err))
+			select {
+			case s.serveErrors <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// shutdown drains in-flight requests for up to the configured timeout, keeping
+// the service manager informed with StopPending checkpoints while it waits
+func (s *Service) shutdown(ctx context.Context, changes chan<- svc.Status) {
+	timeout := s.config.ShutdownDuration()
+	const progressInterval = time.Second
+	waitHint := uint32((progressInterval * 3).Milliseconds())
 
-				// Graceful shutdown
-				shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 5*time.Second)
-				defer cancelShutdown()
+	changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((timeout + progressInterval + consulTimeout).Milliseconds())}
+	if consul := s.config.Consul; consul != nil {
+		deregisterConsul(consul, s.config.Port, s.elog)
+	}
 
-				s.runningMux.Lock()
-				s.isRunning = false
-				s.runningMux.Unlock()
+	s.runningMux.Lock()
+	s.isRunning = false
+	s.runningMux.Unlock()
 
-				if err := s.server.Shutdown(shutdownCtx); err != nil {
-					s.elog.Error(1, fmt.Sprintf("Error during shutdown: %v", err))
-				}
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, timeout)
+	defer cancelShutdown()
 
-				s.elog.Info(1, "Service stopped successfully")
-				return false, 0
-			default:
-				s.elog.Error(1, fmt.Sprintf("Unexpected control request: %d", c))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.server.Shutdown(shutdownCtx)
+	}()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	checkpoint := uint32(1)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				s.elog.Warning(eventStartup, fmt.Sprintf("Shutdown timeout of %s reached, closing remaining connections: %v", timeout, err))
+				s.server.Close()
 			}
+			return
+		case <-ticker.C:
+			changes <- svc.Status{State: svc.StopPending, CheckPoint: checkpoint, WaitHint: waitHint}
+			checkpoint++
 		}
 	}
 }
 
-func createServer(config *Config) *http.Server {
+// startPending runs step, sending StartPending checkpoints to the service
+// manager while it runs
+func (s *Service) startPending(changes chan<- svc.Status, accepts svc.Accepted, step func() error) error {
+	const progressInterval = time.Second
+	waitHint := uint32((folderStartupDelay + 2*progressInterval).Milliseconds())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- step()
+	}()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	checkpoint := uint32(1)
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			changes <- svc.Status{State: svc.StartPending, Accepts: accepts, CheckPoint: checkpoint, WaitHint: waitHint}
+			checkpoint++
+		}
+	}
+}
+
+// listenExitCode maps a listen error to the exit code reported to the service
+// manager: the Win32 error (e.g. WSAEADDRINUSE when the port is already taken)
+// when there is one, a service-specific code otherwise
+func listenExitCode(err error) (bool, uint32) {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return false, uint32(errno)
+	}
+	return true, 1
+}
+
+// startFolder starts monitoring the folder, watching it for changes when
+// files are cached, indexed or purged from a CDN, and scheduled backups, until ctx is done
+func (s *Service) startFolder(ctx context.Context) {
+	if s.config.Folder == embeddedFolder {
+		// The embedded files can't go away or change
+		return
+	}
+	go s.monitor.Run(ctx)
+	if s.monitor.breaker != nil {
+		go s.monitor.breaker.Run(ctx)
+	}
+	if s.git != nil {
+		go s.git.Run(ctx)
+	}
+	var listeners []func(name string)
+	if s.cache != nil {
+		listeners = append(listeners, s.cache.invalidate)
+	}
+	if s.index != nil {
+		listeners = append(listeners, s.index.changed)
+		go s.index.Run(ctx)
+	}
+	if s.sitemap != nil {
+		listeners = append(listeners, s.sitemap.changed)
+	}
+	if purger := newCDNPurger(s.config.CDN, s.elog); purger != nil {
+		listeners = append(listeners, purger.changed)
+		go purger.Run(ctx)
+	}
+	if s.notifier != nil {
+		listeners = append(listeners, s.notifier.changed)
+		go s.notifier.Run(ctx)
+	}
+	if s.publisher != nil && s.publisher.config.publishes("file") {
+		listeners = append(listeners, s.publisher.changed)
+	}
+	if s.feed != nil {
+		listeners = append(listeners, s.feed.watch(s.config.Folder))
+	}
+	if len(listeners) > 0 {
+		isGit := s.config.Git != nil
+		go watchChanges(ctx, s.config.Folder, s.elog, func(name string) {
+			if isGit && isGitPath("", name) {
+				// Pulls rewrite the repository, only the working tree is served
+				return
+			}
+			for _, changed := range listeners {
+				changed(name)
+			}
+		})
+	}
+	if backup := s.config.Backup; backup != nil && backup.Interval > 0 {
+		go scheduleBackups(ctx, s.config.Folder, backup, s.elog)
+	}
+}
+
+// newHandler builds the routes for config, serving files through cache unless it is nil
+func newHandler(config *Config, monitor *folderMonitor, cache *fileCache, sitemap *sitemap, shares *shareStore, verifier *folderVerifier, hashes *imageHashIndex, git *gitRepo, index *folderIndex, stats *requestStats, feed *changeFeed) http.Handler {
+	embedded := config.Folder == embeddedFolder
+	files := monitor.files()
+	if embedded {
+		files = embeddedFiles()
+	} else if cache != nil {
+		files = cache
+	}
+	if index != nil {
+		files = indexFS{files, index}
+	}
+	if git != nil {
+		files = gitTreeFS{files, config.Folder}
+	}
+	files = normalizedFS{files}
+	conversions.configure(config.Conversions)
+
 	mux := http.NewServeMux()
-	mux.Handle("/", http.FileServer(http.Dir(config.Folder)))
+	if index != nil {
+		mux.HandleFunc("/readyz", index.readyHandler(monitor))
+	} else {
+		mux.HandleFunc("/readyz", monitor.readyHandler)
+	}
+	dimensions := &imageDimensions{}
+	// readOnly also holds for the admin API, whatever the token allows
+	guard := func(h http.Handler) http.Handler {
+		if config.ReadOnly {
+			return readOnlyGuard(h)
+		}
+		return h
+	}
+	if git != nil && (config.adminAPI() || config.Git.WebhookSecret != "") {
+		mux.Handle("/api/git/pull", guard(git.handler(config.AdminToken)))
+	}
+	if config.adminAPI() {
+		mux.Handle("/api/config", adminOnly(config.AdminToken, configHandler(config)))
+		// These scan the folder on disk
+		if !embedded {
+			mux.Handle("/api/verify", adminOnly(config.AdminToken, verifier.handler(config.Folder)))
+			mux.Handle("/api/duplicates", adminOnly(config.AdminToken, hashes.duplicatesHandler(config.Folder)))
+			mux.Handle(similarPrefix, adminOnly(config.AdminToken, hashes.similarHandler(config.Folder)))
+			mux.Handle(contactSheetPrefix, adminOnly(config.AdminToken, contactSheetHandler(config.Folder)))
+		}
+		mux.Handle("/api/metrics", adminOnly(config.AdminToken, metricsHandler(stats, cache, monitor.breaker)))
+		mux.Handle("/api/stats/live", adminOnly(config.AdminToken, stats.live.handler()))
+		mux.Handle("/api/transfers/kill", adminOnly(config.AdminToken, stats.live.killHandler()))
+		mux.Handle("/api/bans", guard(adminOnly(config.AdminToken, stats.live.bansHandler())))
+		mux.Handle("/admin/stats", adminPage(config.AdminToken, dashboardHandler(stats, cache)))
+		mux.Handle(graphqlPath, adminOnly(config.AdminToken, newLibrary(files, dimensions, stats, cache, config.ContentTypes).handler()))
+		if config.Fetch != nil {
+			mux.Handle("/api/fetch", adminOnly(config.AdminToken, fetchHandler(config.Fetch, config.Folder, contentTypeOverrides(config.ContentTypes))))
+		}
+		if shares != nil {
+			mux.Handle("/api/share", guard(adminOnly(config.AdminToken, shares.createHandler(config.Shares, config.Folder))))
+			mux.Handle("/api/shares", guard(adminOnly(config.AdminToken, shares.manageHandler(config.Shares))))
+		}
+		// Profiling is only offered on a private listener, never next to the files
+		if config.adminListener() {
+			mux.Handle("/debug/pprof/", adminOnly(config.AdminToken, http.HandlerFunc(pprof.Index)))
+			mux.Handle("/debug/pprof/cmdline", adminOnly(config.AdminToken, http.HandlerFunc(pprof.Cmdline)))
+			mux.Handle("/debug/pprof/profile", adminOnly(config.AdminToken, http.HandlerFunc(pprof.Profile)))
+			mux.Handle("/debug/pprof/symbol", adminOnly(config.AdminToken, http.HandlerFunc(pprof.Symbol)))
+			mux.Handle("/debug/pprof/trace", adminOnly(config.AdminToken, http.HandlerFunc(pprof.Trace)))
+		}
+	}
+	// API keys are checked against the image path, as for the image itself
+	dimensionsAPI := dimensions.handler(files)
+	if len(config.APIKeys) > 0 {
+		dimensionsAPI = apiKeyGuard(config.APIKeys, dimensionsAPI)
+	}
+	mux.Handle(dimensionsPrefix, monitor.middleware(http.StripPrefix(strings.TrimSuffix(dimensionsPrefix, "/"), dimensionsAPI)))
+	fileHandler := newFileHandler(config, files, dimensions)
+	if config.CanonicalCase {
+		fileHandler = canonicalCaseRedirect(config.Folder, fileHandler)
+	}
+	if config.ReadOnly {
+		fileHandler = readOnlyGuard(fileHandler)
+	}
+	if len(config.Headers) > 0 {
+		fileHandler = headerRules(diskFolder(config), config.Headers, fileHandler)
+	}
+	if config.CDN != nil {
+		fileHandler = surrogateKeyHeaders(fileHandler)
+	}
+	if feed != nil {
+		// Listing settings and API keys apply to the folder of each event
+		events := feed.eventsHandler(config)
+		mux.Handle(eventsPrefix, events)
+		mux.Handle(eventsPrefix+"/", events)
+		mux.Handle(grpcWatchPath, feed.grpcHandler(config))
+	}
+	if config.RobotsTxt != "" {
+		mux.Handle("/robots.txt", robotsHandler(config.RobotsTxt))
+	}
+	if sitemap != nil {
+		mux.Handle("/sitemap.xml", sitemap)
+	}
+	if shares != nil {
+		// Share links bypass API keys and prefix settings, the token is the key
+		mux.Handle(sharePrefix, monitor.middleware(shares.shareHandler(config.Shares, files, feed)))
+	}
+	if len(config.BlockUserAgents) > 0 {
+		fileHandler = userAgentBlock(config.BlockUserAgents, fileHandler)
+	}
+	mux.Handle("/", monitor.middleware(fileHandler))
+	return pageSettings(config.Language, config.Theme, requestLimits(config.Limits, mux))
+}
+
+// readOnlyGuard rejects every request that could modify the folder, whatever
+// credentials it carries, for mirror and DR instances
+func readOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			http.Error(w, "server is read-only", http.StatusMethodNotAllowed)
+		}
+	})
+}
 
+// writeTimeout bounds each write of a response, see listenerConn.Write.
+// The server has no timeout for whole responses, large downloads to slow
+// clients take as long as they take.
+const writeTimeout = 15 * time.Second
+
+func createServer(config *Config, handler http.Handler, elog debug.Log) *http.Server {
 	return &http.Server{
-		Addr:         ":" + config.Port,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:        ":" + config.Port,
+		Handler:     handler,
+		ReadTimeout: 15 * time.Second,
+		IdleTimeout: 60 * time.Second,
+		ErrorLog:    httpErrorLog(elog),
 	}
 }
 
 func main() {
+	if os.Getenv(gitAskPassEnv) != "" {
+		os.Exit(runGitAskPass(os.Args[1:]))
+	}
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "install":
-			if err := installService(); err != nil {
+			opts, err := parseInstallOptions(os.Args[2:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := installService(opts); err != nil {
 				log.Fatal(err)
 			}
 			fmt.Println("Service installed successfully")
@@ -163,17 +504,33 @@ func main() {
 			}
 			fmt.Println("Service removed successfully")
 			return
-		case "debug":
-			// Run in debug mode with console logging
-			config, err := LoadConfig("config.json")
-			if err != nil {
-				log.Fatal(err)
-			}
-			server := createServer(config)
-			log.Printf("Debug mode: Serving %s on port %s\n", config.Folder, config.Port)
-			if err := server.ListenAndServe(); err != nil {
+		case "update":
+			if err := runUpdate(os.Args[2:]); err != nil {
 				log.Fatal(err)
 			}
+			fmt.Println("Service updated successfully")
+			return
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "backup":
+			os.Exit(runBackupCommand(os.Args[2:]))
+		case "sync":
+			os.Exit(runSync(os.Args[2:]))
+		case "optimize":
+			os.Exit(runOptimize(os.Args[2:]))
+		case "warmup":
+			os.Exit(runWarmup(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "report":
+			os.Exit(runReportCommand(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		case "debug":
+			// Run in debug mode with console logging, Ctrl+C stops the server
+			runService(true, os.Args[2:])
 			return
 		}
 	}
@@ -187,40 +544,234 @@ func main() {
 		log.Fatal("This program can only be run as a Windows service or with the debug flag")
 	}
 
-	// Initialize event logger
-	elog, err := eventlog.Open("ImageServer")
-	if err != nil {
-		log.Fatal("Failed to open event log:", err)
+	// The service command line can carry --config and overrides set at install time
+	var serviceArgs []string
+	if len(os.Args) > 2 && os.Args[1] == "service" {
+		serviceArgs = os.Args[2:]
 	}
-	defer elog.Close()
+	runService(false, serviceArgs)
+}
 
-	elog.Info(1, "Service starting...")
+// runService loads the config and runs the service, either under the service
+// manager or interactively in debug mode with events written to the console
+func runService(interactive bool, args []string) {
+	var elog debug.Log
+	if interactive {
+		elog = debug.New("ImageServer")
+	} else {
+		// Initialize event logger
+		eventLog, err := eventlog.Open("ImageServer")
+		if err != nil {
+			log.Fatal("Failed to open event log:", err)
+		}
+		defer eventLog.Close()
+		elog = eventLog
+	}
+
+	elog.Info(eventStartup, "Service starting...")
+	removeOldExecutable()
 
 	// Load configuration
-	config, err := LoadConfig("config.json")
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		elog.Error(eventConfig, fmt.Sprintf("Invalid arguments: %v", err))
+		log.Fatal(err)
+	}
+	config, err := flags.Load()
 	if err != nil {
-		elog.Error(1, fmt.Sprintf("Failed to load config: %v", err))
+		elog.Error(eventConfig, fmt.Sprintf("Failed to load config: %v", err))
 		log.Fatal(err)
 	}
 
-	// Create service instance
+	// Create service instance, only logging events at or above the configured level from here on
+	exporter := newLogExporter(config.LogExport, elog)
+	if exporter != nil {
+		elog = exportedLog{Log: elog, exporter: exporter}
+	}
+	logger := newLeveledLog(elog, config.LogLevel)
+	for _, warning := range config.Warnings() {
+		logger.Warning(eventConfig, "Config: "+warning)
+	}
+	monitor := newFolderMonitor(config.Folder, config.CircuitBreaker, logger)
+	stats := &requestStats{started: time.Now()}
+	stats.live.elog = logger
+	cache := newFileCache(monitor.files(), config.FileCacheMB)
+	sitemap := newSitemap(config.Sitemap, config.Folder, logger)
+	shares, err := openShareStore(config.Shares)
+	if err != nil {
+		elog.Error(eventConfig, fmt.Sprintf("Failed to load the shares: %v", err))
+		log.Fatal(err)
+	}
+	verifier := &folderVerifier{}
+	hashes, err := openHashIndex()
+	if err != nil {
+		logger.Warning(eventStorage, fmt.Sprintf("Failed to load the image hash index, the next scan starts over: %v", err))
+	}
+	git := newGitRepo(config.Git, config.Folder, logger)
+	index := newFolderIndex(config.Index, config.Folder, config.Git != nil, logger)
+	var feed *changeFeed
+	if config.ChangeEvents && config.Folder != embeddedFolder {
+		feed = newChangeFeed()
+	}
+	handler := &swapHandler{h: newHandler(config, monitor, cache, sitemap, shares, verifier, hashes, git, index, stats, feed)}
+	var guarded http.Handler = handler
+	if config.GeoIP != nil {
+		db, err := openMMDB(config.GeoIP.Database)
+		if err != nil {
+			elog.Error(eventConfig, fmt.Sprintf("Failed to open the GeoIP database: %v", err))
+			log.Fatal(err)
+		}
+		guarded = geoIPGuard(config.GeoIP, db, guarded)
+		if exporter != nil {
+			exporter.geo = db
+		}
+	}
+	slowLog := newSlowRequestLog(logger, config.SlowRequestMS)
+	root := stats.middleware(slowLog.middleware(guarded))
+	if exporter != nil {
+		root = exporter.middleware(root)
+	}
+	publisher := newEventPublisher(config.Publish, config.Folder, logger)
+	if publisher != nil {
+		root = publisher.middleware(root)
+	}
+	server := createServer(config, root, logger)
+	server.ConnState = stats.live.connState
+	server.ConnContext = connContext
+	if feed != nil {
+		// Shutdown waits for the streams
+		server.RegisterOnShutdown(feed.close)
+	}
 	srv := &Service{
-		server: createServer(config),
-		elog:   elog,
-		config: config,
+		server:     server,
+		handler:    handler,
+		elog:       logger,
+		config:     config,
+		loadConfig: flags.Load,
+		monitor:    monitor,
+		cache:      cache,
+		sitemap:    sitemap,
+		shares:     shares,
+		verifier:   verifier,
+		hashes:     hashes,
+		git:        git,
+		index:      index,
+		stats:      stats,
+		exporter:   exporter,
+		publisher:  publisher,
+		slowLog:    slowLog,
+		notifier:   newNotifier(config.Notifications, config.Shares, config.Folder, shares, logger),
+		feed:       feed,
 	}
 
 	// Run service
-	err = svc.Run("ImageServer", srv)
-	if err != nil {
-		elog.Error(1, fmt.Sprintf("Service failed: %v", err))
+	run := svc.Run
+	if interactive {
+		run = debug.Run
+	}
+	if err := run("ImageServer", srv); err != nil {
+		elog.Error(eventStartup, fmt.Sprintf("Service failed: %v", err))
 		log.Fatal(err)
 	}
 }
 
 // Add these functions after the main() function:
 
-func installService() error {
+// installOptions holds the flags accepted by the install command
+type installOptions struct {
+	delayedStart bool
+	dependencies []string
+	firewall     bool
+	user         string
+	password     string
+	serviceArgs  []string
+	// config is nil when the config couldn't be loaded, with configErr set
+	config    *Config
+	configErr error
+}
+
+// stringList is a flag value that can be repeated and also accepts comma separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// parseInstallOptions parses the arguments following the install command
+func parseInstallOptions(args []string) (*installOptions, error) {
+	opts := &installOptions{}
+	var depends stringList
+
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	fs.BoolVar(&opts.delayedStart, "delayed-start", false, "start the service after other auto-start services (Automatic (Delayed Start))")
+	fs.Var(&depends, "depend", "service that must be running before this one starts (can be repeated)")
+	fs.BoolVar(&opts.firewall, "firewall", false, "create an inbound Windows Firewall rule for the configured port")
+	fs.StringVar(&opts.user, "user", "LocalSystem", `account the service runs as, e.g. DOMAIN\user (needed to read network shares)`)
+	fs.StringVar(&opts.password, "password", "", "password for the account given with --user, or a secret reference like @credman:NAME")
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	opts.user = normalizeAccountName(opts.user)
+	var err error
+	if opts.password, err = resolveSecret(opts.password); err != nil {
+		return nil, fmt.Errorf("--password: %w", err)
+	}
+	opts.dependencies = depends
+
+	// The service is started with the same config file and overrides
+	serviceArgs, err := flags.args()
+	if err != nil {
+		return nil, err
+	}
+	opts.serviceArgs = append([]string{"service"}, serviceArgs...)
+	opts.config, opts.configErr = flags.Load()
+
+	// A UNC folder is only reachable once the workstation service is up
+	if opts.config != nil && isUNCPath(opts.config.Folder) {
+		if !containsFold(opts.dependencies, "LanmanWorkstation") {
+			opts.dependencies = append(opts.dependencies, "LanmanWorkstation")
+		}
+	}
+
+	return opts, nil
+}
+
+// isUNCPath reports whether path points at a network share (\\server\share)
+func isUNCPath(path string) bool {
+	return strings.HasPrefix(path, `\\`) || strings.HasPrefix(path, "//")
+}
+
+// isBuiltinAccount reports whether account is one of the service accounts
+// that are allowed to run services out of the box
+func isBuiltinAccount(account string) bool {
+	return containsFold([]string{
+		"LocalSystem",
+		`NT AUTHORITY\LocalService`,
+		`NT AUTHORITY\NetworkService`,
+	}, account)
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func installService(opts *installOptions) error {
 	// First try to remove any existing event logger
 	eventlog.Remove("ImageServer") // Ignore error as it might not exist
 
@@ -242,6 +793,13 @@ func installService() error {
 		return fmt.Errorf("service already exists - please remove it first")
 	}
 
+	// Builtin accounts already have the right, anything else needs it before the service can start
+	if !isBuiltinAccount(opts.user) {
+		if err := grantLogonAsService(opts.user); err != nil {
+			return err
+		}
+	}
+
 	s, err = m.CreateService(
 		"ImageServer",
 		exePath,
@@ -249,15 +807,45 @@ func installService() error {
 			StartType:        mgr.StartAutomatic,
 			DisplayName:      "Image Server",
 			Description:      "A simple image-serving web server.",
-			ServiceStartName: "LocalSystem",
+			ServiceStartName: opts.user,
+			Password:         opts.password,
+			DelayedAutoStart: opts.delayedStart,
+			Dependencies:     opts.dependencies,
 		},
-		"service",
+		opts.serviceArgs...,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to create service: %w", err)
 	}
 	defer s.Close()
 
+	// Restart automatically if the process dies: first after 5s, then every 30s,
+	// with the failure count reset after a day without crashes
+	recoveryActions := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+	}
+	if err := s.SetRecoveryActions(recoveryActions, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+	// Also recover when the service stops itself with a non-zero exit code
+	if err := s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to enable recovery on non-crash failures: %w", err)
+	}
+
+	// Give the pre-shutdown drain enough time before Windows kills the process
+	shutdownTimeout := defaultShutdownTimeout * time.Second
+	if opts.config != nil {
+		shutdownTimeout = opts.config.ShutdownDuration()
+	}
+	if err := setPreshutdownTimeout(s, shutdownTimeout+10*time.Second); err != nil {
+		s.Delete()
+		return err
+	}
+
 	// Install event logger
 	err = eventlog.InstallAsEventCreate("ImageServer", eventlog.Error|eventlog.Warning|eventlog.Info)
 	if err != nil {
@@ -268,6 +856,27 @@ func installService() error {
 		}
 	}
 
+	if opts.firewall {
+		if opts.config == nil {
+			s.Delete()
+			return fmt.Errorf("cannot create firewall rule without a valid config: %w", opts.configErr)
+		}
+		if err := addFirewallRule(exePath, firewallPorts(opts.config)); err != nil {
+			s.Delete()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPreshutdownTimeout sets how long the service manager waits for the
+// service to handle SERVICE_CONTROL_PRESHUTDOWN
+func setPreshutdownTimeout(s *mgr.Service, timeout time.Duration) error {
+	info := uint32(timeout.Milliseconds())
+	if err := windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_PRESHUTDOWN_INFO, (*byte)(unsafe.Pointer(&info))); err != nil {
+		return fmt.Errorf("failed to set pre-shutdown timeout: %w", err)
+	}
 	return nil
 }
 
@@ -314,5 +923,11 @@ func removeService() error {
 		}
 	}
 
+	// Remove the firewall rule in case the service was installed with
+	// --firewall. The service is gone already, so this doesn't fail the removal.
+	if err := removeFirewallRule(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v, delete the %q rule in Windows Firewall by hand\n", err, firewallRuleName)
+	}
+
 	return nil
 }
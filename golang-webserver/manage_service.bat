@@ -44,13 +44,9 @@ goto :eof
 :process_commands
 if "%1"=="install" (
     echo Installing %SERVICE_NAME% service...
-    "%~dp0%EXE_NAME%" install
+    "%~dp0%EXE_NAME%" install %2 %3 %4 %5 %6 %7 %8 %9
     if !errorLevel! equ 0 (
         echo Service installed successfully.
-        echo Configuring service...
-        sc config %SERVICE_NAME% start= auto
-        sc failure %SERVICE_NAME% reset= 86400 actions= restart/60000/restart/60000/restart/60000
-        echo Service configured for automatic restart on failure.
     ) else (
         echo Failed to install service.
     )
@@ -123,6 +119,52 @@ if "%1"=="disable" (
     goto end
 )
 
+if "%1"=="update" (
+    echo Updating %SERVICE_NAME% service...
+    "%~dp0%EXE_NAME%" update %2 %3
+    goto end
+)
+
+if "%1"=="check" (
+    "%~dp0%EXE_NAME%" check %2 %3
+    goto end
+)
+
+if "%1"=="verify" (
+    "%~dp0%EXE_NAME%" verify %2 %3 %4 %5
+    goto end
+)
+
+if "%1"=="backup" (
+    "%~dp0%EXE_NAME%" backup %2 %3
+    goto end
+)
+
+if "%1"=="report" (
+    "%~dp0%EXE_NAME%" report %2 %3 %4
+    goto end
+)
+
+if "%1"=="sync" (
+    "%~dp0%EXE_NAME%" sync %2 %3 %4 %5 %6 %7 %8 %9
+    goto end
+)
+
+if "%1"=="warmup" (
+    "%~dp0%EXE_NAME%" warmup %2 %3 %4 %5 %6 %7 %8 %9
+    goto end
+)
+
+if "%1"=="bench" (
+    "%~dp0%EXE_NAME%" bench %2 %3 %4 %5 %6 %7 %8 %9
+    goto end
+)
+
+if "%1"=="selftest" (
+    "%~dp0%EXE_NAME%" selftest
+    goto end
+)
+
 if "%1"=="debug" (
     echo Running in debug mode...
     "%~dp0%EXE_NAME%" debug
@@ -157,7 +199,12 @@ echo.
 echo ImageServer Service Manager
 echo =========================
 echo Usage:
-echo   %~n0 install        - Install the service
+echo   %~n0 install [OPTIONS] - Install the service
+echo       --delayed-start       Use Automatic (Delayed Start)
+echo       --depend SERVICE      Service that must start first (repeatable)
+echo       --firewall            Open the configured port in Windows Firewall
+echo       --user ACCOUNT        Run the service as ACCOUNT instead of LocalSystem
+echo       --password PASSWORD   Password for --user
 echo   %~n0 remove         - Remove the service
 echo   %~n0 start          - Start the service
 echo   %~n0 stop           - Stop the service
@@ -165,6 +212,15 @@ echo   %~n0 restart        - Restart the service
 echo   %~n0 status         - Check service status
 echo   %~n0 enable         - Enable and start service
 echo   %~n0 disable        - Stop and disable service
+echo   %~n0 update [--url URL] - Download, verify and install a new release
+echo   %~n0 check [--config FILE] - Validate the config and show effective settings
+echo   %~n0 verify [--checksums FILE] - Report images that are corrupt or truncated
+echo   %~n0 backup [--target DIR] - Copy new and changed images to the backup folder
+echo   %~n0 sync --from DIR [--interval 5m] [--delete remove] - Mirror DIR into the folder
+echo   %~n0 selftest       - Check the server against a temporary folder
+echo   %~n0 warmup --target URL --log FILE - Fetch the most requested URLs of a log
+echo   %~n0 bench --target URL [--concurrency 16] [--log FILE] - Load a server and report latencies
+echo   %~n0 report [--dry-run] - Mail the weekly report of the folder now
 echo   %~n0 debug          - Run in debug mode
 echo   %~n0 config         - Show current config
 echo   %~n0 config PORT FOLDER - Create/update config file
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS is an http.FileSystem held in memory. It behaves like http.Dir on a
+// folder, so tests use it in place of one, and it is the reference
+// filesystem_test.go checks the wrappers of the folder and other storage
+// against.
+type memFS struct {
+	mu   sync.RWMutex
+	root *memNode
+}
+
+// memNode is a file or directory of a memFS
+type memNode struct {
+	data    []byte
+	modTime time.Time
+	// children is nil for files
+	children map[string]*memNode
+}
+
+func newMemFS() *memFS {
+	return &memFS{root: &memNode{children: map[string]*memNode{}}}
+}
+
+// WriteFile stores a copy of data as the file at the slash separated name,
+// creating the directories above it with the same modification time
+func (m *memFS) WriteFile(name string, data []byte, modTime time.Time) error {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := m.root
+	elems := strings.Split(name[1:], "/")
+	for _, elem := range elems[:len(elems)-1] {
+		next, ok := dir.children[elem]
+		if !ok {
+			next = &memNode{modTime: modTime, children: map[string]*memNode{}}
+			dir.children[elem] = next
+			dir.modTime = modTime
+		} else if next.children == nil {
+			return &fs.PathError{Op: "write", Path: name, Err: errors.New("not a directory")}
+		}
+		dir = next
+	}
+	base := elems[len(elems)-1]
+	if node, ok := dir.children[base]; ok && node.children != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: errors.New("is a directory")}
+	}
+	dir.children[base] = &memNode{data: append([]byte(nil), data...), modTime: modTime}
+	dir.modTime = modTime
+	return nil
+}
+
+// Remove deletes the file or directory at name with everything below it
+func (m *memFS) Remove(name string) error {
+	name = path.Clean("/" + name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, ok := m.lookup(path.Dir(name))
+	if name == "/" || !ok || dir.children == nil || dir.children[path.Base(name)] == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(dir.children, path.Base(name))
+	return nil
+}
+
+// lookup returns the node at the clean name, m.mu must be held
+func (m *memFS) lookup(name string) (*memNode, bool) {
+	node := m.root
+	if name == "/" {
+		return node, true
+	}
+	for _, elem := range strings.Split(name[1:], "/") {
+		if node.children == nil {
+			return nil, false
+		}
+		next, ok := node.children[elem]
+		if !ok {
+			return nil, false
+		}
+		node = next
+	}
+	return node, true
+}
+
+func (n *memNode) info(name string) *indexEntry {
+	if n.children != nil {
+		return &indexEntry{name: name, mode: fs.ModeDir | 0o555, modTime: n.modTime}
+	}
+	return &indexEntry{name: name, size: int64(len(n.data)), mode: 0o444, modTime: n.modTime}
+}
+
+func (m *memFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	info := node.info(path.Base(name))
+	if node.children == nil {
+		// Written files are never modified, a new write replaces the node
+		return &memFile{Reader: bytes.NewReader(node.data), info: info}, nil
+	}
+	// The listing is taken when the directory is opened, like a snapshot
+	entries := make([]fs.FileInfo, 0, len(node.children))
+	for elem, child := range node.children {
+		entries = append(entries, child.info(elem))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return &memDir{info: info, entries: entries}, nil
+}
+
+// memDir is an open directory of a memFS
+type memDir struct {
+	info    fs.FileInfo
+	entries []fs.FileInfo
+	offset  int
+}
+
+func (d *memDir) Close() error {
+	return nil
+}
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// Seek only rewinds the listing, as on a directory opened from disk
+func (d *memDir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &fs.PathError{Op: "seek", Path: d.info.Name(), Err: fs.ErrInvalid}
+	}
+	d.offset = 0
+	return 0, nil
+}
+
+func (d *memDir) Readdir(count int) ([]fs.FileInfo, error) {
+	rest := d.entries[d.offset:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if len(rest) > count {
+			rest = rest[:count]
+		}
+	}
+	d.offset += len(rest)
+	return append([]fs.FileInfo(nil), rest...), nil
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDimensionEntries bounds the dimensions cache, which is simply emptied when full
+const maxDimensionEntries = 10000
+
+// dimensionsPrefix is the URL path GET /api/dimensions/<path> is served below
+const dimensionsPrefix = "/api/dimensions/"
+
+// imageDimensions caches the dimensions of images by path, for as long as
+// their size and modification time stay the same
+type imageDimensions struct {
+	mu      sync.Mutex
+	entries map[string]dimensionEntry
+}
+
+type dimensionEntry struct {
+	size          int64
+	modTime       time.Time
+	width, height int
+	ok            bool
+}
+
+// get returns the dimensions of the image at name, whose stat info is size
+// and modTime, decoding only its header when they aren't cached. ok is false
+// for files that aren't in a format the decoders know.
+func (d *imageDimensions) get(files http.FileSystem, name string, size int64, modTime time.Time) (width, height int, ok bool) {
+	d.mu.Lock()
+	entry, found := d.entries[name]
+	d.mu.Unlock()
+	if found && entry.size == size && entry.modTime.Equal(modTime) {
+		return entry.width, entry.height, entry.ok
+	}
+
+	entry = dimensionEntry{size: size, modTime: modTime}
+	if f, err := files.Open(name); err == nil {
+		if config, _, err := image.DecodeConfig(f); err == nil {
+			entry.width, entry.height, entry.ok = config.Width, config.Height, true
+		}
+		f.Close()
+	}
+
+	d.mu.Lock()
+	if d.entries == nil || len(d.entries) >= maxDimensionEntries {
+		d.entries = map[string]dimensionEntry{}
+	}
+	d.entries[name] = entry
+	d.mu.Unlock()
+	return entry.width, entry.height, entry.ok
+}
+
+// fileETag is a strong validator from the file's size and modification time,
+// so conditional requests and HEAD probes never need to read the content
+func fileETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// metadataHeaders sets ETag, which http.FileServer then answers If-None-Match
+// with, and when dimensions is set the X-Image-Width and X-Image-Height of
+// images, so HEAD requests tell clients everything about a file without
+// transferring it
+func metadataHeaders(files http.FileSystem, dimensions *imageDimensions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		f, err := files.Open(name)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil || info.IsDir() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("ETag", fileETag(info.Size(), info.ModTime()))
+		if dimensions != nil {
+			if width, height, ok := dimensions.get(files, name, info.Size(), info.ModTime()); ok {
+				w.Header().Set("X-Image-Width", strconv.Itoa(width))
+				w.Header().Set("X-Image-Height", strconv.Itoa(height))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handler serves the width, height and aspect ratio of the image at the
+// request path as JSON, from the dimensions cache, so layout engines can
+// reserve space before loading the image
+func (d *imageDimensions) handler(files http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		f, err := files.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		width, height, ok := d.get(files, name, info.Size(), info.ModTime())
+		if !ok {
+			http.Error(w, "not an image the server can read the dimensions of", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		etag := fileETag(info.Size(), info.ModTime())
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(struct {
+			Width  int     `json:"width"`
+			Height int     `json:"height"`
+			Aspect float64 `json:"aspect"`
+		}{width, height, math.Round(float64(width)/float64(height)*10000) / 10000})
+	})
+}
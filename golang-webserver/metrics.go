@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxMetricSeries bounds the label combinations tracked, requests beyond it
+// are counted under prefix "other" so scanners can't grow the map without end
+const maxMetricSeries = 1000
+
+// responseSizeBuckets are the upper bounds of the response size histogram
+var responseSizeBuckets = []int64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+
+// seriesKey labels a request by the first element of its path, its file
+// extension and its status code
+type seriesKey struct {
+	prefix string
+	ext    string
+	status int
+}
+
+type seriesStats struct {
+	requests uint64
+	bytes    uint64
+}
+
+// sizeHistogram counts responses by size for one path prefix
+type sizeHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     uint64
+}
+
+// requestBreakdown holds the labeled series behind /api/metrics
+type requestBreakdown struct {
+	mu     sync.Mutex
+	series map[seriesKey]*seriesStats
+	sizes  map[string]*sizeHistogram
+}
+
+// metricLabels returns the prefix and extension label of a request path,
+// lowercase since paths are case insensitive on Windows
+func metricLabels(urlPath string) (prefix, ext string) {
+	p := strings.ToLower(path.Clean("/" + urlPath))
+	prefix = "/"
+	if i := strings.Index(p[1:], "/"); i >= 0 {
+		prefix = p[:i+2]
+	}
+	return prefix, path.Ext(p)
+}
+
+// statuses returns the requests by status code
+func (b *requestBreakdown) statuses() map[int]uint64 {
+	statuses := map[int]uint64{}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, series := range b.series {
+		statuses[key.status] += series.requests
+	}
+	return statuses
+}
+
+func (b *requestBreakdown) observe(urlPath string, status int, bytes int64) {
+	prefix, ext := metricLabels(urlPath)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.series == nil {
+		b.series = map[seriesKey]*seriesStats{}
+		b.sizes = map[string]*sizeHistogram{}
+	}
+
+	key := seriesKey{prefix: prefix, ext: ext, status: status}
+	series, ok := b.series[key]
+	if !ok {
+		if len(b.series) >= maxMetricSeries {
+			key = seriesKey{prefix: "other", status: status}
+			prefix = "other"
+			series = b.series[key]
+		}
+		if series == nil {
+			series = &seriesStats{}
+			b.series[key] = series
+		}
+	}
+	series.requests++
+	series.bytes += uint64(bytes)
+
+	hist, ok := b.sizes[prefix]
+	if !ok {
+		hist = &sizeHistogram{buckets: make([]uint64, len(responseSizeBuckets))}
+		b.sizes[prefix] = hist
+	}
+	for i, bound := range responseSizeBuckets {
+		if bytes <= bound {
+			hist.buckets[i]++
+		}
+	}
+	hist.count++
+	hist.sum += uint64(bytes)
+}
+
+// metricsHandler serves the request statistics in the Prometheus text format.
+// cache may be nil when the file cache is disabled.
+func metricsHandler(stats *requestStats, cache *fileCache, breaker *circuitBreaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		var b strings.Builder
+		snapshot := stats.Snapshot()
+		fmt.Fprintf(&b, "# HELP imageserver_client_errors_total Responses with a 4xx status.\n# TYPE imageserver_client_errors_total counter\nimageserver_client_errors_total %d\n", snapshot.ClientErrors)
+		fmt.Fprintf(&b, "# HELP imageserver_server_errors_total Responses with a 5xx status.\n# TYPE imageserver_server_errors_total counter\nimageserver_server_errors_total %d\n", snapshot.ServerErrors)
+
+		b.WriteString("# HELP imageserver_request_duration_seconds Request duration quantiles over the last 2048 requests.\n# TYPE imageserver_request_duration_seconds gauge\n")
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			fmt.Fprintf(&b, "imageserver_request_duration_seconds{quantile=\"%g\"} %g\n", q, stats.latency.percentile(q).Seconds())
+		}
+
+		stats.breakdown.mu.Lock()
+		keys := make([]seriesKey, 0, len(stats.breakdown.series))
+		for key := range stats.breakdown.series {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].prefix != keys[j].prefix {
+				return keys[i].prefix < keys[j].prefix
+			}
+			if keys[i].ext != keys[j].ext {
+				return keys[i].ext < keys[j].ext
+			}
+			return keys[i].status < keys[j].status
+		})
+		b.WriteString("# HELP imageserver_requests_total Requests by path prefix, file extension and status.\n# TYPE imageserver_requests_total counter\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "imageserver_requests_total{%s} %d\n", seriesLabels(key), stats.breakdown.series[key].requests)
+		}
+		b.WriteString("# HELP imageserver_response_bytes_total Body bytes served by path prefix, file extension and status.\n# TYPE imageserver_response_bytes_total counter\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "imageserver_response_bytes_total{%s} %d\n", seriesLabels(key), stats.breakdown.series[key].bytes)
+		}
+
+		prefixes := make([]string, 0, len(stats.breakdown.sizes))
+		for prefix := range stats.breakdown.sizes {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		b.WriteString("# HELP imageserver_response_size_bytes Response body sizes by path prefix.\n# TYPE imageserver_response_size_bytes histogram\n")
+		for _, prefix := range prefixes {
+			hist := stats.breakdown.sizes[prefix]
+			label := "prefix=" + labelValue(prefix)
+			for i, bound := range responseSizeBuckets {
+				fmt.Fprintf(&b, "imageserver_response_size_bytes_bucket{%s,le=\"%d\"} %d\n", label, bound, hist.buckets[i])
+			}
+			fmt.Fprintf(&b, "imageserver_response_size_bytes_bucket{%s,le=\"+Inf\"} %d\n", label, hist.count)
+			fmt.Fprintf(&b, "imageserver_response_size_bytes_sum{%s} %d\n", label, hist.sum)
+			fmt.Fprintf(&b, "imageserver_response_size_bytes_count{%s} %d\n", label, hist.count)
+		}
+		stats.breakdown.mu.Unlock()
+
+		if cache != nil {
+			b.WriteString("# HELP imageserver_file_cache_lookups_total File cache lookups by result.\n# TYPE imageserver_file_cache_lookups_total counter\n")
+			fmt.Fprintf(&b, "imageserver_file_cache_lookups_total{result=\"hit\"} %d\n", atomic.LoadUint64(&cache.hits))
+			fmt.Fprintf(&b, "imageserver_file_cache_lookups_total{result=\"miss\"} %d\n", atomic.LoadUint64(&cache.misses))
+		}
+		b.WriteString("# HELP imageserver_conversion_cache_lookups_total Converted image cache lookups by result.\n# TYPE imageserver_conversion_cache_lookups_total counter\n")
+		fmt.Fprintf(&b, "imageserver_conversion_cache_lookups_total{result=\"hit\"} %d\n", atomic.LoadUint64(&conversions.hits))
+		fmt.Fprintf(&b, "imageserver_conversion_cache_lookups_total{result=\"miss\"} %d\n", atomic.LoadUint64(&conversions.misses))
+		conversions.mu.Lock()
+		fmt.Fprintf(&b, "# HELP imageserver_conversion_cache_bytes Bytes of converted images cached.\n# TYPE imageserver_conversion_cache_bytes gauge\nimageserver_conversion_cache_bytes %d\n", conversions.size)
+		conversions.mu.Unlock()
+		if breaker != nil {
+			open := 0
+			if breaker.Err() != nil {
+				open = 1
+			}
+			fmt.Fprintf(&b, "# HELP imageserver_circuit_open Whether the circuit breaker refuses file requests.\n# TYPE imageserver_circuit_open gauge\nimageserver_circuit_open %d\n", open)
+			fmt.Fprintf(&b, "# HELP imageserver_circuit_trips_total Times the circuit breaker opened.\n# TYPE imageserver_circuit_trips_total counter\nimageserver_circuit_trips_total %d\n", breaker.Trips())
+		}
+		w.Write([]byte(b.String()))
+	})
+}
+
+func seriesLabels(key seriesKey) string {
+	return fmt.Sprintf("prefix=%s,ext=%s,status=\"%d\"", labelValue(key.prefix), labelValue(key.ext), key.status)
+}
+
+// labelEscaper escapes label values as the Prometheus text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
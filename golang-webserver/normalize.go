@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modnormaliz         = windows.NewLazySystemDLL("normaliz.dll")
+	procNormalizeString = modnormaliz.NewProc("NormalizeString")
+)
+
+// normalizationC asks NormalizeString for the composed form, NFC
+const normalizationC = 1
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// nfc returns s in Unicode normalization form C, or s itself when Windows
+// can't normalize it
+func nfc(s string) string {
+	if isASCII(s) || procNormalizeString.Find() != nil {
+		return s
+	}
+	src, err := windows.UTF16FromString(s)
+	if err != nil {
+		return s
+	}
+	src = src[:len(src)-1]
+	size := len(src) + 8
+	// A negative result estimates the size needed, which may take a few tries
+	for try := 0; try < 4; try++ {
+		dst := make([]uint16, size)
+		r, _, callErr := procNormalizeString.Call(normalizationC, uintptr(unsafe.Pointer(&src[0])), uintptr(len(src)), uintptr(unsafe.Pointer(&dst[0])), uintptr(len(dst)))
+		n := int(int32(r))
+		if n > 0 {
+			return windows.UTF16ToString(dst[:n])
+		}
+		if callErr != windows.ERROR_INSUFFICIENT_BUFFER {
+			return s
+		}
+		if -n > size {
+			size = -n
+		} else {
+			size *= 2
+		}
+	}
+	return s
+}
+
+// normalizedFS opens the file whose name differs from the requested one
+// only in its Unicode normalization when no file has the exact name, e.g.
+// the decomposed names (NFD) files copied from macOS have for the composed
+// ones (NFC) browsers send, which display the same
+type normalizedFS struct {
+	http.FileSystem
+}
+
+func (n normalizedFS) Open(name string) (http.File, error) {
+	f, err := n.FileSystem.Open(name)
+	if err == nil || !os.IsNotExist(err) || isASCII(name) {
+		return f, err
+	}
+	resolved, ok := n.resolve(name)
+	if !ok {
+		return nil, err
+	}
+	return n.FileSystem.Open(resolved)
+}
+
+// resolve returns name with its elements as they are named in the folder,
+// comparing them in NFC
+func (n normalizedFS) resolve(name string) (string, bool) {
+	resolved := "/"
+	for _, elem := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if isASCII(elem) {
+			resolved = path.Join(resolved, elem)
+			continue
+		}
+		dir, err := n.FileSystem.Open(resolved)
+		if err != nil {
+			return "", false
+		}
+		entries, err := dir.Readdir(-1)
+		dir.Close()
+		if err != nil {
+			return "", false
+		}
+		want := nfc(elem)
+		found := ""
+		for _, entry := range entries {
+			if !isASCII(entry.Name()) && nfc(entry.Name()) == want {
+				found = entry.Name()
+				break
+			}
+		}
+		if found == "" {
+			return "", false
+		}
+		resolved = path.Join(resolved, found)
+	}
+	return resolved, true
+}
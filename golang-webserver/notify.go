@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"image/jpeg"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// notifyCheckInterval is how often the quiet folders are looked for
+	notifyCheckInterval = 15 * time.Second
+	// notifyMaxFiles and notifyThumbnails bound how many files a mail lists,
+	// and how many of them it shows a thumbnail of
+	notifyMaxFiles   = 50
+	notifyThumbnails = 6
+	// notifyThumbnailSize is the pixels the thumbnails are fitted in
+	notifyThumbnailSize = 160
+)
+
+// NotificationConfig emails the watchers of a folder when files land in it
+type NotificationConfig struct {
+	MailConfig
+	// Watch are the folders and who is told about new files in them
+	Watch []WatchConfig `json:"watch"`
+	// QuietSeconds is how long a folder has to stay unchanged before the mail
+	// goes out, so a batch of uploads makes one mail. 300 by default.
+	QuietSeconds int `json:"quietSeconds,omitempty"`
+	// LinkDays is how many days the share link in the mail works, 7 by default
+	LinkDays int `json:"linkDays,omitempty"`
+}
+
+// WatchConfig is a folder with the people told about its new files
+type WatchConfig struct {
+	// Folder is the URL path of the folder, files in its subfolders count too
+	Folder string `json:"folder"`
+	// To are the recipients
+	To []string `json:"to"`
+}
+
+func (c *NotificationConfig) validate(shares *ShareConfig) []error {
+	errs := c.MailConfig.validate("notifications")
+	if shares == nil || shares.BaseURL == "" {
+		errs = append(errs, fmt.Errorf("notifications need shares with a baseURL for the links in the mails"))
+	}
+	if len(c.Watch) == 0 {
+		errs = append(errs, fmt.Errorf("notifications.watch needs at least one folder"))
+	}
+	for i, watch := range c.Watch {
+		if !strings.HasPrefix(watch.Folder, "/") {
+			errs = append(errs, fmt.Errorf("notifications.watch[%d].folder must start with /, got %q", i, watch.Folder))
+		}
+		errs = append(errs, validateRecipients(fmt.Sprintf("notifications.watch[%d].to", i), watch.To)...)
+	}
+	if c.QuietSeconds < 0 {
+		errs = append(errs, fmt.Errorf("notifications.quietSeconds cannot be negative"))
+	}
+	if c.LinkDays < 0 || time.Duration(c.LinkDays)*24*time.Hour > shareMaxExpiry {
+		errs = append(errs, fmt.Errorf("notifications.linkDays must be between 0 and %d", int(shareMaxExpiry/(24*time.Hour))))
+	}
+	return errs
+}
+
+func (c *NotificationConfig) quiet() time.Duration {
+	if c.QuietSeconds == 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.QuietSeconds) * time.Second
+}
+
+func (c *NotificationConfig) linkDuration() time.Duration {
+	if c.LinkDays == 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(c.LinkDays) * 24 * time.Hour
+}
+
+// notifier collects the files changed in the watched folders and mails
+// their watchers once a folder has been quiet for a while
+type notifier struct {
+	config      *NotificationConfig
+	shareConfig *ShareConfig
+	folder      string
+	shares      *shareStore
+	elog        debug.Log
+	changes     chan string
+}
+
+// newNotifier returns a notifier for config, or nil when notifications aren't configured
+func newNotifier(config *NotificationConfig, shareConfig *ShareConfig, folder string, shares *shareStore, elog debug.Log) *notifier {
+	if config == nil || shares == nil {
+		return nil
+	}
+	return &notifier{
+		config:      config,
+		shareConfig: shareConfig,
+		folder:      folder,
+		shares:      shares,
+		elog:        elog,
+		changes:     make(chan string, 1024),
+	}
+}
+
+// changed queues a path relative to the folder that changed
+func (n *notifier) changed(name string) {
+	if name == "" {
+		// Missed changes can't be told apart from old files
+		return
+	}
+	select {
+	case n.changes <- name:
+	default:
+		// Too many changes at once, the names are only for the mail
+	}
+}
+
+// pendingUploads are the files changed in a watched folder that await a mail
+type pendingUploads struct {
+	files map[string]bool
+	last  time.Time
+}
+
+// Run mails the watchers of the folders changed until ctx is done
+func (n *notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(notifyCheckInterval)
+	defer ticker.Stop()
+	// By index of the watch
+	pending := map[int]*pendingUploads{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-n.changes:
+			urlPath := "/" + name
+			for i, watch := range n.config.Watch {
+				if !inFolder(urlPath, watch.Folder) || isTemporaryFile(path.Base(urlPath)) {
+					continue
+				}
+				p := pending[i]
+				if p == nil {
+					p = &pendingUploads{files: map[string]bool{}}
+					pending[i] = p
+				}
+				p.files[urlPath] = true
+				p.last = time.Now()
+			}
+		case now := <-ticker.C:
+			for i, p := range pending {
+				if now.Sub(p.last) < n.config.quiet() {
+					continue
+				}
+				delete(pending, i)
+				watch := n.config.Watch[i]
+				sent, err := n.notify(watch, p.files)
+				switch {
+				case err != nil:
+					n.elog.Warning(eventMail, fmt.Sprintf("Failed to tell %s about the new files in %s: %v", strings.Join(watch.To, ", "), watch.Folder, err))
+				case sent > 0:
+					n.elog.Info(eventMail, fmt.Sprintf("Told %s about %d new files in %s", strings.Join(watch.To, ", "), sent, watch.Folder))
+				}
+			}
+		}
+	}
+}
+
+// inFolder reports whether urlPath is below the folder, case insensitively as on Windows
+func inFolder(urlPath, folder string) bool {
+	dir := prefixDir(folder)
+	p := strings.ToLower(urlPath)
+	return dir == "" || strings.HasPrefix(p, dir+"/")
+}
+
+// isTemporaryFile reports whether name looks like a file still being
+// written or an editor's scratch file, which aren't worth a mail
+func isTemporaryFile(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tmp", ".part", ".partial", ".crdownload", ".download"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return strings.HasPrefix(name, "~$") || strings.HasPrefix(name, ".") || lower == "thumbs.db" || lower == "desktop.ini"
+}
+
+// uploadedFile is a file listed in a notification
+type uploadedFile struct {
+	Name string
+	Link string
+	Size string
+	// CID is the Content-ID of its thumbnail, or "" without one
+	CID       string
+	modified  time.Time
+	thumbnail []byte
+}
+
+// notify mails the watchers of watch about the files that still exist, with
+// a new share link to the folder, returning how many files it told about
+func (n *notifier) notify(watch WatchConfig, changed map[string]bool) (int, error) {
+	var files []uploadedFile
+	for urlPath := range changed {
+		info, err := os.Stat(filepath.Join(n.folder, filepath.FromSlash(urlPath)))
+		if err != nil || !info.Mode().IsRegular() {
+			// Deleted again, or a folder whose files are listed themselves
+			continue
+		}
+		files = append(files, uploadedFile{Name: urlPath, Size: formatBytes(uint64(info.Size())), modified: info.ModTime()})
+	}
+	if len(files) == 0 {
+		return 0, nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modified.After(files[j].modified) })
+	total := len(files)
+	if len(files) > notifyMaxFiles {
+		files = files[:notifyMaxFiles]
+	}
+
+	folder := path.Clean(watch.Folder)
+	sh, err := n.shares.create(folder, n.config.linkDuration(), 0, "")
+	if err != nil {
+		return 0, err
+	}
+	base := strings.TrimSuffix(n.shareConfig.BaseURL, "/")
+	thumbnails := 0
+	for i := range files {
+		f := &files[i]
+		name := filepath.Join(n.folder, filepath.FromSlash(f.Name))
+		// The file matched the folder case insensitively, the case may differ
+		rel := f.Name[len(strings.TrimSuffix(folder, "/")):]
+		f.Link = base + shareURL(sh, rel)
+		f.Name = strings.TrimPrefix(rel, "/")
+		if thumbnails < notifyThumbnails {
+			if f.thumbnail = notificationThumbnail(name); f.thumbnail != nil {
+				thumbnails++
+				f.CID = fmt.Sprintf("thumb%d@imageserver", thumbnails)
+			}
+		}
+	}
+
+	data := notificationData{
+		Folder:  folder,
+		Link:    base + shareURL(sh, "/"),
+		Files:   files,
+		More:    total - len(files),
+		Expires: sh.Expires.Local().Format("2 January 2006"),
+	}
+	subject := fmt.Sprintf("%d new files in %s", total, folder)
+	if total == 1 {
+		subject = fmt.Sprintf("New file in %s: %s", folder, files[0].Name)
+	}
+	msg, err := n.message(watch.To, subject, data)
+	if err != nil {
+		return 0, err
+	}
+	if err := n.config.send(watch.To, msg); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// notificationThumbnail returns a small JPEG of the image file name, or nil
+// when it isn't an image that decodes
+func notificationThumbnail(name string) []byte {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+	default:
+		return nil
+	}
+	img, err := decodeImageFile(name)
+	if err != nil {
+		return nil
+	}
+	w, h := fitSize(img.Bounds().Dx(), img.Bounds().Dy(), notifyThumbnailSize)
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, thumbnail(img, w, h), &jpeg.Options{Quality: 80}); err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+type notificationData struct {
+	Folder  string
+	Link    string
+	Files   []uploadedFile
+	More    int
+	Expires string
+}
+
+var notificationTemplate = template.Must(template.New("notification").Parse(`<!doctype html>
+<html>
+<body style="font-family:sans-serif;color:#18181b">
+<p>New files are up in <strong>{{.Folder}}</strong>.</p>
+<p><a href="{{.Link}}" style="display:inline-block;padding:.6em 1.2em;background:#2563eb;color:#fff;text-decoration:none;border-radius:4px">Open the folder</a></p>
+<table cellpadding="6" style="border-collapse:collapse">
+{{range .Files}}<tr><td>{{if .CID}}<a href="{{.Link}}"><img src="cid:{{.CID}}" alt="" style="display:block;max-width:160px"></a>{{end}}</td><td><a href="{{.Link}}">{{.Name}}</a><br><span style="color:#71717a">{{.Size}}</span></td></tr>
+{{end}}</table>
+{{if .More}}<p>And {{.More}} more.</p>{{end}}
+<p style="color:#71717a;font-size:.85em">The link works until {{.Expires}}.</p>
+</body>
+</html>
+`))
+
+// message builds the mail: a plain text and an HTML version, the HTML one
+// with the thumbnails attached inline
+func (n *notifier) message(to []string, subject string, data notificationData) ([]byte, error) {
+	var text strings.Builder
+	fmt.Fprintf(&text, "New files are up in %s:\r\n%s\r\n\r\n", data.Folder, data.Link)
+	for _, f := range data.Files {
+		fmt.Fprintf(&text, "%s (%s)\r\n%s\r\n\r\n", f.Name, f.Size, f.Link)
+	}
+	if data.More > 0 {
+		fmt.Fprintf(&text, "And %d more.\r\n\r\n", data.More)
+	}
+	fmt.Fprintf(&text, "The link works until %s.\r\n", data.Expires)
+	var page bytes.Buffer
+	if err := notificationTemplate.Execute(&page, data); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	n.config.writeMailHeader(&msg, to, subject)
+	alternative := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", alternative.Boundary())
+
+	part, err := alternative.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Transfer-Encoding": {"quoted-printable"}})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write([]byte(text.String()))
+	qp.Close()
+
+	var related bytes.Buffer
+	relatedWriter := multipart.NewWriter(&related)
+	part, err = alternative.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/related; boundary=" + relatedWriter.Boundary()}})
+	if err != nil {
+		return nil, err
+	}
+	html, err := relatedWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}, "Content-Transfer-Encoding": {"quoted-printable"}})
+	if err != nil {
+		return nil, err
+	}
+	qp = quotedprintable.NewWriter(html)
+	qp.Write(page.Bytes())
+	qp.Close()
+	for _, f := range data.Files {
+		if f.CID == "" {
+			continue
+		}
+		image, err := relatedWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/jpeg"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<" + f.CID + ">"},
+			"Content-Disposition":       {"inline"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		image.Write(base64Lines(f.thumbnail))
+	}
+	relatedWriter.Close()
+	part.Write(related.Bytes())
+	alternative.Close()
+	return msg.Bytes(), nil
+}
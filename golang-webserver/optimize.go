@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pngColorChunks change how a PNG is rendered or animate it, the standard
+// library decoder ignores them so such files can't be re-encoded losslessly
+var pngColorChunks = map[string]bool{"iCCP": true, "gAMA": true, "cHRM": true, "acTL": true}
+
+// pngPlainChunks carry the image itself and survive re-encoding, any other
+// chunk is metadata that re-encoding drops
+var pngPlainChunks = map[string]bool{"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true, "tRNS": true}
+
+// pngCopiedChunks change how a PNG is rendered but not with its pixel
+// format, which re-encoding may change, so they are copied over from the
+// original. bKGD isn't one of them, its value depends on the format.
+var pngCopiedChunks = map[string]bool{"sRGB": true}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// optimizeOptions controls an optimize run
+type optimizeOptions struct {
+	folder        string
+	backup        string
+	stripMetadata bool
+	dryRun        bool
+}
+
+// optimizeResult summarizes an optimize run
+type optimizeResult struct {
+	Scanned   int
+	Optimized int
+	Skipped   int
+	Saved     int64
+	Failed    []verifyProblem
+}
+
+func (r optimizeResult) String() string {
+	return fmt.Sprintf("%d scanned, %d optimized (%d bytes saved), %d skipped, %d failed", r.Scanned, r.Optimized, r.Saved, r.Skipped, len(r.Failed))
+}
+
+// pngChunkTypes returns the chunk types of a PNG file
+func pngChunkTypes(data []byte) ([]string, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+	var types []string
+	for i := len(pngSignature); i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		types = append(types, string(data[i+4:i+8]))
+		i += 12 + length
+	}
+	return types, nil
+}
+
+// pngChunks returns the chunks of data whose types are in types, each with
+// its length, type and CRC
+func pngChunks(data []byte, types map[string]bool) [][]byte {
+	var chunks [][]byte
+	for i := len(pngSignature); i+12 <= len(data); {
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			break
+		}
+		if types[string(data[i+4:i+8])] {
+			chunks = append(chunks, data[i:end])
+		}
+		i = end
+	}
+	return chunks
+}
+
+// optimizePNG returns data re-encoded with the best compression, or nil when
+// that wouldn't be smaller or would lose something
+func optimizePNG(data []byte, stripMetadata bool) ([]byte, error) {
+	types, err := pngChunkTypes(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if pngColorChunks[t] || (!pngPlainChunks[t] && !pngCopiedChunks[t] && !stripMetadata) {
+			return nil, nil
+		}
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	if copied := pngChunks(data, pngCopiedChunks); len(copied) > 0 {
+		// They go right after IHDR, ahead of PLTE and IDAT as they have to
+		encoded := buf.Bytes()
+		ihdr := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(encoded[len(pngSignature):]))
+		var out bytes.Buffer
+		out.Write(encoded[:ihdr])
+		for _, chunk := range copied {
+			out.Write(chunk)
+		}
+		out.Write(encoded[ihdr:])
+		buf = out
+	}
+	if buf.Len() >= len(data) {
+		return nil, nil
+	}
+	// Cheap insurance next to rewriting an original in place
+	check, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil || !samePixels(img, check) {
+		return nil, fmt.Errorf("re-encoded image doesn't match the original")
+	}
+	return buf.Bytes(), nil
+}
+
+func samePixels(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// optimizeFolder re-encodes the PNGs of opts.folder in place when that makes
+// them smaller without changing a pixel, copying each original to opts.backup first
+func optimizeFolder(ctx context.Context, opts optimizeOptions, progress func(optimizeResult)) (optimizeResult, error) {
+	var result optimizeResult
+	lastProgress := time.Now()
+	err := filepath.WalkDir(opts.folder, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, relErr := filepath.Rel(opts.folder, path)
+		if relErr != nil {
+			return relErr
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, verifyProblem{Path: filepath.ToSlash(rel), Problem: err.Error()})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".png") {
+			return nil
+		}
+		result.Scanned++
+		if time.Since(lastProgress) >= syncProgressInterval {
+			progress(result)
+			lastProgress = time.Now()
+		}
+
+		fail := func(err error) error {
+			result.Failed = append(result.Failed, verifyProblem{Path: filepath.ToSlash(rel), Problem: err.Error()})
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fail(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fail(err)
+		}
+		optimized, err := optimizePNG(data, opts.stripMetadata)
+		if err != nil {
+			return fail(err)
+		}
+		if optimized == nil {
+			result.Skipped++
+			return nil
+		}
+		if !opts.dryRun {
+			if opts.backup != "" {
+				if _, err := copyFile(path, filepath.Join(opts.backup, rel), info.ModTime()); err != nil {
+					return fail(fmt.Errorf("backing up the original: %v", err))
+				}
+			}
+			if err := writeFileAtomic(path, optimized); err != nil {
+				return fail(err)
+			}
+		}
+		result.Optimized++
+		result.Saved += int64(len(data) - len(optimized))
+		return nil
+	})
+	return result, err
+}
+
+// runOptimize re-encodes the PNGs of the configured folder losslessly. It
+// returns the process exit code: 0 on success, 1 when files failed and 2
+// when the run couldn't start.
+func runOptimize(args []string) int {
+	fs := flag.NewFlagSet("optimize", flag.ContinueOnError)
+	backup := fs.String("backup", "", "folder the originals are copied to before being replaced")
+	noBackup := fs.Bool("no-backup", false, "replace the originals without keeping a copy")
+	stripMetadata := fs.Bool("strip-metadata", false, "also optimize PNGs with text, EXIF or other metadata, which is dropped")
+	dryRun := fs.Bool("dry-run", false, "only report what would be optimized and the bytes saved")
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *backup == "" && !*noBackup && !*dryRun {
+		fmt.Fprintln(os.Stderr, "--backup is required, or --no-backup to replace the originals without a copy")
+		return 2
+	}
+	config, err := flags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if config.Folder == embeddedFolder {
+		fmt.Fprintln(os.Stderr, "The folder is embedded in the executable, optimize works on a folder on disk")
+		return 2
+	}
+	if config.ReadOnly && !*dryRun {
+		fmt.Fprintln(os.Stderr, "The folder is configured as readOnly, not optimizing it")
+		return 2
+	}
+	if rel, err := filepath.Rel(config.Folder, *backup); *backup != "" && err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		fmt.Fprintln(os.Stderr, "--backup cannot be inside the folder")
+		return 2
+	}
+	opts := optimizeOptions{folder: config.Folder, backup: *backup, stripMetadata: *stripMetadata, dryRun: *dryRun}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	started := time.Now()
+	result, err := optimizeFolder(ctx, opts, func(r optimizeResult) {
+		fmt.Printf("Optimizing %s: %s so far\n", opts.folder, r)
+	})
+	for _, f := range result.Failed {
+		fmt.Printf("%s: %s\n", f.Path, f.Problem)
+	}
+	fmt.Printf("Optimized %s in %s: %s\n", opts.folder, time.Since(started).Round(time.Second), result)
+	switch {
+	case err != nil && ctx.Err() == nil:
+		fmt.Fprintln(os.Stderr, "Optimize failed:", err)
+		return 2
+	case len(result.Failed) > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// testPNG returns an uncompressed PNG with the chunks inserted after IHDR
+func testPNG(t *testing.T, chunks map[string][]byte) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	ihdr := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+	out := append([]byte{}, data[:ihdr]...)
+	for typ, content := range chunks {
+		chunk := make([]byte, 4, 12+len(content))
+		binary.BigEndian.PutUint32(chunk, uint32(len(content)))
+		chunk = append(append(chunk, typ...), content...)
+		chunk = append(chunk, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(chunk[4:len(chunk)-4]))
+		out = append(out, chunk...)
+	}
+	return append(out, data[ihdr:]...)
+}
+
+func TestOptimizePNGKeepsSRGB(t *testing.T) {
+	data := testPNG(t, map[string][]byte{"sRGB": {0}})
+	optimized, err := optimizePNG(data, false)
+	if err != nil || optimized == nil {
+		t.Fatalf("the PNG wasn't optimized: %v", err)
+	}
+	types, err := pngChunkTypes(optimized)
+	if err != nil || len(types) < 2 || types[0] != "IHDR" || types[1] != "sRGB" {
+		t.Errorf("the optimized PNG has the chunks %v, %v", types, err)
+	}
+	if !bytes.Equal(pngChunks(optimized, pngCopiedChunks)[0], pngChunks(data, pngCopiedChunks)[0]) {
+		t.Error("the sRGB chunk changed")
+	}
+	original, _ := png.Decode(bytes.NewReader(data))
+	if img, err := png.Decode(bytes.NewReader(optimized)); err != nil || !samePixels(original, img) {
+		t.Errorf("the optimized PNG doesn't decode to the same pixels: %v", err)
+	}
+}
+
+func TestOptimizePNGMetadata(t *testing.T) {
+	data := testPNG(t, map[string][]byte{"bKGD": {0, 0, 0, 0, 0, 0}})
+	if optimized, err := optimizePNG(data, false); err != nil || optimized != nil {
+		t.Errorf("a PNG with bKGD was optimized without --strip-metadata: %v", err)
+	}
+	optimized, err := optimizePNG(data, true)
+	if err != nil || optimized == nil {
+		t.Fatalf("the PNG wasn't optimized with --strip-metadata: %v", err)
+	}
+	if types, _ := pngChunkTypes(optimized); len(pngChunks(optimized, map[string]bool{"bKGD": true})) != 0 {
+		t.Errorf("--strip-metadata kept bKGD: %v", types)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modiphlpapi             = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetExtendedTcpTable = modiphlpapi.NewProc("GetExtendedTcpTable")
+)
+
+// tcpTableOwnerPIDListener asks GetExtendedTcpTable for listening sockets with their process
+const tcpTableOwnerPIDListener = 3
+
+// mibTCPRowOwnerPID is a MIB_TCPROW_OWNER_PID
+type mibTCPRowOwnerPID struct {
+	State      uint32
+	LocalAddr  uint32
+	LocalPort  uint32
+	RemoteAddr uint32
+	RemotePort uint32
+	OwningPID  uint32
+}
+
+// mibTCP6RowOwnerPID is a MIB_TCP6ROW_OWNER_PID
+type mibTCP6RowOwnerPID struct {
+	LocalAddr     [16]byte
+	LocalScopeID  uint32
+	LocalPort     uint32
+	RemoteAddr    [16]byte
+	RemoteScopeID uint32
+	RemotePort    uint32
+	State         uint32
+	OwningPID     uint32
+}
+
+// tcpListenerTable returns the raw table of listening sockets for family
+func tcpListenerTable(family uint32) ([]byte, error) {
+	size := uint32(4096)
+	for {
+		buf := make([]byte, size)
+		r, _, _ := procGetExtendedTcpTable.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0, uintptr(family), tcpTableOwnerPIDListener, 0)
+		switch windows.Errno(r) {
+		case 0:
+			return buf, nil
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			// size was updated, the table may grow again before the next call
+			continue
+		default:
+			return nil, windows.Errno(r)
+		}
+	}
+}
+
+// listeningPID returns the process listening on the TCP port, over IPv4 or IPv6
+func listeningPID(port int) (uint32, error) {
+	// Ports are stored in network byte order in the low 16 bits
+	want := uint32(port>>8&0xff | port&0xff<<8)
+	for _, family := range []uint32{windows.AF_INET, windows.AF_INET6} {
+		buf, err := tcpListenerTable(family)
+		if err != nil {
+			return 0, err
+		}
+		n := *(*uint32)(unsafe.Pointer(&buf[0]))
+		// The rows start after dwNumEntries, aligned to their 4 byte fields
+		rows := unsafe.Pointer(&buf[4])
+		for i := uint32(0); i < n; i++ {
+			if family == windows.AF_INET {
+				row := (*mibTCPRowOwnerPID)(unsafe.Add(rows, uintptr(i)*unsafe.Sizeof(mibTCPRowOwnerPID{})))
+				if row.LocalPort == want {
+					return row.OwningPID, nil
+				}
+			} else {
+				row := (*mibTCP6RowOwnerPID)(unsafe.Add(rows, uintptr(i)*unsafe.Sizeof(mibTCP6RowOwnerPID{})))
+				if row.LocalPort == want {
+					return row.OwningPID, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no process is listening on port %d", port)
+}
+
+// processName returns the executable name of pid, or an empty string when the
+// service account may not query it
+func processName(pid uint32) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return ""
+	}
+	return filepath.Base(windows.UTF16ToString(buf[:size]))
+}
+
+// portConflict describes the process holding the port when err is a listen
+// failing with WSAEADDRINUSE, or returns an empty string when it can't be found
+func portConflict(err error) string {
+	var opErr *net.OpError
+	if !errors.Is(err, windows.WSAEADDRINUSE) || !errors.As(err, &opErr) {
+		return ""
+	}
+	addr, ok := opErr.Addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	pid, err := listeningPID(addr.Port)
+	if err != nil {
+		return ""
+	}
+	if pid == 4 {
+		// Sockets of HTTP.sys, used by IIS and other services sharing ports through it
+		return fmt.Sprintf("port %d is used by HTTP.sys (PID 4), see netsh http show servicestate", addr.Port)
+	}
+	if name := processName(pid); name != "" {
+		return fmt.Sprintf("port %d is used by %s (PID %d)", addr.Port, name, pid)
+	}
+	return fmt.Sprintf("port %d is used by PID %d", addr.Port, pid)
+}
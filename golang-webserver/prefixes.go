@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PrefixConfig turns features on or off for the URL paths below Path, e.g.
+// to make /raw/ a plain file server while /web/ keeps listings. Settings
+// left out inherit the top-level behaviour; the longest matching path wins.
+type PrefixConfig struct {
+	Path string `json:"path"`
+	// Listings serves directory listings, which are on by default
+	Listings *bool `json:"listings,omitempty"`
+	// RequireAPIKey requires one of the apiKeys, on by default when any are configured
+	RequireAPIKey *bool `json:"requireAPIKey,omitempty"`
+	// SniffContentType overrides the top-level sniffContentType
+	SniffContentType *bool `json:"sniffContentType,omitempty"`
+	// NoIndex sends X-Robots-Tag so search engines don't index the files, off by default
+	NoIndex *bool `json:"noIndex,omitempty"`
+	// Transforms handles ?format= and ?ops=, which are on by default
+	Transforms *bool `json:"transforms,omitempty"`
+}
+
+func validatePrefixes(prefixes []PrefixConfig) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, prefix := range prefixes {
+		if !strings.HasPrefix(prefix.Path, "/") {
+			errs = append(errs, fmt.Errorf("prefixes[%d].path must start with /, got %q", i, prefix.Path))
+			continue
+		}
+		dir := prefixDir(prefix.Path)
+		if seen[dir] {
+			errs = append(errs, fmt.Errorf("prefixes[%d].path %q is configured twice", i, prefix.Path))
+		}
+		seen[dir] = true
+	}
+	return errs
+}
+
+// prefixDir normalizes a prefix to its lowercase, composed (NFC) directory
+// without trailing slash
+func prefixDir(prefix string) string {
+	return strings.TrimSuffix(strings.ToLower(nfc(path.Clean(prefix))), "/")
+}
+
+// matchPath returns the URL path p the way prefixes are matched against it.
+// Windows opens the same file for names that differ in case, trailing dots
+// and spaces, Unicode normalization or by being an 8.3 short name, so each
+// element is brought to one spelling: the long name on disk below folder,
+// trimmed, composed (NFC) and lowercase.
+func matchPath(folder, p string) string {
+	elems := strings.Split(path.Clean("/"+p), "/")
+	for i, elem := range elems {
+		if trimmed := strings.TrimRight(elem, ". "); trimmed != "" {
+			elem = trimmed
+		}
+		elems[i] = nfc(elem)
+	}
+	return strings.ToLower(longPath(folder, strings.Join(elems, "/")))
+}
+
+// diskFolder returns the folder short names are resolved in, none when the
+// files are built into the executable
+func diskFolder(config *Config) string {
+	if config.Folder == embeddedFolder {
+		return ""
+	}
+	return config.Folder
+}
+
+// fileFeatures are the features the file handler chain is built with
+type fileFeatures struct {
+	listings      bool
+	requireAPIKey bool
+	sniff         bool
+	noIndex       bool
+	transforms    bool
+}
+
+func (f fileFeatures) with(prefix PrefixConfig) fileFeatures {
+	if prefix.Listings != nil {
+		f.listings = *prefix.Listings
+	}
+	if prefix.RequireAPIKey != nil {
+		f.requireAPIKey = *prefix.RequireAPIKey
+	}
+	if prefix.SniffContentType != nil {
+		f.sniff = *prefix.SniffContentType
+	}
+	if prefix.NoIndex != nil {
+		f.noIndex = *prefix.NoIndex
+	}
+	if prefix.Transforms != nil {
+		f.transforms = *prefix.Transforms
+	}
+	return f
+}
+
+// newFileHandler serves files from files with the features of config, and of
+// its prefixes for the paths below them. dimensions caches the image
+// dimensions for the dimension headers.
+func newFileHandler(config *Config, files http.FileSystem, dimensions *imageDimensions) http.Handler {
+	defaults := defaultFeatures(config)
+	if len(config.Prefixes) == 0 {
+		return fileChain(config, files, dimensions, defaults)
+	}
+
+	type route struct {
+		dir     string
+		handler http.Handler
+	}
+	routes := make([]route, 0, len(config.Prefixes))
+	for _, prefix := range config.Prefixes {
+		routes = append(routes, route{dir: prefixDir(prefix.Path), handler: fileChain(config, files, dimensions, defaults.with(prefix))})
+	}
+	// Longest first, so the most specific prefix wins
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i].dir) > len(routes[j].dir) })
+	fallback := fileChain(config, files, dimensions, defaults)
+	folder := diskFolder(config)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := matchPath(folder, r.URL.Path)
+		for _, route := range routes {
+			if p == route.dir || strings.HasPrefix(p, route.dir+"/") {
+				route.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// defaultFeatures are the features of the paths no prefix covers
+func defaultFeatures(config *Config) fileFeatures {
+	return fileFeatures{listings: true, requireAPIKey: len(config.APIKeys) > 0, sniff: config.SniffContentType, transforms: true}
+}
+
+// featuresFor returns the features newFileHandler serves the URL path p with
+func featuresFor(config *Config, p string) fileFeatures {
+	p = matchPath(diskFolder(config), p)
+	features := defaultFeatures(config)
+	longest := -1
+	for _, prefix := range config.Prefixes {
+		dir := prefixDir(prefix.Path)
+		if (p == dir || strings.HasPrefix(p, dir+"/")) && len(dir) > longest {
+			features, longest = defaultFeatures(config).with(prefix), len(dir)
+		}
+	}
+	return features
+}
+
+// fileChain builds the file server and the middleware for features
+func fileChain(config *Config, files http.FileSystem, dimensions *imageDimensions, features fileFeatures) http.Handler {
+	var handler http.Handler = listingServer(files, config.listingPageSize(), http.FileServer(files))
+	if !features.listings {
+		handler = noListings(files, handler)
+	} else if config.PreloadImages > 0 {
+		handler = preloadLinks(files, config.PreloadImages, handler)
+	}
+	if !config.DimensionHeaders {
+		dimensions = nil
+	}
+	handler = metadataHeaders(files, dimensions, handler)
+	handler = contentTypeHandler(files, contentTypeOverrides(config.ContentTypes), features.sniff, config.DefaultCharset, handler)
+	handler = outputOptions(files, features.transforms, handler)
+	if features.noIndex {
+		handler = noIndex(handler)
+	}
+	if features.requireAPIKey && len(config.APIKeys) > 0 {
+		handler = apiKeyGuard(config.APIKeys, handler)
+	}
+	return handler
+}
+
+// noListings answers 404 for directories, unless they have an index.html
+// which http.FileServer serves instead of the listing
+func noListings(files http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if isDir(files, name) && !fileExistsIn(files, path.Join(name, "index.html")) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isDir(files http.FileSystem, name string) bool {
+	f, err := files.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && info.IsDir()
+}
+
+func fileExistsIn(files http.FileSystem, name string) bool {
+	f, err := files.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrefixAliases(t *testing.T) {
+	off := false
+	on := true
+	config := &Config{Prefixes: []PrefixConfig{
+		{Path: "/private/", Listings: &off, NoIndex: &on},
+		{Path: "/café/", Listings: &off, NoIndex: &on},
+	}}
+	handler := newFileHandler(config, http.Dir(t.TempDir()), nil)
+	for _, test := range []struct {
+		name, url string
+	}{
+		{"case", "/PRIVATE/x.jpg"},
+		{"trailing dot", "/private./x.jpg"},
+		{"trailing dots", "/private.../x.jpg"},
+		{"trailing space", "/private%20/x.jpg"},
+		{"trailing dot and space", "/private.%20./x.jpg"},
+		{"directory", "/private./"},
+		{"NFC", "/caf%C3%A9/x.jpg"},
+		{"NFD", "/cafe%CC%81/x.jpg"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if features := featuresFor(config, r.URL.Path); features.listings || !features.noIndex {
+				t.Errorf("%s got the default features", test.url)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Header().Get("X-Robots-Tag") == "" {
+				t.Errorf("%s was served without the prefix's noIndex", test.url)
+			}
+		})
+	}
+	if features := featuresFor(config, "/privateer/x.jpg"); !features.listings {
+		t.Error("a sibling of the prefix got its features")
+	}
+}
+
+func TestPrefixTransforms(t *testing.T) {
+	dir := t.TempDir()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"raw", "web"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, sub, "a.png"), img.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	off := false
+	config := &Config{Prefixes: []PrefixConfig{{Path: "/raw/", Transforms: &off}}}
+	handler := newFileHandler(config, http.Dir(dir), nil)
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	// Below the prefix the file is served as it is, whatever is asked
+	for _, url := range []string{"/raw/a.png?format=jpg", "/raw/a.png?ops=rotate:90", "/raw/a.png?ops=nonsense", "/raw/a.png?format=webp"} {
+		if w := get(url); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), img.Bytes()) {
+			t.Errorf("%s got %d and %d bytes, want the file unchanged", url, w.Code, w.Body.Len())
+		}
+	}
+	if w := get("/raw/a.png?format=jpg&download=1"); w.Header().Get("Content-Disposition") != `attachment; filename=a.png` {
+		t.Errorf("a download below the prefix is named %q", w.Header().Get("Content-Disposition"))
+	}
+	if w := get("/web/a.png?format=jpg"); w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("transforms are off outside the prefix, got %q", w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// preloadLinks adds Link preload headers for the first n images of directory
+// listings, in the order http.FileServer lists them, so browsers start
+// fetching them while the listing is still being parsed
+func preloadLinks(files http.FileSystem, n int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/") {
+			for _, link := range listingImages(files, path.Clean("/"+r.URL.Path), n) {
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=image", link))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listingImages returns the escaped URL paths of the first n images in the
+// directory name, or nothing when it isn't a directory or has an index.html
+func listingImages(files http.FileSystem, name string, n int) []string {
+	if fileExistsIn(files, path.Join(name, "index.html")) {
+		return nil
+	}
+	dir, err := files.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer dir.Close()
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return nil
+	}
+	// http.FileServer sorts listings by name
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var links []string
+	for _, entry := range entries {
+		if len(links) == n {
+			break
+		}
+		if entry.IsDir() || !strings.HasPrefix(mime.TypeByExtension(path.Ext(entry.Name())), "image/") {
+			continue
+		}
+		links = append(links, (&url.URL{Path: path.Join(name, entry.Name())}).EscapedPath())
+	}
+	return links
+}
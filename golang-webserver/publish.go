@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// publishQueue is how many events wait to be published before new ones are dropped
+	publishQueue = 10000
+	// publishAttempts is how many times a batch is sent before it is dropped
+	publishAttempts = 3
+	// publishFinalFlush bounds sending the last batch when the service stops
+	publishFinalFlush = 5 * time.Second
+)
+
+// The schemas of the published events. A version only ever gains fields,
+// anything else makes a new one.
+const (
+	accessEventSchema = "imageserver.access.v1"
+	fileEventSchema   = "imageserver.file.v1"
+)
+
+// PublishConfig publishes file and access events to RabbitMQ or Kafka, for
+// a data warehouse to consume
+type PublishConfig struct {
+	// Type is rabbitmq or kafka
+	Type string `json:"type"`
+	// URL is the RabbitMQ management API, e.g. http://rabbitmq:15672, or the
+	// Kafka REST Proxy, e.g. http://kafka-rest:8082
+	URL string `json:"url"`
+	// Exchange is the RabbitMQ exchange, amq.topic by default. The events are
+	// published with their schema as the routing key.
+	Exchange string `json:"exchange,omitempty"`
+	// VHost is the RabbitMQ virtual host, / by default
+	VHost string `json:"vhost,omitempty"`
+	// Topic is the Kafka topic, imageserver-events by default
+	Topic string `json:"topic,omitempty"`
+	// Username and Password authenticate with basic auth
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty" secret:"true"`
+	// Events are the kinds of events published, access and file by default
+	Events []string `json:"events,omitempty"`
+	// BatchSize is how many events are sent at once, 500 by default
+	BatchSize int `json:"batchSize,omitempty"`
+	// FlushInterval is the most seconds an event waits to be sent, 5 by default
+	FlushInterval int `json:"flushInterval,omitempty"`
+}
+
+func (c *PublishConfig) validate() []error {
+	var errs []error
+	if c.Type != "rabbitmq" && c.Type != "kafka" {
+		errs = append(errs, fmt.Errorf("publish.type must be rabbitmq or kafka, got %q", c.Type))
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		errs = append(errs, fmt.Errorf("publish.url must be an http or https URL, got %q", c.URL))
+	}
+	for i, kind := range c.Events {
+		if kind != "access" && kind != "file" {
+			errs = append(errs, fmt.Errorf("publish.events[%d] must be access or file, got %q", i, kind))
+		}
+	}
+	if c.BatchSize < 0 {
+		errs = append(errs, fmt.Errorf("publish.batchSize cannot be negative"))
+	}
+	if c.FlushInterval < 0 {
+		errs = append(errs, fmt.Errorf("publish.flushInterval cannot be negative"))
+	}
+	return errs
+}
+
+// publishes reports whether events of kind are published
+func (c *PublishConfig) publishes(kind string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, k := range c.Events {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// publishedEvent is the envelope of every event, with the payload its schema names
+type publishedEvent struct {
+	Schema string `json:"schema"`
+	// ID is unique, for consumers to drop the duplicates a retried batch can leave
+	ID     string       `json:"id"`
+	Time   time.Time    `json:"time"`
+	Host   string       `json:"host"`
+	Access *accessEvent `json:"access,omitempty"`
+	File   *fileEvent   `json:"file,omitempty"`
+}
+
+// key partitions the events on Kafka, the events of a path stay in order
+func (e *publishedEvent) key() string {
+	if e.Access != nil {
+		return e.Access.Path
+	}
+	return e.File.Path
+}
+
+type accessEvent struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"durationMs"`
+	Client     string  `json:"client"`
+	UserAgent  string  `json:"userAgent,omitempty"`
+	Referer    string  `json:"referer,omitempty"`
+}
+
+type fileEvent struct {
+	// Action is changed for files added or changed, deleted for files removed
+	Action   string     `json:"action"`
+	Path     string     `json:"path"`
+	Size     int64      `json:"size,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+}
+
+// eventPublisher queues events and publishes them in batches. Like the log
+// export it drops events when the broker can't keep up rather than slowing
+// down requests.
+type eventPublisher struct {
+	config  *PublishConfig
+	folder  string
+	host    string
+	elog    debug.Log
+	client  *http.Client
+	events  chan *publishedEvent
+	dropped uint64
+	// unrouted is the routing key of an event RabbitMQ had no queue for,
+	// warned about once
+	unrouted       string
+	warnedUnrouted bool
+}
+
+// newEventPublisher returns a publisher for config, or nil when publishing isn't configured
+func newEventPublisher(config *PublishConfig, folder string, elog debug.Log) *eventPublisher {
+	if config == nil {
+		return nil
+	}
+	host, _ := os.Hostname()
+	return &eventPublisher{
+		config: config,
+		folder: folder,
+		host:   host,
+		elog:   elog,
+		client: &http.Client{Timeout: 30 * time.Second},
+		events: make(chan *publishedEvent, publishQueue),
+	}
+}
+
+func (p *eventPublisher) add(event *publishedEvent) {
+	id, err := randomToken(12)
+	if err != nil {
+		atomic.AddUint64(&p.dropped, 1)
+		return
+	}
+	event.ID, event.Host = id, p.host
+	select {
+	case p.events <- event:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+// middleware queues an access event for every request
+func (p *eventPublisher) middleware(next http.Handler) http.Handler {
+	if !p.config.publishes("access") {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		p.add(&publishedEvent{Schema: accessEventSchema, Time: start.UTC(), Access: &accessEvent{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Client:     client,
+			UserAgent:  r.UserAgent(),
+			Referer:    r.Referer(),
+		}})
+	})
+}
+
+// changed queues a file event for a path relative to the folder that changed
+func (p *eventPublisher) changed(name string) {
+	if name == "" {
+		// Changes were missed, there is no telling which
+		return
+	}
+	if event := statFileEvent(p.folder, name); event != nil {
+		p.add(&publishedEvent{Schema: fileEventSchema, Time: time.Now().UTC(), File: event})
+	}
+}
+
+// statFileEvent returns the event of a change to name, a path relative to
+// folder, or nil when it is a directory
+func statFileEvent(folder, name string) *fileEvent {
+	event := &fileEvent{Action: "deleted", Path: "/" + name}
+	if info, err := os.Stat(filepath.Join(folder, filepath.FromSlash(name))); err == nil {
+		if info.IsDir() {
+			// The files in it have events of their own
+			return nil
+		}
+		modified := info.ModTime().UTC()
+		event.Action, event.Size, event.Modified = "changed", info.Size(), &modified
+	}
+	return event
+}
+
+// Run publishes the queued events until ctx is done, then publishes what is left
+func (p *eventPublisher) Run(ctx context.Context) {
+	batchSize := p.config.BatchSize
+	if batchSize == 0 {
+		batchSize = 500
+	}
+	interval := time.Duration(p.config.FlushInterval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*publishedEvent
+	failing := false
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		var err error
+		pending := batch
+		for attempt := 1; attempt <= publishAttempts; attempt++ {
+			var sent int
+			sent, err = p.send(ctx, pending)
+			// Only what wasn't accepted yet is sent again
+			pending = pending[sent:]
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+		// Only log changes, a down broker would otherwise flood the event log
+		if err != nil && !failing {
+			p.elog.Warning(eventExport, fmt.Sprintf("Failed to publish %d events to %s, dropping them until it recovers: %v", len(pending), p.config.URL, err))
+		} else if err == nil && failing {
+			p.elog.Info(eventExport, fmt.Sprintf("Publishing events to %s again", p.config.URL))
+		}
+		failing = err != nil
+		batch = batch[:0]
+		if dropped := atomic.SwapUint64(&p.dropped, 0); dropped > 0 {
+			p.elog.Warning(eventExport, fmt.Sprintf("Dropped %d events because the publish queue was full", dropped))
+		}
+		if p.unrouted != "" && !p.warnedUnrouted {
+			p.elog.Warning(eventExport, fmt.Sprintf("RabbitMQ dropped events with routing key %s since no queue is bound to it, this is only logged once", p.unrouted))
+			p.warnedUnrouted = true
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Drain what was queued before the stop
+			for len(p.events) > 0 && len(batch) < publishQueue {
+				batch = append(batch, <-p.events)
+			}
+			final, cancel := context.WithTimeout(context.Background(), publishFinalFlush)
+			flush(final)
+			cancel()
+			return
+		case event := <-p.events:
+			batch = append(batch, event)
+			if len(batch) >= batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+// send publishes batch, returning how many of its events the broker accepted
+func (p *eventPublisher) send(ctx context.Context, batch []*publishedEvent) (int, error) {
+	if p.config.Type == "kafka" {
+		if err := p.sendKafka(ctx, batch); err != nil {
+			return 0, err
+		}
+		return len(batch), nil
+	}
+	for i, event := range batch {
+		if err := p.sendRabbitMQ(ctx, event); err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+// sendKafka produces batch to the topic with the REST Proxy's v2 API
+func (p *eventPublisher) sendKafka(ctx context.Context, batch []*publishedEvent) error {
+	type record struct {
+		Key   string          `json:"key"`
+		Value *publishedEvent `json:"value"`
+	}
+	records := make([]record, len(batch))
+	for i, event := range batch {
+		records[i] = record{Key: event.key(), Value: event}
+	}
+	topic := p.config.Topic
+	if topic == "" {
+		topic = "imageserver-events"
+	}
+	endpoint := strings.TrimSuffix(p.config.URL, "/") + "/topics/" + url.PathEscape(topic)
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := p.post(ctx, endpoint, "application/vnd.kafka.json.v2+json", map[string]interface{}{"records": records}, &result); err != nil {
+		return err
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("%s rejected some of the events: %s", endpoint, offset.Error)
+		}
+	}
+	return nil
+}
+
+// sendRabbitMQ publishes event to the exchange with the management API,
+// which takes one message at a time
+func (p *eventPublisher) sendRabbitMQ(ctx context.Context, event *publishedEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	vhost := p.config.VHost
+	if vhost == "" {
+		vhost = "/"
+	}
+	exchange := p.config.Exchange
+	if exchange == "" {
+		exchange = "amq.topic"
+	}
+	endpoint := strings.TrimSuffix(p.config.URL, "/") + "/api/exchanges/" + url.PathEscape(vhost) + "/" + url.PathEscape(exchange) + "/publish"
+	message := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"content_type":  "application/json",
+			"delivery_mode": 2,
+			"message_id":    event.ID,
+			"type":          event.Schema,
+			"timestamp":     event.Time.Unix(),
+		},
+		"routing_key":      event.Schema,
+		"payload":          string(payload),
+		"payload_encoding": "string",
+	}
+	var result struct {
+		Routed bool `json:"routed"`
+	}
+	if err := p.post(ctx, endpoint, "application/json", message, &result); err != nil {
+		return err
+	}
+	if !result.Routed {
+		// Not worth a retry, consumers may only want some of the schemas
+		p.unrouted = event.Schema
+	}
+	return nil
+}
+
+// post sends body as JSON to endpoint and decodes the answer into result
+func (p *eventPublisher) post(ctx context.Context, endpoint, contentType string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s %s", endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
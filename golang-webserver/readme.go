@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The files curators annotate a folder with
+const (
+	readmeName   = "README.md"
+	captionsName = "captions.json"
+	// maxNotesSize bounds how much of them is read
+	maxNotesSize = 1 << 20
+)
+
+// folderNotes are the README and the captions of a folder
+type folderNotes struct {
+	// readme is the README.md, as written, and rendered to HTML
+	readme     string
+	readmeHTML template.HTML
+	// captions maps lowercase file names to their captions
+	captions map[string]string
+}
+
+// readFolderNotes reads the README.md and captions.json of the directory
+// dir, leaving out what is missing or can't be parsed
+func readFolderNotes(files http.FileSystem, dir string) folderNotes {
+	var notes folderNotes
+	if data, ok := readNotesFile(files, path.Join(dir, readmeName)); ok {
+		notes.readme = string(data)
+		notes.readmeHTML = renderMarkdown(notes.readme)
+	}
+	if data, ok := readNotesFile(files, path.Join(dir, captionsName)); ok {
+		var captions map[string]string
+		if json.Unmarshal(data, &captions) == nil {
+			notes.captions = make(map[string]string, len(captions))
+			for name, caption := range captions {
+				notes.captions[strings.ToLower(name)] = caption
+			}
+		}
+	}
+	return notes
+}
+
+func readNotesFile(files http.FileSystem, name string) ([]byte, bool) {
+	f, err := files.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		return nil, false
+	}
+	data, err := io.ReadAll(io.LimitReader(f, maxNotesSize))
+	return data, err == nil
+}
+
+// caption returns the caption of the file name, names matching case insensitively as on Windows
+func (n folderNotes) caption(name string) string {
+	return n.captions[strings.ToLower(name)]
+}
+
+// isNotesFile reports whether name is one of the files shown as notes instead of listed
+func isNotesFile(name string) bool {
+	return strings.EqualFold(name, readmeName) || strings.EqualFold(name, captionsName)
+}
+
+var (
+	markdownOrderedItem = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+	markdownLink        = regexp.MustCompile(`^\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// renderMarkdown renders the part of Markdown READMEs need: headings,
+// paragraphs, lists, rules, code blocks, code spans, emphasis and links.
+// Everything else is escaped, HTML included, so the result is safe to embed.
+func renderMarkdown(src string) template.HTML {
+	var b strings.Builder
+	var para []string
+	// list is ul or ol while in a list
+	list := ""
+	flushPara := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + renderInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	item := func(kind, text string) {
+		flushPara()
+		if list != kind {
+			closeList()
+			b.WriteString("<" + kind + ">\n")
+			list = kind
+		}
+		b.WriteString("<li>" + renderInline(text) + "</li>\n")
+	}
+
+	inCode := false
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if inCode {
+			if strings.HasPrefix(trimmed, "```") {
+				b.WriteString("</code></pre>\n")
+				inCode = false
+			} else {
+				b.WriteString(html.EscapeString(line) + "\n")
+			}
+			continue
+		}
+		if level := markdownHeading(trimmed); level > 0 {
+			flushPara()
+			closeList()
+			tag := string(rune('0' + level))
+			b.WriteString("<h" + tag + ">" + renderInline(strings.TrimSpace(trimmed[level:])) + "</h" + tag + ">\n")
+			continue
+		}
+		switch {
+		case trimmed == "":
+			flushPara()
+			closeList()
+		case strings.HasPrefix(trimmed, "```"):
+			flushPara()
+			closeList()
+			b.WriteString("<pre><code>")
+			inCode = true
+		case trimmed == "---" || trimmed == "***":
+			flushPara()
+			closeList()
+			b.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "+ "):
+			item("ul", strings.TrimSpace(trimmed[2:]))
+		case markdownOrderedItem.MatchString(trimmed):
+			item("ol", markdownOrderedItem.FindStringSubmatch(trimmed)[1])
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	if inCode {
+		b.WriteString("</code></pre>\n")
+	}
+	flushPara()
+	closeList()
+	return template.HTML(b.String())
+}
+
+// markdownHeading returns the level of a # heading line, 0 for other lines
+func markdownHeading(line string) int {
+	n := 0
+	for n < len(line) && line[n] == '#' {
+		n++
+	}
+	if n == 0 || n > 6 || (n < len(line) && line[n] != ' ') {
+		return 0
+	}
+	return n
+}
+
+// renderInline renders the code spans, **strong** and *emphasis* and the
+// links of a line of Markdown, escaping the rest
+func renderInline(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "`*[")
+		if i < 0 {
+			b.WriteString(html.EscapeString(s))
+			break
+		}
+		b.WriteString(html.EscapeString(s[:i]))
+		s = s[i:]
+		switch {
+		case s[0] == '`':
+			if end := strings.IndexByte(s[1:], '`'); end >= 0 {
+				b.WriteString("<code>" + html.EscapeString(s[1:1+end]) + "</code>")
+				s = s[end+2:]
+				continue
+			}
+		case strings.HasPrefix(s, "**"):
+			if end := strings.Index(s[2:], "**"); end > 0 {
+				b.WriteString("<strong>" + renderInline(s[2:2+end]) + "</strong>")
+				s = s[end+4:]
+				continue
+			}
+		case s[0] == '*':
+			if end := strings.IndexByte(s[1:], '*'); end > 0 {
+				b.WriteString("<em>" + renderInline(s[1:1+end]) + "</em>")
+				s = s[end+2:]
+				continue
+			}
+		case s[0] == '[':
+			if m := markdownLink.FindStringSubmatch(s); m != nil && safeMarkdownLink(m[2]) {
+				b.WriteString(`<a href="` + html.EscapeString(m[2]) + `">` + renderInline(m[1]) + "</a>")
+				s = s[len(m[0]):]
+				continue
+			}
+		}
+		// Not markup after all
+		b.WriteString(html.EscapeString(s[:1]))
+		s = s[1:]
+	}
+	return b.String()
+}
+
+// safeMarkdownLink reports whether a link target is relative or http(s) or mailto, not javascript: and the like
+func safeMarkdownLink(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
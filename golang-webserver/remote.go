@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// RemoteConfig points at a config document managed centrally. Its settings
+// override the local file, environment variables and flags still override it.
+type RemoteConfig struct {
+	// URL is the https address of the config document
+	URL string `json:"url"`
+	// PublicKey is the base64 Ed25519 key <url>.sig is checked against
+	PublicKey string `json:"publicKey,omitempty"`
+	// CAFile is a PEM bundle trusted for the remote server instead of the system roots
+	CAFile string `json:"caFile,omitempty"`
+	// ClientCert and ClientKey are PEM files presented for mutual TLS
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+	// Interval is how many seconds to wait between refreshes, 0 only fetches at startup
+	Interval int `json:"interval,omitempty"`
+}
+
+// remoteFetchTimeout bounds a single fetch of the document and its signature
+const remoteFetchTimeout = 30 * time.Second
+
+// validate checks the remote settings, the document must be protected by a
+// signature or by a pinned CA
+func (r *RemoteConfig) validate() []error {
+	var errs []error
+	if u, err := url.Parse(r.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("remoteConfig.url must be an https URL, got %q", r.URL))
+	}
+	if r.PublicKey == "" && r.CAFile == "" {
+		errs = append(errs, fmt.Errorf("remoteConfig needs a publicKey or a caFile to verify the document"))
+	}
+	if r.PublicKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(r.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			errs = append(errs, fmt.Errorf("remoteConfig.publicKey is not a base64 encoded Ed25519 public key"))
+		}
+	}
+	if (r.ClientCert == "") != (r.ClientKey == "") {
+		errs = append(errs, fmt.Errorf("remoteConfig.clientCert and remoteConfig.clientKey must be set together"))
+	}
+	if r.Interval < 0 {
+		errs = append(errs, fmt.Errorf("remoteConfig.interval cannot be negative"))
+	}
+	return errs
+}
+
+// applyRemoteConfig overlays the remote document onto config. The last good
+// document is cached next to the local config file and used when the remote
+// server can't be reached, so a branch install still starts during an outage.
+func applyRemoteConfig(configPath string, config *Config) error {
+	// Copied since decoding the document into config would write through the pointer
+	remote := *config.RemoteConfig
+	if errs := remote.validate(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	cachePath := configPath + ".remote"
+	data, signature, fetchErr := fetchRemoteConfig(&remote)
+	if fetchErr == nil {
+		fetchErr = verifyRemoteConfig(&remote, data, signature)
+	}
+	if fetchErr != nil {
+		var err error
+		if data, err = os.ReadFile(cachePath); err != nil {
+			return fmt.Errorf("failed to fetch remote config %s and no cached copy is available: %w", remote.URL, fetchErr)
+		}
+		// Check the cached copy too so it can't be edited to bypass the signature
+		signature, _ = os.ReadFile(cachePath + ".sig")
+		if err := verifyRemoteConfig(&remote, data, signature); err != nil {
+			return fmt.Errorf("failed to fetch remote config %s (%v) and the cached copy is invalid: %w", remote.URL, fetchErr, err)
+		}
+		config.warnings = append(config.warnings, fmt.Sprintf("using cached remote config, fetching %s failed: %v", remote.URL, fetchErr))
+	} else if err := writeRemoteCache(cachePath, data, signature); err != nil {
+		config.warnings = append(config.warnings, fmt.Sprintf("failed to cache remote config: %v", err))
+	}
+
+	// Decode based on the URL's extension, defaulting to JSON
+	name := "remote.json"
+	if u, err := url.Parse(remote.URL); err == nil && path.Ext(u.Path) != "" {
+		name = "remote" + path.Ext(u.Path)
+	}
+	warnings, err := decodeConfigFile(name, data, config)
+	if err != nil {
+		return fmt.Errorf("failed to decode remote config %s: %w", remote.URL, err)
+	}
+	for _, warning := range warnings {
+		config.warnings = append(config.warnings, "remote config: "+warning)
+	}
+	// The remote document can't point the server somewhere else
+	config.RemoteConfig = &remote
+	return nil
+}
+
+// fetchRemoteConfig downloads the document and, when a public key is set, its signature
+func fetchRemoteConfig(remote *RemoteConfig) ([]byte, []byte, error) {
+	client, err := remoteClient(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := fetchRemote(client, remote.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var signature []byte
+	if remote.PublicKey != "" {
+		if signature, err = fetchRemote(client, remote.URL+".sig"); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, signature, nil
+}
+
+// remoteClient builds an HTTP client trusting CAFile and presenting the client certificate
+func remoteClient(remote *RemoteConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if remote.CAFile != "" {
+		pem, err := os.ReadFile(remote.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remoteConfig.caFile: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("remoteConfig.caFile %s contains no certificates", remote.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if remote.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(remote.ClientCert, remote.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load remoteConfig client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   remoteFetchTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func fetchRemote(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// verifyRemoteConfig checks data against the base64 Ed25519 signature when a
+// public key is configured. Without one the pinned CA is what's trusted.
+func verifyRemoteConfig(remote *RemoteConfig, data, signature []byte) error {
+	if remote.PublicKey == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(remote.PublicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid signature file: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+func writeRemoteCache(cachePath string, data, signature []byte) error {
+	if err := os.WriteFile(cachePath, data, 0o600); err != nil {
+		return err
+	}
+	if signature == nil {
+		os.Remove(cachePath + ".sig")
+		return nil
+	}
+	return os.WriteFile(cachePath+".sig", signature, 0o600)
+}
+
+// watchRemoteConfig reloads the whole config every interval and hands it to
+// the service loop. Failed reloads are logged and the current config is kept.
+func (s *Service) watchRemoteConfig(ctx context.Context, interval time.Duration, reloads chan<- *Config) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		config, err := s.loadConfig()
+		if err == nil {
+			err = prepareFolder(config)
+		}
+		if err != nil {
+			s.elog.Warning(eventConfig, fmt.Sprintf("Failed to reload config, keeping the current one: %v", err))
+			continue
+		}
+		select {
+		case reloads <- config:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applyConfig switches the running service to config. A new folder, cache
+// size or backup schedule restarts the folder tasks, whose cancel func is
+// returned. A new port or listeners are bound next to the current ones,
+// which stop accepting but let their connections finish. The log export and
+// GeoIP need a restart.
+func (s *Service) applyConfig(ctx context.Context, config *Config) context.CancelFunc {
+	old := s.config
+	for _, warning := range config.Warnings() {
+		s.elog.Warning(eventConfig, "Config: "+warning)
+	}
+	if !reflect.DeepEqual(config.LogExport, old.LogExport) {
+		s.elog.Warning(eventConfig, "Config changed logExport, restart the service to apply it")
+		config.LogExport = old.LogExport
+	}
+	if config.ChangeEvents != old.ChangeEvents {
+		s.elog.Warning(eventConfig, "Config changed changeEvents, restart the service to apply it")
+		config.ChangeEvents = old.ChangeEvents
+	}
+	if !reflect.DeepEqual(config.Consul, old.Consul) {
+		s.elog.Warning(eventConfig, "Config changed consul, restart the service to apply it")
+		config.Consul = old.Consul
+	}
+	if !reflect.DeepEqual(config.GeoIP, old.GeoIP) {
+		s.elog.Warning(eventConfig, "Config changed geoIP, restart the service to apply it")
+		config.GeoIP = old.GeoIP
+	}
+	if config.Port != old.Port || !reflect.DeepEqual(config.Listeners, old.Listeners) {
+		s.applyListeners(ctx, old, config)
+	}
+	if config.LogLevel != old.LogLevel {
+		s.elog.SetLevel(config.LogLevel)
+		s.elog.Info(eventConfig, fmt.Sprintf("Log level changed to %s", config.LogLevel))
+	}
+	s.slowLog.SetThreshold(config.SlowRequestMS)
+	s.config = config
+
+	if !reflect.DeepEqual(config.Shares, old.Shares) {
+		if shares, err := openShareStore(config.Shares); err != nil {
+			s.elog.Warning(eventConfig, fmt.Sprintf("Failed to load the shares, keeping the current ones: %v", err))
+			config.Shares = old.Shares
+		} else {
+			s.shares = shares
+		}
+	}
+
+	// The handler is always rebuilt since routes like the admin API depend on the config
+	var cancel context.CancelFunc
+	if config.Folder != old.Folder || config.FileCacheMB != old.FileCacheMB || !reflect.DeepEqual(config.Backup, old.Backup) || !reflect.DeepEqual(config.CDN, old.CDN) || !reflect.DeepEqual(config.Sitemap, old.Sitemap) || !reflect.DeepEqual(config.Git, old.Git) || !reflect.DeepEqual(config.CircuitBreaker, old.CircuitBreaker) || !reflect.DeepEqual(config.Index, old.Index) {
+		if config.Folder != old.Folder {
+			s.elog.Info(eventConfig, fmt.Sprintf("Folder changed to %s", config.Folder))
+		}
+		var folderCtx context.Context
+		folderCtx, cancel = context.WithCancel(ctx)
+		s.monitor = newFolderMonitor(config.Folder, config.CircuitBreaker, s.elog)
+		s.cache = newFileCache(s.monitor.files(), config.FileCacheMB)
+		s.sitemap = newSitemap(config.Sitemap, config.Folder, s.elog)
+		s.git = newGitRepo(config.Git, config.Folder, s.elog)
+		s.index = newFolderIndex(config.Index, config.Folder, config.Git != nil, s.elog)
+		s.startFolder(folderCtx)
+	}
+	s.handler.Set(newHandler(config, s.monitor, s.cache, s.sitemap, s.shares, s.verifier, s.hashes, s.git, s.index, s.stats, s.feed))
+	return cancel
+}
+
+// applyListeners moves the service from the port and listeners of old to
+// those of config. Downloads on an address that goes away aren't cut off,
+// only new connections go to the new addresses. When one can't be bound
+// config keeps the old ones.
+func (s *Service) applyListeners(ctx context.Context, old, config *Config) {
+	added, removed, err := s.listeners.update(config)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to listen on the new addresses of the config, keeping the current ones: %v", err)
+		if conflict := portConflict(err); conflict != "" {
+			msg += ", " + conflict
+		}
+		s.elog.Warning(eventConfig, msg)
+		config.Port, config.Listeners = old.Port, old.Listeners
+		return
+	}
+	for _, ln := range added {
+		s.serve(ln)
+		s.elog.Info(eventConfig, fmt.Sprintf("Now listening on %s", ln))
+	}
+	for _, ln := range removed {
+		s.elog.Info(eventConfig, fmt.Sprintf("No longer listening on %s, its open connections are left to finish", ln))
+	}
+	if config.Port != old.Port && config.Consul != nil {
+		deregisterConsul(config.Consul, old.Port, s.elog)
+		go registerConsul(ctx, config.Consul, config.Port, s.elog)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"mime/quotedprintable"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// reportAttempts is how many times a report is sent before giving up until the next one
+	reportAttempts = 3
+	// reportNewFiles and reportTopFiles are how many of each the report lists
+	reportNewFiles = 20
+	reportTopFiles = 10
+)
+
+// ReportConfig emails a weekly summary of the server's use to the people
+// who look after the folder
+type ReportConfig struct {
+	MailConfig
+	// To are the recipients
+	To []string `json:"to"`
+	// Weekday is the day the report is sent, monday by default
+	Weekday string `json:"weekday,omitempty"`
+	// Hour is the local hour (0-23) the report is sent at, 8 by default
+	Hour *int `json:"hour,omitempty"`
+}
+
+func (c *ReportConfig) validate() []error {
+	errs := c.MailConfig.validate("report")
+	errs = append(errs, validateRecipients("report.to", c.To)...)
+	if _, ok := parseWeekday(c.Weekday); !ok {
+		errs = append(errs, fmt.Errorf("report.weekday must be a day of the week such as monday, got %q", c.Weekday))
+	}
+	if c.Hour != nil && (*c.Hour < 0 || *c.Hour > 23) {
+		errs = append(errs, fmt.Errorf("report.hour must be between 0 and 23, got %d", *c.Hour))
+	}
+	return errs
+}
+
+// parseWeekday returns the weekday named day in English, Monday for ""
+func parseWeekday(day string) (time.Weekday, bool) {
+	if day == "" {
+		return time.Monday, true
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(day, d.String()) {
+			return d, true
+		}
+	}
+	return time.Monday, false
+}
+
+func (c *ReportConfig) hour() int {
+	if c.Hour == nil {
+		return 8
+	}
+	return *c.Hour
+}
+
+// nextReport returns when the report after now is due
+func (c *ReportConfig) nextReport(now time.Time) time.Time {
+	day, _ := parseWeekday(c.Weekday)
+	next := time.Date(now.Year(), now.Month(), now.Day(), c.hour(), 0, 0, 0, now.Location())
+	next = next.AddDate(0, 0, (int(day)-int(now.Weekday())+7)%7)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// folderReport is what a report tells about the folder
+type folderReport struct {
+	files     int
+	size      int64
+	newFiles  int
+	newSize   int64
+	newest    []newFile
+	diskFree  uint64
+	diskTotal uint64
+	// err is why the folder couldn't be looked at completely
+	err error
+}
+
+type newFile struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// scanFolderReport walks folder for its size and the files changed since since
+func scanFolderReport(folder string, since time.Time, skipGit bool) folderReport {
+	var report folderReport
+	if folder == embeddedFolder {
+		return report
+	}
+	report.err = filepath.WalkDir(folder, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Keep going past what can't be read, the report is a summary
+			return nil
+		}
+		if d.IsDir() {
+			if skipGit && d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		report.files++
+		report.size += info.Size()
+		if info.ModTime().After(since) {
+			report.newFiles++
+			report.newSize += info.Size()
+			rel, _ := filepath.Rel(folder, name)
+			report.newest = append(report.newest, newFile{path: "/" + filepath.ToSlash(rel), size: info.Size(), modified: info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(report.newest, func(i, j int) bool { return report.newest[i].modified.After(report.newest[j].modified) })
+	if len(report.newest) > reportNewFiles {
+		report.newest = report.newest[:reportNewFiles]
+	}
+	if dir, err := windows.UTF16PtrFromString(folder); err == nil {
+		var available, total, free uint64
+		if windows.GetDiskFreeSpaceEx(dir, &available, &total, &free) == nil {
+			report.diskFree, report.diskTotal = available, total
+		}
+	}
+	return report
+}
+
+// reporter sends the weekly reports, each covering the requests since the
+// last one went out
+type reporter struct {
+	config *ReportConfig
+	folder string
+	isGit  bool
+	stats  *requestStats
+	elog   debug.Log
+
+	// since is when the period of the next report started
+	since time.Time
+	// The counts at since, the report shows what was added to them
+	last     statsSnapshot
+	statuses map[int]uint64
+	files    map[string]uint64
+}
+
+func newReporter(config *ReportConfig, folder string, isGit bool, stats *requestStats, elog debug.Log) *reporter {
+	return &reporter{config: config, folder: folder, isGit: isGit, stats: stats, elog: elog, since: stats.started}
+}
+
+// Run sends a report every week until ctx is done
+func (r *reporter) Run(ctx context.Context) {
+	for {
+		next := r.config.nextReport(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		subject, body := r.build(now)
+		var err error
+		for attempt := 1; attempt <= reportAttempts; attempt++ {
+			if err = r.config.send(subject, body); err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(attempt) * time.Minute):
+			}
+		}
+		if err != nil {
+			// The next report covers this week as well
+			r.elog.Error(eventMail, fmt.Sprintf("Failed to send the weekly report to %s: %v", strings.Join(r.config.To, ", "), err))
+			continue
+		}
+		r.elog.Info(eventMail, fmt.Sprintf("Sent the weekly report to %s", strings.Join(r.config.To, ", ")))
+		r.reset(now)
+	}
+}
+
+// reset starts the period of the next report at now
+func (r *reporter) reset(now time.Time) {
+	r.since = now
+	r.last = r.stats.Snapshot()
+	r.statuses = r.stats.breakdown.statuses()
+	r.files = map[string]uint64{}
+	for _, f := range r.stats.top.top(maxTopFiles) {
+		r.files[f.path] = f.requests
+	}
+}
+
+// build returns the subject and text of the report for the period up to now
+func (r *reporter) build(now time.Time) (string, string) {
+	host, _ := os.Hostname()
+	layout := "Mon 2 Jan 2006 15:04"
+	var b strings.Builder
+	fmt.Fprintf(&b, "ImageServer on %s, %s to %s\n\n", host, r.since.Format(layout), now.Format(layout))
+
+	snapshot := r.stats.Snapshot()
+	requests := snapshot.Requests - r.last.Requests
+	fmt.Fprintf(&b, "Requests\n  %d requests, %s served\n", requests, formatBytes(snapshot.BytesServed-r.last.BytesServed))
+	fmt.Fprintf(&b, "  %d client errors, %d server errors\n\n", snapshot.ClientErrors-r.last.ClientErrors, snapshot.ServerErrors-r.last.ServerErrors)
+
+	// Error responses by status code, most frequent first
+	type statusCount struct {
+		code  int
+		count uint64
+	}
+	var errs []statusCount
+	for code, count := range r.stats.breakdown.statuses() {
+		if count -= r.statuses[code]; code >= 400 && count > 0 {
+			errs = append(errs, statusCount{code, count})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].count > errs[j].count })
+	b.WriteString("Errors\n")
+	if len(errs) == 0 {
+		b.WriteString("  None\n")
+	}
+	for _, e := range errs {
+		fmt.Fprintf(&b, "  %d %s: %d\n", e.code, http.StatusText(e.code), e.count)
+	}
+
+	var top []fileCount
+	for _, f := range r.stats.top.top(maxTopFiles) {
+		if f.requests > r.files[f.path] {
+			f.requests -= r.files[f.path]
+			top = append(top, f)
+		}
+	}
+	sort.SliceStable(top, func(i, j int) bool { return top[i].requests > top[j].requests })
+	if len(top) > reportTopFiles {
+		top = top[:reportTopFiles]
+	}
+	b.WriteString("\nTop downloads\n")
+	if len(top) == 0 {
+		b.WriteString("  None\n")
+	}
+	for i, f := range top {
+		fmt.Fprintf(&b, "  %2d. %s: %d\n", i+1, f.path, f.requests)
+	}
+
+	folder := scanFolderReport(r.folder, r.since, r.isGit)
+	fmt.Fprintf(&b, "\nNew and changed files\n  %d files, %s\n", folder.newFiles, formatBytes(uint64(folder.newSize)))
+	for _, f := range folder.newest {
+		fmt.Fprintf(&b, "  %s  %s (%s)\n", f.modified.Format("2006-01-02 15:04"), f.path, formatBytes(uint64(f.size)))
+	}
+	if folder.newFiles > len(folder.newest) {
+		fmt.Fprintf(&b, "  and %d more\n", folder.newFiles-len(folder.newest))
+	}
+
+	b.WriteString("\nDisk usage\n")
+	fmt.Fprintf(&b, "  The folder has %d files, %s\n", folder.files, formatBytes(uint64(folder.size)))
+	if folder.diskTotal > 0 {
+		fmt.Fprintf(&b, "  %s of %s free on its disk (%.0f%%)\n", formatBytes(folder.diskFree), formatBytes(folder.diskTotal), 100*float64(folder.diskFree)/float64(folder.diskTotal))
+	}
+	if folder.err != nil {
+		fmt.Fprintf(&b, "  The folder couldn't be read completely: %v\n", folder.err)
+	}
+
+	return fmt.Sprintf("ImageServer weekly report for %s", host), b.String()
+}
+
+// send mails a report with subject and text to the recipients
+func (c *ReportConfig) send(subject, text string) error {
+	var msg bytes.Buffer
+	c.writeMailHeader(&msg, c.To, subject)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+	body := quotedprintable.NewWriter(&msg)
+	body.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	body.Close()
+	return c.MailConfig.send(c.To, msg.Bytes())
+}
+
+// runReportCommand sends a report now, to check the mail settings. Only the
+// service has the request statistics, so it covers the folder of the last
+// week. It returns the process exit code: 0 when sent, 2 otherwise.
+func runReportCommand(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print the report instead of mailing it")
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	config, err := flags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if config.Report == nil && !*dryRun {
+		fmt.Fprintln(os.Stderr, "No report settings, set report in the config")
+		return 2
+	}
+
+	now := time.Now()
+	stats := &requestStats{started: now.AddDate(0, 0, -7)}
+	r := newReporter(config.Report, config.Folder, config.Git != nil, stats, nil)
+	subject, body := r.build(now)
+	if *dryRun {
+		fmt.Printf("Subject: %s\n\n%s", subject, body)
+		return 0
+	}
+	if err := config.Report.send(subject, body); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to send the report:", err)
+		return 2
+	}
+	fmt.Printf("Sent the report to %s\n", strings.Join(config.Report.To, ", "))
+	return 0
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// robotsHandler serves the configured robots.txt
+func robotsHandler(robots string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(robots))
+	})
+}
+
+// noIndex asks crawlers not to index the responses or follow their links
+func noIndex(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userAgentBlock rejects requests whose User-Agent contains one of blocked,
+// compared case insensitively, for crawlers that ignore robots.txt
+func userAgentBlock(blocked []string, next http.Handler) http.Handler {
+	lower := make([]string, len(blocked))
+	for i, agent := range blocked {
+		lower[i] = strings.ToLower(agent)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent := strings.ToLower(r.UserAgent())
+		for _, b := range lower {
+			if strings.Contains(agent, b) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
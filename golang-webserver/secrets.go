@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Secret references. Config fields tagged `secret:"true"` (and the install
+// --password flag) may hold one of these instead of the secret itself.
+const (
+	// @file:C:\secrets\key.txt reads the secret from a file
+	secretFilePrefix = "@file:"
+	// @credman:ImageServer/apiKey reads the password of a generic Windows Credential
+	// Manager entry, as created with "cmdkey /generic:ImageServer/apiKey /user:x /pass:..."
+	secretCredmanPrefix = "@credman:"
+	// @secret:name reads a Docker/Kubernetes style secret from /run/secrets/name
+	secretMountPrefix = "@secret:"
+)
+
+// secretMountDir is where container runtimes mount secrets
+const secretMountDir = "/run/secrets"
+
+// resolveSecret returns the secret a reference points to, or value unchanged
+// when it isn't a reference
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		return readSecretFile(strings.TrimPrefix(value, secretFilePrefix))
+	case strings.HasPrefix(value, secretMountPrefix):
+		return readSecretFile(filepath.Join(secretMountDir, strings.TrimPrefix(value, secretMountPrefix)))
+	case strings.HasPrefix(value, secretCredmanPrefix):
+		return readCredential(strings.TrimPrefix(value, secretCredmanPrefix))
+	}
+	return value, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	// Editors like to add a trailing newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolveSecrets replaces secret references in every field of config tagged `secret:"true"`
+func resolveSecrets(config interface{}) error {
+	return walkSecrets(reflect.ValueOf(config), func(field reflect.StructField, v reflect.Value) error {
+		secret, err := resolveSecret(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", jsonName(field), err)
+		}
+		v.SetString(secret)
+		return nil
+	})
+}
+
+// redactSecrets blanks every field tagged `secret:"true"` that is set, for printing
+func redactSecrets(config interface{}) {
+	walkSecrets(reflect.ValueOf(config), func(_ reflect.StructField, v reflect.Value) error {
+		if v.String() != "" {
+			v.SetString("<redacted>")
+		}
+		return nil
+	})
+}
+
+// walkSecrets calls fn for every settable string field tagged `secret:"true"`,
+// descending into nested structs, pointers, slices and maps of structs
+func walkSecrets(v reflect.Value, fn func(reflect.StructField, reflect.Value) error) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			return walkSecrets(v.Elem(), fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			fv := v.Field(i)
+			if field.Tag.Get("secret") == "true" && fv.Kind() == reflect.String {
+				if err := fn(field, fv); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := walkSecrets(fv, fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkSecrets(v.Index(i), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map values aren't addressable, copy them out and back in
+		for _, key := range v.MapKeys() {
+			item := reflect.New(v.Type().Elem()).Elem()
+			item.Set(v.MapIndex(key))
+			if err := walkSecrets(item, fn); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, item)
+		}
+	}
+	return nil
+}
+
+// jsonName returns the config key of a struct field
+func jsonName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+var (
+	procCredReadW = modadvapi32.NewProc("CredReadW")
+	procCredFree  = modadvapi32.NewProc("CredFree")
+)
+
+const credTypeGeneric = 1
+
+// credential mirrors the Win32 CREDENTIALW structure
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// readCredential returns the password of a generic credential. Credentials are
+// per user, so it has to be stored for the account the service runs as.
+func readCredential(target string) (string, error) {
+	name, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return "", err
+	}
+
+	var cred *credential
+	ret, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(name)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		return "", fmt.Errorf("failed to read credential %s: %w", target, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	if cred.CredentialBlobSize == 0 {
+		return "", nil
+	}
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+
+	// cmdkey and the Credential Manager UI store the password as UTF-16
+	if len(blob)%2 == 0 {
+		utf16 := make([]uint16, len(blob)/2)
+		for i := range utf16 {
+			utf16[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+		}
+		return windows.UTF16ToString(utf16), nil
+	}
+	return string(blob), nil
+}
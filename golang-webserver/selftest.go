@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// discardLog is a debug.Log that drops everything, so the self-test only
+// prints its results
+type discardLog struct{}
+
+func (discardLog) Close() error                         { return nil }
+func (discardLog) Info(eid uint32, msg string) error    { return nil }
+func (discardLog) Warning(eid uint32, msg string) error { return nil }
+func (discardLog) Error(eid uint32, msg string) error   { return nil }
+
+// selftestFiles are written to the temporary folder served by the self-test
+var selftestFiles = map[string]string{
+	"gallery/notes.txt":  "0123456789abcdef",
+	"private/secret.txt": "not for the gallery key",
+}
+
+// selftestWidth and selftestHeight are the size of the PNG written to gallery/photo.png
+const selftestWidth, selftestHeight = 64, 48
+
+// selftestCheck is one request made against the temporary instance
+type selftestCheck struct {
+	name string
+	run  func(t *selftestClient) error
+}
+
+// selftestClient sends the checks' requests to the temporary instance
+type selftestClient struct {
+	base       string
+	apiKey     string
+	adminToken string
+	client     *http.Client
+}
+
+// get requests path with the headers, returning the response with its body read
+func (t *selftestClient) get(path string, headers map[string]string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, t.base+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func wantStatus(resp *http.Response, want int) error {
+	if resp.StatusCode != want {
+		return fmt.Errorf("got %s, want %d", resp.Status, want)
+	}
+	return nil
+}
+
+var selftestChecks = []selftestCheck{
+	{"readiness", func(t *selftestClient) error {
+		resp, _, err := t.get("/readyz", nil)
+		if err != nil {
+			return err
+		}
+		return wantStatus(resp, http.StatusOK)
+	}},
+	{"files need an API key", func(t *selftestClient) error {
+		resp, _, err := t.get("/gallery/notes.txt", nil)
+		if err != nil {
+			return err
+		}
+		return wantStatus(resp, http.StatusUnauthorized)
+	}},
+	{"API keys are scoped to their prefixes", func(t *selftestClient) error {
+		resp, _, err := t.get("/private/secret.txt", map[string]string{"X-API-Key": t.apiKey})
+		if err != nil {
+			return err
+		}
+		return wantStatus(resp, http.StatusForbidden)
+	}},
+	{"directory listing", func(t *selftestClient) error {
+		resp, body, err := t.get("/gallery/", map[string]string{"X-API-Key": t.apiKey})
+		if err != nil {
+			return err
+		}
+		if err := wantStatus(resp, http.StatusOK); err != nil {
+			return err
+		}
+		for _, name := range []string{"photo.png", "notes.txt"} {
+			if !bytes.Contains(body, []byte(name)) {
+				return fmt.Errorf("the listing doesn't show %s", name)
+			}
+		}
+		return nil
+	}},
+	{"range request", func(t *selftestClient) error {
+		resp, body, err := t.get("/gallery/notes.txt", map[string]string{"X-API-Key": t.apiKey, "Range": "bytes=2-5"})
+		if err != nil {
+			return err
+		}
+		if err := wantStatus(resp, http.StatusPartialContent); err != nil {
+			return err
+		}
+		if string(body) != "2345" {
+			return fmt.Errorf("got %q, want %q", body, "2345")
+		}
+		if got, want := resp.Header.Get("Content-Range"), "bytes 2-5/16"; got != want {
+			return fmt.Errorf("got Content-Range %q, want %q", got, want)
+		}
+		return nil
+	}},
+	{"format conversion", func(t *selftestClient) error {
+		resp, body, err := t.get("/gallery/photo.png?format=jpg", map[string]string{"X-API-Key": t.apiKey})
+		if err != nil {
+			return err
+		}
+		if err := wantStatus(resp, http.StatusOK); err != nil {
+			return err
+		}
+		if got := resp.Header.Get("Content-Type"); got != "image/jpeg" {
+			return fmt.Errorf("got Content-Type %q, want image/jpeg", got)
+		}
+		config, format, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("the converted image can't be decoded: %w", err)
+		}
+		if format != "jpeg" || config.Width != selftestWidth || config.Height != selftestHeight {
+			return fmt.Errorf("got a %dx%d %s, want a %dx%d jpeg", config.Width, config.Height, format, selftestWidth, selftestHeight)
+		}
+		return nil
+	}},
+	{"admin API needs the admin token", func(t *selftestClient) error {
+		resp, _, err := t.get("/api/config", map[string]string{"Authorization": "Bearer " + t.apiKey})
+		if err != nil {
+			return err
+		}
+		return wantStatus(resp, http.StatusUnauthorized)
+	}},
+	{"admin API redacts secrets", func(t *selftestClient) error {
+		resp, body, err := t.get("/api/config", map[string]string{"Authorization": "Bearer " + t.adminToken})
+		if err != nil {
+			return err
+		}
+		if err := wantStatus(resp, http.StatusOK); err != nil {
+			return err
+		}
+		if bytes.Contains(body, []byte(t.adminToken)) || bytes.Contains(body, []byte(t.apiKey)) {
+			return fmt.Errorf("the effective configuration shows a secret")
+		}
+		return nil
+	}},
+}
+
+// writeSelftestFolder fills dir with the files the checks request
+func writeSelftestFolder(dir string) error {
+	for name, content := range selftestFiles {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, selftestWidth, selftestHeight))
+	for y := 0; y < selftestHeight; y++ {
+		for x := 0; x < selftestWidth; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "gallery", "photo.png"), buf.Bytes(), 0o644)
+}
+
+// runSelftest serves a temporary folder on an ephemeral loopback port with
+// the same handlers the service uses and checks listings, range requests,
+// conversions and authentication against it. It returns the process exit
+// code: 0 when every check passed, 1 when one failed and 2 when the
+// instance couldn't be started.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	dir, err := os.MkdirTemp("", "imageserver-selftest-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer os.RemoveAll(dir)
+	if err := writeSelftestFolder(dir); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write the test files:", err)
+		return 2
+	}
+
+	apiKey, err := randomToken(16)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	adminToken, err := randomToken(16)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to listen:", err)
+		return 2
+	}
+	client := &selftestClient{base: "http://" + ln.Addr().String(), apiKey: apiKey, adminToken: adminToken, client: &http.Client{Timeout: 10 * time.Second}}
+	config := &Config{
+		Port:       strconv.Itoa(ln.Addr().(*net.TCPAddr).Port),
+		Folder:     dir,
+		AdminToken: client.adminToken,
+		APIKeys:    []APIKey{{Name: "selftest", Key: client.apiKey, Prefixes: []string{"/gallery/"}}},
+	}
+	config.applyDefaults()
+	if errs := config.Validate(); len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "The test configuration is invalid:\n%s\n", joinErrors(errs))
+		return 2
+	}
+
+	var elog discardLog
+	monitor := newFolderMonitor(config.Folder, nil, elog)
+	stats := &requestStats{}
+	stats.live.elog = elog
+	hashes := &imageHashIndex{state: hashIndexState{Hashes: map[string]hashEntry{}}}
+	handler := newHandler(config, monitor, nil, nil, nil, &folderVerifier{}, hashes, nil, nil, stats, nil)
+	server := createServer(config, stats.middleware(handler), elog)
+	server.ConnContext = connContext
+	go server.Serve(ln)
+	defer server.Close()
+
+	fmt.Printf("Testing a temporary instance on %s serving %s\n", client.base, dir)
+	failed := 0
+	for _, check := range selftestChecks {
+		if err := check.run(client); err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			continue
+		}
+		fmt.Printf("PASS %s\n", check.name)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(selftestChecks))
+		return 1
+	}
+	fmt.Printf("All %d checks passed\n", len(selftestChecks))
+	return 0
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sharePageTemplate is the page folder share links show instead of the raw listing
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!doctype html>
+<html lang="{{.Text.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<meta name="robots" content="noindex, nofollow">
+<title>{{.Title}}</title>
+<style>
+{{.Theme.Colors}}
+body{font-family:system-ui,sans-serif;margin:0;background:var(--bg);color:var(--fg)}
+header{display:flex;align-items:center;gap:1em;padding:1em 2em;background:var(--surface);border-bottom:1px solid var(--border)}
+header img{max-height:48px}
+h1{font-size:1.4em;margin:0}
+main{padding:1em 2em}
+.bar{display:flex;justify-content:space-between;align-items:center;flex-wrap:wrap;gap:1em}
+a{color:var(--accent)}
+.button{background:var(--accent);color:#fff;padding:.5em 1em;border-radius:4px;text-decoration:none}
+.grid{display:grid;grid-template-columns:repeat(auto-fill,minmax(180px,1fr));gap:1em;margin:1em 0}
+.grid a{display:block;background:var(--surface);border-radius:4px;overflow:hidden;text-decoration:none;color:inherit;font-size:.85em}
+.grid img{width:100%;height:140px;object-fit:cover;display:block;background:var(--placeholder)}
+.grid span{display:block;padding:.4em;overflow:hidden;text-overflow:ellipsis;white-space:nowrap}
+.grid small{display:block;padding:0 .4em .4em;color:var(--muted)}
+.readme{background:var(--surface);border-radius:4px;padding:.1em 1.5em;margin:1em 0}
+ul{padding-left:1.2em}
+footer{padding:1em 2em;color:var(--muted);font-size:.85em}
+#viewer{position:fixed;inset:0;z-index:10;display:flex;flex-direction:column;background:#000;color:#fff}
+#viewer[hidden]{display:none}
+#viewer img{flex:1;min-height:0;width:100%;object-fit:contain}
+.controls{display:flex;align-items:center;justify-content:center;gap:1em;padding:.5em;transition:opacity .3s}
+.controls button{background:none;border:0;color:inherit;font-size:1.4em;cursor:pointer}
+.controls span{min-width:12em;text-align:center;font-size:.9em;overflow:hidden;text-overflow:ellipsis;white-space:nowrap}
+#viewer.playing .controls{opacity:0}
+#viewer.playing:hover .controls{opacity:1}
+{{.Theme.CSS}}
+</style>
+</head>
+<body>
+<header>{{if .Logo}}<img src="{{.Logo}}" alt="">{{end}}<h1>{{.Title}}</h1></header>
+<main>
+<div class="bar">
+<div>{{if .Parent}}<a href="{{.Parent}}">&larr; {{.Text.T "share.back"}}</a> {{end}}<strong>{{.Folder}}</strong></div>
+<div>{{if .Images}}<button type="button" class="button" id="slideshow">{{.Text.T "viewer.slideshow"}}</button> {{end}}{{if or .Folders .Images .Files}}<a class="button" href="?download=zip">{{.Text.T "share.downloadAll"}}</a>{{end}}</div>
+</div>
+{{if .Readme}}<article class="readme">{{.Readme}}</article>{{end}}
+{{if .Folders}}<ul class="folders">{{range .Folders}}<li data-name="{{.Name}}"><a href="{{.URL}}">{{.Name}}/</a>{{if .Caption}} &ndash; {{.Caption}}{{end}}</li>{{end}}</ul>{{end}}
+{{if .Images}}<div class="grid">{{range .Images}}<a href="{{.URL}}" target="_blank" data-name="{{.Name}}" data-caption="{{.Caption}}"><img src="{{.Thumb}}" alt="{{.Caption}}" loading="lazy"><span>{{.Name}}</span>{{if .Caption}}<small>{{.Caption}}</small>{{end}}</a>{{end}}</div>{{end}}
+{{if .Files}}<ul class="files">{{range .Files}}<li data-name="{{.Name}}"><a href="{{.URL}}" download>{{.Name}}</a>{{if .Caption}} &ndash; {{.Caption}}{{end}}</li>{{end}}</ul>{{end}}
+{{if not (or .Folders .Images .Files)}}<p>{{.Text.T "share.empty"}}</p>{{end}}
+</main>
+<footer>{{.Text.T "share.expires" (.Expires.Format (.Text.T "share.dateLayout"))}}</footer>
+{{if .Images}}<div id="viewer" hidden>
+<img alt="">
+<div class="controls"><button type="button" data-action="prev" title="{{.Text.T "viewer.previous"}}">&larr;</button><button type="button" data-action="play" title="{{.Text.T "viewer.play"}}">&#9654;</button><span></span><button type="button" data-action="next" title="{{.Text.T "viewer.next"}}">&rarr;</button><button type="button" data-action="close" title="{{.Text.T "viewer.close"}}">&times;</button></div>
+</div>
+<script>
+(function(){
+var grid=document.querySelector('.grid');
+// Looked up each time, the live updates change the grid
+function links(){return grid.querySelectorAll('a');}
+var viewer=document.getElementById('viewer'),img=viewer.querySelector('img'),caption=viewer.querySelector('.controls span'),play=viewer.querySelector('[data-action=play]');
+var interval={{.Interval}}*1000,current=0,timer=null,next=new Image();
+function show(i){
+  var all=links();
+  if(!all.length){close();return;}
+  current=(i+all.length)%all.length;
+  img.src=all[current].querySelector('img').src;
+  caption.textContent=(all[current].getAttribute('data-caption')||all[current].querySelector('span').textContent)+' ('+(current+1)+'/'+all.length+')';
+  viewer.hidden=false;
+  // Loaded now, the next image shows without a gap
+  next.src=all[(current+1)%all.length].querySelector('img').src;
+}
+function step(d){show(current+d);if(timer)start();}
+function start(){stop();timer=setInterval(function(){show(current+1);},interval);viewer.classList.add('playing');play.innerHTML='&#10074;&#10074;';}
+function stop(){clearInterval(timer);timer=null;viewer.classList.remove('playing');play.innerHTML='&#9654;';}
+function close(){stop();viewer.hidden=true;if(document.fullscreenElement)document.exitFullscreen();}
+function fullscreen(){if(viewer.requestFullscreen&&!document.fullscreenElement)viewer.requestFullscreen().catch(function(){});}
+grid.addEventListener('click',function(e){
+  var a=e.target.closest('a');
+  if(!a)return;
+  e.preventDefault();
+  show([].indexOf.call(links(),a));
+});
+document.getElementById('slideshow').addEventListener('click',function(){show(0);fullscreen();start();});
+viewer.addEventListener('click',function(e){
+  switch(e.target.getAttribute('data-action')){
+  case 'prev':step(-1);break;
+  case 'next':step(1);break;
+  case 'play':if(timer){stop();}else{start();}break;
+  case 'close':close();break;
+  }
+});
+document.addEventListener('keydown',function(e){
+  if(viewer.hidden)return;
+  switch(e.key){
+  case 'ArrowLeft':step(-1);break;
+  case 'ArrowRight':step(1);break;
+  case ' ':if(timer){stop();}else{start();}break;
+  case 'f':fullscreen();break;
+  case 'Escape':close();break;
+  default:return;
+  }
+  e.preventDefault();
+});
+if(/[?&]slideshow(=|&|$)/.test(location.search)){show(0);start();}
+})();
+</script>{{end}}
+{{if .Live}}<script>
+// Follows the changes to the folder over a WebSocket and updates the page in
+// place. Changes it can't place, and missed ones, reload the page.
+(function(){
+var after={{.LiveAfter}},delay=1000;
+function reload(){location.reload();}
+function find(list,name){return [].filter.call(list.children,function(el){return el.getAttribute('data-name')===name;})[0];}
+function place(list,el,name){
+  var key=name.toLowerCase(),before=[].filter.call(list.children,function(c){return c.getAttribute('data-name').toLowerCase()>key;})[0];
+  list.insertBefore(el,before||null);
+}
+function item(list,m,build){
+  var el=find(list,m.name);
+  if(!el){el=build();el.setAttribute('data-name',m.name);place(list,el,m.name);}
+  return el;
+}
+function listItem(m,label,download){
+  var li=document.createElement('li'),a=li.appendChild(document.createElement('a'));
+  li.setAttribute('data-name',m.name);
+  a.href=m.url;
+  a.textContent=label;
+  if(download)a.setAttribute('download','');
+  if(m.caption)li.appendChild(document.createTextNode(' \u2013 '+m.caption));
+  return li;
+}
+function change(m){
+  if(m.action==='resync'||m.kind==='notes'){reload();return;}
+  var grid=document.querySelector('.grid'),folders=document.querySelector('ul.folders'),files=document.querySelector('ul.files');
+  if(m.action==='deleted'){
+    [grid,folders,files].forEach(function(list){var el=list&&find(list,m.name);if(el)list.removeChild(el);});
+    return;
+  }
+  var list={image:grid,folder:folders,file:files}[m.kind];
+  if(!list){reload();return;}
+  if(m.kind==='folder'){
+    item(list,m,function(){return listItem(m,m.name+'/',false);});
+    return;
+  }
+  if(m.kind==='file'){
+    list.replaceChild(listItem(m,m.name,true),item(list,m,function(){return document.createElement('li');}));
+    return;
+  }
+  var a=item(list,m,function(){
+    var a=document.createElement('a');
+    a.target='_blank';
+    a.appendChild(document.createElement('img'));
+    a.appendChild(document.createElement('span')).textContent=m.name;
+    return a;
+  });
+  // The version makes the browser fetch the image again when it's rewritten
+  a.href=m.url+'?v='+m.version;
+  a.querySelector('img').src=m.thumb+'&v='+m.version;
+  a.querySelector('img').alt=m.caption||'';
+  a.setAttribute('data-caption',m.caption||'');
+  var small=a.querySelector('small');
+  if(small)a.removeChild(small);
+  if(m.caption)a.appendChild(document.createElement('small')).textContent=m.caption;
+}
+function connect(){
+  var ws=new WebSocket((location.protocol==='https:'?'wss://':'ws://')+location.host+location.pathname+'?after='+after);
+  ws.onopen=function(){delay=1000;};
+  ws.onmessage=function(e){var m=JSON.parse(e.data);after=m.id;change(m);};
+  ws.onclose=function(){setTimeout(connect,delay);delay=Math.min(2*delay,30000);};
+}
+connect();
+})();
+</script>{{end}}
+</body>
+</html>
+`))
+
+type sharePageEntry struct {
+	Name    string
+	URL     string
+	Caption string
+	// Thumb is the URL images are shown with, which isn't counted as a download
+	Thumb string
+}
+
+type sharePageData struct {
+	Text    messages
+	Theme   pageTheme
+	Title   string
+	Logo    string
+	Folder  string
+	Parent  string
+	Folders []sharePageEntry
+	Images  []sharePageEntry
+	Files   []sharePageEntry
+	// Readme is the folder's README.md, rendered
+	Readme  template.HTML
+	Expires time.Time
+	// Interval is how many seconds the slideshow shows each image
+	Interval int
+	// Live is set when the page follows the changes to the folder, after
+	// the event with ID LiveAfter
+	Live      bool
+	LiveAfter uint64
+}
+
+// shareURL returns the escaped URL of name, relative to the shared folder
+func shareURL(sh *share, name string) string {
+	return (&url.URL{Path: sharePrefix + sh.Token + name}).EscapedPath()
+}
+
+// thumbURL returns the URL the page shows the image name with
+func (s *shareStore) thumbURL(sh *share, name string) string {
+	return shareURL(sh, name) + "?thumb=" + s.thumbToken(sh, name)
+}
+
+// serveShareThumbnail serves the image name of a folder share fitted in
+// shareThumbnailSize pixels, never the file itself. It reports false, having
+// written nothing, for files that aren't JPEG, PNG or GIF images.
+func serveShareThumbnail(w http.ResponseWriter, r *http.Request, sh *share, sub http.FileSystem, name string) bool {
+	contentType, encode := "image/jpeg", func(b *bytes.Buffer, img image.Image) error {
+		return jpeg.Encode(b, img, &jpeg.Options{Quality: 85})
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg":
+	case ".png", ".gif":
+		// PNG keeps the transparency
+		contentType, encode = "image/png", func(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) }
+	default:
+		return false
+	}
+	f, err := sub.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	etag := strings.TrimSuffix(fileETag(info.Size(), info.ModTime()), `"`) + `-thumb"`
+	ops := []imageOp{{"resize", []int{shareThumbnailSize}}}
+	serveConversion(w, r, f, info.ModTime(), cacheKey(path.Join(sh.Path, name))+"\x00"+etag, etag, contentType, ops, encode)
+	return true
+}
+
+// shareEntryKind returns how the page shows the file name: an image in the
+// grid, a file in the list, or notes (README.md and the captions) above them
+func shareEntryKind(name string) string {
+	switch {
+	case isNotesFile(name):
+		return "notes"
+	case strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "image/"):
+		return "image"
+	}
+	return "file"
+}
+
+// servePage renders the branded page for the directory name of a folder
+// share. With the change feed the page follows the changes to the directory.
+func (s *shareStore) servePage(w http.ResponseWriter, r *http.Request, config *ShareConfig, sh *share, sub http.FileSystem, name string, feed *changeFeed) {
+	data := sharePageData{Text: pageText(r), Theme: requestTheme(r), Title: config.Title, Logo: config.Logo, Folder: path.Base(sh.Path), Expires: sh.Expires, Interval: config.slideshowSeconds()}
+	if feed != nil {
+		// Taken before listing the directory, so no change is missed
+		data.Live, data.LiveAfter = true, feed.resumeID("")
+	}
+	dir, err := sub.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer dir.Close()
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		http.Error(w, "failed to list the folder", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name()) })
+
+	if n, err := strconv.Atoi(r.URL.Query().Get("interval")); err == nil && n > 0 && n <= 3600 {
+		data.Interval = n
+	}
+	if data.Title == "" {
+		data.Title = data.Theme.Title
+	}
+	if data.Title == "" {
+		data.Title = data.Text.T("share.title")
+	}
+	if data.Logo == "" {
+		data.Logo = data.Theme.Logo
+	}
+	if name != "/" {
+		data.Folder = path.Join(data.Folder, name)
+		data.Parent = shareURL(sh, strings.TrimSuffix(path.Dir(name), "/")+"/")
+	}
+	notes := readFolderNotes(sub, name)
+	data.Readme = notes.readmeHTML
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name())
+		switch {
+		case entry.IsDir():
+			data.Folders = append(data.Folders, sharePageEntry{Name: entry.Name(), URL: shareURL(sh, child+"/"), Caption: notes.caption(entry.Name())})
+		case shareEntryKind(entry.Name()) == "notes":
+			// Shown above the files instead
+		case shareEntryKind(entry.Name()) == "image":
+			data.Images = append(data.Images, sharePageEntry{entry.Name(), shareURL(sh, child), notes.caption(entry.Name()), s.thumbURL(sh, child)})
+		default:
+			data.Files = append(data.Files, sharePageEntry{Name: entry.Name(), URL: shareURL(sh, child), Caption: notes.caption(entry.Name())})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	sharePageTemplate.Execute(w, data)
+}
+
+// liveChange is a change to the directory of a share page, sent to the page
+// over its WebSocket
+type liveChange struct {
+	ID     uint64 `json:"id"`
+	Action string `json:"action"`
+	// Name is the file in the directory, or the folder in it for changes
+	// further down
+	Name string `json:"name,omitempty"`
+	// Kind is image, file, notes or folder
+	Kind    string `json:"kind,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Thumb   string `json:"thumb,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	// Version changes when the file is written
+	Version string `json:"version,omitempty"`
+}
+
+// liveEntry returns the entry of dir the change to p is in, and whether p
+// is that entry rather than below it
+func liveEntry(dir, p string) (name string, direct, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	depth := 0
+	if dir != "/" {
+		depth = strings.Count(dir, "/")
+	}
+	if len(parts) <= depth || !strings.EqualFold("/"+strings.Join(parts[:depth], "/"), dir) {
+		return "", false, false
+	}
+	return parts[depth], len(parts) == depth+1, true
+}
+
+// serveLive streams the changes to the directory name of a folder share to
+// its page over a WebSocket, until the share expires or is revoked
+func (s *shareStore) serveLive(w http.ResponseWriter, r *http.Request, sh *share, sub http.FileSystem, name string, feed *changeFeed) {
+	id := feed.resumeID(r.URL.Query().Get("after"))
+	ws, ok := upgradeWebSocket(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		ws.readLoop()
+		cancel()
+	}()
+
+	dir := path.Join(sh.Path, name)
+	// Changes further down only add the folder they're in
+	visible := func(e *changeEvent) bool {
+		_, direct, ok := liveEntry(dir, e.Path)
+		return e.Action == "resync" || ok && (direct || e.Action == "changed")
+	}
+	usable := func() error {
+		if current, reason := s.lookup(sh.Token); current == nil || reason != "" {
+			return errShareEnded
+		}
+		return nil
+	}
+	feed.stream(ctx, id, sh.Expires, visible, func(e *changeEvent) error {
+		if err := usable(); err != nil {
+			return err
+		}
+		change := liveChange{ID: e.ID, Action: e.Action}
+		if e.Action != "resync" {
+			entry, direct, _ := liveEntry(dir, e.Path)
+			child := path.Join(name, entry)
+			change.Name, change.Kind, change.URL = entry, shareEntryKind(entry), shareURL(sh, child)
+			if !direct {
+				change.Kind, change.URL = "folder", shareURL(sh, child+"/")
+			}
+			if change.Kind == "image" {
+				change.Thumb = s.thumbURL(sh, child)
+			}
+			if e.Action == "changed" {
+				change.Caption = readFolderNotes(sub, name).caption(entry)
+			}
+			if direct && e.Modified != nil {
+				change.Version = strconv.FormatInt(e.Modified.UnixNano(), 36) + "-" + strconv.FormatInt(e.Size, 36)
+			}
+		}
+		data, _ := json.Marshal(change)
+		return ws.write(wsText, data)
+	}, func() error {
+		if err := usable(); err != nil {
+			return err
+		}
+		return ws.write(wsPing, nil)
+	})
+	if ctx.Err() != nil {
+		// The page closed the connection
+		ws.conn.Close()
+		return
+	}
+	ws.close(websocketGoingAway)
+}
+
+var errShareEnded = errors.New("the share has ended")
+
+// serveZip serves the files below the directory name of a folder share as
+// one ZIP download. Images are already compressed so they're stored as is,
+// which also keeps the server from spending CPU on large folders. The
+// archive is laid out from the listing, so it has a length and an ETag and
+// interrupted downloads resume with Range.
+func (s *shareStore) serveZip(w http.ResponseWriter, r *http.Request, sh *share, sub http.FileSystem, name, session string) {
+	m, err := newZipManifest(sub, name)
+	if err != nil {
+		http.Error(w, "failed to list the folder", http.StatusInternalServerError)
+		return
+	}
+	m = s.zips.get(m)
+	if r.Method == http.MethodGet && !s.countDownload(session, sh, path.Join(name, "?download=zip")) {
+		http.Error(w, "this link has reached its download limit", http.StatusGone)
+		return
+	}
+	archive := path.Base(path.Join(sh.Path, name))
+	if archive == "/" || archive == "." {
+		archive = "files"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archive + ".zip"}))
+	w.Header().Set("ETag", m.etag)
+	// A file changing halfway can't be reported anymore, the client sees a
+	// truncated archive and its resume gets the new one from the start
+	zr := newZipArchive(m, sub)
+	defer zr.Close()
+	http.ServeContent(w, r, archive+".zip", m.modified, zr)
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sharePrefix is the URL path share links are served below
+	sharePrefix = "/s/"
+	// shareMaxExpiry is the longest a share link can be valid for
+	shareMaxExpiry = 90 * 24 * time.Hour
+	// sharePasswordRounds slows down guessing share passwords from a stolen store
+	sharePasswordRounds = 20000
+	// shareRetention is how long used up shares are kept, answering 410 rather than 404
+	shareRetention = 7 * 24 * time.Hour
+	// shareSessionTTL is how long the requests of a client for a file count
+	// as one download, so resumed and chunked downloads count once
+	shareSessionTTL = 24 * time.Hour
+	// maxShareSessions bounds the sessions kept, which are emptied when full
+	maxShareSessions = 100000
+	// sharePasswordGuesses is how many passwords a share checks a minute.
+	// Each check costs sharePasswordRounds hashes, clients that passed it
+	// carry a session cookie instead.
+	sharePasswordGuesses = 10
+	// shareCookie is the name of the session cookie of a share, scoped to its path
+	shareCookie = "share_session"
+	// shareThumbnailSize is the pixels ?thumb= images are fitted in: enough
+	// for the page's viewer, not a stand-in for the original
+	shareThumbnailSize = 1280
+)
+
+// ShareConfig enables guest share links, created with the admin API
+type ShareConfig struct {
+	// Store is the file the shares are kept in, relative to the executable, shares.json by default
+	Store string `json:"store,omitempty"`
+	// BaseURL is the public URL of the server the links are built with, e.g. https://images.example.com
+	BaseURL string `json:"baseURL,omitempty"`
+	// Title and Logo brand the page folder links show, Logo is the URL of an image
+	Title string `json:"title,omitempty"`
+	Logo  string `json:"logo,omitempty"`
+	// SlideshowSeconds is how long the slideshow of folder pages shows each image, 8 by default
+	SlideshowSeconds int `json:"slideshowSeconds,omitempty"`
+}
+
+func (c *ShareConfig) validate(adminAPI bool) []error {
+	var errs []error
+	if !adminAPI {
+		errs = append(errs, fmt.Errorf("shares need an adminToken to create them with"))
+	}
+	if c.BaseURL != "" && !strings.HasPrefix(c.BaseURL, "http://") && !strings.HasPrefix(c.BaseURL, "https://") {
+		errs = append(errs, fmt.Errorf("shares.baseURL must be an http or https URL, got %q", c.BaseURL))
+	}
+	if c.Logo != "" && !strings.HasPrefix(c.Logo, "/") && !strings.HasPrefix(c.Logo, "https://") && !strings.HasPrefix(c.Logo, "http://") {
+		errs = append(errs, fmt.Errorf("shares.logo must be a URL path or an http or https URL, got %q", c.Logo))
+	}
+	if c.SlideshowSeconds < 0 {
+		errs = append(errs, fmt.Errorf("shares.slideshowSeconds cannot be negative"))
+	}
+	return errs
+}
+
+func (c *ShareConfig) slideshowSeconds() int {
+	if c.SlideshowSeconds == 0 {
+		return 8
+	}
+	return c.SlideshowSeconds
+}
+
+// share is a tokenized link to a file or folder
+type share struct {
+	Token        string    `json:"token"`
+	Path         string    `json:"path"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	// PasswordSalt and PasswordHash are set for password protected shares
+	PasswordSalt string `json:"passwordSalt,omitempty"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	// ThumbKey signs the ?thumb= tokens of the images on the share's pages
+	// and the share's session cookies
+	ThumbKey string `json:"thumbKey,omitempty"`
+}
+
+// usable reports why a share can't be used anymore, or "" when it can
+func (s *share) usable(now time.Time) string {
+	if now.After(s.Expires) {
+		return "this link has expired"
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return "this link has reached its download limit"
+	}
+	return ""
+}
+
+// hashSharePassword derives the stored hash of password. The standard
+// library has no bcrypt or scrypt, so it iterates salted SHA-256.
+func hashSharePassword(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	for i := 1; i < sharePasswordRounds; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// shareStore keeps the shares in memory and in its file
+type shareStore struct {
+	file string
+
+	mu     sync.Mutex
+	shares map[string]*share
+	// sessions are when each client session last downloaded each file of a share
+	sessions map[string]time.Time
+	// guesses counts the password checks of each share in the current minute
+	guesses map[string]shareGuesses
+
+	// zips are the layouts of the latest ZIP downloads, for resuming them
+	zips zipManifestCache
+}
+
+// openShareStore loads the shares of config, or returns nil when shares aren't configured
+func openShareStore(config *ShareConfig) (*shareStore, error) {
+	if config == nil {
+		return nil, nil
+	}
+	name := config.Store
+	if name == "" {
+		name = "shares.json"
+	}
+	file, err := resolveConfigPath(name)
+	if err != nil {
+		return nil, err
+	}
+	store := &shareStore{file: file, shares: map[string]*share{}}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shares []*share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, s := range shares {
+		store.shares[s.Token] = s
+	}
+	return store, nil
+}
+
+// saveLocked writes the shares, dropping those expired longer than
+// shareRetention ago, s.mu must be held
+func (s *shareStore) saveLocked() error {
+	now := time.Now()
+	shares := make([]*share, 0, len(s.shares))
+	for token, sh := range s.shares {
+		if now.After(sh.Expires.Add(shareRetention)) {
+			delete(s.shares, token)
+			continue
+		}
+		shares = append(shares, sh)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data)
+}
+
+// shareRequest is the body of POST /api/share
+type shareRequest struct {
+	// Path is the URL path of the file or folder to share
+	Path string `json:"path"`
+	// ExpiresIn is how long the link is valid, e.g. 72h
+	ExpiresIn    string `json:"expiresIn"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+// shareInfo is how shares are shown by the admin API, without the password hash
+type shareInfo struct {
+	Token        string    `json:"token"`
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Password     bool      `json:"password"`
+}
+
+func (s *shareStore) info(config *ShareConfig, r *http.Request, sh *share) shareInfo {
+	base := strings.TrimSuffix(config.BaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return shareInfo{
+		Token:        sh.Token,
+		URL:          base + sharePrefix + sh.Token + "/",
+		Path:         sh.Path,
+		Created:      sh.Created,
+		Expires:      sh.Expires,
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		Password:     sh.PasswordHash != "",
+	}
+}
+
+// createHandler serves POST /api/share
+func (s *shareStore) createHandler(config *ShareConfig, folder string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req shareRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 || expiresIn > shareMaxExpiry {
+			http.Error(w, fmt.Sprintf("expiresIn must be a duration such as 72h, up to %v", shareMaxExpiry), http.StatusBadRequest)
+			return
+		}
+		if req.MaxDownloads < 0 {
+			http.Error(w, "maxDownloads cannot be negative", http.StatusBadRequest)
+			return
+		}
+		urlPath := path.Clean("/" + req.Path)
+		if _, err := os.Stat(filepath.Join(folder, filepath.FromSlash(urlPath))); err != nil {
+			http.Error(w, fmt.Sprintf("%s doesn't exist", urlPath), http.StatusBadRequest)
+			return
+		}
+
+		sh, err := s.create(urlPath, expiresIn, req.MaxDownloads, req.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s.info(config, r, sh))
+	})
+}
+
+// create adds a share of urlPath valid for expiresIn, protected by password
+// unless it is empty, and saves the shares
+func (s *shareStore) create(urlPath string, expiresIn time.Duration, maxDownloads int, password string) (*share, error) {
+	token, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	sh := &share{Token: token, Path: urlPath, Created: now, Expires: now.Add(expiresIn), MaxDownloads: maxDownloads}
+	if sh.ThumbKey, err = randomToken(32); err != nil {
+		return nil, err
+	}
+	if password != "" {
+		if sh.PasswordSalt, err = randomToken(16); err != nil {
+			return nil, err
+		}
+		sh.PasswordHash = hashSharePassword(sh.PasswordSalt, password)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares[token] = sh
+	if err := s.saveLocked(); err != nil {
+		return nil, fmt.Errorf("failed to save the share: %w", err)
+	}
+	return sh, nil
+}
+
+// manageHandler lists the shares with GET and revokes one with DELETE ?token=<token>
+func (s *shareStore) manageHandler(config *ShareConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			now := time.Now()
+			s.mu.Lock()
+			shares := make([]shareInfo, 0, len(s.shares))
+			for _, sh := range s.shares {
+				if sh.usable(now) == "" {
+					shares = append(shares, s.info(config, r, sh))
+				}
+			}
+			s.mu.Unlock()
+			sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(shares)
+		case http.MethodDelete:
+			token := r.URL.Query().Get("token")
+			s.mu.Lock()
+			_, ok := s.shares[token]
+			delete(s.shares, token)
+			err := s.saveLocked()
+			s.mu.Unlock()
+			if !ok {
+				http.Error(w, "no such share", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "failed to save the shares: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// lookup returns the share of token and why it can't be used, if it can't
+func (s *shareStore) lookup(token string) (*share, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[token]
+	if !ok {
+		return nil, "this link doesn't exist or was revoked"
+	}
+	return sh, sh.usable(time.Now())
+}
+
+// countDownload records a download of the file name of sh by the client
+// session, refusing it when the limit was reached by a concurrent download
+// meanwhile. The session's further requests for the file within
+// shareSessionTTL, whatever their Range, are part of the same download.
+func (s *shareStore) countDownload(session string, sh *share, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if sh.usable(now) != "" {
+		return false
+	}
+	key := sh.Token + "\x00" + session + "\x00" + name
+	if last, ok := s.sessions[key]; ok && now.Sub(last) < shareSessionTTL {
+		s.sessions[key] = now
+		return true
+	}
+	if s.sessions == nil || len(s.sessions) >= maxShareSessions {
+		s.sessions = map[string]time.Time{}
+	}
+	s.sessions[key] = now
+	sh.Downloads++
+	// Losing a count on a failed write is better than failing the download
+	s.saveLocked()
+	return true
+}
+
+// sign returns the MAC of message with the key of sh. Shares created before
+// they had a key get it the first time.
+func (s *shareStore) sign(sh *share, message string) string {
+	s.mu.Lock()
+	if sh.ThumbKey == "" {
+		if key, err := randomToken(32); err == nil {
+			sh.ThumbKey = key
+			s.saveLocked()
+		}
+	}
+	key := sh.ThumbKey
+	s.mu.Unlock()
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// thumbToken returns the ?thumb= token the page of sh shows the image name
+// of with: the request for it isn't a download
+func (s *shareStore) thumbToken(sh *share, name string) string {
+	return s.sign(sh, path.Clean("/"+name))
+}
+
+// session returns the session of the client of r from its cookie, or ""
+// when it has none for sh or the cookie isn't signed by sh. A session
+// means the client gave the share's password, if it has one.
+func (s *shareStore) session(r *http.Request, sh *share) string {
+	cookie, err := r.Cookie(shareCookie)
+	if err != nil {
+		return ""
+	}
+	id, mac, ok := strings.Cut(cookie.Value, ".")
+	if !ok || id == "" || !hmac.Equal([]byte(mac), []byte(s.sign(sh, "session\x00"+id))) {
+		return ""
+	}
+	return id
+}
+
+// startSession sets the cookie of a new session for sh, valid on the
+// share's paths until it expires, and returns the session
+func (s *shareStore) startSession(w http.ResponseWriter, r *http.Request, sh *share) (string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookie,
+		Value:    id + "." + s.sign(sh, "session\x00"+id),
+		Path:     sharePrefix + sh.Token + "/",
+		Expires:  sh.Expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
+
+// shareGuesses is the password checks of a share since start
+type shareGuesses struct {
+	start time.Time
+	count int
+}
+
+// allowGuess reports whether the password of sh can be checked now, at
+// most sharePasswordGuesses times a minute
+func (s *shareStore) allowGuess(sh *share) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	g := s.guesses[sh.Token]
+	if now.Sub(g.start) >= time.Minute {
+		g = shareGuesses{start: now}
+	}
+	if g.count >= sharePasswordGuesses {
+		return false
+	}
+	g.count++
+	if s.guesses == nil {
+		s.guesses = map[string]shareGuesses{}
+	}
+	s.guesses[sh.Token] = g
+	return true
+}
+
+// isThumbnail reports whether r carries the ?thumb= token of name, which
+// only the share's own pages render
+func (s *shareStore) isThumbnail(r *http.Request, sh *share, name string) bool {
+	token := r.URL.Query().Get("thumb")
+	return token != "" && hmac.Equal([]byte(token), []byte(s.thumbToken(sh, name)))
+}
+
+// subFS serves the files below root of an http.FileSystem
+type subFS struct {
+	fs   http.FileSystem
+	root string
+}
+
+func (f subFS) Open(name string) (http.File, error) {
+	return f.fs.Open(path.Join(f.root, path.Clean("/"+name)))
+}
+
+// shareHandler serves /s/<token>/..., the shared file or the files in the
+// shared folder with a branded page for its folders. Whole file downloads
+// count against the download limit, the images shown on the page don't.
+// With the change feed, folder pages follow the changes over a WebSocket.
+func (s *shareStore) shareHandler(config *ShareConfig, files http.FileSystem, feed *changeFeed) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rest := strings.TrimPrefix(r.URL.Path, sharePrefix)
+		token, rest := rest, ""
+		if i := strings.Index(token, "/"); i >= 0 {
+			token, rest = token[:i], token[i:]
+		}
+		sh, reason := s.lookup(token)
+		if sh == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if reason != "" {
+			http.Error(w, reason, http.StatusGone)
+			return
+		}
+		// The password is checked once, the session cookie stands for it
+		// afterwards, on the images of the page too
+		session := s.session(r, sh)
+		if session == "" {
+			if sh.PasswordHash != "" {
+				_, password, ok := r.BasicAuth()
+				if ok && !s.allowGuess(sh) {
+					w.Header().Set("Retry-After", "60")
+					http.Error(w, "too many password attempts, try again in a minute", http.StatusTooManyRequests)
+					return
+				}
+				if !ok || subtle.ConstantTimeCompare([]byte(hashSharePassword(sh.PasswordSalt, password)), []byte(sh.PasswordHash)) != 1 {
+					w.Header().Set("WWW-Authenticate", `Basic realm="Shared files", charset="UTF-8"`)
+					http.Error(w, "this link needs a password", http.StatusUnauthorized)
+					return
+				}
+			}
+			var err error
+			if session, err = s.startSession(w, r, sh); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if rest == "" {
+			http.Redirect(w, r, sharePrefix+token+"/", http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+		// A file share serves its file at the root, a folder share everything below it
+		if !isDir(files, sh.Path) {
+			if rest != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			f, err := files.Open(sh.Path)
+			if err != nil {
+				http.Error(w, "the shared file is no longer available", http.StatusGone)
+				return
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if r.Method == http.MethodGet && !s.countDownload(session, sh, "/") {
+				http.Error(w, "this link has reached its download limit", http.StatusGone)
+				return
+			}
+			w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", info.Name()))
+			http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+			return
+		}
+
+		sub := subFS{files, sh.Path}
+		name := path.Clean(rest)
+		if isDir(sub, name) {
+			if !strings.HasSuffix(rest, "/") {
+				http.Redirect(w, r, shareURL(sh, name+"/"), http.StatusMovedPermanently)
+				return
+			}
+			if feed != nil && isWebSocket(r) {
+				s.serveLive(w, r, sh, sub, name, feed)
+				return
+			}
+			if r.URL.Query().Get("download") == "zip" {
+				s.serveZip(w, r, sh, sub, name, session)
+				return
+			}
+			if !fileExistsIn(sub, path.Join(name, "index.html")) {
+				s.servePage(w, r, config, sh, sub, name, feed)
+				return
+			}
+		}
+		// The images shown on the page carry a token the page was rendered
+		// with and get a downscaled copy, which doesn't count. Files that
+		// can't be downscaled are served as they are and count.
+		if !isDir(sub, name) && s.isThumbnail(r, sh, name) && serveShareThumbnail(w, r, sh, sub, name) {
+			return
+		}
+		if r.Method == http.MethodGet && !isDir(sub, name) && !s.countDownload(session, sh, name) {
+			http.Error(w, "this link has reached its download limit", http.StatusGone)
+			return
+		}
+		req := r.Clone(r.Context())
+		req.URL.Path = rest
+		http.FileServer(sub).ServeHTTP(w, req)
+	})
+}
+
+// randomToken returns n random bytes, base64url encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
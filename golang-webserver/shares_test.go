@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestShares returns a share store and a folder holding files, name to content
+func newTestShares(t *testing.T, files map[string]string) (*shareStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &shareStore{file: filepath.Join(t.TempDir(), "shares.json"), shares: map[string]*share{}}, dir
+}
+
+// shareClient requests a share link like a browser, keeping its cookies
+type shareClient struct {
+	handler  http.Handler
+	cookies  []*http.Cookie
+	password string
+}
+
+func (c *shareClient) get(url string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	// Every client comes from the same address, as behind a NAT
+	r.RemoteAddr = "192.0.2.1:1234"
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+	if c.password != "" {
+		r.SetBasicAuth("guest", c.password)
+	}
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, r)
+	c.cookies = append(c.cookies, w.Result().Cookies()...)
+	return w
+}
+
+func TestSharePassword(t *testing.T) {
+	store, dir := newTestShares(t, map[string]string{"a.jpg": "a"})
+	sh, err := store.create("/", time.Hour, 0, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := store.shareHandler(&ShareConfig{}, http.Dir(dir), nil)
+	url := sharePrefix + sh.Token + "/a.jpg"
+
+	guest := &shareClient{handler: handler}
+	if w := guest.get(url); w.Code != http.StatusUnauthorized || len(guest.cookies) != 0 {
+		t.Fatalf("without the password got %d and %d cookies", w.Code, len(guest.cookies))
+	}
+	guest.password = "s3cret"
+	if w := guest.get(url); w.Code != http.StatusOK || len(guest.cookies) != 1 {
+		t.Fatalf("with the password got %d and %d cookies", w.Code, len(guest.cookies))
+	}
+
+	// Passwords are checked sharePasswordGuesses times a minute, the
+	// guest's check was one of them
+	attacker := &shareClient{handler: handler, password: "guess"}
+	for i := 1; i < sharePasswordGuesses; i++ {
+		if w := attacker.get(url); w.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d got %d", i+1, w.Code)
+		}
+	}
+	if w := attacker.get(url); w.Code != http.StatusTooManyRequests {
+		t.Errorf("a guess past the limit got %d", w.Code)
+	}
+	// The session cookie stands for the password, without checking it again
+	guest.password = ""
+	if w := guest.get(url); w.Code != http.StatusOK {
+		t.Errorf("the guest's session got %d while guesses are refused", w.Code)
+	}
+	// Nor can it be forged, or taken to another share
+	forged := &shareClient{handler: handler, cookies: []*http.Cookie{{Name: shareCookie, Value: "id.mac"}}}
+	if w := forged.get(url); w.Code != http.StatusUnauthorized {
+		t.Errorf("a forged session got %d", w.Code)
+	}
+	other, err := store.create("/", time.Hour, 0, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest.cookies[0].Path = ""
+	if w := guest.get(sharePrefix + other.Token + "/a.jpg"); w.Code != http.StatusUnauthorized {
+		t.Errorf("the session of another share got %d", w.Code)
+	}
+}
+
+func TestShareDownloadSessions(t *testing.T) {
+	store, dir := newTestShares(t, map[string]string{"a.jpg": "a"})
+	sh, err := store.create("/", time.Hour, 3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := store.shareHandler(&ShareConfig{}, http.Dir(dir), nil)
+	url := sharePrefix + sh.Token + "/a.jpg"
+
+	// A client's repeated requests are one download
+	first := &shareClient{handler: handler}
+	for i := 0; i < 3; i++ {
+		if w := first.get(url); w.Code != http.StatusOK {
+			t.Fatalf("request %d got %d", i+1, w.Code)
+		}
+	}
+	if sh.Downloads != 1 {
+		t.Errorf("one client counted %d downloads", sh.Downloads)
+	}
+	// Another client from the same address is another download
+	second := &shareClient{handler: handler}
+	if w := second.get(url); w.Code != http.StatusOK || sh.Downloads != 2 {
+		t.Errorf("a second client got %d and counted %d downloads", w.Code, sh.Downloads)
+	}
+}
+
+func TestShareThumbnails(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2000, 1000))
+	for x := 0; x < 2000; x++ {
+		img.Set(x, x/2, color.RGBA{255, 0, 0, 255})
+	}
+	var original bytes.Buffer
+	if err := png.Encode(&original, img); err != nil {
+		t.Fatal(err)
+	}
+	store, dir := newTestShares(t, map[string]string{"big.png": original.String(), "logo.svg": "<svg/>"})
+	sh, err := store.create("/", time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := store.shareHandler(&ShareConfig{}, http.Dir(dir), nil)
+
+	// The page's images are downscaled copies, which don't count
+	thumb := func(c *shareClient) {
+		t.Helper()
+		w := c.get(store.thumbURL(sh, "/big.png"))
+		if w.Code != http.StatusOK || bytes.Equal(w.Body.Bytes(), original.Bytes()) {
+			t.Fatalf("the thumbnail got %d, original: %v", w.Code, bytes.Equal(w.Body.Bytes(), original.Bytes()))
+		}
+		config, err := png.DecodeConfig(w.Body)
+		if err != nil || config.Width != shareThumbnailSize || config.Height != shareThumbnailSize/2 {
+			t.Fatalf("the thumbnail is %dx%d, %v", config.Width, config.Height, err)
+		}
+	}
+	guest := &shareClient{handler: handler}
+	thumb(guest)
+	thumb(guest)
+	if sh.Downloads != 0 {
+		t.Errorf("thumbnails counted %d downloads", sh.Downloads)
+	}
+
+	// Files that can't be downscaled are served as they are and count, so
+	// the limit holds for ?thumb= too
+	if w := guest.get(store.thumbURL(sh, "/logo.svg")); w.Code != http.StatusOK || sh.Downloads != 1 {
+		t.Fatalf("a thumbnail of a file that can't be downscaled got %d and counted %d downloads", w.Code, sh.Downloads)
+	}
+	if w := guest.get(store.thumbURL(sh, "/big.png")); w.Code != http.StatusGone {
+		t.Errorf("a thumbnail past the limit got %d", w.Code)
+	}
+}
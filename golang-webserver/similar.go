@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"math/bits"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hashIndexFile keeps the perceptual hashes next to the executable, so a
+	// rescan only decodes new and changed images
+	hashIndexFile = "imagehashes.json"
+	// defaultSimilarDistance is how many of the 64 hash bits may differ for
+	// images to count as near duplicates, re-exports and resizes stay below it
+	defaultSimilarDistance = 4
+	maxSimilarDistance     = 16
+	// similarPrefix is the URL path GET /api/similar/<path> is served below
+	similarPrefix = "/api/similar/"
+)
+
+// dHash is the difference hash of img: it is shrunk to 9x8 gray cells and
+// each bit tells whether a cell is brighter than its right neighbour. It
+// survives resizing, recompression and small color changes.
+func dHash(img image.Image) uint64 {
+	var sums [8][9]float64
+	var counts [8][9]float64
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return 0
+	}
+	ycbcr, _ := img.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		cy := y * 8 / h
+		for x := 0; x < w; x++ {
+			cx := x * 9 / w
+			var gray float64
+			if ycbcr != nil {
+				// JPEGs decode to YCbCr, the luma plane is the gray image already
+				gray = float64(ycbcr.Y[ycbcr.YOffset(bounds.Min.X+x, bounds.Min.Y+y)])
+			} else {
+				r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				gray = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			}
+			sums[cy][cx] += gray
+			counts[cy][cx]++
+		}
+	}
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			// Images narrower than 9 pixels leave cells empty, which compare as equal
+			if counts[y][x] > 0 && counts[y][x+1] > 0 && sums[y][x]/counts[y][x] > sums[y][x+1]/counts[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hashFile decodes the image at name and returns its dHash
+func hashFile(name string) (uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("doesn't decode: %v", err)
+	}
+	return dHash(img), nil
+}
+
+// hashEntry is the hash of one image, valid while its size and modification time stay the same
+type hashEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    uint64    `json:"hash"`
+}
+
+// hashIndexState is what the index file holds
+type hashIndexState struct {
+	Folder  string               `json:"folder"`
+	Scanned time.Time            `json:"scanned"`
+	Hashes  map[string]hashEntry `json:"hashes"`
+}
+
+// bkNode is a node of a BK-tree, which finds the hashes within a Hamming
+// distance of another without comparing against every image
+type bkNode struct {
+	hash     uint64
+	paths    []string
+	children map[int]*bkNode
+}
+
+func (n *bkNode) add(hash uint64, p string) {
+	for {
+		d := bits.OnesCount64(n.hash ^ hash)
+		if d == 0 {
+			n.paths = append(n.paths, p)
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = map[int]*bkNode{}
+			}
+			n.children[d] = &bkNode{hash: hash, paths: []string{p}}
+			return
+		}
+		n = child
+	}
+}
+
+// search calls found for every node within distance of hash
+func (n *bkNode) search(hash uint64, distance int, found func(*bkNode, int)) {
+	d := bits.OnesCount64(n.hash ^ hash)
+	if d <= distance {
+		found(n, d)
+	}
+	for cd, child := range n.children {
+		if cd >= d-distance && cd <= d+distance {
+			child.search(hash, distance, found)
+		}
+	}
+}
+
+// imageHashIndex holds the perceptual hashes of the folder's images, built
+// by background scans started with the admin API like verify scans
+type imageHashIndex struct {
+	file string
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	running bool
+	state   hashIndexState
+	tree    *bkNode
+	// failed are the images of the last scan that couldn't be hashed
+	failed []verifyProblem
+	// scanErr is why the last scan stopped, e.g. the folder went away
+	scanErr string
+}
+
+// openHashIndex loads the index file. A missing or unreadable one starts an
+// empty index, which is still returned with the error.
+func openHashIndex() (*imageHashIndex, error) {
+	index := &imageHashIndex{state: hashIndexState{Hashes: map[string]hashEntry{}}}
+	file, err := resolveConfigPath(hashIndexFile)
+	if err != nil {
+		return index, err
+	}
+	index.file = file
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	var state hashIndexState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return index, fmt.Errorf("%s: %v", file, err)
+	}
+	if state.Hashes != nil {
+		index.state = state
+		index.tree = buildBKTree(state.Hashes)
+	}
+	return index, nil
+}
+
+func buildBKTree(hashes map[string]hashEntry) *bkNode {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	// Sorted so the tree and the reports don't change between runs
+	sort.Strings(names)
+	var tree *bkNode
+	for _, name := range names {
+		if tree == nil {
+			tree = &bkNode{hash: hashes[name].Hash, paths: []string{name}}
+			continue
+		}
+		tree.add(hashes[name].Hash, name)
+	}
+	return tree
+}
+
+// scan hashes the images of folder that are new or changed since the last scan
+func (x *imageHashIndex) scan(ctx context.Context, folder string) {
+	x.mu.Lock()
+	previous := x.state.Hashes
+	if x.state.Folder != folder {
+		previous = nil
+	}
+	x.mu.Unlock()
+
+	hashes := map[string]hashEntry{}
+	var failed []verifyProblem
+	err := filepath.WalkDir(folder, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, relErr := filepath.Rel(folder, p)
+		if relErr != nil {
+			return relErr
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if err != nil {
+			failed = append(failed, verifyProblem{Path: rel, Problem: err.Error()})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !decodableExtensions[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			failed = append(failed, verifyProblem{Path: rel, Problem: err.Error()})
+			return nil
+		}
+		if entry, ok := previous[rel]; ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			hashes[rel] = entry
+			return nil
+		}
+		hash, err := hashFile(p)
+		if err != nil {
+			failed = append(failed, verifyProblem{Path: rel, Problem: err.Error()})
+			return nil
+		}
+		hashes[rel] = hashEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+		return nil
+	})
+	if err != nil {
+		// A cancelled or failed scan keeps the previous index
+		if ctx.Err() == nil {
+			x.mu.Lock()
+			x.scanErr = err.Error()
+			x.mu.Unlock()
+		}
+		return
+	}
+
+	state := hashIndexState{Folder: folder, Scanned: time.Now(), Hashes: hashes}
+	tree := buildBKTree(hashes)
+	x.mu.Lock()
+	x.state, x.tree, x.failed, x.scanErr = state, tree, failed, ""
+	x.mu.Unlock()
+	if data, err := json.Marshal(state); err == nil && x.file != "" {
+		// A lost index only means the next scan decodes everything again
+		writeFileAtomic(x.file, data)
+	}
+}
+
+// start begins a scan unless one is running
+func (x *imageHashIndex) start(folder string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.running {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	x.cancel = cancel
+	x.running = true
+	go func() {
+		x.scan(ctx, folder)
+		x.mu.Lock()
+		x.running, x.cancel = false, nil
+		x.mu.Unlock()
+		cancel()
+	}()
+	return true
+}
+
+// Stop cancels a running scan
+func (x *imageHashIndex) Stop() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.cancel != nil {
+		x.cancel()
+	}
+}
+
+// similarDistance reads the ?distance= parameter of r
+func similarDistance(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("distance")
+	if value == "" {
+		return defaultSimilarDistance, nil
+	}
+	d, err := strconv.Atoi(value)
+	if err != nil || d < 0 || d > maxSimilarDistance {
+		return 0, fmt.Errorf("distance must be a number from 0 to %d", maxSimilarDistance)
+	}
+	return d, nil
+}
+
+type similarImage struct {
+	Path     string `json:"path"`
+	Distance int    `json:"distance"`
+}
+
+// similarHandler serves GET /api/similar/<path>, the indexed images that look
+// like the image at path, closest first
+func (x *imageHashIndex) similarHandler(folder string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		distance, err := similarDistance(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, similarPrefix))
+		// Images added since the last scan are hashed on the spot
+		hash, err := hashFile(filepath.Join(folder, filepath.FromSlash(name)))
+		if errors.Is(err, os.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		similar := []similarImage{}
+		x.mu.Lock()
+		if x.tree != nil {
+			x.tree.search(hash, distance, func(n *bkNode, d int) {
+				for _, p := range n.paths {
+					if !strings.EqualFold(p, name) {
+						similar = append(similar, similarImage{Path: p, Distance: d})
+					}
+				}
+			})
+		}
+		scanned := x.state.Scanned
+		x.mu.Unlock()
+		sort.Slice(similar, func(i, j int) bool {
+			if similar[i].Distance != similar[j].Distance {
+				return similar[i].Distance < similar[j].Distance
+			}
+			return similar[i].Path < similar[j].Path
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Path    string         `json:"path"`
+			Hash    string         `json:"hash"`
+			Scanned time.Time      `json:"indexScanned"`
+			Similar []similarImage `json:"similar"`
+		}{name, fmt.Sprintf("%016x", hash), scanned, similar})
+	})
+}
+
+// duplicateGroups returns the sets of indexed images within distance of one
+// another, largest first. x.mu must be held.
+func (x *imageHashIndex) duplicateGroups(distance int) [][]string {
+	if x.tree == nil {
+		return [][]string{}
+	}
+	// Union-find over the paths, joining every image with its neighbours
+	parent := map[string]string{}
+	var find func(string) string
+	find = func(p string) string {
+		if parent[p] == "" || parent[p] == p {
+			return p
+		}
+		root := find(parent[p])
+		parent[p] = root
+		return root
+	}
+	for name, entry := range x.state.Hashes {
+		x.tree.search(entry.Hash, distance, func(n *bkNode, _ int) {
+			for _, p := range n.paths {
+				if a, b := find(name), find(p); a != b {
+					parent[a] = b
+				}
+			}
+		})
+	}
+	members := map[string][]string{}
+	for name := range x.state.Hashes {
+		root := find(name)
+		members[root] = append(members[root], name)
+	}
+	groups := [][]string{}
+	for _, group := range members {
+		if len(group) > 1 {
+			sort.Strings(group)
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i]) != len(groups[j]) {
+			return len(groups[i]) > len(groups[j])
+		}
+		return groups[i][0] < groups[j][0]
+	})
+	return groups
+}
+
+// duplicatesHandler serves the admin API: POST starts indexing folder, GET
+// reports the groups of near duplicate images found by the last scan
+func (x *imageHashIndex) duplicatesHandler(folder string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if !x.start(folder) {
+				http.Error(w, "an index scan is already running", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodGet, http.MethodHead:
+			distance, err := similarDistance(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			x.mu.Lock()
+			report := struct {
+				Running bool            `json:"running"`
+				Scanned *time.Time      `json:"indexScanned,omitempty"`
+				Indexed int             `json:"indexed"`
+				Error   string          `json:"error,omitempty"`
+				Failed  []verifyProblem `json:"failed,omitempty"`
+				Groups  [][]string      `json:"groups"`
+			}{Running: x.running, Indexed: len(x.state.Hashes), Error: x.scanErr, Failed: x.failed, Groups: x.duplicateGroups(distance)}
+			if scanned := x.state.Scanned; !scanned.IsZero() {
+				report.Scanned = &scanned
+			}
+			x.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(report)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
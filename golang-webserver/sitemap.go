@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+const (
+	// sitemapMaxURLs and sitemapMaxImages are the limits of the sitemap protocol
+	sitemapMaxURLs   = 50000
+	sitemapMaxImages = 1000
+	// sitemapMaxAge bounds how stale the sitemap gets when change notifications are missed
+	sitemapMaxAge = time.Hour
+)
+
+// SitemapConfig serves /sitemap.xml listing the images below public prefixes
+type SitemapConfig struct {
+	// BaseURL is the public URL of the server, e.g. https://images.example.com
+	BaseURL string `json:"baseURL"`
+	// Prefixes are the URL paths of the directories to list, e.g. /products/
+	Prefixes []string `json:"prefixes"`
+}
+
+func (c *SitemapConfig) validate() []error {
+	var errs []error
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("sitemap.baseURL must be an http or https URL, got %q", c.BaseURL))
+	}
+	if len(c.Prefixes) == 0 {
+		errs = append(errs, fmt.Errorf("sitemap.prefixes cannot be empty"))
+	}
+	for _, prefix := range c.Prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("sitemap.prefixes must start with /, got %q", prefix))
+		}
+	}
+	return errs
+}
+
+// sitemap generates the sitemap on the first request after a change below
+// its prefixes, walking a large folder on every request would be too slow
+type sitemap struct {
+	config *SitemapConfig
+	folder string
+	elog   debug.Log
+
+	mu        sync.Mutex
+	xml       []byte
+	generated time.Time
+	stale     bool
+}
+
+// newSitemap returns the sitemap for config, or nil when it isn't configured
+func newSitemap(config *SitemapConfig, folder string, elog debug.Log) *sitemap {
+	if config == nil {
+		return nil
+	}
+	return &sitemap{config: config, folder: folder, elog: elog, stale: true}
+}
+
+// changed marks the sitemap stale when name, relative to the folder, is below one of its prefixes
+func (s *sitemap) changed(name string) {
+	p := strings.ToLower("/" + name)
+	for _, prefix := range s.config.Prefixes {
+		dir := prefixDir(prefix)
+		if name == "" || p == dir || strings.HasPrefix(p, dir+"/") || strings.HasPrefix(dir, p+"/") {
+			s.mu.Lock()
+			s.stale = true
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+type sitemapURL struct {
+	Loc    string         `xml:"loc"`
+	Images []sitemapImage `xml:"image:image"`
+}
+
+type sitemapImage struct {
+	Loc string `xml:"image:loc"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	NS      string       `xml:"xmlns,attr"`
+	ImageNS string       `xml:"xmlns:image,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// generate lists every directory below the prefixes that has images, with its images
+func (s *sitemap) generate() ([]byte, error) {
+	base := strings.TrimSuffix(s.config.BaseURL, "/")
+	escaped := func(urlPath string) string {
+		return base + (&url.URL{Path: urlPath}).EscapedPath()
+	}
+
+	var urls []sitemapURL
+	truncated := false
+	for _, prefix := range s.config.Prefixes {
+		root := filepath.Join(s.folder, filepath.FromSlash(path.Clean("/"+prefix)))
+		dirs := map[string][]string{}
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasPrefix(mime.TypeByExtension(filepath.Ext(p)), "image/") {
+				return nil
+			}
+			rel, err := filepath.Rel(s.folder, p)
+			if err != nil {
+				return nil
+			}
+			urlPath := "/" + filepath.ToSlash(rel)
+			dir := path.Dir(urlPath)
+			dirs[dir] = append(dirs[dir], urlPath)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(dirs))
+		for dir := range dirs {
+			names = append(names, dir)
+		}
+		sort.Strings(names)
+		for _, dir := range names {
+			if len(urls) == sitemapMaxURLs {
+				truncated = true
+				break
+			}
+			images := dirs[dir]
+			sort.Strings(images)
+			if len(images) > sitemapMaxImages {
+				images, truncated = images[:sitemapMaxImages], true
+			}
+			entry := sitemapURL{Loc: escaped(strings.TrimSuffix(dir, "/") + "/")}
+			for _, image := range images {
+				entry.Images = append(entry.Images, sitemapImage{Loc: escaped(image)})
+			}
+			urls = append(urls, entry)
+		}
+	}
+	if truncated {
+		s.elog.Warning(eventConfig, fmt.Sprintf("The sitemap only lists the first %d directories and %d images per directory", sitemapMaxURLs, sitemapMaxImages))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err := enc.Encode(sitemapURLSet{
+		NS:      "http://www.sitemaps.org/schemas/sitemap/0.9",
+		ImageNS: "http://www.google.com/schemas/sitemap-image/1.1",
+		URLs:    urls,
+	})
+	return buf.Bytes(), err
+}
+
+// ServeHTTP serves the sitemap, generating it first when it is stale
+func (s *sitemap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if s.stale || time.Since(s.generated) > sitemapMaxAge {
+		data, err := s.generate()
+		if err != nil {
+			s.mu.Unlock()
+			s.elog.Warning(eventStorage, fmt.Sprintf("Failed to generate the sitemap: %v", err))
+			http.Error(w, "sitemap unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.xml, s.generated, s.stale = data, time.Now(), false
+	}
+	data, generated := s.xml, s.generated
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	http.ServeContent(w, r, "sitemap.xml", generated, bytes.NewReader(data))
+}
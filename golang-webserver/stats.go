@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// requestStats holds the counters published to monitoring
+type requestStats struct {
+	requests     uint64
+	clientErrors uint64
+	serverErrors uint64
+	bytesServed  uint64
+	breakdown    requestBreakdown
+	latency      latencyWindow
+	live         liveTracker
+	// history and top feed the statistics dashboard
+	history trafficHistory
+	top     topFiles
+	// started is when the service started counting
+	started time.Time
+}
+
+// statsSnapshot is a point-in-time copy of requestStats
+type statsSnapshot struct {
+	Requests     uint64
+	ClientErrors uint64
+	ServerErrors uint64
+	BytesServed  uint64
+}
+
+// Snapshot returns the current counter values
+func (s *requestStats) Snapshot() statsSnapshot {
+	return statsSnapshot{
+		Requests:     atomic.LoadUint64(&s.requests),
+		ClientErrors: atomic.LoadUint64(&s.clientErrors),
+		ServerErrors: atomic.LoadUint64(&s.serverErrors),
+		BytesServed:  atomic.LoadUint64(&s.bytesServed),
+	}
+}
+
+// middleware counts requests, error responses and bytes written
+func (s *requestStats) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		s.live.middleware(next).ServeHTTP(rec, r)
+
+		if !rec.isStream() {
+			s.latency.add(time.Since(start))
+		}
+		s.breakdown.observe(r.URL.Path, rec.status, rec.bytes)
+		s.history.add(start, rec.status, rec.bytes)
+		if isFileRequest(r.URL.Path, rec.status) {
+			s.top.observe(r.URL.Path, rec.bytes)
+		}
+		atomic.AddUint64(&s.requests, 1)
+		atomic.AddUint64(&s.bytesServed, uint64(rec.bytes))
+		switch {
+		case rec.status >= 500:
+			atomic.AddUint64(&s.serverErrors, 1)
+		case rec.status >= 400:
+			atomic.AddUint64(&s.clientErrors, 1)
+		}
+	})
+}
+
+// statusRecorder remembers the status code, body size and time of the first
+// byte of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+	firstByte   time.Time
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+		r.firstByte = time.Now()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.started()
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes through, for streamed responses
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		r.started()
+		f.Flush()
+	}
+}
+
+// Hijack passes WebSocket upgrades through, recording them as 101
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && !r.wroteHeader {
+		r.status = http.StatusSwitchingProtocols
+		r.started()
+	}
+	return conn, rw, err
+}
+
+// isStream reports whether the response is a stream of change events or a
+// WebSocket, which lasts as long as the client wants and so isn't a response
+// time
+func (r *statusRecorder) isStream() bool {
+	contentType := r.Header().Get("Content-Type")
+	return r.status == http.StatusSwitchingProtocols || strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/grpc")
+}
+
+// ReadFrom passes io.Copy through to the underlying writer, which implements
+// it with sendfile (TransmitFile on Windows). Without it http.FileServer would
+// copy every file through Write in 32KB chunks.
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.started()
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+// started records an implicit 200 response starting
+func (r *statusRecorder) started() {
+	if !r.wroteHeader {
+		r.wroteHeader = true
+		r.firstByte = time.Now()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// largeFileSize is the size of the file BenchmarkServeLargeFile downloads
+const largeFileSize = 64 << 20
+
+// BenchmarkServeLargeFile downloads a large file over loopback from a bare
+// http.FileServer and from the service's whole handler chain, so the cost
+// of the middleware on throughput shows side by side. Everything is served
+// through the service's listeners, and the handler chain with the file
+// cache and the Git folder's filter as well, which all have to keep
+// sendfile.
+func BenchmarkServeLargeFile(b *testing.B) {
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "large.bin"), make([]byte, largeFileSize), 0o644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("FileServer", func(b *testing.B) {
+		server := &http.Server{Handler: http.FileServer(http.Dir(dir))}
+		benchmarkDownload(b, server, "/large.bin")
+	})
+	for _, bm := range []struct {
+		name      string
+		fileCache bool
+		git       bool
+	}{
+		{name: "Service"},
+		{name: "ServiceFileCache", fileCache: true},
+		{name: "ServiceGit", git: true},
+	} {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) {
+			config := &Config{Folder: dir}
+			config.applyDefaults()
+			if bm.fileCache {
+				config.FileCacheMB = 64
+			}
+			var git *gitRepo
+			if bm.git {
+				config.Git = &GitConfig{}
+				git = &gitRepo{}
+			}
+			var elog discardLog
+			monitor := newFolderMonitor(dir, nil, elog)
+			stats := &requestStats{}
+			stats.live.elog = elog
+			cache := newFileCache(monitor.files(), config.FileCacheMB)
+			handler := newHandler(config, monitor, cache, nil, nil, &folderVerifier{}, nil, git, nil, stats, nil)
+			server := createServer(config, stats.middleware(newSlowRequestLog(elog, config.SlowRequestMS).middleware(handler)), elog)
+			server.ConnState = stats.live.connState
+			server.ConnContext = connContext
+			benchmarkDownload(b, server, "/large.bin")
+		})
+	}
+}
+
+// benchmarkDownload serves with server on a port of a listenerSet and
+// downloads name b.N times over loopback
+func benchmarkDownload(b *testing.B, server *http.Server, name string) {
+	port := freePort(b)
+	set := &listenerSet{}
+	added, _, err := set.update(&Config{Port: port})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer set.close()
+	go server.Serve(added[0])
+	defer server.Close()
+
+	url := "http://127.0.0.1:" + port + name
+	client := &http.Client{Transport: &http.Transport{}}
+	b.SetBytes(largeFileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := client.Get(url)
+		if err != nil {
+			b.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil || n != largeFileSize || resp.StatusCode != http.StatusOK {
+			b.Fatalf("got %d bytes with status %d: %v", n, resp.StatusCode, err)
+		}
+	}
+}
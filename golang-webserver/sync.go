@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+// syncProgressInterval is how often a running sync prints its progress
+const syncProgressInterval = 10 * time.Second
+
+// syncOptions controls how a source is mirrored into the folder
+type syncOptions struct {
+	from   string
+	to     string
+	remove bool
+	dryRun bool
+}
+
+// syncResult summarizes a sync run
+type syncResult struct {
+	Scanned   int
+	Copied    int
+	Unchanged int
+	Removed   int
+	Bytes     int64
+	Failed    []verifyProblem
+}
+
+func (r syncResult) String() string {
+	return fmt.Sprintf("%d scanned, %d copied (%d bytes), %d unchanged, %d removed, %d failed", r.Scanned, r.Copied, r.Bytes, r.Unchanged, r.Removed, len(r.Failed))
+}
+
+// syncFolder copies the files of opts.from that are missing or different in
+// opts.to. Files with the same size but a different modification time are
+// compared by checksum, so touching a file on the source doesn't recopy it.
+// With opts.remove, files no longer in the source are deleted from opts.to.
+func syncFolder(ctx context.Context, opts syncOptions, progress func(syncResult)) (syncResult, error) {
+	var result syncResult
+	seen := map[string]bool{}
+	lastProgress := time.Now()
+
+	err := filepath.WalkDir(opts.from, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, relErr := filepath.Rel(opts.from, path)
+		if relErr != nil {
+			return relErr
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, verifyProblem{Path: filepath.ToSlash(rel), Problem: err.Error()})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Keyed case insensitively like the file system, so a renamed case isn't removed as missing
+		seen[cacheKey(rel)] = true
+		if d.IsDir() {
+			return nil
+		}
+		result.Scanned++
+		if time.Since(lastProgress) >= syncProgressInterval {
+			progress(result)
+			lastProgress = time.Now()
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			result.Failed = append(result.Failed, verifyProblem{Path: filepath.ToSlash(rel), Problem: err.Error()})
+			return nil
+		}
+		dest := filepath.Join(opts.to, rel)
+		same, err := sameFile(path, info, dest)
+		if err != nil {
+			result.Failed = append(result.Failed, verifyProblem{Path: filepath.ToSlash(rel), Problem: err.Error()})
+			return nil
+		}
+		if same {
+			result.Unchanged++
+			return nil
+		}
+		if !opts.dryRun {
+			if _, err := copyFile(path, dest, info.ModTime()); err != nil {
+				result.Failed = append(result.Failed, verifyProblem{Path: filepath.ToSlash(rel), Problem: err.Error()})
+				return nil
+			}
+		}
+		result.Copied++
+		result.Bytes += info.Size()
+		return nil
+	})
+	// Only remove once the whole source was read without errors, so an
+	// unreadable directory or a share dropping halfway doesn't empty the folder
+	if err != nil || !opts.remove || len(result.Failed) > 0 {
+		return result, err
+	}
+
+	var removeDirs []string
+	err = filepath.WalkDir(opts.to, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(opts.to, path)
+		if err != nil || rel == "." || seen[cacheKey(rel)] {
+			return err
+		}
+		if !opts.dryRun {
+			if d.IsDir() {
+				// Removed after the walk, once the files in it are gone
+				removeDirs = append(removeDirs, path)
+			} else if err := os.Remove(path); err != nil {
+				result.Failed = append(result.Failed, verifyProblem{Path: filepath.ToSlash(rel), Problem: err.Error()})
+				return nil
+			}
+		}
+		if !d.IsDir() {
+			result.Removed++
+		}
+		return nil
+	})
+	for i := len(removeDirs) - 1; i >= 0; i-- {
+		os.Remove(removeDirs[i])
+	}
+	return result, err
+}
+
+// sameFile reports whether dest already has the content of src
+func sameFile(src string, info fs.FileInfo, dest string) (bool, error) {
+	destInfo, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if destInfo.Size() != info.Size() {
+		return false, nil
+	}
+	if destInfo.ModTime().Equal(info.ModTime()) {
+		return true, nil
+	}
+	srcSum, err := fileChecksum(src)
+	if err != nil {
+		return false, err
+	}
+	destSum, err := fileChecksum(dest)
+	if err != nil {
+		return false, err
+	}
+	return srcSum == destSum, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// runSync mirrors --from into the configured folder, once or every
+// --interval until interrupted. It returns the process exit code: 0 on
+// success, 1 when files failed to sync and 2 when the sync couldn't run.
+func runSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	from := fs.String("from", "", "folder or share to mirror into the served folder")
+	interval := fs.Duration("interval", 0, "sync again after this long, e.g. 5m, until interrupted (default: sync once)")
+	deletion := fs.String("delete", "keep", "what to do with files that are no longer in the source: keep or remove")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied and removed")
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *from == "" {
+		fmt.Fprintln(os.Stderr, "--from is required")
+		return 2
+	}
+	if *deletion != "keep" && *deletion != "remove" {
+		fmt.Fprintf(os.Stderr, "invalid --delete %q, expected keep or remove\n", *deletion)
+		return 2
+	}
+	config, err := flags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if config.Folder == embeddedFolder {
+		fmt.Fprintln(os.Stderr, "The folder is embedded in the executable, sync works on a folder on disk")
+		return 2
+	}
+	if config.ReadOnly {
+		fmt.Fprintln(os.Stderr, "The folder is configured as readOnly, not syncing into it")
+		return 2
+	}
+	opts := syncOptions{from: *from, to: config.Folder, remove: *deletion == "remove", dryRun: *dryRun}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	progress := func(r syncResult) {
+		fmt.Printf("Syncing %s: %s so far\n", opts.from, r)
+	}
+
+	code := 0
+	for {
+		started := time.Now()
+		result, err := syncFolder(ctx, opts, progress)
+		for _, f := range result.Failed {
+			fmt.Printf("%s: %s\n", f.Path, f.Problem)
+		}
+		fmt.Printf("Synced %s to %s in %s: %s\n", opts.from, opts.to, time.Since(started).Round(time.Second), result)
+		switch {
+		case ctx.Err() != nil:
+			return code
+		case err != nil:
+			fmt.Fprintln(os.Stderr, "Sync failed:", err)
+			code = 2
+		case len(result.Failed) > 0:
+			code = 1
+		default:
+			code = 0
+		}
+		if *interval <= 0 {
+			return code
+		}
+
+		select {
+		case <-ctx.Done():
+			return code
+		case <-time.After(*interval):
+		}
+	}
+}
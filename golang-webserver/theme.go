@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// ThemeConfig brands the share pages and the error pages browsers get
+type ThemeConfig struct {
+	// Title is shown in the header of the pages, and names share pages without a title of their own
+	Title string `json:"title,omitempty"`
+	// Logo is the URL of the logo shown in the header, unless shares has its own
+	Logo string `json:"logo,omitempty"`
+	// AccentColor is the CSS color of buttons and links, #2563eb by default
+	AccentColor string `json:"accentColor,omitempty"`
+	// ColorScheme is light, dark, or auto to follow the browser's setting, the default
+	ColorScheme string `json:"colorScheme,omitempty"`
+	// CSS is added to the styles of the pages, after the built-in ones
+	CSS string `json:"css,omitempty"`
+}
+
+// themeColorPattern accepts the CSS color notations that can't break out of a declaration
+var themeColorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+|(rgb|hsl)a?\([0-9., %/]+\))$`)
+
+func (c *ThemeConfig) validate() []error {
+	var errs []error
+	if c.Logo != "" && !strings.HasPrefix(c.Logo, "/") && !strings.HasPrefix(c.Logo, "https://") && !strings.HasPrefix(c.Logo, "http://") {
+		errs = append(errs, fmt.Errorf("theme.logo must be a URL path or an http or https URL, got %q", c.Logo))
+	}
+	if c.AccentColor != "" && !themeColorPattern.MatchString(c.AccentColor) {
+		errs = append(errs, fmt.Errorf("theme.accentColor must be a CSS color such as #e11d48, got %q", c.AccentColor))
+	}
+	switch c.ColorScheme {
+	case "", "auto", "light", "dark":
+	default:
+		errs = append(errs, fmt.Errorf("theme.colorScheme must be auto, light or dark, got %q", c.ColorScheme))
+	}
+	// It is written into a <style> element as is
+	if strings.Contains(c.CSS, "</") {
+		errs = append(errs, fmt.Errorf("theme.css cannot contain </"))
+	}
+	return errs
+}
+
+// The colors of the pages, as CSS custom properties the theme's CSS can override too
+const (
+	lightColors = "--bg:#f4f4f5;--fg:#18181b;--surface:#fff;--border:#e4e4e7;--muted:#71717a;--placeholder:#e4e4e7"
+	darkColors  = "--bg:#18181b;--fg:#f4f4f5;--surface:#27272a;--border:#3f3f46;--muted:#a1a1aa;--placeholder:#3f3f46"
+)
+
+// pageTheme is what the page templates need of the theme
+type pageTheme struct {
+	Title string
+	Logo  string
+	// Colors defines the custom properties the built-in styles use
+	Colors template.CSS
+	CSS    template.CSS
+}
+
+// newPageTheme returns the theme of the pages, the built-in one for a nil config
+func newPageTheme(c *ThemeConfig) pageTheme {
+	if c == nil {
+		c = &ThemeConfig{}
+	}
+	accent := c.AccentColor
+	if accent == "" {
+		accent = "#2563eb"
+	}
+	var colors string
+	switch c.ColorScheme {
+	case "light":
+		colors = ":root{color-scheme:light;" + lightColors + ";--accent:" + accent + "}"
+	case "dark":
+		colors = ":root{color-scheme:dark;" + darkColors + ";--accent:" + accent + "}"
+	default:
+		colors = ":root{color-scheme:light dark;" + lightColors + ";--accent:" + accent + "}\n@media (prefers-color-scheme:dark){:root{" + darkColors + "}}"
+	}
+	// Validated not to close the <style> element
+	return pageTheme{Title: c.Title, Logo: c.Logo, Colors: template.CSS(colors), CSS: template.CSS(c.CSS)}
+}
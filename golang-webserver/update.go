@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// updateClient is used to download new releases
+var updateClient = &http.Client{Timeout: 10 * time.Minute}
+
+// version is the release of this executable, set by the release builds with
+// -ldflags "-X main.version=v1.2.3". Builds without one accept any signed
+// release from update.
+var version string
+
+// updateManifest describes a release, in the signed <url>.manifest
+type updateManifest struct {
+	// Version of the release, it has to be newer than the running one
+	Version string `json:"version"`
+	// SHA256 is the hex SHA-256 of the executable
+	SHA256 string `json:"sha256"`
+}
+
+// runUpdate downloads the binary at the configured update URL, verifies it
+// against the release's signed manifest, swaps it with the running
+// executable and restarts the service.
+//
+// Next to the binary the server must publish <url>.manifest, an
+// updateManifest in JSON, and <url>.manifest.sig, the base64 Ed25519
+// signature of the manifest made with the key matching updatePublicKey.
+// Signing the version with the hash keeps an older release from being
+// replayed to downgrade the service.
+func runUpdate(args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	url := fs.String("url", "", "URL of the new image_server.exe (defaults to updateURL from the config)")
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	config, err := flags.Load()
+	if err != nil {
+		return err
+	}
+	if *url == "" {
+		*url = config.UpdateURL
+	}
+	if *url == "" {
+		return fmt.Errorf("no update URL, set updateURL in the config or pass --url")
+	}
+	if config.UpdatePublicKey == "" {
+		return fmt.Errorf("updatePublicKey must be set in the config to verify updates")
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(config.UpdatePublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("updatePublicKey is not a base64 encoded Ed25519 public key")
+	}
+
+	fmt.Println("Downloading", *url)
+	binary, err := download(*url)
+	if err != nil {
+		return err
+	}
+	manifest, err := download(*url + ".manifest")
+	if err != nil {
+		return err
+	}
+	signature, err := download(*url + ".manifest.sig")
+	if err != nil {
+		return err
+	}
+
+	release, err := verifyUpdate(binary, manifest, signature, publicKey, version)
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		fmt.Println("This executable has no version, any signed release replaces it")
+	}
+	fmt.Println("Signature and checksum of release", release.Version, "verified")
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	if err := swapExecutable(exePath, binary); err != nil {
+		return err
+	}
+	fmt.Println("Executable replaced, restarting service")
+
+	return restartService()
+}
+
+// download fetches url into memory
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	return data, nil
+}
+
+// verifyUpdate checks the signature of the manifest, then the binary against
+// the manifest's checksum, and that the release is newer than running, the
+// version of this executable. An empty running version accepts any release.
+func verifyUpdate(binary, manifest, signature []byte, publicKey ed25519.PublicKey, running string) (*updateManifest, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature file: %w", err)
+	}
+	if !ed25519.Verify(publicKey, manifest, sig) {
+		return nil, fmt.Errorf("signature verification failed")
+	}
+	var release updateManifest
+	if err := json.Unmarshal(manifest, &release); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	releaseVersion, ok := parseVersion(release.Version)
+	if !ok {
+		return nil, fmt.Errorf("the manifest's version must be like 1.2.3, got %q", release.Version)
+	}
+	expected, err := hex.DecodeString(release.SHA256)
+	if err != nil || len(expected) != sha256.Size {
+		return nil, fmt.Errorf("the manifest's sha256 must be a hex SHA-256, got %q", release.SHA256)
+	}
+	actual := sha256.Sum256(binary)
+	if !bytes.Equal(expected, actual[:]) {
+		return nil, fmt.Errorf("checksum mismatch: expected %x, got %x", expected, actual)
+	}
+
+	if running == "" {
+		return &release, nil
+	}
+	runningVersion, ok := parseVersion(running)
+	if !ok {
+		return nil, fmt.Errorf("the running version %q can't be compared with releases", running)
+	}
+	if compareVersions(releaseVersion, runningVersion) <= 0 {
+		return nil, fmt.Errorf("release %s isn't newer than the running %s", release.Version, running)
+	}
+	return &release, nil
+}
+
+// parseVersion splits a version like 1.2.3 or v1.2.3 into its numbers
+func parseVersion(v string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || strings.HasPrefix(part, "+") {
+			return nil, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b. Missing numbers count as 0, so 1.2 is 1.2.0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// swapExecutable replaces exePath with binary. Windows allows renaming a running
+// executable but not overwriting it, so the current one is moved aside first.
+func swapExecutable(exePath string, binary []byte) error {
+	newPath := exePath + ".new"
+	oldPath := exePath + ".old"
+
+	if err := os.WriteFile(newPath, binary, 0755); err != nil {
+		return fmt.Errorf("failed to write new executable: %w", err)
+	}
+
+	os.Remove(oldPath) // Leftover from a previous update, if any
+	if err := os.Rename(exePath, oldPath); err != nil {
+		os.Remove(newPath)
+		return fmt.Errorf("failed to move current executable aside: %w", err)
+	}
+	if err := os.Rename(newPath, exePath); err != nil {
+		// Put the old binary back so the service still starts
+		os.Rename(oldPath, exePath)
+		return fmt.Errorf("failed to install new executable: %w", err)
+	}
+	return nil
+}
+
+// removeOldExecutable deletes the binary left behind by a previous update
+func removeOldExecutable() {
+	if exePath, err := os.Executable(); err == nil {
+		os.Remove(exePath + ".old")
+	}
+}
+
+// restartService stops the service if it is running and starts it again
+func restartService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService("ImageServer")
+	if err != nil {
+		return fmt.Errorf("failed to open service: %w", err)
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("failed to query service: %w", err)
+	}
+	if status.State != svc.Stopped {
+		if _, err := s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("failed to stop service: %w", err)
+		}
+		for status.State != svc.Stopped {
+			time.Sleep(time.Second)
+			if status, err = s.Query(); err != nil {
+				return fmt.Errorf("failed to query service: %w", err)
+			}
+		}
+	}
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service: %w", err)
+	}
+	return nil
+}
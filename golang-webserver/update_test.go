@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVerifyUpdate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("MZ the new release")
+	manifest := func(version string, binary []byte) []byte {
+		return []byte(fmt.Sprintf(`{"version": %q, "sha256": "%x"}`, version, sha256.Sum256(binary)))
+	}
+	sign := func(key ed25519.PrivateKey, manifest []byte) []byte {
+		return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)) + "\n")
+	}
+
+	tests := []struct {
+		name      string
+		manifest  []byte
+		signature []byte
+		running   string
+		wantErr   string
+	}{
+		{name: "newer release", manifest: manifest("1.3.0", binary), running: "v1.2.9"},
+		{name: "newer release with a v", manifest: manifest("v1.10", binary), running: "1.9.4"},
+		{name: "unversioned executable", manifest: manifest("1.0.0", binary)},
+		{name: "same release", manifest: manifest("1.2.0", binary), running: "v1.2", wantErr: "isn't newer"},
+		// The signed manifest of an older release, replayed
+		{name: "older release", manifest: manifest("1.1.7", binary), running: "1.2.0", wantErr: "isn't newer"},
+		{name: "another binary", manifest: manifest("1.3.0", []byte("MZ another")), running: "1.2.0", wantErr: "checksum mismatch"},
+		{name: "other key", manifest: manifest("1.3.0", binary), signature: sign(otherKey, manifest("1.3.0", binary)), wantErr: "signature verification failed"},
+		{name: "changed version", manifest: manifest("1.3.0", binary), signature: sign(privateKey, manifest("1.0.0", binary)), wantErr: "signature verification failed"},
+		{name: "no version", manifest: manifest("", binary), wantErr: "version must be like"},
+		{name: "running version can't be compared", manifest: manifest("1.3.0", binary), running: "main", wantErr: "can't be compared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature := tt.signature
+			if signature == nil {
+				signature = sign(privateKey, tt.manifest)
+			}
+			release, err := verifyUpdate(binary, tt.manifest, signature, publicKey, tt.running)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyUpdate() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyUpdate() = %v", err)
+			}
+			if release.SHA256 != fmt.Sprintf("%x", sha256.Sum256(binary)) {
+				t.Errorf("verifyUpdate() returned the manifest of %s", release.SHA256)
+			}
+		})
+	}
+}
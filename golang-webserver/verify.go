@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// decodableExtensions are the image formats verify decodes, other files are
+// only checked against the checksum manifest
+var decodableExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+// verifyReport is the result of scanning the folder for corrupt files
+type verifyReport struct {
+	Folder   string          `json:"folder"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Checked  int             `json:"checked"`
+	Skipped  int             `json:"skipped"`
+	Problems []verifyProblem `json:"problems"`
+	// Error is set when the scan itself failed, e.g. the folder went away
+	Error string `json:"error,omitempty"`
+}
+
+// verifyProblem is a file that failed to decode or doesn't match its checksum
+type verifyProblem struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// verifyFolder decodes every image below folder and compares files against
+// checksums, which maps slash separated relative paths to hex SHA-256 sums
+func verifyFolder(ctx context.Context, folder string, checksums map[string]string) *verifyReport {
+	report := &verifyReport{Folder: folder, Started: time.Now(), Problems: []verifyProblem{}}
+	seen := map[string]bool{}
+
+	err := filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, relErr := filepath.Rel(folder, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			// Unreadable directories are reported, the rest of the tree is still scanned
+			report.Problems = append(report.Problems, verifyProblem{Path: rel, Problem: err.Error()})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		want, hasChecksum := checksums[rel]
+		decodable := decodableExtensions[strings.ToLower(filepath.Ext(path))]
+		if !decodable && !hasChecksum {
+			report.Skipped++
+			return nil
+		}
+		seen[rel] = true
+		report.Checked++
+		if problem := verifyFile(path, decodable, want); problem != "" {
+			report.Problems = append(report.Problems, verifyProblem{Path: rel, Problem: problem})
+		}
+		return nil
+	})
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	for rel := range checksums {
+		if !seen[rel] && err == nil {
+			report.Problems = append(report.Problems, verifyProblem{Path: rel, Problem: "missing, listed in the checksum manifest"})
+		}
+	}
+
+	finished := time.Now()
+	report.Finished = &finished
+	return report
+}
+
+// verifyFile decodes the image and compares its checksum, returning what is
+// wrong with it or "" when it is fine
+func verifyFile(path string, decode bool, checksum string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	var r io.Reader = f
+	if checksum != "" {
+		r = io.TeeReader(f, hash)
+	}
+	if decode {
+		if _, _, err := image.Decode(r); err != nil {
+			return fmt.Sprintf("doesn't decode: %v", err)
+		}
+	}
+	if checksum == "" {
+		return ""
+	}
+	// Hash whatever the decoder didn't read, e.g. trailing metadata
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err.Error()
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(got, checksum) {
+		return fmt.Sprintf("checksum mismatch, expected %s got %s", checksum, got)
+	}
+	return ""
+}
+
+// readChecksums reads a manifest in sha256sum format, "<hex>  <path>" per
+// line with paths relative to the folder
+func readChecksums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s line %d: expected \"<sha256>  <path>\"", path, line)
+		}
+		// sha256sum marks binary mode with a leading '*'
+		name := strings.TrimPrefix(strings.TrimSpace(fields[1]), "*")
+		checksums[filepath.ToSlash(filepath.Clean(name))] = fields[0]
+	}
+	return checksums, scanner.Err()
+}
+
+// runVerify scans the configured folder and prints a report of corrupt and
+// truncated files. It returns the process exit code: 0 when every file is
+// fine, 1 when problems were found and 2 when the scan couldn't run.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	checksumFile := fs.String("checksums", "", "sha256sum manifest to compare files against, relative to the folder unless absolute")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	config, err := flags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var checksums map[string]string
+	if *checksumFile != "" {
+		path := *checksumFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.Folder, path)
+		}
+		if checksums, err = readChecksums(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	report := verifyFolder(context.Background(), config.Folder, checksums)
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, p := range report.Problems {
+			fmt.Printf("%s: %s\n", p.Path, p.Problem)
+		}
+		fmt.Printf("Checked %d files in %s, skipped %d, %d problems\n", report.Checked, report.Folder, report.Skipped, len(report.Problems))
+	}
+
+	switch {
+	case report.Error != "":
+		fmt.Fprintln(os.Stderr, "Scan failed:", report.Error)
+		return 2
+	case len(report.Problems) > 0:
+		return 1
+	}
+	return 0
+}
+
+// folderVerifier runs verify scans in the background for the admin API,
+// since scanning a large share takes far longer than a request may
+type folderVerifier struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	running bool
+	last    *verifyReport
+}
+
+// handler serves the admin API: POST starts a scan of folder, optionally
+// against the ?checksums= manifest in the folder, GET returns the last
+// finished report and whether a scan is running
+func (v *folderVerifier) handler(folder string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			var checksums map[string]string
+			if name := r.URL.Query().Get("checksums"); name != "" {
+				// Rooted and cleaned so the manifest can't be read from outside the folder
+				manifest := filepath.Join(folder, filepath.FromSlash(path.Clean("/"+name)))
+				var err error
+				if checksums, err = readChecksums(manifest); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if !v.start(folder, checksums) {
+				http.Error(w, "a verify scan is already running", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodGet, http.MethodHead:
+			v.mu.Lock()
+			status := struct {
+				Running bool          `json:"running"`
+				Last    *verifyReport `json:"last"`
+			}{Running: v.running, Last: v.last}
+			v.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(status)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// start begins a scan unless one is running
+func (v *folderVerifier) start(folder string, checksums map[string]string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.running {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	v.cancel = cancel
+	v.running = true
+	go func() {
+		report := verifyFolder(ctx, folder, checksums)
+		v.mu.Lock()
+		v.last, v.running, v.cancel = report, false, nil
+		v.mu.Unlock()
+		cancel()
+	}()
+	return true
+}
+
+// Stop cancels a running scan
+func (v *folderVerifier) Stop() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.cancel != nil {
+		v.cancel()
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmupConfig replays the most requested URLs of an access log through the
+// server when the service starts, so the file cache, the image dimensions
+// and the disk or share's own cache are warm before clients ask
+type WarmupConfig struct {
+	// Log is an access log or a list of paths, as read by bench --log
+	Log string `json:"log"`
+	// MaxURLs is how many of the most requested URLs are replayed, 1000 by default
+	MaxURLs int `json:"maxURLs,omitempty"`
+	// Concurrency is how many URLs are requested at the same time, 4 by default
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+func (c *WarmupConfig) validate() []error {
+	var errs []error
+	if c.Log == "" {
+		errs = append(errs, fmt.Errorf("warmup.log cannot be empty"))
+	}
+	if c.MaxURLs < 0 {
+		errs = append(errs, fmt.Errorf("warmup.maxURLs cannot be negative"))
+	}
+	if c.Concurrency < 0 {
+		errs = append(errs, fmt.Errorf("warmup.concurrency cannot be negative"))
+	}
+	return errs
+}
+
+func (c *WarmupConfig) maxURLs() int {
+	if c.MaxURLs == 0 {
+		return 1000
+	}
+	return c.MaxURLs
+}
+
+func (c *WarmupConfig) concurrency() int {
+	if c.Concurrency == 0 {
+		return 4
+	}
+	return c.Concurrency
+}
+
+// warmupPaths returns the distinct paths of the log, most requested first,
+// at most max of them
+func warmupPaths(log string, max int) ([]string, error) {
+	paths, err := readBenchLog(log)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	var distinct []string
+	for _, p := range paths {
+		if counts[p] == 0 {
+			distinct = append(distinct, p)
+		}
+		counts[p]++
+	}
+	// Stable, so paths requested as often keep the order of the log
+	sort.SliceStable(distinct, func(i, j int) bool { return counts[distinct[i]] > counts[distinct[j]] })
+	if len(distinct) > max {
+		distinct = distinct[:max]
+	}
+	return distinct, nil
+}
+
+// replayWarmup requests paths with fetch from concurrency workers until
+// they are done or ctx is, returning how many were fetched and the failures
+func replayWarmup(ctx context.Context, paths []string, concurrency int, fetch func(ctx context.Context, path string) error) (fetched int, failed []string) {
+	var mu sync.Mutex
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				err := fetch(ctx, p)
+				if ctx.Err() != nil {
+					continue
+				}
+				mu.Lock()
+				if err != nil {
+					failed = append(failed, fmt.Sprintf("%s: %v", p, err))
+				} else {
+					fetched++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range paths {
+		select {
+		case queue <- p:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return fetched, failed
+}
+
+// warmupContextKey marks the requests replayed by the service itself, which
+// don't come from a connection and need no API key
+type warmupContextKey struct{}
+
+func isWarmup(r *http.Request) bool {
+	warmup, _ := r.Context().Value(warmupContextKey{}).(bool)
+	return warmup
+}
+
+// discardResponse is the ResponseWriter of replayed requests
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponse) Header() http.Header { return w.header }
+
+func (w *discardResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+// serveWarmup requests path from handler in-process
+func serveWarmup(ctx context.Context, handler http.Handler, path string) error {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, warmupContextKey{}, true), http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	req.RequestURI = path
+	req.RemoteAddr = "127.0.0.1:0"
+	w := &discardResponse{header: http.Header{}}
+	handler.ServeHTTP(w, req)
+	if w.status >= http.StatusBadRequest {
+		return fmt.Errorf("%d %s", w.status, http.StatusText(w.status))
+	}
+	return nil
+}
+
+// warmup replays the configured log through the handler after a start
+func (s *Service) warmup(ctx context.Context, config *WarmupConfig) {
+	paths, err := warmupPaths(config.Log, config.maxURLs())
+	if err != nil {
+		s.elog.Warning(eventStartup, fmt.Sprintf("Failed to read the warmup log, starting cold: %v", err))
+		return
+	}
+	started := time.Now()
+	fetched, failed := replayWarmup(ctx, paths, config.concurrency(), func(ctx context.Context, p string) error {
+		return serveWarmup(ctx, s.handler, p)
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	msg := fmt.Sprintf("Warmed up the caches with %d URLs from %s in %s", fetched, config.Log, time.Since(started).Round(time.Millisecond))
+	if len(failed) > 0 {
+		msg += fmt.Sprintf(", %d failed, e.g. %s", len(failed), failed[0])
+	}
+	s.elog.Info(eventStartup, msg)
+}
+
+// runWarmup requests the most requested URLs of --log from --target, e.g.
+// a new mirror or the CDN in front of it. It returns the process exit code:
+// 0 when every URL was fetched, 1 when some failed and 2 when the warmup
+// couldn't run.
+func runWarmup(args []string) int {
+	fs := flag.NewFlagSet("warmup", flag.ContinueOnError)
+	target := fs.String("target", "", "server or CDN to warm up, e.g. https://images.example.com")
+	logFile := fs.String("log", "", "access log or list of paths to replay")
+	maxURLs := fs.Int("max-urls", 1000, "how many of the most requested URLs to fetch")
+	concurrency := fs.Int("concurrency", 4, "URLs fetched at the same time")
+	apiKey := fs.String("api-key", "", "API key sent with every request")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	u, err := url.Parse(*target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintln(os.Stderr, "--target must be an http(s) URL, e.g. https://images.example.com")
+		return 2
+	}
+	if *logFile == "" {
+		fmt.Fprintln(os.Stderr, "--log is required")
+		return 2
+	}
+	if *maxURLs < 1 || *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "--max-urls and --concurrency must be at least 1")
+		return 2
+	}
+	paths, err := warmupPaths(*logFile, *maxURLs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read the log:", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	base := strings.TrimSuffix(*target, "/")
+	client := &http.Client{Timeout: time.Minute}
+	started := time.Now()
+	fmt.Printf("Fetching the %d most requested URLs of %s from %s\n", len(paths), *logFile, base)
+	fetched, failed := replayWarmup(ctx, paths, *concurrency, func(ctx context.Context, p string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+p, nil)
+		if err != nil {
+			return err
+		}
+		if *apiKey != "" {
+			req.Header.Set("X-API-Key", *apiKey)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// Read to the end, caches only keep complete responses
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			return err
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	})
+	for _, f := range failed {
+		fmt.Println(f)
+	}
+	fmt.Printf("Fetched %d of %d URLs in %s\n", fetched, len(paths), time.Since(started).Round(time.Millisecond))
+	switch {
+	case ctx.Err() != nil:
+		return 2
+	case len(failed) > 0:
+		return 1
+	}
+	return 0
+}
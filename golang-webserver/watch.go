@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// watchBufferSize is the change notification buffer, change notifications on
+// network shares are limited to 64KB
+const watchBufferSize = 64 * 1024
+
+// watchChanges calls changed for every change below folder until ctx is done,
+// see watchFolder. When the folder can't be watched it retries every check
+// interval, and once watching works again changed is called with "" since
+// changes were missed meanwhile.
+func watchChanges(ctx context.Context, folder string, elog debug.Log, changed func(name string)) {
+	ticker := time.NewTicker(folderCheckInterval)
+	defer ticker.Stop()
+	var lastErr error
+	missed := false
+	started := func() {
+		if missed {
+			changed("")
+			missed = false
+		}
+	}
+	for {
+		err := watchFolder(ctx, folder, started, changed)
+		if ctx.Err() != nil {
+			return
+		}
+		missed = true
+		if err != nil && (lastErr == nil || err.Error() != lastErr.Error()) {
+			elog.Warning(eventStorage, fmt.Sprintf("Failed to watch %s for changes, changed files won't be picked up right away: %v", folder, err))
+		}
+		lastErr = err
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchFolder calls changed with the slash separated path, relative to
+// folder, of every file or directory that changes below it, or with "" when
+// notifications were lost and anything may have changed. started is called
+// once the first notification request is queued. It returns nil once ctx is done, or the
+// error when watching fails, e.g. because the share dropped.
+func watchFolder(ctx context.Context, folder string, started func(), changed func(name string)) error {
+	path, err := windows.UTF16PtrFromString(folder)
+	if err != nil {
+		return err
+	}
+	h, err := windows.CreateFile(path, windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(h)
+
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(event)
+
+	// Cancelling the pending read makes GetOverlappedResult return
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			windows.CancelIoEx(h, nil)
+		case <-done:
+		}
+	}()
+
+	const mask = windows.FILE_NOTIFY_CHANGE_FILE_NAME | windows.FILE_NOTIFY_CHANGE_DIR_NAME |
+		windows.FILE_NOTIFY_CHANGE_SIZE | windows.FILE_NOTIFY_CHANGE_LAST_WRITE
+	buf := make([]byte, watchBufferSize)
+	for {
+		overlapped := windows.Overlapped{HEvent: event}
+		err := windows.ReadDirectoryChanges(h, &buf[0], uint32(len(buf)), true, mask, nil, &overlapped, 0)
+		if err != nil && err != windows.ERROR_IO_PENDING {
+			return err
+		}
+		if started != nil {
+			started()
+			started = nil
+		}
+		var n uint32
+		if err := windows.GetOverlappedResult(h, &overlapped, &n, true); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		// An empty result means the buffer overflowed and changes were dropped
+		if n == 0 {
+			changed("")
+			continue
+		}
+		for offset := uint32(0); ; {
+			info := (*windows.FileNotifyInformation)(unsafe.Pointer(&buf[offset]))
+			name := windows.UTF16ToString(unsafe.Slice(&info.FileName, info.FileNameLength/2))
+			changed(filepath.ToSlash(name))
+			if info.NextEntryOffset == 0 {
+				break
+			}
+			offset += info.NextEntryOffset
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server side of WebSockets (RFC 6455), enough to push messages to
+// pages: the handshake, unfragmented text frames out, and answering the
+// browser's pings and close frames.
+
+// websocketGUID is appended to the key of the handshake
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+
+	// websocketGoingAway is the close status when the server ends the stream
+	websocketGoingAway = 1001
+
+	// maxWebSocketFrame bounds the frames clients send, pages only send
+	// control frames
+	maxWebSocketFrame = 4096
+	// websocketIdle is how long a client may stay silent; it answers the
+	// pings sent every eventsHeartbeat
+	websocketIdle = 2*eventsHeartbeat + 15*time.Second
+)
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketConn is an upgraded connection, written to by one goroutine at a time
+type websocketConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	mu   sync.Mutex
+}
+
+// upgradeWebSocket completes the handshake of r, or answers it with the
+// error and returns false
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocketConn, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, false
+	}
+	// Browsers send the credentials of the page with cross-site sockets too,
+	// so only the server's own pages may connect
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "cross-origin WebSocket", http.StatusForbidden)
+			return nil, false
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "WebSockets not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+	// The server's timeouts were for the request
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	rw.WriteString(base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &websocketConn{conn: conn, br: rw.Reader}, true
+}
+
+// write sends payload in one frame
+func (c *websocketConn) write(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+// readFrame reads the next frame of the client, unmasked
+func (c *websocketConn) readFrame() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(websocketIdle))
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked frame from the client")
+	}
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > maxWebSocketFrame {
+		return 0, nil, errors.New("frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// readLoop answers the client's control frames, ignoring its messages,
+// until it closes the connection, goes silent or breaks the protocol
+func (c *websocketConn) readLoop() {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			c.write(wsPong, payload)
+		case wsClose:
+			// Echo the status code, the connection is done
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.write(wsClose, payload)
+			return
+		}
+	}
+}
+
+// close ends the connection with the status code, e.g. 1001 when the
+// server is going away
+func (c *websocketConn) close(code uint16) {
+	c.write(wsClose, []byte{byte(code >> 8), byte(code)})
+	c.conn.Close()
+}
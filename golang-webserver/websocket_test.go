@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bufferConn is a net.Conn reading the client's frames from in and
+// collecting the server's in out
+type bufferConn struct {
+	in, out bytes.Buffer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *bufferConn) Close() error                       { return nil }
+func (c *bufferConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *bufferConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *bufferConn) SetDeadline(t time.Time) error      { return nil }
+func (c *bufferConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *bufferConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newBufferWebSocket(in []byte) (*websocketConn, *bufferConn) {
+	conn := &bufferConn{}
+	conn.in.Write(in)
+	return &websocketConn{conn: conn, br: bufio.NewReader(conn)}, conn
+}
+
+// clientFrame is a masked frame, as browsers send them
+func clientFrame(opcode byte, payload []byte) []byte {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 0x80|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[2:], uint64(n))
+	}
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func TestIsWebSocket(t *testing.T) {
+	tests := []struct {
+		upgrade    string
+		connection []string
+		want       bool
+	}{
+		{"websocket", []string{"Upgrade"}, true},
+		{"WebSocket", []string{"keep-alive, Upgrade"}, true},
+		{"websocket", []string{"keep-alive", "upgrade"}, true},
+		{"websocket", []string{"keep-alive"}, false},
+		{"h2c", []string{"Upgrade"}, false},
+		{"", []string{"Upgrade"}, false},
+		{"websocket", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Upgrade", tt.upgrade)
+		for _, value := range tt.connection {
+			r.Header.Add("Connection", value)
+		}
+		if got := isWebSocket(r); got != tt.want {
+			t.Errorf("isWebSocket(Upgrade: %q, Connection: %q) = %v, want %v", tt.upgrade, tt.connection, got, tt.want)
+		}
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, ok := upgradeWebSocket(w, r)
+		if !ok {
+			return
+		}
+		ws.write(wsText, []byte("hello"))
+		ws.close(websocketGoingAway)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		// The key and accept value of RFC 6455 section 1.3
+		{name: "handshake", method: http.MethodGet, headers: map[string]string{"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Origin": "http://" + host}, status: http.StatusSwitchingProtocols},
+		{name: "no origin", method: http.MethodGet, headers: map[string]string{"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, status: http.StatusSwitchingProtocols},
+		{name: "cross origin", method: http.MethodGet, headers: map[string]string{"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Origin": "https://evil.example"}, status: http.StatusForbidden},
+		{name: "old version", method: http.MethodGet, headers: map[string]string{"Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, status: http.StatusUpgradeRequired},
+		{name: "no key", method: http.MethodGet, headers: map[string]string{"Sec-WebSocket-Version": "13"}, status: http.StatusBadRequest},
+		{name: "POST", method: http.MethodPost, headers: map[string]string{"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			req, _ := http.NewRequest(tt.method, server.URL+"/", nil)
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			req.Write(conn)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusSwitchingProtocols {
+				return
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("Sec-WebSocket-Accept = %q", got)
+			}
+			frames := make([]byte, 11)
+			if _, err := io.ReadFull(br, frames); err != nil {
+				t.Fatal(err)
+			}
+			if want := "\x81\x05hello\x88\x02\x03\xe9"; string(frames) != want {
+				t.Errorf("frames = %q, want %q", frames, want)
+			}
+		})
+	}
+}
+
+func TestWebSocketWrite(t *testing.T) {
+	tests := []struct {
+		size   int
+		header []byte
+	}{
+		{0, []byte{0x81, 0}},
+		{125, []byte{0x81, 125}},
+		{126, []byte{0x81, 126, 0, 126}},
+		{0xFFFF, []byte{0x81, 126, 0xFF, 0xFF}},
+		{0x10000, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		ws, conn := newBufferWebSocket(nil)
+		payload := bytes.Repeat([]byte{'x'}, tt.size)
+		if err := ws.write(wsText, payload); err != nil {
+			t.Fatal(err)
+		}
+		got := conn.out.Bytes()
+		if !bytes.Equal(got[:len(tt.header)], tt.header) || !bytes.Equal(got[len(tt.header):], payload) {
+			t.Errorf("write of %d bytes has header %x, want %x", tt.size, got[:len(tt.header)], tt.header)
+		}
+	}
+}
+
+func TestWebSocketReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		opcode  byte
+		payload string
+		wantErr string
+	}{
+		{name: "text", in: clientFrame(wsText, []byte("hello")), opcode: wsText, payload: "hello"},
+		{name: "empty ping", in: clientFrame(wsPing, nil), opcode: wsPing},
+		{name: "16-bit length", in: clientFrame(wsText, bytes.Repeat([]byte{'a'}, 300)), opcode: wsText, payload: strings.Repeat("a", 300)},
+		{name: "largest frame", in: clientFrame(wsText, bytes.Repeat([]byte{'b'}, maxWebSocketFrame)), opcode: wsText, payload: strings.Repeat("b", maxWebSocketFrame)},
+		{name: "unmasked", in: []byte{0x81, 0x01, 'x'}, wantErr: "unmasked"},
+		{name: "too large", in: clientFrame(wsText, make([]byte, maxWebSocketFrame+1)), wantErr: "too large"},
+		{name: "64-bit length", in: []byte{0x81, 0xFF, 0x80, 0, 0, 0, 0, 0, 0, 0}, wantErr: "too large"},
+		{name: "truncated header", in: []byte{0x81}, wantErr: "EOF"},
+		{name: "truncated length", in: []byte{0x81, 0xFE, 0x01}, wantErr: "EOF"},
+		{name: "truncated mask", in: []byte{0x81, 0x81, 1, 2}, wantErr: "EOF"},
+		{name: "truncated payload", in: clientFrame(wsText, []byte("hello"))[:8], wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, _ := newBufferWebSocket(tt.in)
+			opcode, payload, err := ws.readFrame()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readFrame() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readFrame() error = %v", err)
+			}
+			if opcode != tt.opcode || string(payload) != tt.payload {
+				t.Errorf("readFrame() = %x %q, want %x %q", opcode, payload, tt.opcode, tt.payload)
+			}
+		})
+	}
+}
+
+func TestWebSocketReadLoop(t *testing.T) {
+	var in []byte
+	in = append(in, clientFrame(wsText, []byte("ignored"))...)
+	in = append(in, clientFrame(wsPing, []byte("p1"))...)
+	in = append(in, clientFrame(wsPong, nil)...)
+	in = append(in, clientFrame(wsClose, []byte("\x03\xe8bye"))...)
+	in = append(in, clientFrame(wsPing, []byte("after close"))...)
+	ws, conn := newBufferWebSocket(in)
+	ws.readLoop()
+	// The ping is answered and the close echoed with its status only
+	if want := "\x8a\x02p1\x88\x02\x03\xe8"; conn.out.String() != want {
+		t.Errorf("readLoop() wrote %q, want %q", conn.out.String(), want)
+	}
+}
+
+func FuzzWebSocketReadFrame(f *testing.F) {
+	f.Add(clientFrame(wsText, []byte("hello")))
+	f.Add(clientFrame(wsClose, []byte("\x03\xe8")))
+	f.Add(clientFrame(wsText, bytes.Repeat([]byte{'a'}, 300)))
+	f.Add([]byte{0x81, 0xFF, 0, 0, 0, 0, 0, 0, 0x10, 0})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		ws, _ := newBufferWebSocket(in)
+		for {
+			opcode, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			if opcode > 0x0F || len(payload) > maxWebSocketFrame {
+				t.Fatalf("readFrame() = %x with %d bytes", opcode, len(payload))
+			}
+		}
+	})
+}
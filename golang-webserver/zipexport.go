@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ZIP exports of folders are laid out up front from the listing: names,
+// sizes and modification times fix every offset of the archive, so its
+// length is known and any byte range of it can be produced without building
+// the rest. That is what lets interrupted downloads resume with Range. Files
+// are stored uncompressed, with zip64 records for files and archives past
+// 4 GB and for more than 65535 files.
+
+const (
+	// zipManifestCacheSize is how many layouts are kept, with the CRCs
+	// computed while sending them, for the downloads resuming them
+	zipManifestCacheSize = 16
+	// zipManifestTTL is how long an unused layout is kept
+	zipManifestTTL = 24 * time.Hour
+
+	zipUint32Max = 0xFFFFFFFF
+	zipUint16Max = 0xFFFF
+
+	zipLocalHeaderLen   = 30
+	zipCentralHeaderLen = 46
+	zipEndLen           = 22
+	zip64EndLen         = 56
+	zip64LocatorLen     = 20
+	// zipTimeExtraLen is the extended timestamp field with the modification time
+	zipTimeExtraLen = 9
+	// zip64LocalExtraLen holds both sizes in the local header
+	zip64LocalExtraLen = 20
+
+	zipFlagDataDescriptor = 0x8
+	zipFlagUTF8           = 0x800
+)
+
+// zipEntry is a file of an archive layout
+type zipEntry struct {
+	// name is the name in the archive, path the one in the file system
+	name     string
+	path     string
+	size     int64
+	modified time.Time
+	// offset is where the local header starts, central where the entry of
+	// the central directory does
+	offset  int64
+	central int64
+	// crc is set, with hasCRC, once the file has been read
+	crc    uint32
+	hasCRC bool
+}
+
+// zip64 reports whether the size of the entry needs zip64 fields
+func (e *zipEntry) zip64() bool {
+	return e.size >= zipUint32Max
+}
+
+func (e *zipEntry) localLen() int64 {
+	n := zipLocalHeaderLen + int64(len(e.name)) + zipTimeExtraLen
+	if e.zip64() {
+		n += zip64LocalExtraLen
+	}
+	return n
+}
+
+func (e *zipEntry) descriptorLen() int64 {
+	if e.zip64() {
+		return 24
+	}
+	return 16
+}
+
+// centralZip64 returns the fields of the entry's central directory header
+// that overflow to its zip64 extra field
+func (e *zipEntry) centralZip64() int {
+	n := 0
+	if e.zip64() {
+		n += 2
+	}
+	if e.offset >= zipUint32Max {
+		n++
+	}
+	return n
+}
+
+func (e *zipEntry) centralLen() int64 {
+	n := zipCentralHeaderLen + int64(len(e.name)) + zipTimeExtraLen
+	if k := e.centralZip64(); k > 0 {
+		n += 4 + 8*int64(k)
+	}
+	return n
+}
+
+// zipManifest is the layout of the ZIP export of a folder
+type zipManifest struct {
+	entries []zipEntry
+	// centralOffset and centralSize place the central directory, size is
+	// the length of the archive
+	centralOffset int64
+	centralSize   int64
+	size          int64
+	// etag identifies the listing the layout was made from, modified is the
+	// newest file in it
+	etag     string
+	modified time.Time
+
+	// mu guards the CRCs of the entries
+	mu sync.Mutex
+	// used is when the cache last handed the layout out
+	used time.Time
+}
+
+// zip64End reports whether the archive needs the zip64 end records
+func (m *zipManifest) zip64End() bool {
+	return len(m.entries) >= zipUint16Max || m.centralOffset >= zipUint32Max || m.centralSize >= zipUint32Max
+}
+
+// newZipManifest lays out the files below dir in their fixed order: sorted
+// by name in each folder, folders where their name sorts
+func newZipManifest(files http.FileSystem, dir string) (*zipManifest, error) {
+	m := &zipManifest{}
+	if err := m.add(files, dir, ""); err != nil {
+		return nil, err
+	}
+	digest := sha256.New()
+	var offset int64
+	for i := range m.entries {
+		e := &m.entries[i]
+		e.offset = offset
+		offset += e.localLen() + e.size + e.descriptorLen()
+		fmt.Fprintf(digest, "%s\x00%d\x00%d\n", e.name, e.size, e.modified.UnixNano())
+		if e.modified.After(m.modified) {
+			m.modified = e.modified
+		}
+	}
+	m.centralOffset = offset
+	for i := range m.entries {
+		e := &m.entries[i]
+		e.central = m.centralSize
+		m.centralSize += e.centralLen()
+	}
+	m.size = m.centralOffset + m.centralSize + zipEndLen
+	if m.zip64End() {
+		m.size += zip64EndLen + zip64LocatorLen
+	}
+	m.etag = `"zip-` + hex.EncodeToString(digest.Sum(nil)[:12]) + `"`
+	return m, nil
+}
+
+func (m *zipManifest) add(files http.FileSystem, dir, prefix string) error {
+	d, err := files.Open(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := m.add(files, name, prefix+entry.Name()+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		m.entries = append(m.entries, zipEntry{name: prefix + entry.Name(), path: name, size: entry.Size(), modified: entry.ModTime()})
+	}
+	return nil
+}
+
+// crc returns the CRC-32 of entry i, reading the file unless it was read
+// already
+func (m *zipManifest) crc(files http.FileSystem, i int) (uint32, error) {
+	m.mu.Lock()
+	e := &m.entries[i]
+	if e.hasCRC {
+		defer m.mu.Unlock()
+		return e.crc, nil
+	}
+	m.mu.Unlock()
+
+	f, err := files.Open(e.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sum := crc32.NewIEEE()
+	if _, err := io.CopyN(sum, f, e.size); err != nil {
+		return 0, fmt.Errorf("%s changed while zipping: %w", e.name, err)
+	}
+	m.setCRC(i, sum.Sum32())
+	return sum.Sum32(), nil
+}
+
+func (m *zipManifest) setCRC(i int, crc uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[i].crc, m.entries[i].hasCRC = crc, true
+}
+
+// zipManifestCache keeps the latest layouts by ETag, so a resumed download
+// gets the layout and CRCs of the one it continues
+type zipManifestCache struct {
+	mu        sync.Mutex
+	manifests map[string]*zipManifest
+}
+
+// get returns the cached layout of the same listing as m, or caches m
+func (c *zipManifestCache) get(m *zipManifest) *zipManifest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.manifests == nil {
+		c.manifests = map[string]*zipManifest{}
+	}
+	if cached := c.manifests[m.etag]; cached != nil {
+		m = cached
+	} else {
+		c.manifests[m.etag] = m
+	}
+	m.used = now
+
+	var oldest *zipManifest
+	for etag, cached := range c.manifests {
+		if now.Sub(cached.used) > zipManifestTTL {
+			delete(c.manifests, etag)
+		} else if oldest == nil || cached.used.Before(oldest.used) {
+			oldest = cached
+		}
+	}
+	if len(c.manifests) > zipManifestCacheSize {
+		delete(c.manifests, oldest.etag)
+	}
+	return m
+}
+
+// zipArchive reads the archive of a layout, producing the bytes at the
+// position it is seeked to. It keeps one file open at a time.
+type zipArchive struct {
+	m     *zipManifest
+	files http.FileSystem
+	pos   int64
+
+	// file is entry index's file, read up to filePos. sum hashes it while
+	// it is read from the start.
+	file    http.File
+	index   int
+	filePos int64
+	sum     hash.Hash32
+}
+
+func newZipArchive(m *zipManifest, files http.FileSystem) *zipArchive {
+	return &zipArchive{m: m, files: files, index: -1}
+}
+
+func (a *zipArchive) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += a.pos
+	case io.SeekEnd:
+		offset += a.m.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	a.pos = offset
+	return offset, nil
+}
+
+func (a *zipArchive) Read(p []byte) (int, error) {
+	if a.pos >= a.m.size {
+		return 0, io.EOF
+	}
+	var n int
+	var err error
+	m := a.m
+	switch end := m.centralOffset + m.centralSize; {
+	case a.pos < m.centralOffset:
+		i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].offset > a.pos }) - 1
+		e := &m.entries[i]
+		dataStart := e.offset + e.localLen()
+		dataEnd := dataStart + e.size
+		switch {
+		case a.pos < dataStart:
+			n = copy(p, e.localHeader()[a.pos-e.offset:])
+		case a.pos < dataEnd:
+			if int64(len(p)) > dataEnd-a.pos {
+				p = p[:dataEnd-a.pos]
+			}
+			n, err = a.readFile(i, p, a.pos-dataStart)
+		default:
+			var crc uint32
+			if crc, err = m.crc(a.files, i); err == nil {
+				n = copy(p, e.descriptor(crc)[a.pos-dataEnd:])
+			}
+		}
+	case a.pos < end:
+		rel := a.pos - m.centralOffset
+		i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].central > rel }) - 1
+		var crc uint32
+		if crc, err = m.crc(a.files, i); err == nil {
+			n = copy(p, m.entries[i].centralHeader(crc)[rel-m.entries[i].central:])
+		}
+	default:
+		n = copy(p, m.end()[a.pos-end:])
+	}
+	a.pos += int64(n)
+	return n, err
+}
+
+// readFile reads entry i's file at off, hashing it when read from the start
+func (a *zipArchive) readFile(i int, p []byte, off int64) (int, error) {
+	e := &a.m.entries[i]
+	if a.index != i || a.filePos != off {
+		a.Close()
+		f, err := a.files.Open(e.path)
+		if err != nil {
+			return 0, err
+		}
+		if off > 0 {
+			if _, err := f.Seek(off, io.SeekStart); err != nil {
+				f.Close()
+				return 0, err
+			}
+		} else {
+			a.sum = crc32.NewIEEE()
+		}
+		a.file, a.index, a.filePos = f, i, off
+	}
+	n, err := io.ReadFull(a.file, p)
+	a.filePos += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("%s changed while zipping: %w", e.name, err)
+	}
+	if a.sum != nil {
+		a.sum.Write(p[:n])
+		if a.filePos == e.size {
+			a.m.setCRC(i, a.sum.Sum32())
+		}
+	}
+	return n, nil
+}
+
+// Close closes the file being read
+func (a *zipArchive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file, a.index, a.sum = nil, -1, nil
+	return err
+}
+
+// zipDOSTime returns the MS-DOS date and time of t, in local time as
+// archivers expect
+func zipDOSTime(t time.Time) (uint16, uint16) {
+	t = t.Local()
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	clock := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return date, clock
+}
+
+func (e *zipEntry) flags() uint16 {
+	for i := 0; i < len(e.name); i++ {
+		if e.name[i] >= utf8.RuneSelf {
+			return zipFlagDataDescriptor | zipFlagUTF8
+		}
+	}
+	return zipFlagDataDescriptor
+}
+
+func (e *zipEntry) version() uint16 {
+	if e.centralZip64() > 0 {
+		return 45
+	}
+	return 20
+}
+
+// timeExtra is the extended timestamp field, precise to the second
+func (e *zipEntry) timeExtra(b zipBytes) zipBytes {
+	b = b.u16(0x5455)
+	b = b.u16(5)
+	b = append(b, 1)
+	return b.u32(uint32(e.modified.Unix()))
+}
+
+// localHeader returns the local file header. The CRC follows the data in
+// the data descriptor, it is only known once the file is read.
+func (e *zipEntry) localHeader() []byte {
+	date, clock := zipDOSTime(e.modified)
+	b := make(zipBytes, 0, e.localLen())
+	b = b.u32(0x04034b50)
+	b = b.u16(e.version())
+	b = b.u16(e.flags())
+	b = b.u16(0) // stored
+	b = b.u16(clock)
+	b = b.u16(date)
+	b = b.u32(0)
+	size := uint32(e.size)
+	if e.zip64() {
+		size = zipUint32Max
+	}
+	b = b.u32(size)
+	b = b.u32(size)
+	b = b.u16(uint16(len(e.name)))
+	extra := zipTimeExtraLen
+	if e.zip64() {
+		extra += zip64LocalExtraLen
+	}
+	b = b.u16(uint16(extra))
+	b = append(b, e.name...)
+	b = e.timeExtra(b)
+	if e.zip64() {
+		b = b.u16(0x0001)
+		b = b.u16(16)
+		b = b.u64(uint64(e.size))
+		b = b.u64(uint64(e.size))
+	}
+	return b
+}
+
+func (e *zipEntry) descriptor(crc uint32) []byte {
+	b := make(zipBytes, 0, e.descriptorLen())
+	b = b.u32(0x08074b50)
+	b = b.u32(crc)
+	if e.zip64() {
+		b = b.u64(uint64(e.size))
+		return b.u64(uint64(e.size))
+	}
+	b = b.u32(uint32(e.size))
+	return b.u32(uint32(e.size))
+}
+
+func (e *zipEntry) centralHeader(crc uint32) []byte {
+	date, clock := zipDOSTime(e.modified)
+	b := make(zipBytes, 0, e.centralLen())
+	b = b.u32(0x02014b50)
+	// Made by Unix, for the permissions in the external attributes
+	b = b.u16(3<<8 | e.version())
+	b = b.u16(e.version())
+	b = b.u16(e.flags())
+	b = b.u16(0)
+	b = b.u16(clock)
+	b = b.u16(date)
+	b = b.u32(crc)
+	size, offset := uint32(e.size), uint32(e.offset)
+	if e.zip64() {
+		size = zipUint32Max
+	}
+	if e.offset >= zipUint32Max {
+		offset = zipUint32Max
+	}
+	b = b.u32(size)
+	b = b.u32(size)
+	b = b.u16(uint16(len(e.name)))
+	extra := zipTimeExtraLen
+	if k := e.centralZip64(); k > 0 {
+		extra += 4 + 8*k
+	}
+	b = b.u16(uint16(extra))
+	b = b.u16(0) // comment
+	b = b.u16(0) // disk
+	b = b.u16(0) // internal attributes
+	b = b.u32(0100644 << 16)
+	b = b.u32(offset)
+	b = append(b, e.name...)
+	b = e.timeExtra(b)
+	if k := e.centralZip64(); k > 0 {
+		// Only the fields set to 0xFFFFFFFF above, in this order
+		b = b.u16(0x0001)
+		b = b.u16(uint16(8 * k))
+		if e.zip64() {
+			b = b.u64(uint64(e.size))
+			b = b.u64(uint64(e.size))
+		}
+		if e.offset >= zipUint32Max {
+			b = b.u64(uint64(e.offset))
+		}
+	}
+	return b
+}
+
+// end returns the end of central directory record, after the zip64 ones
+// when the archive needs them
+func (m *zipManifest) end() []byte {
+	var b zipBytes
+	count, size, offset := uint16(len(m.entries)), uint32(m.centralSize), uint32(m.centralOffset)
+	if m.zip64End() {
+		end64 := m.centralOffset + m.centralSize
+		b = b.u32(0x06064b50)
+		b = b.u64(zip64EndLen - 12)
+		b = b.u16(3<<8 | 45)
+		b = b.u16(45)
+		b = b.u32(0)
+		b = b.u32(0)
+		b = b.u64(uint64(len(m.entries)))
+		b = b.u64(uint64(len(m.entries)))
+		b = b.u64(uint64(m.centralSize))
+		b = b.u64(uint64(m.centralOffset))
+
+		b = b.u32(0x07064b50)
+		b = b.u32(0)
+		b = b.u64(uint64(end64))
+		b = b.u32(1)
+		count, size, offset = zipUint16Max, zipUint32Max, zipUint32Max
+	}
+	b = b.u32(0x06054b50)
+	b = b.u16(0)
+	b = b.u16(0)
+	b = b.u16(count)
+	b = b.u16(count)
+	b = b.u32(size)
+	b = b.u32(offset)
+	return b.u16(0)
+}
+
+// zipBytes builds the little-endian records of the archive
+type zipBytes []byte
+
+func (b zipBytes) u16(v uint16) zipBytes {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func (b zipBytes) u32(v uint32) zipBytes {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (b zipBytes) u64(v uint64) zipBytes {
+	return b.u32(uint32(v)).u32(uint32(v >> 32))
+}
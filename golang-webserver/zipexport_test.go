@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeZipFolder creates files, by slash separated name, in a new folder
+// with the same modification time
+func writeZipFolder(t *testing.T, files map[string]string, modified time.Time) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readZipArchive reads the whole archive of m
+func readZipArchive(t *testing.T, m *zipManifest, files http.FileSystem) []byte {
+	t.Helper()
+	a := newZipArchive(m, files)
+	defer a.Close()
+	data, err := io.ReadAll(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != m.size {
+		t.Fatalf("archive of %d bytes, the layout has %d", len(data), m.size)
+	}
+	return data
+}
+
+// checkZip opens data with archive/zip and compares its files to want
+func checkZip(t *testing.T, data []byte, names []string, want map[string]string, modified time.Time) *zip.Reader {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(names) {
+		t.Fatalf("archive has %d files, want %d", len(zr.File), len(names))
+	}
+	for i, f := range zr.File {
+		if f.Name != names[i] {
+			t.Fatalf("file %d is %q, want %q", i, f.Name, names[i])
+		}
+		if !f.Modified.Equal(modified) {
+			t.Errorf("%s modified %v, want %v", f.Name, f.Modified, modified)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Reading to the end checks the CRC too
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		if string(content) != want[f.Name] {
+			t.Errorf("%s has %q, want %q", f.Name, content, want[f.Name])
+		}
+	}
+	return zr
+}
+
+func TestZipExportRoundTrip(t *testing.T) {
+	modified := time.Date(2026, 3, 4, 5, 6, 8, 0, time.UTC)
+	files := map[string]string{
+		"b.txt":        "bee",
+		"a/2.jpg":      strings.Repeat("2", 5000),
+		"a/1.jpg":      strings.Repeat("1", 3000),
+		"a/deep/x.png": "x",
+		"empty":        "",
+		"é/ü.txt":      "unicode",
+	}
+	dir := writeZipFolder(t, files, modified)
+	m, err := newZipManifest(http.Dir(dir), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readZipArchive(t, m, http.Dir(dir))
+	// Sorted by name in each folder, folders where their name sorts
+	names := []string{"a/1.jpg", "a/2.jpg", "a/deep/x.png", "b.txt", "empty", "é/ü.txt"}
+	zr := checkZip(t, data, names, files, modified)
+	for _, f := range zr.File {
+		if f.Method != zip.Store || f.NonUTF8 {
+			t.Errorf("%s has method %d and NonUTF8 %v", f.Name, f.Method, f.NonUTF8)
+		}
+	}
+	if m.zip64End() {
+		t.Error("a small archive has zip64 end records")
+	}
+
+	sub, err := newZipManifest(http.Dir(dir), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkZip(t, readZipArchive(t, sub, http.Dir(dir)), []string{"1.jpg", "2.jpg", "deep/x.png"},
+		map[string]string{"1.jpg": files["a/1.jpg"], "2.jpg": files["a/2.jpg"], "deep/x.png": "x"}, modified)
+}
+
+func TestZipExportManyFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 70000 files")
+	}
+	const folders, perFolder = 70, 1000
+	modified := time.Date(2026, 3, 4, 5, 6, 8, 0, time.UTC)
+	files := map[string]string{}
+	var names []string
+	for i := 0; i < folders; i++ {
+		for j := 0; j < perFolder; j++ {
+			name := fmt.Sprintf("%02d/%04d.jpg", i, j)
+			files[name] = ""
+			if j%250 == 0 {
+				files[name] = name
+			}
+			names = append(names, name)
+		}
+	}
+	dir := writeZipFolder(t, files, modified)
+	m, err := newZipManifest(http.Dir(dir), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.zip64End() {
+		t.Fatalf("%d files without zip64 end records", len(m.entries))
+	}
+	data := readZipArchive(t, m, http.Dir(dir))
+	// The end of central directory record only has room for 65535 files,
+	// archive/zip has to take the count from the zip64 one
+	end := data[len(data)-zipEndLen:]
+	end64 := data[len(data)-zipEndLen-zip64LocatorLen-zip64EndLen:]
+	if !bytes.HasPrefix(end, []byte("PK\x05\x06")) || !bytes.HasPrefix(end64, []byte("PK\x06\x06")) {
+		t.Fatalf("archive ends with %x", data[len(data)-zipEndLen-zip64LocatorLen-zip64EndLen:])
+	}
+	if count := int(end[8]) | int(end[9])<<8; count != zipUint16Max {
+		t.Errorf("end record counts %d files", count)
+	}
+	checkZip(t, data, names, files, modified)
+}
+
+func TestZipExportResume(t *testing.T) {
+	modified := time.Date(2026, 3, 4, 5, 6, 8, 0, time.UTC)
+	files := map[string]string{
+		"a.txt":     strings.Repeat("a", 2500),
+		"b/c.jpg":   strings.Repeat("c", 7000),
+		"b/d.jpg":   strings.Repeat("d", 1200),
+		"e.png":     strings.Repeat("e", 4100),
+		"f/g/h.txt": "h",
+	}
+	dir := writeZipFolder(t, files, modified)
+	store := &shareStore{file: filepath.Join(t.TempDir(), "shares.json"), shares: map[string]*share{}}
+	sh := &share{Token: "token", Path: "/", Expires: time.Now().Add(time.Hour)}
+	store.shares[sh.Token] = sh
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/s/token/?download=zip", nil)
+		for name := range header {
+			r.Header.Set(name, header.Get(name))
+		}
+		w := httptest.NewRecorder()
+		store.serveZip(w, r, sh, http.Dir(dir), "/", "session")
+		return w
+	}
+	resume := func(etag string, start, end int64) *httptest.ResponseRecorder {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		if end < 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+		}
+		header.Set("If-Range", etag)
+		return serve(header)
+	}
+
+	w := serve(nil)
+	full := w.Body.Bytes()
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Content-Length") != fmt.Sprint(len(full)) {
+		t.Fatalf("download got %d with ETag %q and Content-Length %s", w.Code, etag, w.Header().Get("Content-Length"))
+	}
+	names := []string{"a.txt", "b/c.jpg", "b/d.jpg", "e.png", "f/g/h.txt"}
+	checkZip(t, full, names, files, modified)
+
+	// A download cut off halfway through a file resumes from there. A new
+	// cache makes the resume read the CRCs of the files it starts after.
+	for _, cached := range []bool{true, false} {
+		for _, cut := range []int64{1, 40, 3000, 9000, int64(len(full)) - 200, int64(len(full)) - 5} {
+			if !cached {
+				store.zips = zipManifestCache{}
+			}
+			w := resume(etag, cut, -1)
+			if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), full[cut:]) {
+				t.Errorf("resuming at %d (cached %v) got %d with %d bytes, want the last %d", cut, cached, w.Code, w.Body.Len(), len(full)-int(cut))
+			}
+		}
+	}
+
+	// Ranges out of order and crossing every record reassemble the archive
+	store.zips = zipManifestCache{}
+	pieces := make([][]byte, 0, len(full)/997+1)
+	for start := int64(0); start < int64(len(full)); start += 997 {
+		pieces = append(pieces, nil)
+	}
+	for i := len(pieces) - 1; i >= 0; i-- {
+		start := int64(i) * 997
+		w := resume(etag, start, start+996)
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("range at %d got %d", start, w.Code)
+		}
+		pieces[i] = w.Body.Bytes()
+	}
+	if joined := bytes.Join(pieces, nil); !bytes.Equal(joined, full) {
+		t.Errorf("ranges joined into %d bytes different from the %d of the archive", len(joined), len(full))
+	}
+	if sh.Downloads != 1 {
+		t.Errorf("the download and its resumes counted %d downloads", sh.Downloads)
+	}
+
+	// A changed file changes the ETag, and the resume starts over
+	changed := time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)
+	files["b/d.jpg"] = "changed"
+	if err := os.WriteFile(filepath.Join(dir, "b", "d.jpg"), []byte(files["b/d.jpg"]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "b", "d.jpg"), changed, changed); err != nil {
+		t.Fatal(err)
+	}
+	w = resume(etag, 3000, -1)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("resume after a change got %d with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := zr.File[2]; f.Name != "b/d.jpg" || f.UncompressedSize64 != uint64(len("changed")) || !f.Modified.Equal(changed) {
+		t.Errorf("the new archive has %s of %d bytes modified %v", f.Name, f.UncompressedSize64, f.Modified)
+	}
+}
+
+func TestZipDOSTime(t *testing.T) {
+	tests := []struct {
+		t           time.Time
+		date, clock uint16
+	}{
+		{time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local), 1<<5 | 1, 0},
+		{time.Date(2026, 3, 4, 5, 6, 9, 0, time.Local), 46<<9 | 3<<5 | 4, 5<<11 | 6<<5 | 4},
+		{time.Date(2107, 12, 31, 23, 59, 58, 0, time.Local), 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29},
+		// Archivers can't show earlier times, they get the earliest one
+		{time.Date(1970, 1, 1, 0, 0, 0, 0, time.Local), 1<<5 | 1, 0},
+	}
+	for _, tt := range tests {
+		if date, clock := zipDOSTime(tt.t); date != tt.date || clock != tt.clock {
+			t.Errorf("zipDOSTime(%v) = %#x %#x, want %#x %#x", tt.t, date, clock, tt.date, tt.clock)
+		}
+	}
+}